@@ -0,0 +1,188 @@
+use std::collections::BTreeMap;
+use itertools::Itertools;
+use k8s_openapi::api::core::v1::{Pod, PodAffinityTerm, TopologySpreadConstraint, WeightedPodAffinityTerm};
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::LabelSelector;
+use crate::skatelet::{PodmanPodInfo, PodmanPodStatus};
+use crate::state::state::NodeState;
+
+// the domain a node is in for a topology key, hostname keys make every node its own domain
+pub fn topology_value(node: &NodeState, key: &str) -> Option<String> {
+    match key {
+        "kubernetes.io/hostname" | "skate.io/hostname" => Some(node.node_name.clone()),
+        _ => node.all_labels().get(key).cloned()
+    }
+}
+
+// a selector that isn't set matches nothing, same as kubernetes
+pub fn selector_matches(selector: Option<&LabelSelector>, labels: &BTreeMap<String, String>) -> bool {
+    let selector = match selector {
+        Some(selector) => selector,
+        None => return false
+    };
+    let match_labels = selector.match_labels.iter().flatten().all(|(k, v)| labels.get(k) == Some(v));
+    let match_expressions = selector.match_expressions.iter().flatten().all(|e| {
+        let values = e.values.clone().unwrap_or_default();
+        match e.operator.as_str() {
+            "In" => labels.get(&e.key).map(|v| values.contains(v)).unwrap_or(false),
+            "NotIn" => labels.get(&e.key).map(|v| !values.contains(v)).unwrap_or(true),
+            "Exists" => labels.contains_key(&e.key),
+            "DoesNotExist" => !labels.contains_key(&e.key),
+            _ => false
+        }
+    });
+    match_labels && match_expressions
+}
+
+pub fn describe_selector(selector: Option<&LabelSelector>) -> String {
+    let selector = match selector {
+        Some(selector) => selector,
+        None => return "<none>".to_string()
+    };
+    selector.match_labels.iter().flatten().map(|(k, v)| format!("{}={}", k, v))
+        .chain(selector.match_expressions.iter().flatten().map(|e| format!("{} {} ({})", e.key, e.operator, e.values.clone().unwrap_or_default().join(","))))
+        .join(",")
+}
+
+// a surge pod stands in for the pod it's named after while that one gets replaced
+fn replaced_name(name: &str, labels: Option<&BTreeMap<String, String>>) -> String {
+    match labels.map(|l| l.contains_key("skate.io/surge")).unwrap_or(false) {
+        true => name.strip_suffix("-surge").unwrap_or(name).to_string(),
+        false => name.to_string()
+    }
+}
+
+// pods running or about to run on the node in the namespace, leaving out earlier copies of the pod being placed and
+// its surge pod, otherwise a rolling update could never surge a pod that keeps away from its own replicas
+fn node_pods(node: &NodeState, namespaces: &Vec<String>, pod: &Pod) -> Vec<PodmanPodInfo> {
+    let name = replaced_name(&pod.metadata.name.clone().unwrap_or_default(), pod.metadata.labels.as_ref());
+    let ns = pod.metadata.namespace.clone().unwrap_or_default();
+    node.host_info.as_ref().and_then(|h| h.system_info.as_ref()).and_then(|si| si.pods.clone()).unwrap_or_default().into_iter()
+        .filter(|p| p.status != PodmanPodStatus::Exited && p.status != PodmanPodStatus::Dead)
+        .filter(|p| namespaces.contains(&p.namespace()))
+        .filter(|p| !(replaced_name(&p.name, Some(&p.labels)) == name && p.namespace() == ns))
+        .collect()
+}
+
+fn required_anti_affinity(pod: &Pod) -> Vec<PodAffinityTerm> {
+    pod.spec.as_ref().and_then(|s| s.affinity.as_ref()).and_then(|a| a.pod_anti_affinity.as_ref())
+        .and_then(|a| a.required_during_scheduling_ignored_during_execution.clone()).unwrap_or_default()
+}
+
+fn term_namespaces(term: &PodAffinityTerm, pod: &Pod) -> Vec<String> {
+    match term.namespaces.as_ref() {
+        Some(namespaces) if namespaces.len() > 0 => namespaces.clone(),
+        _ => vec!(pod.metadata.namespace.clone().unwrap_or_default())
+    }
+}
+
+// the required podAntiAffinity terms that placing the pod on the node would break: some node in the same topology
+// domain already has a matching pod
+pub fn violated_anti_affinity(nodes: &Vec<NodeState>, node: &NodeState, pod: &Pod) -> Vec<PodAffinityTerm> {
+    required_anti_affinity(pod).into_iter().filter(|term| term_satisfied(nodes, node, pod, term)).collect()
+}
+
+fn required_affinity(pod: &Pod) -> Vec<PodAffinityTerm> {
+    pod.spec.as_ref().and_then(|s| s.affinity.as_ref()).and_then(|a| a.pod_affinity.as_ref())
+        .and_then(|a| a.required_during_scheduling_ignored_during_execution.clone()).unwrap_or_default()
+}
+
+fn preferred_affinity(pod: &Pod) -> Vec<WeightedPodAffinityTerm> {
+    pod.spec.as_ref().and_then(|s| s.affinity.as_ref()).and_then(|a| a.pod_affinity.as_ref())
+        .and_then(|a| a.preferred_during_scheduling_ignored_during_execution.clone()).unwrap_or_default()
+}
+
+// whether some node in the node's topology domain for the term has a matching pod, a node that isn't in any domain
+// for the key has nothing to be with or apart from
+fn term_satisfied(nodes: &Vec<NodeState>, node: &NodeState, pod: &Pod, term: &PodAffinityTerm) -> bool {
+    let domain = match topology_value(node, &term.topology_key) {
+        Some(domain) => domain,
+        None => return false
+    };
+    let namespaces = term_namespaces(term, pod);
+    nodes.iter().filter(|n| topology_value(n, &term.topology_key).as_ref() == Some(&domain))
+        .any(|n| node_pods(n, &namespaces, pod).iter().any(|p| selector_matches(term.label_selector.as_ref(), &p.labels)))
+}
+
+// the required podAffinity terms that placing the pod on the node would break: nothing in the node's topology domain
+// matches. like kubernetes, a term the pod matches itself is let through while no pod anywhere matches it, otherwise
+// the first replica of a group that wants to be together could never go anywhere
+pub fn violated_affinity(nodes: &Vec<NodeState>, node: &NodeState, pod: &Pod) -> Vec<PodAffinityTerm> {
+    let labels = pod.metadata.labels.clone().unwrap_or_default();
+    required_affinity(pod).into_iter().filter(|term| {
+        if term_satisfied(nodes, node, pod, term) {
+            return false;
+        }
+        let namespaces = term_namespaces(term, pod);
+        let matches_self = selector_matches(term.label_selector.as_ref(), &labels)
+            && namespaces.contains(&pod.metadata.namespace.clone().unwrap_or_default());
+        let matched_anywhere = nodes.iter()
+            .any(|n| node_pods(n, &namespaces, pod).iter().any(|p| selector_matches(term.label_selector.as_ref(), &p.labels)));
+        !(matches_self && !matched_anywhere && topology_value(node, &term.topology_key).is_some())
+    }).collect()
+}
+
+// higher is better, the weights of the preferred podAffinity terms the node would satisfy
+pub fn affinity_score(nodes: &Vec<NodeState>, node: &NodeState, pod: &Pod) -> i32 {
+    preferred_affinity(pod).iter()
+        .filter(|t| term_satisfied(nodes, node, pod, &t.pod_affinity_term))
+        .map(|t| t.weight)
+        .sum()
+}
+
+// how many of the pod's own replicas can run at once when its anti-affinity matches itself: one per topology domain
+pub fn anti_affinity_capacity(nodes: &Vec<NodeState>, pod: &Pod) -> Option<(usize, String)> {
+    let labels = pod.metadata.labels.clone().unwrap_or_default();
+    required_anti_affinity(pod).into_iter()
+        .filter(|term| selector_matches(term.label_selector.as_ref(), &labels))
+        .map(|term| {
+            let domains = nodes.iter().filter_map(|n| topology_value(n, &term.topology_key)).unique().count();
+            (domains, term.topology_key.clone())
+        })
+        .min_by_key(|(domains, _)| *domains)
+}
+
+fn spread_constraints(pod: &Pod) -> Vec<TopologySpreadConstraint> {
+    pod.spec.as_ref().and_then(|s| s.topology_spread_constraints.clone()).unwrap_or_default()
+}
+
+// matching pods in each of the domains of the constraint's topology key, across the candidate nodes
+fn domain_counts(candidates: &Vec<NodeState>, pod: &Pod, constraint: &TopologySpreadConstraint) -> BTreeMap<String, i32> {
+    let namespaces = vec!(pod.metadata.namespace.clone().unwrap_or_default());
+    candidates.iter().fold(BTreeMap::new(), |mut acc, n| {
+        match topology_value(n, &constraint.topology_key) {
+            Some(domain) => {
+                let count = node_pods(n, &namespaces, pod).iter()
+                    .filter(|p| selector_matches(constraint.label_selector.as_ref(), &p.labels)).count() as i32;
+                *acc.entry(domain).or_insert(0) += count;
+            }
+            None => {}
+        }
+        acc
+    })
+}
+
+// the DoNotSchedule constraints that placing the pod on the node would take over maxSkew
+pub fn violated_spread(candidates: &Vec<NodeState>, node: &NodeState, pod: &Pod) -> Vec<TopologySpreadConstraint> {
+    spread_constraints(pod).into_iter()
+        .filter(|c| c.when_unsatisfiable == "DoNotSchedule")
+        .filter(|c| {
+            let domain = match topology_value(node, &c.topology_key) {
+                Some(domain) => domain,
+                // nodes without the key aren't part of the spread
+                None => return true
+            };
+            let counts = domain_counts(candidates, pod, c);
+            let min = counts.values().min().cloned().unwrap_or(0);
+            counts.get(&domain).cloned().unwrap_or(0) + 1 - min > c.max_skew
+        }).collect()
+}
+
+// lower is better, the matching pods already in the node's domains for every constraint including ScheduleAnyway ones
+pub fn spread_score(candidates: &Vec<NodeState>, node: &NodeState, pod: &Pod) -> i32 {
+    spread_constraints(pod).iter().map(|c| {
+        match topology_value(node, &c.topology_key) {
+            Some(domain) => domain_counts(candidates, pod, c).get(&domain).cloned().unwrap_or(0),
+            None => 0
+        }
+    }).sum()
+}
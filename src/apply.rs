@@ -1,13 +1,22 @@
+use std::collections::BTreeMap;
 use std::error::Error;
 use anyhow::anyhow;
 use clap::Args;
+use itertools::Itertools;
 
 use crate::config::Config;
+use crate::logging;
+use crate::logging::Entry;
 use crate::refresh::refreshed_state;
-use crate::scheduler::{DefaultScheduler, Scheduler};
+use crate::reconcile::owns;
+use crate::scheduler::{DEFAULT_MAX_CONCURRENCY, DefaultScheduler, OpType, ScheduledOperation, ScheduleResult, Scheduler};
 
-use crate::skate::ConfigFileArgs;
+use crate::skate::{ConfigFileArgs, SupportedResources};
 use crate::ssh;
+use crate::ssh::SshClients;
+use crate::state::state::ClusterState;
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, INFO_EMOJI};
+use crate::validate::validate;
 
 
 #[derive(Debug, Args)]
@@ -18,18 +27,51 @@ pub struct ApplyArgs {
     #[arg(long, default_value_t = - 1, long_help = "Period of time in seconds given to the resource to terminate gracefully. Ignored if negative. Set to 1 for \
 immediate shutdown.")]
     pub grace_period: i32,
+    #[arg(long, default_value_t = DEFAULT_MAX_CONCURRENCY, long_help = "How many nodes to work on at the same time.")]
+    pub max_concurrency: usize,
+    #[arg(long, num_args = 0..=1, default_missing_value = "client", value_parser = parse_dry_run, long_help = "Validate without changing anything. \
+client only checks the manifests, server also checks them against the cluster: referenced secrets and configmaps exist \
+and which nodes each pod would be scheduled on.")]
+    pub dry_run: Option<DryRun>,
+    #[arg(long, long_help = "Undo the whole apply if any of it fails: resources that were applied before are put back to \
+their previous version and the pods of new ones are removed.")]
+    pub atomic: bool,
+    #[arg(long, default_value_t = true, num_args = 0..=1, default_missing_value = "true", action = clap::ArgAction::Set, long_help = "Reject \
+fields the resource's kind doesn't have, listing every one with its line. --validate=false lets them through, ignored.")]
+    pub validate: bool,
+    #[command(flatten)]
+    pub render: RenderArgs,
     #[command(flatten)]
     pub config: ConfigFileArgs,
 }
 
+#[derive(Debug, Clone, PartialEq)]
+pub enum DryRun {
+    Client,
+    Server,
+}
+
+fn parse_dry_run(s: &str) -> Result<DryRun, String> {
+    match s {
+        "client" => Ok(DryRun::Client),
+        "server" => Ok(DryRun::Server),
+        _ => Err(format!("unsupported dry run {}, expected client or server", s))
+    }
+}
+
 pub async fn apply(args: ApplyArgs) -> Result<(), Box<dyn Error>> {
-    let config = Config::load(Some(args.config.skateconfig)).expect("failed to load skate config");
-    let objects = crate::skate::read_manifests(args.filename).unwrap(); // huge
+    match args.dry_run {
+        Some(dry_run) => return apply_dry_run(crate::kustomize::manifest_sources(&args.filename, &args.render)?, args.validate, dry_run, args.config).await,
+        None => {}
+    }
+
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone()).expect("failed to load skate config");
+    let objects = crate::skate::read_manifests(crate::kustomize::manifest_sources(&args.filename, &args.render)?, args.validate)?;
     let cluster = config.current_cluster()?;
     let (conns, errors) = ssh::cluster_connections(cluster).await;
     match errors {
         Some(e) => {
-            eprintln!("{}", e)
+            e.log()
         }
         _ => {}
     };
@@ -41,23 +83,285 @@ pub async fn apply(args: ApplyArgs) -> Result<(), Box<dyn Error>> {
         _ => {}
     };
 
-    let objects: Vec<Result<_, _>> = objects.into_iter().map(|sr| sr.fixup()).collect();
+    let namespace = cluster.namespace(None);
+    let objects: Vec<Result<_, _>> = objects.into_iter().map(|sr| sr.with_default_namespace(&namespace).fixup()).collect();
     let objects: Vec<_> = objects.into_iter().map(|sr| sr.unwrap()).collect();
 
     let conns = conns.ok_or("no clients")?;
 
     let mut state = refreshed_state(&cluster.name, &conns, &config).await.expect("failed to refresh state");
 
-    let scheduler = DefaultScheduler {};
-    match scheduler.schedule(&conns, &mut state, objects).await {
-        Ok(_) => {}
+    // what was there before, for --atomic to go back to
+    let previous: Vec<_> = objects.iter().map(|o| state.locate_stored_resource(o)).collect();
+
+    // keep the specs around so later reconciles (eg autoscaling) can reschedule them
+    for object in &objects {
+        state.store_resource(object)?;
+    }
+
+    let has_secrets = objects.iter().any(|o| match o {
+        SupportedResources::Secret(_) => true,
+        _ => false
+    });
+    match (state.secret_key.as_ref(), has_secrets) {
+        (None, true) => Entry::warn(format!("{} secrets are stored unencrypted, see `skate secret rotate-key` to set a key for cluster {}", INFO_EMOJI, cluster.name)).operation("store").eprint(),
+        _ => {}
+    }
+
+    let scheduler = DefaultScheduler { max_concurrency: args.max_concurrency };
+    if args.atomic {
+        return apply_atomic(&config, &cluster.name, &conns, state, &scheduler, objects.into_iter().zip(previous).collect()).await;
+    }
+
+    let result = match scheduler.schedule(&conns, &mut state, objects).await {
+        Ok(result) => result,
         Err(e) => {
-            eprintln!("{}", e);
+            Entry::error(e.to_string()).operation("schedule").eprint();
             return Err(anyhow!("failed to schedule resources").into());
         }
-    }
+    };
 
     state.persist()?;
 
+    print_node_summary(&result);
+
     Ok(())
 }
+
+// one resource at a time, stopping at the first failure and undoing everything applied up to and including it
+async fn apply_atomic(config: &Config, cluster_name: &str, conns: &SshClients, mut state: ClusterState, scheduler: &DefaultScheduler, objects: Vec<(SupportedResources, Option<SupportedResources>)>) -> Result<(), Box<dyn Error>> {
+    let mut result = ScheduleResult { placements: vec![] };
+    let mut touched = 0;
+    let mut failure = None;
+    for (object, _) in &objects {
+        touched += 1;
+        let placements = scheduler.schedule(conns, &mut state, vec!(object.clone())).await?.placements;
+        failure = placements.iter().find(|p| p.error.is_some())
+            .map(|p| format!("{} {}: {}", p.resource, p.resource.name(), p.error.clone().unwrap_or_default()));
+        result.placements.extend(placements);
+        if failure.is_some() {
+            break;
+        }
+    }
+
+    let failure = match failure {
+        Some(failure) => failure,
+        None => {
+            state.persist()?;
+            print_node_summary(&result);
+            return Ok(());
+        }
+    };
+
+    Entry::error(format!("{} {}, rolling back", CROSS_EMOJI, failure)).operation("rollback").print();
+
+    // the ones not reached were only stored
+    for (object, previous) in &objects[touched..] {
+        match previous {
+            Some(previous) => state.store_resource(previous)?,
+            None => state.remove_stored_resource(object)
+        }
+    }
+
+    // newest first, so each is undone on top of what it was applied over
+    for (object, previous) in objects[..touched].iter().rev() {
+        match previous {
+            Some(previous) => {
+                state.store_resource(previous)?;
+                scheduler.schedule(conns, &mut state, vec!(previous.clone())).await?;
+            }
+            None => {
+                state.remove_stored_resource(object);
+                let pods: Vec<_> = state.filter_pods(&|p| owns(object, p)).into_iter().map(|(pod_info, node)| ScheduledOperation {
+                    node: Some(node.clone()),
+                    resource: SupportedResources::Pod(pod_info.into()),
+                    error: None,
+                    operation: OpType::Delete,
+                }).collect();
+                DefaultScheduler::execute(conns, &mut state, pods, scheduler.max_concurrency).await?;
+            }
+        }
+    }
+    state.persist()?;
+
+    // checked against what the nodes now report rather than what the rollback thinks it did
+    let state = refreshed_state(cluster_name, conns, config).await?;
+    let mut delta = vec!();
+    for (object, previous) in &objects[..touched] {
+        match previous {
+            Some(previous) => {
+                let actions = DefaultScheduler::dry_run(&mut state.clone(), &vec!(previous.clone()));
+                for action in actions {
+                    let name = format!("{} {}", action.resource, action.resource.name());
+                    let node_name = action.node.as_ref().map(|n| n.node_name.clone()).unwrap_or("-".to_string());
+                    match (&action.operation, &action.error) {
+                        (_, Some(err)) => delta.push(format!("{}: {}", name, err)),
+                        (OpType::Create, None) => delta.push(format!("{} is missing", name)),
+                        (OpType::Delete, None) => delta.push(format!("{} on node {} is not the previous version", name, node_name)),
+                        _ => {}
+                    }
+                }
+            }
+            None => {
+                for (pod, node) in state.filter_pods(&|p| owns(object, p)) {
+                    delta.push(format!("Pod {}.{} on node {} is left over from {} {}", pod.name, pod.namespace(), node.node_name, object, object.name()));
+                }
+            }
+        }
+    }
+
+    match delta.len() {
+        0 => {
+            Entry::info(format!("{} rolled back {} resources", CHECKBOX_EMOJI, touched)).operation("rollback").print();
+            Err(anyhow!("apply failed and was rolled back: {}", failure).into())
+        }
+        _ => {
+            Entry::error(format!("{} rollback incomplete, these differ from before the apply and need cleaning up:\n    {}", CROSS_EMOJI, delta.join("\n    ")))
+                .operation("rollback").print();
+            Err(anyhow!("apply failed and {} differences remain after rolling back: {}", delta.len(), failure).into())
+        }
+    }
+}
+
+// a verdict for each resource, nothing is stored or sent to the nodes
+async fn apply_dry_run(sources: Vec<(String, String)>, strict: bool, dry_run: DryRun, config_args: ConfigFileArgs) -> Result<(), Box<dyn Error>> {
+    let objects = crate::skate::read_manifests(sources, strict)?;
+    let config = Config::load(Some(config_args.skateconfig.clone()), config_args.context.clone())?;
+    // a client dry run doesn't need a cluster, only its namespace if there is one
+    let namespace = config.current_cluster().map(|c| c.namespace(None)).unwrap_or("default".to_string());
+
+    let mut valid: Vec<SupportedResources> = vec!();
+    let mut failed = 0;
+    let total = objects.len();
+    for object in objects {
+        let object = object.with_default_namespace(&namespace);
+        let name = format!("{} {}", object, object.name());
+        let errors = match object.fixup() {
+            Ok(object) => {
+                let errors = validate(&object);
+                if errors.len() == 0 {
+                    valid.push(object);
+                }
+                errors
+            }
+            Err(e) => vec!(e.to_string())
+        };
+        if errors.len() > 0 {
+            failed += 1;
+            println!("{} {}", CROSS_EMOJI, name);
+            for err in errors {
+                println!("    {}", err);
+            }
+        } else if dry_run == DryRun::Client {
+            println!("{} {} valid", CHECKBOX_EMOJI, name);
+        }
+    }
+
+    if dry_run == DryRun::Server && valid.len() > 0 {
+        let cluster = config.current_cluster()?;
+        let (conns, errors) = ssh::cluster_connections(cluster).await;
+        match errors {
+            Some(e) => {
+                e.log()
+            }
+            _ => {}
+        };
+        let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+        // a copy that never gets persisted
+        let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+        for object in &valid {
+            state.store_resource(object)?;
+        }
+
+        for object in &valid {
+            let name = format!("{} {}", object, object.name());
+            let actions = DefaultScheduler::dry_run(&mut state, &vec!(object.clone()));
+
+            let mut errors: Vec<String> = vec!();
+            let mut created: Vec<String> = vec!();
+            let mut deleted = 0;
+            let mut unchanged = 0;
+            for action in &actions {
+                match (&action.operation, &action.error) {
+                    (_, Some(err)) => errors.push(format!("{} {}: {}", action.resource, action.resource.name(), err)),
+                    (OpType::Create, None) => {
+                        // the credentials are only put together when the pod is created
+                        match &action.resource {
+                            SupportedResources::Pod(pod) => match state.registry_auth(pod) {
+                                Ok(_) => {}
+                                Err(e) => errors.push(format!("{} {}: {}", action.resource, action.resource.name(), e))
+                            },
+                            _ => {}
+                        }
+                        created.push(action.node.as_ref().map(|n| n.node_name.clone()).unwrap_or("-".to_string()));
+                    }
+                    (OpType::Delete, None) => deleted += 1,
+                    (OpType::Unchanged, None) => unchanged += 1,
+                    _ => {}
+                }
+            }
+
+            if errors.len() > 0 {
+                failed += 1;
+                println!("{} {}", CROSS_EMOJI, name);
+                for err in errors {
+                    println!("    {}", err);
+                }
+                continue;
+            }
+
+            let mut summary = vec!();
+            if created.len() > 0 {
+                summary.push(format!("would create {} pods on {}", created.len(), created.iter().unique().join(", ")));
+            }
+            if deleted > 0 {
+                summary.push(format!("would delete {} pods", deleted));
+            }
+            if unchanged > 0 {
+                summary.push(format!("{} pods unchanged", unchanged));
+            }
+            match summary.len() {
+                0 => println!("{} {} valid", CHECKBOX_EMOJI, name),
+                _ => println!("{} {} valid, {}", CHECKBOX_EMOJI, name, summary.join(", "))
+            }
+        }
+    }
+
+    match failed {
+        0 => Ok(()),
+        _ => Err(anyhow!("{} of {} resources failed validation", failed, total).into())
+    }
+}
+
+// nodes are worked on concurrently so their output is interleaved, this sums it up per node
+fn print_node_summary(result: &ScheduleResult) {
+    let mut nodes: BTreeMap<String, (usize, Vec<String>)> = BTreeMap::new();
+    for placement in &result.placements {
+        if placement.operation != OpType::Create && placement.operation != OpType::Delete && placement.error.is_none() {
+            continue;
+        }
+        let node_name = placement.node.as_ref().map(|n| n.node_name.clone()).unwrap_or("-".to_string());
+        let entry = nodes.entry(node_name).or_insert((0, vec!()));
+        match &placement.error {
+            Some(err) => entry.1.push(format!("{} {}: {}", placement.resource, placement.resource.name(), err)),
+            None => entry.0 += 1
+        }
+    }
+
+    if nodes.len() == 0 {
+        return;
+    }
+
+    match logging::is_json() {
+        true => {}
+        false => println!()
+    }
+    for (node_name, (succeeded, errors)) in nodes {
+        match errors.len() {
+            0 => Entry::info(format!("{} {}: {} succeeded", CHECKBOX_EMOJI, node_name, succeeded)).node(&node_name).operation("apply").print(),
+            _ => Entry::error(format!("{} {}: {} succeeded, {} failed\n    {}", CROSS_EMOJI, node_name, succeeded, errors.len(), errors.join("\n    ")))
+                .node(&node_name).operation("apply").print()
+        }
+    }
+}
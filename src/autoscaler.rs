@@ -0,0 +1,104 @@
+use chrono::Utc;
+use k8s_openapi::api::apps::v1::Deployment;
+use k8s_openapi::api::autoscaling::v1::{HorizontalPodAutoscaler, HorizontalPodAutoscalerStatus};
+use k8s_openapi::api::core::v1::Pod;
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::Time;
+use crate::scheduler::DefaultScheduler;
+use crate::skate::SupportedResources;
+use crate::skatelet::PodmanPodStatus;
+use crate::state::state::ClusterState;
+
+// same as kubernetes, don't scale when usage is within 10% of the target
+const TOLERANCE: f32 = 0.1;
+const DEFAULT_TARGET_CPU_PERCENT: i32 = 80;
+
+#[derive(Debug, Clone)]
+pub struct ScaleDecision {
+    pub current_replicas: i32,
+    pub desired_replicas: i32,
+    pub current_cpu_percent: Option<f32>,
+}
+
+impl ScaleDecision {
+    pub fn into_status(self, previous: Option<HorizontalPodAutoscalerStatus>) -> HorizontalPodAutoscalerStatus {
+        let last_scale_time = match self.desired_replicas != self.current_replicas {
+            true => Some(Time(Utc::now())),
+            false => previous.and_then(|p| p.last_scale_time)
+        };
+        HorizontalPodAutoscalerStatus {
+            current_cpu_utilization_percentage: self.current_cpu_percent.map(|c| c.round() as i32),
+            current_replicas: self.current_replicas,
+            desired_replicas: self.desired_replicas,
+            last_scale_time,
+            observed_generation: None,
+        }
+    }
+}
+
+fn requires_anti_affinity(deployment: &Deployment) -> bool {
+    deployment.spec.as_ref()
+        .and_then(|s| s.template.spec.as_ref())
+        .and_then(|s| s.affinity.as_ref())
+        .and_then(|a| a.pod_anti_affinity.as_ref())
+        .and_then(|a| a.required_during_scheduling_ignored_during_execution.as_ref())
+        .map(|terms| !terms.is_empty())
+        .unwrap_or(false)
+}
+
+// works out how many replicas the deployment should have based on the cpu usage of its running pods
+pub fn decide(state: &ClusterState, hpa: &HorizontalPodAutoscaler, deployment: &Deployment) -> ScaleDecision {
+    let spec = hpa.spec.clone().unwrap_or_default();
+    let min = spec.min_replicas.unwrap_or(1);
+    let max = spec.max_replicas.max(min);
+    let target = spec.target_cpu_utilization_percentage.unwrap_or(DEFAULT_TARGET_CPU_PERCENT).max(1) as f32;
+
+    let name = deployment.metadata.name.clone().unwrap_or("".to_string());
+    let ns = deployment.metadata.namespace.clone().unwrap_or("".to_string());
+
+    let pods = state.locate_deployment(&name, &ns);
+    let running: Vec<_> = pods.iter().filter(|(p, _)| p.status == PodmanPodStatus::Running).collect();
+
+    let usages: Vec<f32> = running.iter().filter_map(|(p, node)| {
+        node.host_info.as_ref()?.system_info.as_ref()?.pod_cpu_percent(&p.id)
+    }).collect();
+
+    let current_cpu_percent = match usages.len() {
+        0 => None,
+        n => Some(usages.iter().sum::<f32>() / n as f32)
+    };
+
+    let current_replicas = pods.len() as i32;
+
+    let desired = match (current_cpu_percent, running.len()) {
+        // nothing to measure yet, start from the spec
+        (_, 0) => deployment.spec.as_ref().and_then(|s| s.replicas).unwrap_or(min).max(current_replicas),
+        (None, _) => current_replicas,
+        (Some(usage), num_running) => {
+            let ratio = usage / target;
+            match (ratio - 1.0).abs() <= TOLERANCE {
+                true => current_replicas,
+                false => (num_running as f32 * ratio).ceil() as i32
+            }
+        }
+    };
+
+    let mut desired_replicas = desired.clamp(min, max);
+
+    // can't have more replicas than nodes if they aren't allowed to share one
+    if requires_anti_affinity(deployment) {
+        let template = deployment.spec.as_ref().map(|s| s.template.clone()).unwrap_or_default();
+        let pod = SupportedResources::Pod(Pod {
+            metadata: template.metadata.unwrap_or_default(),
+            spec: template.spec,
+            status: None,
+        });
+        let eligible = DefaultScheduler::eligible_nodes(&state.nodes, &pod).len() as i32;
+        desired_replicas = desired_replicas.min(eligible);
+    }
+
+    ScaleDecision {
+        current_replicas,
+        desired_replicas,
+        current_cpu_percent,
+    }
+}
@@ -0,0 +1,294 @@
+use std::collections::BTreeSet;
+use std::error::Error;
+use std::fs;
+use std::io::Write;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::Path;
+use anyhow::anyhow;
+use chrono::{DateTime, SecondsFormat, Utc};
+use clap::{Args, Subcommand};
+use itertools::Itertools;
+use serde::{Deserialize, Serialize};
+use crate::config::{Cluster, Config};
+use crate::logging::Entry;
+use crate::refresh::refreshed_state;
+use crate::scheduler::{DefaultScheduler, OpType, Scheduler, DEFAULT_MAX_CONCURRENCY};
+use crate::secret::{encrypt, is_encrypted, SecretKey, ENCRYPTED_ANNOTATION};
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::skatelet::PodmanPodInfo;
+use crate::ssh;
+use crate::state::state::{ClusterState, NodeStatus};
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, EQUAL_EMOJI, INFO_EMOJI};
+
+// bumped whenever a backup written by this version can't be read by an older one
+const BACKUP_VERSION: u32 = 1;
+
+#[derive(Debug, Args)]
+pub struct ClusterArgs {
+    #[command(subcommand)]
+    command: ClusterCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum ClusterCommands {
+    #[command(about = "write the cluster's state to a file", long_about = "Write everything skate keeps about the cluster to a \
+single file: the cluster's config with its nodes, every applied spec, node labels, taints and cordons, and secrets, \
+encrypted. Only the local state is read, the nodes aren't contacted.")]
+    Backup(BackupArgs),
+    #[command(about = "load a backup and check it against the nodes", long_about = "Load a backup written by `skate cluster \
+backup`, adding the cluster to the config, then connect to its nodes and report where what's running differs from the \
+restored specs.")]
+    Restore(RestoreArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct BackupArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, long_help = "Write secrets that are stored unencrypted as they are, rather than refusing to when the cluster \
+has no secret_key_file to encrypt them with.")]
+    allow_unencrypted_secrets: bool,
+    #[arg(long_help = "File to write the backup to.")]
+    file: String,
+}
+
+#[derive(Debug, Args)]
+pub struct RestoreArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, long_help = "Replace a cluster of the same name and its state, if there already is one.")]
+    force: bool,
+    #[arg(long, long_help = "Key file to decrypt the backup's secrets with on this machine, instead of the cluster's \
+secret_key_file from the backup.")]
+    secret_key_file: Option<String>,
+    #[arg(long, long_help = "Schedule what's missing or out of date on the nodes, the same as applying every restored spec \
+again, instead of only reporting it.")]
+    reconcile: bool,
+    #[arg(long_help = "Backup file, as written by `skate cluster backup`.")]
+    file: String,
+}
+
+#[derive(Serialize, Deserialize)]
+struct Backup {
+    version: u32,
+    created: DateTime<Utc>,
+    skate_version: String,
+    // the cluster's entry in the config, nodes and all
+    cluster: Cluster,
+    // applied specs, node labels, taints and cordons, what volume is on which node. nothing the nodes report
+    state: ClusterState,
+}
+
+pub async fn cluster(args: ClusterArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        ClusterCommands::Backup(args) => backup(args),
+        ClusterCommands::Restore(args) => restore(args).await,
+    }
+}
+
+// what was running is out of date by the time the backup is restored, so only what skate decided is kept
+fn strip_runtime(state: &mut ClusterState) {
+    for node in state.nodes.iter_mut() {
+        node.status = NodeStatus::Unknown;
+        node.host_info = None;
+        node.failures = 0;
+        node.last_seen = None;
+        node.down = false;
+    }
+    state.events = vec!();
+    state.restarts.clear();
+}
+
+fn backup(args: BackupArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?.clone();
+
+    let mut state = match Path::new(&ClusterState::path(&cluster.name)).exists() {
+        true => ClusterState::load(&cluster.name)?,
+        false => return Err(anyhow!("no state for cluster {}, there's nothing to back up", cluster.name).into())
+    };
+    strip_runtime(&mut state);
+
+    let key = match &cluster.secret_key_file {
+        Some(path) => Some(SecretKey::load(path)?),
+        None => None
+    };
+    let mut encrypted = 0;
+    for resource in state.resources.iter_mut() {
+        match resource {
+            SupportedResources::Secret(secret) if !is_encrypted(secret) => match (&key, args.allow_unencrypted_secrets) {
+                (Some(key), _) => {
+                    *secret = encrypt(secret, key)?;
+                    encrypted += 1;
+                }
+                (None, true) => {}
+                (None, false) => return Err(anyhow!("secret {} is stored unencrypted and cluster {} has no secret_key_file, set one with \
+`skate secret rotate-key` or pass --allow-unencrypted-secrets", secret.metadata.name.clone().unwrap_or_default(), cluster.name).into())
+            },
+            _ => {}
+        }
+    }
+
+    let backup = Backup {
+        version: BACKUP_VERSION,
+        created: Utc::now(),
+        skate_version: env!("CARGO_PKG_VERSION").to_string(),
+        cluster: cluster.clone(),
+        state,
+    };
+
+    // secrets and all, so only for the owner, same as a key file
+    let mut file = fs::OpenOptions::new().write(true).create(true).truncate(true).mode(0o600).open(&args.file)
+        .map_err(|e| anyhow!("failed to create backup file {}", args.file).context(e))?;
+    file.write_all(serde_json::to_string_pretty(&backup)?.as_bytes())?;
+
+    let count = |f: &dyn Fn(&SupportedResources) -> bool| backup.state.resources.iter().filter(|r| f(r)).count();
+    let secrets = count(&|r| matches!(r, SupportedResources::Secret(_)));
+    println!("{} backed up cluster {} to {}: {} nodes, {} resources, {} secrets", CHECKBOX_EMOJI, cluster.name, args.file,
+        backup.cluster.nodes.len(), backup.state.resources.len() - secrets, secrets);
+    if encrypted > 0 {
+        println!("{} encrypted {} secrets that were stored unencrypted with key {}", INFO_EMOJI, encrypted, key.map(|k| k.id()).unwrap_or_default());
+    }
+    match &cluster.secret_key_file {
+        Some(path) => println!("{} the secret key isn't in the backup, keep {} alongside it, restoring needs it", INFO_EMOJI, path),
+        None => {}
+    }
+    Ok(())
+}
+
+// the ids of the keys the backup's secrets are encrypted with
+fn secret_key_ids(state: &ClusterState) -> BTreeSet<String> {
+    state.resources.iter().filter_map(|r| match r {
+        SupportedResources::Secret(secret) => secret.metadata.annotations.as_ref().and_then(|a| a.get(ENCRYPTED_ANNOTATION)).cloned(),
+        _ => None
+    }).collect()
+}
+
+// the kind/name.namespace of whatever a running pod was created for
+fn owner(pod: &PodmanPodInfo) -> String {
+    [("skate.io/deployment", "deployment"), ("skate.io/daemonset", "daemonset"), ("skate.io/statefulset", "statefulset"), ("skate.io/job", "job")].iter()
+        .find_map(|(label, kind)| pod.labels.get(*label).filter(|v| !v.is_empty()).map(|v| format!("{}/{}.{}", kind, v, pod.namespace())))
+        .unwrap_or(format!("pod/{}.{}", pod.name, pod.namespace()))
+}
+
+async fn restore(args: RestoreArgs) -> Result<(), Box<dyn Error>> {
+    let contents = fs::read_to_string(&args.file).map_err(|e| anyhow!("failed to read backup file {}", args.file).context(e))?;
+    let backup: Backup = serde_json::from_str(&contents).map_err(|e| anyhow!("{} is not a skate cluster backup", args.file).context(e))?;
+    if backup.version > BACKUP_VERSION {
+        return Err(anyhow!("{} was written by skate {} in a newer format ({}), upgrade skate to restore it", args.file, backup.skate_version, backup.version).into());
+    }
+
+    let mut cluster = backup.cluster.clone();
+    let mut state = backup.state;
+    state.cluster_name = cluster.name.clone();
+
+    let mut config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let existing = config.clusters.iter().position(|c| c.name == cluster.name);
+    let has_state = Path::new(&ClusterState::path(&cluster.name)).exists();
+    if (existing.is_some() || has_state) && !args.force {
+        return Err(anyhow!("cluster {} already exists, pass --force to replace it and its state", cluster.name).into());
+    }
+
+    // checked before anything is written, a restore that can't open its secrets would only leave a broken cluster
+    match &args.secret_key_file {
+        Some(path) => cluster.secret_key_file = Some(path.clone()),
+        None => {}
+    }
+    let key_ids = secret_key_ids(&state);
+    if key_ids.len() > 0 {
+        let path = cluster.secret_key_file.clone()
+            .ok_or(anyhow!("the backup's secrets are encrypted with key {}, pass --secret-key-file", key_ids.iter().join(", ")))?;
+        let key = SecretKey::load(&path)?;
+        let other: Vec<_> = key_ids.iter().filter(|id| **id != key.id()).collect();
+        if other.len() > 0 {
+            return Err(anyhow!("the backup's secrets are encrypted with key {}, {} holds key {}", other.iter().join(", "), path, key.id()).into());
+        }
+    }
+
+    match existing {
+        Some(index) => config.clusters[index] = cluster.clone(),
+        None => config.clusters.push(cluster.clone())
+    }
+    config.persist(Some(args.config.skateconfig.clone()))?;
+    state.persist()?;
+    println!("{} restored cluster {} from {} (backed up {}): {} nodes, {} resources", CHECKBOX_EMOJI, cluster.name, args.file,
+        backup.created.to_rfc3339_opts(SecondsFormat::Secs, true), cluster.nodes.len(), state.resources.len());
+
+    check_drift(&config, &cluster, args.reconcile).await
+}
+
+// what's on the nodes against what was restored: pods the specs want that aren't there or are out of date, and pods
+// nothing restored accounts for
+async fn check_drift(config: &Config, cluster: &Cluster, reconcile: bool) -> Result<(), Box<dyn Error>> {
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any of cluster {}'s nodes, nothing to check the restored state against", cluster.name))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, config).await?;
+    state.persist()?;
+
+    for node in state.nodes.iter().filter(|n| n.status != NodeStatus::Healthy) {
+        Entry::warn(format!("{} node {} isn't reachable, what runs there isn't checked", CROSS_EMOJI, node.node_name))
+            .node(&node.node_name).operation("restore").eprint();
+    }
+
+    let workloads: Vec<_> = state.resources.iter().filter(|r| match r {
+        SupportedResources::Pod(_) | SupportedResources::Deployment(_) | SupportedResources::DaemonSet(_)
+        | SupportedResources::StatefulSet(_) | SupportedResources::Job(_) => true,
+        _ => false
+    }).cloned().collect();
+
+    let known: BTreeSet<String> = workloads.iter().map(|r| format!("{}/{}", r.to_string().to_lowercase(), r.name())).collect();
+    let orphans: Vec<_> = state.filter_pods(&|p| !known.contains(&owner(p))).into_iter()
+        .map(|(p, n)| (p.name.clone(), p.namespace(), owner(&p), n.node_name.clone()))
+        .collect();
+
+    // a copy, so planning doesn't leave anything behind in the state
+    let mut planned = state.clone();
+    let actions = DefaultScheduler::dry_run(&mut planned, &workloads);
+    let drift: Vec<_> = actions.iter().filter(|a| a.operation == OpType::Create || a.operation == OpType::Delete || a.error.is_some()).collect();
+
+    for action in &drift {
+        let node_name = action.node.as_ref().map(|n| n.node_name.clone()).unwrap_or("-".to_string());
+        let message = match (&action.operation, &action.error) {
+            (_, Some(err)) => format!("{} {} {} can't be scheduled: {}", CROSS_EMOJI, action.resource, action.resource.name(), err),
+            (OpType::Create, None) => format!("{} {} {} is missing, would be created on node {}", INFO_EMOJI, action.resource, action.resource.name(), node_name),
+            _ => format!("{} {} {} on node {} is out of date, would be removed", INFO_EMOJI, action.resource, action.resource.name(), node_name),
+        };
+        Entry::warn(message).node(&node_name).object(&action.resource).operation("restore").print();
+    }
+    for (name, namespace, owner, node_name) in &orphans {
+        Entry::warn(format!("{} pod {}.{} on node {} belongs to {}, which isn't in the backup", INFO_EMOJI, name, namespace, node_name, owner))
+            .node(node_name).resource(&format!("pod/{}.{}", name, namespace)).operation("restore").print();
+    }
+
+    if drift.len() == 0 && orphans.len() == 0 {
+        Entry::info(format!("{} the nodes match the restored state", EQUAL_EMOJI)).operation("restore").print();
+        return Ok(());
+    }
+
+    match reconcile {
+        false => {
+            println!("{} {} differences, pass --reconcile to schedule the restored specs, pods that aren't in the backup are left alone \
+either way", INFO_EMOJI, drift.len() + orphans.len());
+            Ok(())
+        }
+        true => {
+            let scheduler = DefaultScheduler { max_concurrency: DEFAULT_MAX_CONCURRENCY };
+            let result = scheduler.schedule(&conns, &mut state, workloads).await;
+            state.persist()?;
+            match result {
+                Ok(_) => {
+                    Entry::info(format!("{} scheduled the restored specs on cluster {}", CHECKBOX_EMOJI, cluster.name)).operation("restore").print();
+                    Ok(())
+                }
+                Err(e) => Err(anyhow!("failed to schedule the restored specs: {}", e).into())
+            }
+        }
+    }
+}
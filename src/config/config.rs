@@ -12,6 +12,9 @@ use std::hash::{Hash};
 pub struct Config {
     pub current_context: Option<String>,
     pub clusters: Vec<Cluster>,
+    // from --context, wins over current-context and is never written back
+    #[serde(skip)]
+    pub context: Option<String>,
 }
 
 #[derive(Serialize, Deserialize, Hash, Clone)]
@@ -19,9 +22,55 @@ pub struct Cluster {
     pub name: String,
     pub default_user: Option<String>,
     pub default_key: Option<String>,
+    // seconds, defaults to 5
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub connect_timeout: Option<u64>,
+    // seconds between keepalives on open connections, 0 turns them off, defaults to 5
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub keepalive_interval: Option<u64>,
+    // consecutive failed health checks before a node's pods are rescheduled, defaults to 3
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub node_failure_threshold: Option<u32>,
+    // seconds a node has to have been unreachable for as well, defaults to 60
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub node_grace_period: Option<u64>,
+    // percent of a node's cpus and memory that the requests of its pods may add up to, over 100 overcommits it. both
+    // default to 100
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_cpu_allocation: Option<u32>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_memory_allocation: Option<u32>,
+    // containers are restarted by `skate reconcile`, backing off, instead of straight away by podman. only for clusters
+    // that keep `skate reconcile` running, nothing restarts them otherwise. defaults to false
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub reconcile_restarts: Option<bool>,
+    // key that secrets are encrypted with in the cluster state, as created by `skate secret generate-key`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub secret_key_file: Option<String>,
+    // used by commands when no --namespace is given
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub default_namespace: Option<String>,
+    // where coredns sends lookups outside of cluster.skate, see `skate create coredns`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dns: Option<DnsConfig>,
     pub nodes: Vec<Node>,
 }
 
+#[derive(Serialize, Deserialize, Clone, Debug, Hash, Default)]
+pub struct DnsConfig {
+    // defaults to 8.8.8.8
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub upstreams: Vec<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub forward_zones: Vec<ForwardZone>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, Hash, Default)]
+pub struct ForwardZone {
+    pub zone: String,
+    pub upstreams: Vec<String>,
+}
+
 
 #[derive(Serialize, Deserialize, Clone, Debug, Hash)]
 pub struct Node {
@@ -37,17 +86,29 @@ pub struct Node {
 }
 
 impl Config {
+    // refuses to guess between several clusters when none is selected
     pub fn current_cluster(&self) -> Result<&Cluster, Box<dyn Error>> {
         if self.clusters.len() == 0 {
             return Err(anyhow!("no clusters in config").into());
         }
 
-        let first = &(self.clusters).first().expect("no first cluster");
+        let cluster_name = match (self.context.as_ref().or(self.current_context.as_ref()), self.clusters.len()) {
+            (Some(name), _) => name.clone(),
+            (None, 1) => self.clusters[0].name.clone(),
+            (None, _) => {
+                let names = self.clusters.iter().map(|c| c.name.clone()).collect::<Vec<_>>().join(", ");
+                return Err(anyhow!("no context selected and there are several ({}), pass --context or run skate config use-context", names).into());
+            }
+        };
 
-        let cluster_name = self.current_context.clone().unwrap_or(first.name.to_owned());
+        self.clusters.iter().find(|c| c.name == cluster_name)
+            .ok_or(anyhow!("no context named {}", cluster_name).into())
+    }
+}
 
-        Ok(self.clusters.iter().find(|c| c.name == cluster_name)
-            .expect(format!("found no cluster by name of {}", cluster_name).as_str()))
+impl Cluster {
+    pub fn namespace(&self, namespace: Option<String>) -> String {
+        namespace.or(self.default_namespace.clone()).unwrap_or("default".to_string())
     }
 }
 
@@ -78,6 +139,7 @@ pub fn ensure_config() -> Result<(), Box<dyn Error>> {
     let default_config = Config {
         current_context: None,
         clusters: vec![],
+        context: None,
     };
 
     if !path.exists() {
@@ -100,11 +162,13 @@ impl Config {
         };
         shellexpand::tilde(&path).to_string()
     }
-    pub fn load(path: Option<String>) -> Result<Config, Box<dyn Error>> {
+    // context is the one picked with --context, if any
+    pub fn load(path: Option<String>, context: Option<String>) -> Result<Config, Box<dyn Error>> {
         let path = Config::path(path);
         let path = Path::new(&path);
         let f = fs::File::open(path).expect("failed to open config file");
-        let data: Config = serde_yaml::from_reader(f).expect("failed to read config file");
+        let mut data: Config = serde_yaml::from_reader(f).expect("failed to read config file");
+        data.context = context;
         Ok(data)
     }
 
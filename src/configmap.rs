@@ -0,0 +1,179 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::error::Error;
+use anyhow::anyhow;
+use k8s_openapi::api::core::v1::{ConfigMap, Container, EnvVar, HostPathVolumeSource, Pod, PodSpec};
+use crate::skatelet::VAR_PATH;
+use crate::state::state::ClusterState;
+
+// carries the files of a configMap volume to the node, the skatelet writes them out and drops the annotation
+pub(crate) const VOLUME_ANNOTATION_PREFIX: &str = "skate.io/configmap.";
+
+// names of the config maps a pod spec uses
+pub fn referenced(spec: &PodSpec) -> BTreeSet<String> {
+    let mut names = BTreeSet::new();
+    let containers = spec.containers.iter().chain(spec.init_containers.iter().flatten());
+    for container in containers {
+        for env in container.env.iter().flatten() {
+            match env.value_from.as_ref().and_then(|v| v.config_map_key_ref.as_ref()).and_then(|r| r.name.clone()) {
+                Some(name) => {
+                    names.insert(name);
+                }
+                None => {}
+            }
+        }
+        for env_from in container.env_from.iter().flatten() {
+            match env_from.config_map_ref.as_ref().and_then(|r| r.name.clone()) {
+                Some(name) => {
+                    names.insert(name);
+                }
+                None => {}
+            }
+        }
+    }
+    for volume in spec.volumes.iter().flatten() {
+        match volume.config_map.as_ref().and_then(|c| c.name.clone()) {
+            Some(name) => {
+                names.insert(name);
+            }
+            None => {}
+        }
+    }
+    names
+}
+
+fn lookup<'a>(config_maps: &'a BTreeMap<String, ConfigMap>, name: &str, optional: Option<bool>, pod_name: &str) -> Result<Option<&'a ConfigMap>, Box<dyn Error>> {
+    match (config_maps.get(name), optional.unwrap_or(false)) {
+        (Some(cm), _) => Ok(Some(cm)),
+        (None, true) => Ok(None),
+        (None, false) => Err(anyhow!("configmap {} referenced by pod {} has not been applied", name, pod_name).into())
+    }
+}
+
+fn project_env(container: &mut Container, config_maps: &BTreeMap<String, ConfigMap>, pod_name: &str) -> Result<(), Box<dyn Error>> {
+    let mut env: Vec<EnvVar> = vec!();
+
+    // envFrom goes first, anything set explicitly in env takes precedence
+    let explicit: BTreeSet<_> = container.env.iter().flatten().map(|e| e.name.clone()).collect();
+    let mut env_from = vec!();
+    for source in container.env_from.take().unwrap_or_default() {
+        let cm_ref = match source.config_map_ref.clone() {
+            Some(cm_ref) => cm_ref,
+            None => {
+                env_from.push(source);
+                continue;
+            }
+        };
+        let name = cm_ref.name.clone().unwrap_or_default();
+        let cm = match lookup(config_maps, &name, cm_ref.optional, pod_name)? {
+            Some(cm) => cm,
+            None => continue
+        };
+        let prefix = source.prefix.clone().unwrap_or_default();
+        for (k, v) in cm.data.clone().unwrap_or_default() {
+            let var_name = format!("{}{}", prefix, k);
+            if explicit.contains(&var_name) {
+                continue;
+            }
+            env.push(EnvVar { name: var_name, value: Some(v), value_from: None });
+        }
+    }
+    container.env_from = match env_from.len() {
+        0 => None,
+        _ => Some(env_from)
+    };
+
+    for mut var in container.env.take().unwrap_or_default() {
+        let key_ref = match var.value_from.as_ref().and_then(|v| v.config_map_key_ref.clone()) {
+            Some(key_ref) => key_ref,
+            None => {
+                env.push(var);
+                continue;
+            }
+        };
+        let name = key_ref.name.clone().unwrap_or_default();
+        let value = match lookup(config_maps, &name, key_ref.optional, pod_name)? {
+            Some(cm) => cm.data.as_ref().and_then(|d| d.get(&key_ref.key)).cloned(),
+            None => None
+        };
+        match (value, key_ref.optional.unwrap_or(false)) {
+            (Some(value), _) => {
+                var.value = Some(value);
+                var.value_from = None;
+                env.push(var);
+            }
+            // rather than starting with a blank value
+            (None, false) => {
+                return Err(anyhow!("configmap {} has no key {}, needed for {} in container {} of pod {}", name, key_ref.key, var.name, container.name, pod_name).into());
+            }
+            (None, true) => {}
+        }
+    }
+
+    container.env = match env.len() {
+        0 => None,
+        _ => Some(env)
+    };
+    Ok(())
+}
+
+// where the files of a pod's configMap volume go on its node. the executor works it out again from the name the
+// pod is played under, a surge pod gets its own copy rather than the one its namesake removes
+pub(crate) fn volume_path(ns: &str, pod_name: &str, volume: &str) -> String {
+    format!("{}/configmaps/{}/{}/{}", VAR_PATH, ns, pod_name, volume)
+}
+
+// resolves config map references into plain env values, and configMap volumes into host paths with their
+// content attached, so a changed config map changes the pod's hash and gets it restarted
+pub fn project(state: &ClusterState, pod: &mut Pod) -> Result<(), Box<dyn Error>> {
+    let spec = match pod.spec.as_mut() {
+        Some(spec) => spec,
+        None => return Ok(())
+    };
+    let names = referenced(spec);
+    if names.len() == 0 {
+        return Ok(());
+    }
+
+    let pod_name = pod.metadata.name.clone().unwrap_or_default();
+    let ns = pod.metadata.namespace.clone().unwrap_or_default();
+    let config_maps: BTreeMap<String, ConfigMap> = names.into_iter().filter_map(|name| {
+        let cm = state.locate_stored_config_map(&name, &ns)?;
+        Some((name, cm))
+    }).collect();
+
+    for container in spec.containers.iter_mut().chain(spec.init_containers.iter_mut().flatten()) {
+        project_env(container, &config_maps, &pod_name)?;
+    }
+
+    let mut annotations = pod.metadata.annotations.clone().unwrap_or_default();
+    for volume in spec.volumes.iter_mut().flatten() {
+        let source = match volume.config_map.take() {
+            Some(source) => source,
+            None => continue
+        };
+        let name = source.name.clone().unwrap_or_default();
+        let data = match lookup(&config_maps, &name, source.optional, &pod_name)? {
+            Some(cm) => cm.data.clone().unwrap_or_default(),
+            None => BTreeMap::new()
+        };
+
+        let files: BTreeMap<String, String> = match &source.items {
+            Some(items) => items.iter().map(|item| match data.get(&item.key) {
+                Some(value) => Ok((item.path.clone(), value.clone())),
+                None => Err(anyhow!("configmap {} has no key {}, needed for volume {} of pod {}", name, item.key, volume.name, pod_name))
+            }).collect::<Result<_, _>>()?,
+            None => data
+        };
+
+        annotations.insert(format!("{}{}", VOLUME_ANNOTATION_PREFIX, volume.name), serde_json::to_string(&files)?);
+        volume.host_path = Some(HostPathVolumeSource {
+            path: volume_path(&ns, &pod_name, &volume.name),
+            type_: Some("DirectoryOrCreate".to_string()),
+        });
+    }
+    if annotations.len() > 0 {
+        pod.metadata.annotations = Some(annotations);
+    }
+
+    Ok(())
+}
@@ -0,0 +1,87 @@
+use std::error::Error;
+use anyhow::anyhow;
+use clap::{Args, Subcommand};
+use crate::config::Config;
+use crate::skate::ConfigFileArgs;
+use crate::util::CHECKBOX_EMOJI;
+
+#[derive(Debug, Args)]
+pub struct ConfigArgs {
+    #[command(subcommand)]
+    command: ConfigCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum ConfigCommands {
+    #[command(about = "set the context commands use by default", long_about = "Set the current-context in the config file, \
+used by every command unless --context is given.")]
+    UseContext(UseContextArgs),
+    #[command(about = "list the contexts in the config file")]
+    GetContexts(ContextArgs),
+    #[command(about = "show the context commands would use")]
+    CurrentContext(ContextArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct UseContextArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long_help = "Name of the context.")]
+    name: String,
+}
+
+#[derive(Debug, Args)]
+pub struct ContextArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+}
+
+pub async fn config(args: ConfigArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        ConfigCommands::UseContext(args) => use_context(args),
+        ConfigCommands::GetContexts(args) => get_contexts(args),
+        ConfigCommands::CurrentContext(args) => current_context(args),
+    }
+}
+
+fn use_context(args: UseContextArgs) -> Result<(), Box<dyn Error>> {
+    let mut config = Config::load(Some(args.config.skateconfig.clone()), None)?;
+    if !config.clusters.iter().any(|c| c.name == args.name) {
+        return Err(anyhow!("no context named {}", args.name).into());
+    }
+    config.current_context = Some(args.name.clone());
+    config.persist(Some(args.config.skateconfig.clone()))?;
+    println!("{} switched to context {}", CHECKBOX_EMOJI, args.name);
+    Ok(())
+}
+
+fn get_contexts(args: ContextArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    // nothing is current when it would be ambiguous
+    let current = config.current_cluster().ok().map(|c| c.name.clone());
+
+    println!(
+        "{0: <8}  {1: <20}  {2: <6}  {3: <15}  {4}",
+        "CURRENT", "NAME", "NODES", "USER", "NAMESPACE"
+    );
+    for cluster in &config.clusters {
+        println!(
+            "{0: <8}  {1: <20}  {2: <6}  {3: <15}  {4}",
+            match current.as_ref() == Some(&cluster.name) {
+                true => "*",
+                false => ""
+            },
+            cluster.name,
+            cluster.nodes.len(),
+            cluster.default_user.clone().unwrap_or("-".to_string()),
+            cluster.namespace(None)
+        )
+    }
+    Ok(())
+}
+
+fn current_context(args: ContextArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    println!("{}", config.current_cluster()?.name);
+    Ok(())
+}
@@ -0,0 +1,156 @@
+use std::error::Error;
+use std::time::Duration;
+use anyhow::anyhow;
+use clap::Args;
+use crate::config::Config;
+use crate::logging::Entry;
+use crate::refresh::refreshed_state;
+use crate::scheduler::{DEFAULT_TERMINATION_GRACE_PERIOD, DefaultScheduler, OpType, Scheduler};
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::skatelet::PodmanPodInfo;
+use crate::ssh;
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, INFO_EMOJI, parse_duration};
+
+#[derive(Debug, Args)]
+pub struct CordonArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long_help = "Name of the node.")]
+    name: String,
+}
+
+#[derive(Debug, Args)]
+pub struct DrainArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, long_help = "Also remove daemonset and job pods, which can't be moved to another node.")]
+    force: bool,
+    #[arg(long, default_value = "5m", value_parser = parse_duration, long_help = "How long to wait for moved pods to come up, eg 30s, 5m, 1h.")]
+    timeout: Duration,
+    #[arg(long_help = "Name of the node.")]
+    name: String,
+}
+
+async fn set_unschedulable(config: &ConfigFileArgs, name: &str, unschedulable: bool) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(config.skateconfig.clone()), config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+    let node = state.nodes.iter_mut().find(|n| n.node_name == name)
+        .ok_or(anyhow!("node {} not found", name))?;
+    node.unschedulable = unschedulable;
+
+    state.persist()
+}
+
+pub async fn cordon(args: CordonArgs) -> Result<(), Box<dyn Error>> {
+    set_unschedulable(&args.config, &args.name, true).await?;
+    Entry::info(format!("{} node {} cordoned", CHECKBOX_EMOJI, args.name)).node(&args.name).operation("cordon").print();
+    Ok(())
+}
+
+pub async fn uncordon(args: CordonArgs) -> Result<(), Box<dyn Error>> {
+    set_unschedulable(&args.config, &args.name, false).await?;
+    Entry::info(format!("{} node {} uncordoned", CHECKBOX_EMOJI, args.name)).node(&args.name).operation("uncordon").print();
+    Ok(())
+}
+
+// the applied resource a pod belongs to, if it can be run somewhere else
+fn owner(resources: &Vec<SupportedResources>, pod: &PodmanPodInfo) -> Option<SupportedResources> {
+    let ns = pod.namespace();
+    resources.iter().find(|r| {
+        let name = r.name();
+        name.namespace == ns && match r {
+            SupportedResources::Deployment(_) => pod.deployment() == name.name,
+            SupportedResources::Pod(_) => pod.name == name.name && pod.labels.get("skate.io/deployment").is_none(),
+            _ => false
+        }
+    }).cloned()
+}
+
+pub async fn drain(args: DrainArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    let node = state.nodes.iter_mut().find(|n| n.node_name == args.name)
+        .ok_or(anyhow!("node {} not found", args.name))?;
+    node.unschedulable = true;
+    node.draining = true;
+    let node = node.clone();
+    // stays cordoned even if moving the pods fails part way
+    state.persist()?;
+    Entry::info(format!("{} node {} cordoned", CHECKBOX_EMOJI, args.name)).node(&args.name).operation("drain").print();
+
+    let pods = node.host_info.as_ref().and_then(|h| h.system_info.as_ref()).and_then(|si| si.pods.clone()).unwrap_or_default();
+
+    let mut movable: Vec<SupportedResources> = vec!();
+    let mut unmovable: Vec<PodmanPodInfo> = vec!();
+    for pod in pods {
+        match owner(&state.resources, &pod) {
+            Some(resource) => {
+                if !movable.iter().any(|m| m.to_string() == resource.to_string() && m.name().to_string() == resource.name().to_string()) {
+                    movable.push(resource);
+                }
+            }
+            None => unmovable.push(pod)
+        }
+    }
+
+    if unmovable.len() > 0 && !args.force {
+        let names: Vec<_> = unmovable.iter().map(|p| p.name.clone()).collect();
+        Entry::warn(format!("{} leaving {} on node {}, use --force to remove them", INFO_EMOJI, names.join(", "), args.name)).node(&args.name).operation("drain").print();
+    }
+
+    let scheduler = DefaultScheduler::default();
+    let result = scheduler.schedule(&conns, &mut state, movable).await?;
+
+    let failed: Vec<_> = result.placements.iter().filter(|p| p.error.is_some()).collect();
+    if failed.len() > 0 {
+        state.persist()?;
+        return Err(anyhow!("failed to move {} pods off node {}", failed.len(), args.name).into());
+    }
+
+    // rolling updates wait for themselves, anything moved one at a time needs checking
+    let created: Vec<_> = result.placements.iter().filter(|p| p.operation == OpType::Create).filter_map(|p| {
+        Some((p.resource.name().name, p.node.as_ref()?.node_name.clone()))
+    }).collect();
+    DefaultScheduler::wait_for_pods(&conns, created, args.timeout).await?;
+
+    if args.force {
+        let conn = conns.find(&args.name).ok_or(anyhow!("failed to find connection to node {}", args.name))?;
+        for pod in unmovable {
+            let grace_period = pod.labels.get("skate.io/grace-period").and_then(|g| g.parse().ok()).unwrap_or(DEFAULT_TERMINATION_GRACE_PERIOD);
+            let manifest = serde_yaml::to_string(&SupportedResources::Pod(pod.clone().into()))?;
+            match conn.remove_resource(&manifest, grace_period).await {
+                Ok(_) => Entry::info(format!("{} deleted {} on node {}", CHECKBOX_EMOJI, pod.name, args.name))
+                    .node(&args.name).resource(&format!("pod/{}.{}", pod.name, pod.namespace())).operation("drain").print(),
+                Err(e) => Entry::error(format!("{} failed to delete {} on node {}: {}", CROSS_EMOJI, pod.name, args.name, e))
+                    .node(&args.name).resource(&format!("pod/{}.{}", pod.name, pod.namespace())).operation("drain").print()
+            }
+        }
+    }
+
+    state.persist()?;
+    Entry::info(format!("{} node {} drained", CHECKBOX_EMOJI, args.name)).node(&args.name).operation("drain").print();
+    Ok(())
+}
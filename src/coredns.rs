@@ -0,0 +1,107 @@
+use std::error::Error;
+use std::fs::File;
+use std::io::Write;
+use std::net::{IpAddr, SocketAddr};
+use anyhow::anyhow;
+use k8s_openapi::api::apps::v1::DaemonSet;
+use crate::apply::{apply, ApplyArgs};
+use crate::config::Cluster;
+use crate::kustomize::RenderArgs;
+use crate::scheduler::DEFAULT_MAX_CONCURRENCY;
+use crate::skate::ConfigFileArgs;
+
+const COREDNS_MANIFEST: &str = include_str!("../manifests/coredns.yaml");
+const COREFILE_ENV: &str = "CORE_FILE";
+const CLUSTER_ZONE: &str = "cluster.skate";
+const DEFAULT_UPSTREAMS: [&str; 1] = ["8.8.8.8"];
+
+// what coredns's forward plugin takes: an ip with an optional port, a dns:// or tls:// one, or a resolv.conf
+fn valid_upstream(upstream: &str) -> bool {
+    let address = upstream.strip_prefix("dns://").or(upstream.strip_prefix("tls://")).unwrap_or(upstream);
+    address.parse::<IpAddr>().is_ok() || address.parse::<SocketAddr>().is_ok()
+        || (upstream.starts_with('/') && !upstream.contains(|c: char| c.is_whitespace() || "{}\"'#;".contains(c)))
+}
+
+// zones are spliced into the Corefile as they are, so nothing but a dns name gets through
+fn valid_zone(zone: &str) -> bool {
+    zone.len() <= 253 && zone.split('.').all(|label| {
+        label.len() > 0 && label.len() <= 63
+            && label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+            && !label.starts_with('-') && !label.ends_with('-')
+    })
+}
+
+fn validate(cluster: &Cluster) -> Result<(), Box<dyn Error>> {
+    let dns = cluster.dns.clone().unwrap_or_default();
+    let mut errors = vec!();
+    for upstream in dns.upstreams.iter().filter(|u| !valid_upstream(u)) {
+        errors.push(format!("invalid upstream {}", upstream));
+    }
+    for zone in &dns.forward_zones {
+        let name = zone.zone.trim_end_matches('.');
+        if name.is_empty() {
+            errors.push("forward zone with no zone".to_string());
+        } else if !valid_zone(name) {
+            errors.push(format!("forward zone {} is not a valid dns name", zone.zone));
+        }
+        if name == CLUSTER_ZONE || name.ends_with(&format!(".{}", CLUSTER_ZONE)) {
+            errors.push(format!("forward zone {} is within the cluster's own zone", zone.zone));
+        }
+        if zone.upstreams.len() == 0 {
+            errors.push(format!("forward zone {} has no upstreams", zone.zone));
+        }
+        for upstream in zone.upstreams.iter().filter(|u| !valid_upstream(u)) {
+            errors.push(format!("forward zone {}: invalid upstream {}", zone.zone, upstream));
+        }
+    }
+    match errors.len() {
+        0 => Ok(()),
+        _ => Err(anyhow!("invalid dns config for cluster {}: {}", cluster.name, errors.join(", ")).into())
+    }
+}
+
+// the manifest's Corefile only has the cluster's own zone, which stays as it is. the forwarding of everything else
+// comes from the cluster's dns config
+pub fn corefile(cluster_zone: &str, cluster: &Cluster) -> String {
+    let dns = cluster.dns.clone().unwrap_or_default();
+    let mut corefile = format!("{}\n", cluster_zone.trim_end());
+    for zone in &dns.forward_zones {
+        corefile += &format!("{}:53 {{\n    forward . {}\n    errors\n    cache\n}}\n", zone.zone, zone.upstreams.join(" "));
+    }
+    let upstreams = match dns.upstreams.len() {
+        0 => DEFAULT_UPSTREAMS.iter().map(|u| u.to_string()).collect(),
+        _ => dns.upstreams.clone()
+    };
+    corefile += &format!(".:53 {{\n    forward . {}\n    log\n    errors\n    cache\n}}\n", upstreams.join(" "));
+    corefile
+}
+
+pub fn manifest(cluster: &Cluster) -> Result<String, Box<dyn Error>> {
+    validate(cluster)?;
+    let mut daemonset: DaemonSet = serde_yaml::from_str(COREDNS_MANIFEST)?;
+    let env = daemonset.spec.as_mut().and_then(|s| s.template.spec.as_mut())
+        .and_then(|s| s.containers.first_mut())
+        .and_then(|c| c.env.as_mut())
+        .and_then(|e| e.iter_mut().find(|e| e.name == COREFILE_ENV))
+        .ok_or(anyhow!("no {} in the coredns manifest", COREFILE_ENV))?;
+    env.value = Some(corefile(env.value.as_deref().unwrap_or_default(), cluster));
+    Ok(serde_yaml::to_string(&daemonset)?)
+}
+
+// a changed Corefile changes the daemonset's template, so each node's coredns is replaced with one that has it
+pub async fn apply_coredns(config: &ConfigFileArgs, cluster: &Cluster) -> Result<(), Box<dyn Error>> {
+    let coredns_yaml_path = "/tmp/skate-coredns.yaml";
+    let mut file = File::create(coredns_yaml_path)?;
+    file.write_all(manifest(cluster)?.as_bytes())?;
+
+    apply(ApplyArgs {
+        filename: vec![coredns_yaml_path.to_string()],
+        grace_period: 0,
+        max_concurrency: DEFAULT_MAX_CONCURRENCY,
+        dry_run: None,
+        atomic: false,
+        validate: true,
+        render: RenderArgs::default(),
+        config: config.clone(),
+    }).await
+}
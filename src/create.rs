@@ -1,6 +1,4 @@
 use std::error::Error;
-use std::fs::File;
-use std::io::Write;
 use std::net::ToSocketAddrs;
 use anyhow::anyhow;
 use base64::Engine;
@@ -8,16 +6,14 @@ use base64::engine::general_purpose;
 use clap::{Args, Subcommand};
 use itertools::Itertools;
 use semver::{Version, VersionReq};
-use crate::apply::{apply, ApplyArgs};
 use crate::config::{Cluster, Config, Node};
+use crate::coredns::apply_coredns;
 use crate::skate::{ConfigFileArgs, Distribution, Os};
 use crate::ssh;
 use crate::ssh::{cluster_connections, node_connection, NodeSystemInfo, SshClient};
 use crate::state::state::ClusterState;
 use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI};
 
-const coredns_manifest_bytes: &[u8] = include_bytes!("../manifests/coredns.yaml");
-
 #[derive(Debug, Args)]
 pub struct CreateArgs {
     #[command(flatten)]
@@ -29,6 +25,8 @@ pub struct CreateArgs {
 #[derive(Debug, Subcommand)]
 pub enum CreateCommands {
     Node(CreateNodeArgs),
+    #[command(about = "regenerate coredns's config from the cluster's dns settings and roll it out to every node")]
+    Coredns(CreateCorednsArgs),
 }
 
 #[derive(Debug, Args)]
@@ -50,15 +48,30 @@ pub struct CreateNodeArgs {
     config: ConfigFileArgs,
 }
 
+#[derive(Debug, Args)]
+pub struct CreateCorednsArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+}
+
 pub async fn create(args: CreateArgs) -> Result<(), Box<dyn Error>> {
     match args.command {
-        CreateCommands::Node(args) => create_node(args).await?
+        CreateCommands::Node(args) => create_node(args).await?,
+        CreateCommands::Coredns(args) => create_coredns(args).await?
     }
     Ok(())
 }
 
+async fn create_coredns(args: CreateCorednsArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    apply_coredns(&args.config, cluster).await?;
+    println!("{} coredns config rolled out to cluster {}", CHECKBOX_EMOJI, cluster.name);
+    Ok(())
+}
+
 async fn create_node(args: CreateNodeArgs) -> Result<(), Box<dyn Error>> {
-    let mut config = Config::load(Some(args.config.skateconfig.clone()))?;
+    let mut config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
 
 
     let context = match args.config.context {
@@ -173,6 +186,8 @@ async fn create_node(args: CreateNodeArgs) -> Result<(), Box<dyn Error>> {
 
     setup_networking(&conn, &cluster, &node, &info, &args).await?;
 
+    setup_probes(&conn).await?;
+
 
     config.persist(Some(args.config.skateconfig))?;
 
@@ -181,6 +196,29 @@ async fn create_node(args: CreateNodeArgs) -> Result<(), Box<dyn Error>> {
     Ok(())
 }
 
+// readiness and liveness probes run on the node on their own schedule, whether or not skate is looking
+async fn setup_probes(conn: &SshClient) -> Result<(), Box<dyn Error>> {
+    let unit = general_purpose::STANDARD.encode("[Unit]
+Description=skatelet probes
+After=network-online.target
+
+[Service]
+ExecStart=/usr/local/bin/skatelet system probe
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+");
+
+    let cmd = format!("sudo bash -c 'echo {} | base64 --decode > /etc/systemd/system/skatelet-probes.service'", unit);
+    conn.execute(&cmd).await?;
+
+    let cmd = "sudo bash -c 'systemctl daemon-reload && systemctl enable skatelet-probes && systemctl restart skatelet-probes'";
+    conn.execute(cmd).await?;
+    Ok(())
+}
+
 async fn setup_networking(conn: &SshClient, cluster_conf: &Cluster, node: &Node, info: &NodeSystemInfo, args: &CreateNodeArgs) -> Result<(), Box<dyn Error>> {
     let cmd = "sudo cp /usr/share/containers/containers.conf /etc/containers/containers.conf";
     conn.execute(cmd).await?;
@@ -240,16 +278,7 @@ async fn setup_networking(conn: &SshClient, cluster_conf: &Cluster, node: &Node,
     conn.execute(cmd).await?;
 
 
-    let coredns_yaml_path = "/tmp/skate-coredns.yaml";
-    let mut file = File::create(coredns_yaml_path)?;
-    file.write_all(coredns_manifest_bytes)?;
-
-
-    apply(ApplyArgs {
-        filename: vec![coredns_yaml_path.to_string()],
-        grace_period: 0,
-        config: args.config.clone(),
-    }).await?;
+    apply_coredns(&args.config, cluster_conf).await?;
 
 
     // // install dnsmasq
@@ -1,21 +1,50 @@
 use std::error::Error;
+use std::time::{Duration, Instant};
 use anyhow::anyhow;
 use clap::{Args, Subcommand};
 use itertools::Itertools;
-use crate::config::Config;
-use crate::skate::ConfigFileArgs;
+use k8s_openapi::api::apps::v1::StatefulSet;
+use k8s_openapi::api::core::v1::PodSpec;
+use crate::config::{Cluster, Config};
+use crate::configmap;
+use crate::kustomize::{manifest_sources, RenderArgs};
+use crate::logging::Entry;
+use crate::reconcile::owns;
+use crate::refresh::refreshed_state;
+use crate::scheduler::{DEFAULT_MAX_CONCURRENCY, DefaultScheduler, OpType, ScheduledOperation};
+use crate::skate::{ConfigFileArgs, read_manifests, SupportedResources};
+use crate::ssh;
+use crate::ssh::SshClients;
+use crate::skatelet::PodmanPodInfo;
+use crate::state::state::{ClusterState, NodeState, NodeStatus};
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, INFO_EMOJI, parse_duration};
 
 #[derive(Debug, Args)]
+#[command(args_conflicts_with_subcommands = true)]
 pub struct DeleteArgs {
     #[command(flatten)]
     config: ConfigFileArgs,
+    #[arg(short, long, long_help = "The files that contain the resources to delete.")]
+    filename: Vec<String>,
+    #[command(flatten)]
+    render: RenderArgs,
+    #[arg(long, long_help = "Wait until the pods are gone from every node, containers and all. Pods that failed to be \
+removed are tried again and unreachable nodes are waited for.")]
+    wait: bool,
+    #[arg(long, default_value = "5m", value_parser = parse_duration, long_help = "How long to wait with --wait, eg 30s, 5m, 1h.")]
+    timeout: Duration,
+    #[arg(long, default_value_t = DEFAULT_MAX_CONCURRENCY, long_help = "How many nodes to work on at the same time.")]
+    max_concurrency: usize,
     #[command(subcommand)]
-    command: DeleteCommands,
+    command: Option<DeleteCommands>,
 }
 
 #[derive(Debug, Subcommand)]
 pub enum DeleteCommands {
     Node(DeleteNodeArgs),
+    #[command(about = "delete a namespace and everything in it", long_about = "Delete every resource applied to the namespace and \
+remove their pods from the nodes. StatefulSet volumes are left on the nodes.")]
+    Namespace(DeleteNamespaceArgs),
 }
 
 #[derive(Debug, Args)]
@@ -26,15 +55,299 @@ pub struct DeleteNodeArgs {
     config: ConfigFileArgs,
 }
 
+#[derive(Debug, Args)]
+pub struct DeleteNamespaceArgs {
+    #[arg(long, long_help = "Name of the namespace.")]
+    name: String,
+    #[arg(long, default_value_t = DEFAULT_MAX_CONCURRENCY, long_help = "How many nodes to work on at the same time.")]
+    max_concurrency: usize,
+    #[command(flatten)]
+    config: ConfigFileArgs,
+}
+
 pub async fn delete(args: DeleteArgs) -> Result<(), Box<dyn Error>> {
     match args.command {
-        DeleteCommands::Node(args) => delete_node(args).await.expect("failed to delete node")
+        Some(DeleteCommands::Node(args)) => delete_node(args).await.expect("failed to delete node"),
+        Some(DeleteCommands::Namespace(args)) => delete_namespace(args).await?,
+        None => delete_manifests(args).await?
     }
     Ok(())
 }
 
+// dependents go before what they depend on: autoscalers before what they scale, pods and their owners before the
+// configmaps and secrets they use
+fn deletion_order(resource: &SupportedResources) -> u8 {
+    match resource {
+        SupportedResources::HorizontalPodAutoscaler(_) => 0,
+        SupportedResources::ConfigMap(_) | SupportedResources::Secret(_) => 2,
+        _ => 1
+    }
+}
+
+fn pod_spec(resource: &SupportedResources) -> Option<&PodSpec> {
+    match resource {
+        SupportedResources::Pod(p) => p.spec.as_ref(),
+        SupportedResources::Deployment(d) => d.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        SupportedResources::DaemonSet(ds) => ds.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        SupportedResources::StatefulSet(sts) => sts.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        SupportedResources::Job(j) => j.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        _ => None
+    }
+}
+
+// whether `user` needs `resource` around: an autoscaler its target, pods their configmaps and pull secrets
+fn depends_on(user: &SupportedResources, resource: &SupportedResources) -> bool {
+    let name = resource.name();
+    if user.name().namespace != name.namespace {
+        return false;
+    }
+    match (user, resource) {
+        (SupportedResources::HorizontalPodAutoscaler(h), _) => h.spec.as_ref().map(|s| {
+            s.scale_target_ref.kind == resource.to_string() && s.scale_target_ref.name == name.name
+        }).unwrap_or(false),
+        (_, SupportedResources::ConfigMap(_)) => pod_spec(user).map(|s| configmap::referenced(s).contains(&name.name)).unwrap_or(false),
+        (_, SupportedResources::Secret(_)) => pod_spec(user).and_then(|s| s.image_pull_secrets.as_ref())
+            .map(|refs| refs.iter().any(|r| r.name.as_deref() == Some(name.name.as_str()))).unwrap_or(false),
+        _ => false
+    }
+}
+
+fn same_resource(a: &SupportedResources, b: &SupportedResources) -> bool {
+    a.to_string() == b.to_string() && a.name().to_string() == b.name().to_string()
+}
+
+fn removal(pod_info: PodmanPodInfo, node: &NodeState) -> ScheduledOperation<SupportedResources> {
+    ScheduledOperation {
+        node: Some(node.clone()),
+        resource: SupportedResources::Pod(pod_info.into()),
+        error: None,
+        operation: OpType::Delete,
+    }
+}
+
+async fn delete_manifests(args: DeleteArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let namespace = cluster.namespace(None);
+    // what was applied is deleted even if it wouldn't pass validation today
+    let objects: Vec<_> = read_manifests(manifest_sources(&args.filename, &args.render)?, false)?.into_iter()
+        .map(|o| o.with_default_namespace(&namespace))
+        .collect();
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    let mut resources: Vec<SupportedResources> = vec!();
+    for object in &objects {
+        match state.locate_stored_resource(object) {
+            Some(stored) => resources.push(stored),
+            // pods can outlive what they were applied from, eg after a failed delete
+            None if state.filter_pods(&|p| owns(object, p)).len() > 0 => resources.push(object.clone()),
+            None => Entry::info(format!("{} {} {} not found", INFO_EMOJI, object, object.name())).object(object).operation("delete").print()
+        }
+    }
+
+    // an autoscaler without its target has nothing left to scale
+    let orphaned: Vec<_> = state.resources.iter()
+        .filter(|r| !resources.iter().any(|d| same_resource(r, d)) && resources.iter().any(|d| matches_autoscaler(r, d)))
+        .cloned().collect();
+    for autoscaler in orphaned {
+        Entry::info(format!("{} also deleting {} {}, its target is being deleted", INFO_EMOJI, autoscaler, autoscaler.name())).object(&autoscaler).operation("delete").print();
+        resources.push(autoscaler);
+    }
+
+    // running pods keep what they started with, but can't be recreated without it
+    for resource in &resources {
+        let users: Vec<_> = state.resources.iter()
+            .filter(|r| !resources.iter().any(|d| same_resource(r, d)) && depends_on(r, resource))
+            .map(|r| format!("{} {}", r.to_string().to_lowercase(), r.name()))
+            .collect();
+        if users.len() > 0 {
+            Entry::warn(format!("{} {} {} is still used by {}, their pods won't start again without it", CROSS_EMOJI, resource, resource.name(), users.join(", ")))
+                .object(resource).operation("delete").print();
+        }
+    }
+
+    resources.sort_by_key(deletion_order);
+
+    let mut failed = 0;
+    for resource in &resources {
+        // the spec goes first so nothing brings the pods back
+        state.remove_stored_resource(resource);
+        let pods: Vec<_> = state.filter_pods(&|p| owns(resource, p)).into_iter().map(|(pod_info, node)| removal(pod_info, node)).collect();
+        let result = DefaultScheduler::execute(&conns, &mut state, pods, args.max_concurrency).await?;
+        failed += result.iter().filter(|a| a.error.is_some()).count();
+        match resource {
+            SupportedResources::StatefulSet(sts) => remove_statefulset_volumes(&conns, &mut state, sts).await,
+            _ => {}
+        }
+        state.persist()?;
+        Entry::info(format!("{} deleted {} {} ({} pods)", CHECKBOX_EMOJI, resource, resource.name(), result.len())).object(resource).operation("delete").print();
+    }
+
+    match (args.wait, failed) {
+        (true, _) => wait_for_removal(cluster, &config, conns, &resources, args.timeout, args.max_concurrency).await,
+        (false, 0) => Ok(()),
+        (false, _) => Err(anyhow!("failed to remove {} pods, they're removed once reconciled or with delete --wait", failed).into())
+    }
+}
+
+fn matches_autoscaler(autoscaler: &SupportedResources, target: &SupportedResources) -> bool {
+    match autoscaler {
+        SupportedResources::HorizontalPodAutoscaler(_) => depends_on(autoscaler, target),
+        _ => false
+    }
+}
+
+// statefulset volumes are kept, for the next statefulset of the same name, unless
+// persistentVolumeClaimRetentionPolicy.whenDeleted is Delete
+async fn remove_statefulset_volumes(conns: &SshClients, state: &mut ClusterState, sts: &StatefulSet) {
+    let ns = sts.metadata.namespace.clone().unwrap_or_default();
+    let name = sts.metadata.name.clone().unwrap_or_default();
+    let templates: Vec<String> = sts.spec.as_ref().and_then(|s| s.volume_claim_templates.clone()).unwrap_or_default()
+        .into_iter().filter_map(|t| t.metadata.name).collect();
+
+    // claims are named <template>-<statefulset>-<ordinal>.<namespace>
+    let claims: Vec<(String, String, String)> = state.volume_nodes.iter().filter_map(|(key, node_name)| {
+        let claim = key.strip_prefix(&format!("{}/", ns))?;
+        let ordinal = claim.strip_suffix(&format!(".{}", ns))
+            .and_then(|c| templates.iter().find_map(|t| c.strip_prefix(&format!("{}-{}-", t, name))))?;
+        match ordinal.len() > 0 && ordinal.chars().all(|c| c.is_ascii_digit()) {
+            true => Some((key.clone(), claim.to_string(), node_name.clone())),
+            false => None
+        }
+    }).collect();
+    if claims.len() == 0 {
+        return;
+    }
+
+    let policy = sts.spec.as_ref().and_then(|s| s.persistent_volume_claim_retention_policy.as_ref()).and_then(|p| p.when_deleted.clone());
+    if policy.as_deref() != Some("Delete") {
+        Entry::info(format!("{} kept {} volumes of statefulset {}, set persistentVolumeClaimRetentionPolicy.whenDeleted to Delete to have them removed", INFO_EMOJI, claims.len(), name))
+            .resource(&format!("statefulset/{}.{}", name, ns)).operation("delete").print();
+        return;
+    }
+
+    for (key, claim, node_name) in claims {
+        let conn = match conns.find(&node_name) {
+            Some(conn) => conn,
+            None => {
+                Entry::error(format!("{} can't delete volume {}, node {} is unreachable", CROSS_EMOJI, claim, node_name))
+                    .node(&node_name).resource(&format!("volume/{}", claim)).operation("delete").print();
+                continue;
+            }
+        };
+        match conn.remove_volume(&claim).await {
+            Ok(_) => {
+                state.volume_nodes.remove(&key);
+                Entry::info(format!("{} deleted volume {} on node {}", CHECKBOX_EMOJI, claim, node_name))
+                    .node(&node_name).resource(&format!("volume/{}", claim)).operation("delete").print()
+            }
+            Err(e) => Entry::error(format!("{} failed to delete volume {} on node {}: {}", CROSS_EMOJI, claim, node_name, e))
+                .node(&node_name).resource(&format!("volume/{}", claim)).operation("delete").print()
+        }
+    }
+}
+
+// done once no node reports any of the resources' pods, which the nodes only stop doing once the pod and its
+// containers are removed. leftovers on reachable nodes get removed again, unreachable nodes are waited for
+async fn wait_for_removal(cluster: &Cluster, config: &Config, conns: SshClients, resources: &Vec<SupportedResources>, timeout: Duration, max_concurrency: usize) -> Result<(), Box<dyn Error>> {
+    let deadline = Instant::now() + timeout;
+    let mut conns = Some(conns);
+
+    loop {
+        let (connected, _) = ssh::reconnect(cluster, conns.take()).await;
+        conns = connected;
+        let current = conns.as_ref().ok_or(anyhow!("failed to connect to any hosts"))?;
+        let mut state = refreshed_state(&cluster.name, current, config).await?;
+
+        let remaining: Vec<_> = state.filter_pods(&|p| resources.iter().any(|r| owns(r, p))).into_iter()
+            .map(|(pod_info, node)| (pod_info, node.clone()))
+            .collect();
+        if remaining.len() == 0 {
+            Entry::info(format!("{} all pods removed", CHECKBOX_EMOJI)).operation("delete").print();
+            return Ok(());
+        }
+
+        if Instant::now() >= deadline {
+            let names: Vec<_> = remaining.iter().map(|(p, n)| format!("{} on node {}", p.name, n.node_name)).collect();
+            return Err(anyhow!("timed out waiting for {} to be removed", names.join(", ")).into());
+        }
+
+        let (retries, waiting): (Vec<_>, Vec<_>) = remaining.into_iter()
+            .partition(|(_, n)| n.status == NodeStatus::Healthy && current.find(&n.node_name).is_some());
+        for (pod, node) in &waiting {
+            Entry::info(format!("{} waiting for node {} to remove {}", INFO_EMOJI, node.node_name, pod.name))
+                .node(&node.node_name).resource(&format!("pod/{}.{}", pod.name, pod.namespace())).operation("delete").print();
+        }
+        let retries: Vec<_> = retries.into_iter().map(|(pod_info, node)| removal(pod_info, &node)).collect();
+        if retries.len() > 0 {
+            DefaultScheduler::execute(current, &mut state, retries, max_concurrency).await?;
+            state.persist()?;
+        }
+
+        tokio::time::sleep(Duration::from_secs(2)).await;
+    }
+}
+
+async fn delete_namespace(args: DeleteNamespaceArgs) -> Result<(), Box<dyn Error>> {
+    if args.name == "skate" {
+        return Err(anyhow!("the skate namespace holds skate's own pods, eg coredns, and can't be deleted").into());
+    }
+
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    // the specs go first so nothing brings the pods back
+    let resources: Vec<_> = state.resources.iter().filter(|r| r.name().namespace == args.name).cloned().collect();
+    for resource in &resources {
+        state.remove_stored_resource(resource);
+        Entry::info(format!("{} deleted {} {}", CHECKBOX_EMOJI, resource, resource.name())).object(resource).operation("delete").print();
+    }
+
+    // pods on nodes that couldn't be reached are left to be cleaned up once they're back
+    let pods: Vec<_> = state.filter_pods(&|p| p.namespace() == args.name).into_iter().map(|(pod_info, node)| removal(pod_info, node)).collect();
+    let result = DefaultScheduler::execute(&conns, &mut state, pods, args.max_concurrency).await?;
+    state.persist()?;
+
+    let volumes = state.volume_nodes.keys().filter(|k| k.starts_with(&format!("{}/", args.name))).count();
+    if volumes > 0 {
+        Entry::info(format!("{} kept {} statefulset volumes, remove them with podman volume rm on the nodes if they're no longer needed", INFO_EMOJI, volumes))
+            .resource(&format!("namespace/{}", args.name)).operation("delete").print();
+    }
+
+    let failed = result.iter().filter(|a| a.error.is_some()).count();
+    match failed {
+        0 => {
+            Entry::info(format!("{} deleted namespace {}: {} resources, {} pods", CHECKBOX_EMOJI, args.name, resources.len(), result.len()))
+                .resource(&format!("namespace/{}", args.name)).operation("delete").print();
+            Ok(())
+        }
+        _ => Err(anyhow!("failed to delete {} of the {} pods in namespace {}", failed, result.len(), args.name).into())
+    }
+}
+
 async fn delete_node(args: DeleteNodeArgs) -> Result<(), Box<dyn Error>> {
-    let mut config = Config::load(Some(args.config.skateconfig.clone()))?;
+    let mut config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
 
     let context = match args.config.context {
         None => match config.current_context {
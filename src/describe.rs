@@ -1,11 +1,23 @@
 use std::error::Error;
-use clap::{Args, Subcommand};
-use k8s_openapi::api::core::v1::Node as K8sNode;
+use anyhow::anyhow;
+use chrono::{Local, SecondsFormat};
+use clap::{Args, Command, FromArgMatches, Subcommand};
+use itertools::Itertools;
+use k8s_openapi::api::core::v1::{Node as K8sNode, Pod, PodSpec};
+use serde_json::Value;
 use crate::config::Config;
+use crate::configmap;
 use crate::refresh::refreshed_state;
-use crate::skate::ConfigFileArgs;
+use crate::restart;
+use crate::scheduler::claim_volumes;
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::skatelet::PodmanPodInfo;
 use crate::ssh;
+use crate::ssh::SshClients;
 use crate::state::state::{ClusterState, NodeState};
+use crate::util::shell_quote;
+
+const MAX_EVENTS: usize = 10;
 
 #[derive(Debug, Clone, Args)]
 pub struct DescribeArgs {
@@ -23,7 +35,7 @@ pub enum IdCommand {
 pub struct DescribeObjectArgs {
     #[command(flatten)]
     config: ConfigFileArgs,
-    #[arg(long, short, long_help = "Filter by resource namespace")]
+    #[arg(long, short, long_help = "Namespace of the resource, defaults to the context's default_namespace or default.")]
     namespace: Option<String>,
     #[command(subcommand)]
     id: Option<IdCommand>,
@@ -37,15 +49,68 @@ pub enum DescribeCommands {
     Deployment(DescribeObjectArgs),
     #[command(alias("nodes"))]
     Node(DescribeObjectArgs),
+    // kind/name, the way kubectl takes it
+    #[command(external_subcommand)]
+    Resource(Vec<String>),
 }
 
 pub async fn describe(args: DescribeArgs) -> Result<(), Box<dyn Error>> {
     let global_args = args.clone();
-    match args.commands {
-        DescribeCommands::Pod(p_args) => Ok(()),
-        DescribeCommands::Deployment(d_args) => Ok(()),
-        DescribeCommands::Node(n_args) => describe_node(global_args, n_args).await
+    match expand(args.commands)? {
+        DescribeCommands::Pod(p_args) => describe_pod(p_args).await,
+        DescribeCommands::Deployment(d_args) => describe_deployment(d_args).await,
+        DescribeCommands::Node(n_args) => describe_node(global_args, n_args).await,
+        DescribeCommands::Resource(_) => Err(anyhow!("expected a resource kind").into())
+    }
+}
+
+// turns `deployment/foo -n bar` into `deployment -n bar foo`, anything after the name would be taken as the id
+fn expand(commands: DescribeCommands) -> Result<DescribeCommands, Box<dyn Error>> {
+    let argv = match commands {
+        DescribeCommands::Resource(argv) => argv,
+        commands => return Ok(commands)
+    };
+    let (kind, name) = argv.first().and_then(|r| r.split_once('/'))
+        .ok_or(anyhow!("unrecognized subcommand {}, expected pod, deployment, node or <kind>/<name>", argv.first().cloned().unwrap_or_default()))?;
+
+    let expanded = [vec!["describe".to_string(), kind.to_string()], argv[1..].to_vec(), vec![name.to_string()]].concat();
+    let matches = DescribeArgs::augment_args(Command::new("describe")).try_get_matches_from(expanded)?;
+    match DescribeArgs::from_arg_matches(&matches)?.commands {
+        DescribeCommands::Resource(_) => Err(anyhow!("unsupported resource kind {}", kind).into()),
+        commands => Ok(commands)
+    }
+}
+
+fn object_id(args: &DescribeObjectArgs) -> Result<String, Box<dyn Error>> {
+    let id = args.id.as_ref().and_then(|cmd| match cmd {
+        IdCommand::Id(ids) => ids.first().cloned()
+    });
+    id.ok_or(anyhow!("name is required").into())
+}
+
+// connections are kept so the nodes can be asked for what only they know
+async fn load_state(args: &DescribeObjectArgs) -> Result<(Option<SshClients>, ClusterState), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let (conns, errors) = ssh::cluster_connections(&cluster).await;
+    if errors.is_some() {
+        errors.unwrap().log();
+        eprintln!("using last known cluster state");
     }
+
+    let state = match &conns {
+        Some(clients) => refreshed_state(&cluster.name, clients, &config).await,
+        None => {
+            ClusterState::load(&cluster.name)
+        }
+    }?;
+    Ok((conns, state))
+}
+
+// --namespace, or the context's default
+fn namespace(args: &DescribeObjectArgs) -> Result<String, Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    Ok(config.current_cluster()?.namespace(args.namespace.clone()))
 }
 
 pub trait Describer<T> {
@@ -57,13 +122,9 @@ struct NodeDescriber {}
 
 impl Describer<NodeState> for NodeDescriber {
     fn find(&self, filters: &DescribeObjectArgs, state: &ClusterState) -> Option<NodeState> {
-        let id = filters.id.as_ref().and_then(|cmd| match cmd {
-            IdCommand::Id(ids) => ids.first().and_then(|id| Some((*id).clone())),
-            _ => None
-        });
-        let id = match id {
-            Some(id) => id,
-            None => {
+        let id = match object_id(filters) {
+            Ok(id) => id,
+            Err(_) => {
                 return None;
             }
         };
@@ -82,21 +143,8 @@ async fn describe_node(global_args: DescribeArgs, args: DescribeObjectArgs) -> R
     describe_object(global_args, args, &inspector).await
 }
 
-async fn describe_object<T>(global_args: DescribeArgs, args: DescribeObjectArgs, inspector: &dyn Describer<T>) -> Result<(), Box<dyn Error>> {
-    let config = Config::load(Some(args.config.skateconfig.clone()))?;
-    let cluster = config.current_cluster()?;
-    let conns = ssh::cluster_connections(&cluster).await;
-    if conns.1.is_some() {
-        eprintln!("{}", conns.1.unwrap());
-        eprintln!("using last known cluster state");
-    }
-
-    let state = match conns.0 {
-        Some(clients) => refreshed_state(&cluster.name, &clients, &config).await,
-        None => {
-            ClusterState::load(&cluster.name)
-        }
-    }?;
+async fn describe_object<T>(_global_args: DescribeArgs, args: DescribeObjectArgs, inspector: &dyn Describer<T>) -> Result<(), Box<dyn Error>> {
+    let (_, state) = load_state(&args).await?;
 
     let node = inspector.find(&args, &state);
 
@@ -106,4 +154,381 @@ async fn describe_object<T>(global_args: DescribeArgs, args: DescribeObjectArgs,
     };
 
     state.persist()
-}
\ No newline at end of file
+}
+
+async fn describe_deployment(args: DescribeObjectArgs) -> Result<(), Box<dyn Error>> {
+    let name = object_id(&args)?;
+    let ns = namespace(&args)?;
+    let (conns, state) = load_state(&args).await?;
+
+    let deployment = state.locate_stored_deployment(&name, &ns)
+        .ok_or(anyhow!("deployment {} not found in namespace {}", name, ns))?;
+    let spec = deployment.spec.clone().unwrap_or_default();
+    let pods = state.locate_deployment(&name, &ns);
+    let desired = state.desired_replicas(&name, &ns).or(spec.replicas).unwrap_or(0);
+    let ready = pods.iter().filter(|(p, _)| p.is_ready()).count();
+
+    print_field("Name", &name);
+    print_field("Namespace", &ns);
+    print_field("Replicas", &format!("{} desired | {} current | {} ready", desired, pods.len(), ready));
+    print_field("Strategy", &spec.strategy.as_ref().and_then(|s| s.type_.clone()).unwrap_or(match spec.strategy.as_ref().and_then(|s| s.rolling_update.as_ref()) {
+        Some(_) => "RollingUpdate".to_string(),
+        None => "Recreate".to_string()
+    }));
+
+    // the template as the pods get it, with config maps filled in
+    let mut template = Pod {
+        metadata: spec.template.metadata.clone().unwrap_or_default(),
+        spec: spec.template.spec.clone(),
+        status: None,
+    };
+    template.metadata.name = Some(name.clone());
+    template.metadata.namespace = Some(ns.clone());
+    print_resolved(&state, template);
+
+    println!("\nPods:");
+    if pods.len() == 0 {
+        println!("  <none>");
+    }
+    for (pod, node) in &pods {
+        print_pod(conns.as_ref(), &state, pod, &node.node_name, false).await;
+    }
+
+    println!("\nSpec:");
+    println!("{}", indent(&serde_yaml::to_string(&deployment)?, 2));
+
+    print_events(&state, &ns, &format!("deployment/{}", name));
+
+    state.persist()
+}
+
+async fn describe_pod(args: DescribeObjectArgs) -> Result<(), Box<dyn Error>> {
+    let name = object_id(&args)?;
+    let ns = namespace(&args)?;
+    let (conns, state) = load_state(&args).await?;
+
+    let pods = state.locate_pods(&name, &ns);
+    let applied = applied_pod(&state, &name, &ns, pods.first().map(|(p, _)| p));
+    if pods.len() == 0 && applied.is_none() {
+        return Err(anyhow!("pod {} not found in namespace {}", name, ns).into());
+    }
+
+    print_field("Name", &name);
+    print_field("Namespace", &ns);
+    let owner = pods.first().and_then(|(p, _)| {
+        ["deployment", "daemonset", "statefulset", "job"].iter().find_map(|kind| {
+            p.labels.get(&format!("skate.io/{}", kind)).map(|o| format!("{}/{}", kind, o))
+        })
+    });
+    print_field("Controlled By", &owner.unwrap_or("-".to_string()));
+
+    match applied.clone() {
+        Some(pod) => print_resolved(&state, pod),
+        None => {}
+    }
+
+    println!("\nPods:");
+    if pods.len() == 0 {
+        println!("  <none>");
+    }
+    for (pod, node) in &pods {
+        print_pod(conns.as_ref(), &state, pod, &node.node_name, true).await;
+    }
+
+    match applied {
+        Some(pod) => {
+            println!("\nSpec:");
+            println!("{}", indent(&serde_yaml::to_string(&pod)?, 2));
+        }
+        None => {}
+    }
+
+    print_events(&state, &ns, &format!("pod/{}", name));
+
+    state.persist()
+}
+
+// the pod as applied, or as its deployment, daemonset or statefulset would create it
+pub(crate) fn applied_pod(state: &ClusterState, name: &str, ns: &str, info: Option<&PodmanPodInfo>) -> Option<Pod> {
+    let owner = info.and_then(|i| {
+        i.labels.get("skate.io/deployment").map(|d| ("Deployment", d.clone()))
+            .or(i.labels.get("skate.io/daemonset").map(|d| ("DaemonSet", d.clone())))
+            .or(i.labels.get("skate.io/statefulset").map(|d| ("StatefulSet", d.clone())))
+    });
+    let template = state.resources.iter().find_map(|r| {
+        let r_name = r.name();
+        if r_name.namespace != ns {
+            return None;
+        }
+        match (r, &owner) {
+            (SupportedResources::Pod(p), None) if r_name.name == name => Some(p.clone()),
+            (SupportedResources::Deployment(d), Some(("Deployment", owner))) if r_name.name == *owner => {
+                let template = d.spec.clone()?.template;
+                Some(Pod { metadata: template.metadata.unwrap_or_default(), spec: template.spec, status: None })
+            }
+            (SupportedResources::DaemonSet(ds), Some(("DaemonSet", owner))) if r_name.name == *owner => {
+                let template = ds.spec.clone()?.template;
+                Some(Pod { metadata: template.metadata.unwrap_or_default(), spec: template.spec, status: None })
+            }
+            (SupportedResources::StatefulSet(sts), Some(("StatefulSet", owner))) if r_name.name == *owner => {
+                let template = sts.spec.clone()?.template;
+                let mut spec = template.spec.unwrap_or_default();
+                let claims = claim_volumes(sts, name);
+                let mut volumes: Vec<_> = spec.volumes.unwrap_or_default().into_iter()
+                    .filter(|v| !claims.iter().any(|c| c.name == v.name)).collect();
+                volumes.extend(claims);
+                spec.volumes = Some(volumes);
+                Some(Pod { metadata: template.metadata.unwrap_or_default(), spec: Some(spec), status: None })
+            }
+            _ => None
+        }
+    });
+    template.map(|mut pod| {
+        pod.metadata.name = Some(name.to_string());
+        pod.metadata.namespace = Some(ns.to_string());
+        pod
+    })
+}
+
+fn print_field(name: &str, value: &str) {
+    println!("{0: <15}{1}", format!("{}:", name), value);
+}
+
+fn indent(text: &str, width: usize) -> String {
+    text.lines().map(|l| format!("{}{}", " ".repeat(width), l)).join("\n")
+}
+
+fn print_resolved(state: &ClusterState, mut pod: Pod) {
+    match configmap::project(state, &mut pod) {
+        Ok(_) => {}
+        Err(e) => {
+            println!("\nEnvironment:\n  <failed to resolve: {}>", e);
+            return;
+        }
+    }
+    let spec = pod.spec.unwrap_or_default();
+    print_environment(&spec);
+    print_volumes(&spec);
+}
+
+fn print_environment(spec: &PodSpec) {
+    println!("\nEnvironment:");
+    for container in spec.init_containers.iter().flatten().chain(spec.containers.iter()) {
+        println!("  {}:", container.name);
+        let env = container.env.clone().unwrap_or_default();
+        if env.len() == 0 && container.env_from.is_none() {
+            println!("    <none>");
+        }
+        for var in env {
+            let value = match (var.value, var.value_from) {
+                (Some(value), _) => value,
+                (None, Some(from)) => match (from.secret_key_ref, from.field_ref, from.resource_field_ref) {
+                    (Some(s), _, _) => format!("<secret {} key {}>", s.name.unwrap_or_default(), s.key),
+                    (_, Some(f), _) => format!("<field {}>", f.field_path),
+                    (_, _, Some(r)) => format!("<resource {}>", r.resource),
+                    _ => "<unresolved>".to_string()
+                },
+                (None, None) => "".to_string()
+            };
+            println!("    {}={}", var.name, value);
+        }
+        for env_from in container.env_from.iter().flatten() {
+            match &env_from.secret_ref {
+                Some(s) => println!("    <all keys of secret {}>", s.name.clone().unwrap_or_default()),
+                None => {}
+            }
+        }
+    }
+}
+
+fn print_volumes(spec: &PodSpec) {
+    println!("\nVolumes:");
+    let volumes = spec.volumes.clone().unwrap_or_default();
+    if volumes.len() == 0 {
+        println!("  <none>");
+    }
+    for volume in volumes {
+        let source = match (&volume.host_path, &volume.persistent_volume_claim, &volume.empty_dir, &volume.secret) {
+            (Some(h), _, _, _) => format!("hostPath {} ({})", h.path, h.type_.clone().unwrap_or("-".to_string())),
+            (_, Some(c), _, _) => format!("podman volume {}", c.claim_name),
+            (_, _, Some(_), _) => "emptyDir".to_string(),
+            (_, _, _, Some(s)) => format!("secret {}", s.secret_name.clone().unwrap_or_default()),
+            _ => "-".to_string()
+        };
+        println!("  {0: <20}{1}", volume.name, source);
+
+        for container in spec.init_containers.iter().flatten().chain(spec.containers.iter()) {
+            for mount in container.volume_mounts.iter().flatten().filter(|m| m.name == volume.name) {
+                let mode = match mount.read_only {
+                    Some(true) => "ro",
+                    _ => "rw"
+                };
+                println!("    mounted at {} in {} ({})", mount.mount_path, container.name, mode);
+            }
+        }
+    }
+}
+
+// container details come from the node, and are skipped when it can't be reached
+async fn print_pod(conns: Option<&SshClients>, state: &ClusterState, pod: &PodmanPodInfo, node_name: &str, with_command: bool) {
+    println!("  {} on node {}: {} (created {})", pod.name, node_name, pod.status, pod.created.to_rfc3339_opts(SecondsFormat::Secs, true));
+
+    let containers: Vec<_> = pod.containers.clone().unwrap_or_default().into_iter().filter(|c| !c.is_infra()).collect();
+    let conn = conns.and_then(|c| c.find(node_name));
+
+    let inspected = match conn {
+        Some(conn) => match conn.inspect_containers(&containers.iter().map(|c| c.id.clone()).collect::<Vec<_>>()).await {
+            Ok(Value::Array(inspected)) => inspected,
+            Ok(_) => vec!(),
+            Err(e) => {
+                println!("    <failed to inspect containers: {}>", e);
+                vec!()
+            }
+        },
+        None => vec!()
+    };
+
+    for container in containers {
+        let inspect = inspected.iter().find(|i| i["Id"].as_str().map(|id| id.starts_with(&container.id) || container.id.starts_with(id)).unwrap_or(false));
+        let full_id = inspect.and_then(|i| i["Id"].as_str()).unwrap_or(container.id.as_str()).to_string();
+
+        match container.init {
+            true => println!("    {} (init)", container.names),
+            false => println!("    {}", container.names)
+        }
+        println!("      {0: <11}{1}", "ID:", full_id);
+        match inspect.and_then(|i| i["ImageName"].as_str().or(i["Config"]["Image"].as_str())) {
+            Some(image) => println!("      {0: <11}{1}", "Image:", image),
+            None => {}
+        }
+        let restart = state.restarts.get(&restart::key(pod, &container));
+        let status = match (container.exit_code, restart::crash_looping(pod, &container, restart)) {
+            (Some(code), true) => format!("CrashLoopBackOff (exit code {}, restarting at {})", code,
+                                          restart.and_then(|r| r.retry_at()).map(|t| t.to_rfc3339_opts(SecondsFormat::Secs, true)).unwrap_or_default()),
+            (Some(code), false) => format!("{} (exit code {})", container.status, code),
+            (None, _) => container.status.clone()
+        };
+        println!("      {0: <11}{1}", "Status:", status);
+        println!("      {0: <11}{1}", "Restarts:", container.restart_count.unwrap_or(0) + restart.map(|r| r.restarts as usize).unwrap_or(0));
+        match restart.and_then(|r| r.last_exit_code.map(|code| (code, r.reason.clone().unwrap_or_default()))) {
+            Some((code, reason)) => println!("      {0: <11}{1} (exit code {2})", "Last State:", reason, code),
+            None => {}
+        }
+        println!("      {0: <11}{1}", "Ready:", container.ready.map(|r| r.to_string()).unwrap_or("-".to_string()));
+        println!("      {0: <11}{1}", "Live:", container.live.map(|l| l.to_string()).unwrap_or("-".to_string()));
+
+        match conn {
+            Some(conn) => {
+                let unit = format!("libpod-{}.scope", full_id);
+                let state = match conn.unit_state(&unit).await {
+                    Ok(state) if !state.is_empty() => state,
+                    Ok(_) => "unknown".to_string(),
+                    Err(e) => format!("unknown ({})", e)
+                };
+                println!("      {0: <11}{1} {2}", "Unit:", unit, state);
+            }
+            None => {}
+        }
+
+        match (with_command, inspect) {
+            (true, Some(inspect)) => println!("      {0: <11}{1}", "Command:", run_command(inspect, &pod.podman_name())),
+            _ => {}
+        }
+    }
+}
+
+// the podman run equivalent of what play kube created
+fn run_command(inspect: &Value, pod_name: &str) -> String {
+    let mut args: Vec<String> = vec!["podman".to_string(), "run".to_string(), "--detach".to_string()];
+    match inspect["Name"].as_str() {
+        Some(name) => args.push(format!("--name={}", name)),
+        None => {}
+    }
+    args.push(format!("--pod={}", pod_name));
+
+    for env in inspect["Config"]["Env"].as_array().into_iter().flatten().filter_map(|e| e.as_str()) {
+        // set by podman itself
+        if env.starts_with("container=") || env.starts_with("HOSTNAME=") {
+            continue;
+        }
+        args.push(format!("--env={}", env));
+    }
+
+    for mount in inspect["Mounts"].as_array().into_iter().flatten() {
+        let source = match mount["Type"].as_str() {
+            Some("volume") => mount["Name"].as_str(),
+            _ => mount["Source"].as_str()
+        };
+        let destination = mount["Destination"].as_str();
+        match (source, destination) {
+            (Some(source), Some(destination)) => {
+                let ro = match mount["RW"].as_bool() {
+                    Some(false) => ":ro",
+                    _ => ""
+                };
+                args.push(format!("--volume={}:{}{}", source, destination, ro));
+            }
+            _ => {}
+        }
+    }
+
+    let host_config = &inspect["HostConfig"];
+    match host_config["NanoCpus"].as_i64() {
+        Some(nano) if nano > 0 => args.push(format!("--cpus={}", nano as f64 / 1e9)),
+        _ => {}
+    }
+    match host_config["Memory"].as_i64() {
+        Some(memory) if memory > 0 => args.push(format!("--memory={}", memory)),
+        _ => {}
+    }
+    match host_config["RestartPolicy"]["Name"].as_str() {
+        Some(policy) if !policy.is_empty() && policy != "no" => args.push(format!("--restart={}", policy)),
+        _ => {}
+    }
+
+    // older podmans give the entrypoint as a string
+    let entrypoint: Vec<String> = match &inspect["Config"]["Entrypoint"] {
+        Value::String(e) => vec![e.clone()],
+        Value::Array(e) => e.iter().filter_map(|e| e.as_str().map(|s| s.to_string())).collect(),
+        _ => vec![]
+    };
+    match entrypoint.len() {
+        0 => {}
+        1 => args.push(format!("--entrypoint={}", entrypoint[0])),
+        _ => args.push(format!("--entrypoint={}", serde_json::to_string(&entrypoint).unwrap_or_default()))
+    }
+
+    match inspect["ImageName"].as_str().or(inspect["Config"]["Image"].as_str()) {
+        Some(image) => args.push(image.to_string()),
+        None => {}
+    }
+    for arg in inspect["Config"]["Cmd"].as_array().into_iter().flatten().filter_map(|a| a.as_str()) {
+        args.push(arg.to_string());
+    }
+
+    args.iter().map(|a| shell_quote(a)).join(" ")
+}
+
+fn print_events(state: &ClusterState, ns: &str, resource: &str) {
+    println!("\nEvents:");
+    let events: Vec<_> = state.events.iter().filter(|e| e.namespace == ns && e.concerns(resource))
+        .sorted_by_key(|e| e.time).rev().take(MAX_EVENTS).collect();
+    if events.len() == 0 {
+        println!("  <none>");
+        return;
+    }
+    println!(
+        "  {0: <22}  {1: <8}  {2: <20}  {3: <15}  {4}",
+        "LAST SEEN", "TYPE", "REASON", "NODE", "MESSAGE"
+    );
+    for event in events.into_iter().rev() {
+        println!(
+            "  {0: <22}  {1: <8}  {2: <20}  {3: <15}  {4}",
+            event.time.with_timezone(&Local).to_rfc3339_opts(SecondsFormat::Secs, true),
+            event.type_,
+            event.reason,
+            event.node.clone().unwrap_or("-".to_string()),
+            event.message
+        )
+    }
+}
@@ -0,0 +1,124 @@
+use std::collections::BTreeMap;
+use std::error::Error;
+use std::process;
+use anyhow::anyhow;
+use clap::Args;
+use crate::config::Config;
+use crate::refresh::refreshed_state;
+use crate::scheduler::{DefaultScheduler, OpType};
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::ssh;
+use crate::util::{hash_string, unified_diff};
+
+#[derive(Debug, Args)]
+#[command(arg_required_else_help(true))]
+pub struct DiffArgs {
+    #[arg(short, long, long_help = "The files that contain the configurations to diff.")]
+    pub filename: Vec<String>,
+    #[arg(long, default_value_t = 1, long_help = "Exit code to use when there are differences.")]
+    pub exit_code: i32,
+    #[arg(long, default_value_t = true, num_args = 0..=1, default_missing_value = "true", action = clap::ArgAction::Set, long_help = "Reject \
+fields the resource's kind doesn't have, the same as for apply.")]
+    pub validate: bool,
+    #[command(flatten)]
+    pub render: RenderArgs,
+    #[command(flatten)]
+    pub config: ConfigFileArgs,
+}
+
+// the manifest as applied, leaving out the status skate keeps for itself
+fn manifest_yaml(resource: &SupportedResources) -> Result<String, Box<dyn Error>> {
+    let yaml = match resource.clone() {
+        SupportedResources::Pod(p) => serde_yaml::to_string(&p),
+        SupportedResources::Deployment(d) => serde_yaml::to_string(&d),
+        SupportedResources::DaemonSet(ds) => serde_yaml::to_string(&ds),
+        SupportedResources::ConfigMap(cm) => serde_yaml::to_string(&cm),
+        SupportedResources::HorizontalPodAutoscaler(mut hpa) => {
+            hpa.status = None;
+            serde_yaml::to_string(&hpa)
+        }
+        SupportedResources::StatefulSet(mut sts) => {
+            sts.status = None;
+            serde_yaml::to_string(&sts)
+        }
+        SupportedResources::Job(mut job) => {
+            job.status = None;
+            serde_yaml::to_string(&job)
+        }
+        // values are hashed so changes still show without printing them
+        SupportedResources::Secret(mut secret) => {
+            let mut hashed: BTreeMap<String, String> = BTreeMap::new();
+            for (k, v) in secret.data.take().unwrap_or_default() {
+                hashed.insert(k, format!("<hash {}>", hash_string(&v.0)));
+            }
+            for (k, v) in secret.string_data.take().unwrap_or_default() {
+                hashed.insert(k, format!("<hash {}>", hash_string(v.as_bytes())));
+            }
+            secret.string_data = Some(hashed);
+            serde_yaml::to_string(&secret)
+        }
+    }?;
+    Ok(yaml)
+}
+
+pub async fn diff(args: DiffArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let objects = crate::skate::read_manifests(crate::kustomize::manifest_sources(&args.filename, &args.render)?, args.validate)?;
+    let namespace = cluster.namespace(None);
+    let objects = objects.into_iter().map(|sr| sr.with_default_namespace(&namespace).fixup()).collect::<Result<Vec<_>, _>>()?;
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    let mut lines = vec!();
+
+    for object in &objects {
+        let previous = match state.locate_stored_resource(object) {
+            Some(previous) => manifest_yaml(&previous)?,
+            None => "".to_string()
+        };
+        let diff = unified_diff(&previous, &manifest_yaml(object)?, 3);
+        if !diff.is_empty() {
+            lines.push(format!("--- {} {} (applied)", object, object.name()));
+            lines.push(format!("+++ {} {} (new)", object, object.name()));
+            lines.push(diff);
+        }
+    }
+
+    // same as apply does, but on a copy that never gets persisted
+    for object in &objects {
+        state.store_resource(object)?;
+    }
+    let actions = DefaultScheduler::dry_run(&mut state, &objects);
+
+    let placements: Vec<_> = actions.iter().filter_map(|a| {
+        let node_name = a.node.as_ref().map(|n| n.node_name.clone()).unwrap_or("-".to_string());
+        match (&a.operation, &a.error) {
+            (_, Some(err)) => Some(format!("! {} {}: {}", a.resource, a.resource.name(), err)),
+            (OpType::Create, None) => Some(format!("+ create {} {} on node {}", a.resource, a.resource.name(), node_name)),
+            (OpType::Delete, None) => Some(format!("- delete {} {} on node {}", a.resource, a.resource.name(), node_name)),
+            _ => None
+        }
+    }).collect();
+
+    if placements.len() > 0 {
+        lines.push("scheduling:".to_string());
+        lines.extend(placements);
+    }
+
+    if lines.len() == 0 {
+        return Ok(());
+    }
+
+    println!("{}", lines.join("\n"));
+    process::exit(args.exit_code);
+}
@@ -0,0 +1,93 @@
+use std::error::Error;
+use anyhow::anyhow;
+use k8s_openapi::api::core::v1::{EnvVar, Pod};
+
+// the pod's address is only known on the node, where the skatelet picks it before starting the pod. with host
+// networking it's the node's, like status.hostIP
+const POD_IP_FIELDS: [&str; 2] = ["status.podIP", "status.podIPs"];
+
+const SUPPORTED_FIELDS: [&str; 6] = ["metadata.name", "metadata.namespace", "spec.nodeName", "spec.serviceAccountName",
+    "status.hostIP", "status.hostIPs"];
+
+// metadata.labels['<key>'] and metadata.annotations['<key>'] give that one label or annotation
+fn subscript<'a>(field: &'a str, prefix: &str) -> Option<&'a str> {
+    field.strip_prefix(prefix)?.strip_prefix("['")?.strip_suffix("']")
+}
+
+pub fn is_supported(field: &str) -> bool {
+    SUPPORTED_FIELDS.contains(&field) || POD_IP_FIELDS.contains(&field)
+        || subscript(field, "metadata.labels").is_some() || subscript(field, "metadata.annotations").is_some()
+}
+
+fn field_ref(env: &EnvVar) -> Option<&str> {
+    env.value_from.as_ref().and_then(|v| v.field_ref.as_ref()).map(|f| f.field_path.as_str())
+}
+
+fn host_network(pod: &Pod) -> bool {
+    pod.spec.as_ref().and_then(|s| s.host_network).unwrap_or(false)
+}
+
+// each env var with a fieldRef on one of the fields becomes a plain value
+fn replace(pod: &mut Pod, value: &dyn Fn(&str) -> Result<Option<String>, Box<dyn Error>>) -> Result<(), Box<dyn Error>> {
+    let spec = match pod.spec.as_mut() {
+        Some(spec) => spec,
+        None => return Ok(())
+    };
+    for container in spec.containers.iter_mut().chain(spec.init_containers.iter_mut().flatten()) {
+        for env in container.env.iter_mut().flatten() {
+            let resolved = match field_ref(env) {
+                Some(field) => value(field).map_err(|e| anyhow!("container {}: {}", container.name, e))?,
+                None => continue
+            };
+            match resolved {
+                Some(resolved) => {
+                    env.value = Some(resolved);
+                    env.value_from = None;
+                }
+                None => {}
+            }
+        }
+    }
+    Ok(())
+}
+
+// valueFrom.fieldRef, resolved once the node the pod goes to is known. podman would only do the name, labels and
+// annotations, and takes the name as the one it knows the pod by, <name>.<namespace>
+pub fn project(pod: &mut Pod, node_name: &str, host_ip: Option<&str>) -> Result<(), Box<dyn Error>> {
+    let original = pod.clone();
+    let on_host = host_network(&original);
+    replace(pod, &|field| {
+        let node_address = || host_ip.map(|ip| ip.to_string()).ok_or(anyhow!("the address of node {} for {} isn't known yet", node_name, field));
+        match field {
+            "metadata.name" => Ok(original.metadata.name.clone()),
+            "metadata.namespace" => Ok(original.metadata.namespace.clone()),
+            "spec.nodeName" => Ok(Some(node_name.to_string())),
+            "spec.serviceAccountName" => Ok(Some(original.spec.as_ref().and_then(|s| s.service_account_name.clone()).unwrap_or("default".to_string()))),
+            "status.hostIP" | "status.hostIPs" => Ok(Some(node_address()?)),
+            f if POD_IP_FIELDS.contains(&f) => match on_host {
+                true => Ok(Some(node_address()?)),
+                false => Ok(None)
+            },
+            // missing ones are empty, same as kubernetes
+            f => match (subscript(f, "metadata.labels"), subscript(f, "metadata.annotations")) {
+                (Some(key), _) => Ok(Some(original.metadata.labels.as_ref().and_then(|l| l.get(key).cloned()).unwrap_or_default())),
+                (_, Some(key)) => Ok(Some(original.metadata.annotations.as_ref().and_then(|a| a.get(key).cloned()).unwrap_or_default())),
+                _ => Err(anyhow!("unsupported fieldRef {}", f).into())
+            }
+        }
+    })
+}
+
+// whether the pod still needs its address filled in on the node
+pub fn wants_pod_ip(pod: &Pod) -> bool {
+    pod.spec.as_ref().map(|s| s.containers.iter().chain(s.init_containers.iter().flatten())
+        .flat_map(|c| c.env.iter().flatten())
+        .any(|e| field_ref(e).map(|f| POD_IP_FIELDS.contains(&f)).unwrap_or(false))).unwrap_or(false)
+}
+
+pub fn project_pod_ip(pod: &mut Pod, ip: &str) -> Result<(), Box<dyn Error>> {
+    replace(pod, &|field| match POD_IP_FIELDS.contains(&field) {
+        true => Ok(Some(ip.to_string())),
+        false => Ok(None)
+    })
+}
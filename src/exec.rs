@@ -0,0 +1,121 @@
+use std::error::Error;
+use std::io::IsTerminal;
+use std::process;
+use anyhow::anyhow;
+use clap::Args;
+use itertools::Itertools;
+use crate::config::Config;
+use crate::logs::locate_resource_pods;
+use crate::refresh::refreshed_state;
+use crate::skate::ConfigFileArgs;
+use crate::skatelet::{PodmanPodInfo, PodmanPodStatus};
+use crate::ssh;
+use crate::ssh::{native_ssh_command, native_ssh_tty_command};
+use crate::util::shell_quote;
+
+#[derive(Debug, Args)]
+pub struct ExecArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, short, long_help = "Namespace of the resource, defaults to the context's default_namespace or default.")]
+    namespace: Option<String>,
+    #[arg(long, short, long_help = "Container to run the command in, defaults to the pod's first container.")]
+    container: Option<String>,
+    #[arg(long, short = 'i', long_help = "Pass stdin through to the command.")]
+    stdin: bool,
+    #[arg(long, short = 't', long_help = "Allocate a terminal for the command, usually along with -i.")]
+    tty: bool,
+    #[arg(long_help = "Pod name, pod/<name>, deployment/<name>, daemonset/<name> or statefulset/<name>. For anything with replicas a ready one \
+is picked.")]
+    resource: String,
+    #[arg(last = true, required = true, long_help = "The command to run, after --.")]
+    command: Vec<String>,
+}
+
+// ready replicas first, then anything still running, sorted so repeated calls land on the same pod
+fn pick_pod(pods: Vec<(PodmanPodInfo, String)>) -> Option<(PodmanPodInfo, String)> {
+    pods.into_iter()
+        .filter(|(p, _)| p.status == PodmanPodStatus::Running)
+        .sorted_by_key(|(p, _)| (!p.is_ready(), p.name.clone()))
+        .next()
+}
+
+pub async fn exec(args: ExecArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let namespace = cluster.namespace(args.namespace.clone());
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let state = refreshed_state(&cluster.name, &conns, &config).await?;
+    let pods = locate_resource_pods(&state, &args.resource, &namespace)?;
+    if pods.len() == 0 {
+        return Err(anyhow!("no pods found for {} in namespace {}", args.resource, namespace).into());
+    }
+    let (pod, node_name) = pick_pod(pods).ok_or(anyhow!("no running pods for {} in namespace {}", args.resource, namespace))?;
+
+    // podman names containers <pod>-<container>. init containers have exited by the time there's anything to exec into
+    let containers: Vec<_> = pod.containers.clone().unwrap_or_default().into_iter().filter(|c| !c.is_infra() && !c.init).collect();
+    let container = match &args.container {
+        Some(name) => containers.iter().find(|c| c.names == format!("{}-{}", pod.podman_name(), name)),
+        // sidecars go ahead of the pod's own containers, which are what's wanted by default
+        None => containers.iter().find(|c| !pod.is_sidecar(c)).or(containers.first())
+    };
+    let container = match container {
+        Some(container) => container.names.clone(),
+        None => {
+            let names = containers.iter().map(|c| c.names.strip_prefix(&format!("{}-", pod.podman_name())).unwrap_or(c.names.as_str()).to_string()).join(", ");
+            return Err(anyhow!("container {} not found in pod {}, it has {}", args.container.clone().unwrap_or_default(), pod.name, names).into());
+        }
+    };
+
+    let node = cluster.nodes.iter().find(|n| n.name == node_name).ok_or(anyhow!("node {} not found in config", node_name))?;
+
+    // same as kubectl, a terminal is no use without one on this end
+    let tty = match args.tty && !std::io::stdin().is_terminal() {
+        true => {
+            eprintln!("Unable to use a TTY - input is not a terminal");
+            false
+        }
+        false => args.tty
+    };
+
+    let mut remote = vec!("sudo podman exec".to_string());
+    if args.stdin {
+        remote.push("-i".to_string());
+    }
+    if tty {
+        remote.push("-t".to_string());
+    }
+    remote.push(container);
+    remote.extend(args.command.iter().map(|a| shell_quote(a)));
+
+    let mut cmd = match tty {
+        true => native_ssh_tty_command(cluster, node),
+        false => native_ssh_command(cluster, node)
+    };
+    // ssh would otherwise read whatever is on stdin, a terminal needs it to be left alone
+    if !args.stdin && !tty {
+        cmd.stdin(process::Stdio::null());
+    }
+    cmd.arg(remote.join(" "));
+
+    let status = cmd.status().await?;
+
+    // the exit code of the command, like running it locally
+    match status.code() {
+        Some(0) => Ok(()),
+        Some(code) => {
+            ssh::cleanup_control_sockets();
+            process::exit(code)
+        }
+        None => Err(anyhow!("exec on node {} was interrupted", node_name).into())
+    }
+}
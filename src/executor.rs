@@ -1,11 +1,28 @@
+use std::collections::{BTreeMap, HashSet};
 use std::error::Error;
+use std::fs;
 use std::fs::File;
 use std::io::{Write};
+use std::net::Ipv4Addr;
+use std::os::unix::fs::{DirBuilderExt, OpenOptionsExt};
+use std::path::{Component, Path};
 use std::process;
 use std::process::Stdio;
+use std::thread;
+use std::time::{Duration, Instant};
 use anyhow::anyhow;
+use fs2::FileExt;
+use k8s_openapi::api::core::v1::Pod;
+use crate::configmap::{self, VOLUME_ANNOTATION_PREFIX};
+use crate::downward;
+use crate::restart::RECONCILE_RESTARTS_LABEL;
+use crate::sidecar;
 use crate::skate::SupportedResources;
-use crate::util::{hash_string, metadata_name};
+use crate::skatelet::{remove_pod_hosts, VAR_PATH};
+use crate::util::{hash_string, metadata_name, NamespacedName, parse_cpu, parse_memory};
+
+// once (the default) or always
+const INIT_CONTAINER_TYPE_ANNOTATION: &str = "io.podman.annotations.init.container.type";
 
 pub trait Executor {
     fn apply(&self, manifest: &str) -> Result<(), Box<dyn Error>>;
@@ -14,6 +31,20 @@ pub trait Executor {
 
 pub struct DefaultExecutor {}
 
+// the registry credentials skate wrote for a pod, removed once dropped
+struct RegistryAuthFile(String);
+
+impl Drop for RegistryAuthFile {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.0);
+    }
+}
+
+// podman's network, as `skate create node` sets it up
+const CNI_CONFIG_PATH: &str = "/etc/cni/net.d/87-podman-bridge.conflist";
+// host-local's record of the addresses it has handed out, a file named after each
+const CNI_IPAM_PATH: &str = "/var/lib/cni/networks/podman";
+
 impl DefaultExecutor {
     fn write_to_file(manifest: &str) -> Result<String, Box<dyn Error>> {
         let file_path = format!("/tmp/skate-{}.yaml", hash_string(manifest));
@@ -21,25 +52,378 @@ impl DefaultExecutor {
         file.write_all(manifest.as_ref()).expect("failed to write manifest to file");
         Ok(file_path)
     }
+
+    // the manifest a pod was started with, the one skate sends on removal only has its name
+    fn manifest_path(ns: &str, name: &str) -> String {
+        format!("{}/manifests/{}/{}.yaml", VAR_PATH, ns, name)
+    }
+
+    fn store_manifest(pod: &Pod) -> Result<(), Box<dyn Error>> {
+        let path = DefaultExecutor::manifest_path(pod.metadata.namespace.as_deref().unwrap_or(""), pod.metadata.name.as_deref().unwrap_or(""));
+        match Path::new(&path).parent() {
+            Some(parent) => fs::create_dir_all(parent)?,
+            None => {}
+        }
+        fs::write(path, serde_yaml::to_string(pod)?)?;
+        Ok(())
+    }
+
+    // written by skate just before the pod is applied (root only), and removed once the images are pulled
+    pub(crate) fn registry_auth_path(ns: &str, name: &str) -> String {
+        format!("{}/auth/{}/{}.json", VAR_PATH, ns, name)
+    }
+
+    pub(crate) fn write_registry_auth(ns: &str, name: &str, auth: &str) -> Result<(), Box<dyn Error>> {
+        let path = DefaultExecutor::registry_auth_path(ns, name);
+        let dir = Path::new(&path).parent().ok_or(anyhow!("invalid registry auth path {}", path))?;
+        fs::DirBuilder::new().recursive(true).mode(0o700).create(dir)
+            .map_err(|e| anyhow!("failed to create {}: {}", dir.display(), e))?;
+        let mut file = fs::OpenOptions::new().write(true).create(true).truncate(true).mode(0o600).open(&path)
+            .map_err(|e| anyhow!("failed to open {}: {}", path, e))?;
+        file.write_all(auth.as_bytes())?;
+        Ok(())
+    }
+
+    pub(crate) fn stored_manifest(ns: &str, name: &str) -> Option<Pod> {
+        let manifest = fs::read_to_string(DefaultExecutor::manifest_path(ns, name)).ok()?;
+        serde_yaml::from_str(&manifest).ok()
+    }
+
+    // runs each container's preStop exec hook, giving up on any still running at the deadline
+    fn run_pre_stop_hooks(pod: &Pod, pod_name: &str, deadline: Instant) {
+        let containers = pod.spec.as_ref().map(|s| s.containers.clone()).unwrap_or_default();
+        for container in containers {
+            let pre_stop = match container.lifecycle.and_then(|l| l.pre_stop) {
+                Some(pre_stop) => pre_stop,
+                None => continue
+            };
+            let command = match pre_stop.exec.and_then(|e| e.command) {
+                Some(command) => command,
+                None => {
+                    eprintln!("only exec preStop hooks are supported, skipping hook for {}", container.name);
+                    continue;
+                }
+            };
+
+            // podman names containers <pod>-<container>
+            let container_name = format!("{}-{}", pod_name, container.name);
+            let child = process::Command::new("podman")
+                .args([vec!["exec".to_string(), container_name.clone()], command].concat())
+                .stdin(Stdio::null())
+                .spawn();
+            let mut child = match child {
+                Ok(child) => child,
+                Err(e) => {
+                    eprintln!("failed to run preStop hook for {}: {}", container_name, e);
+                    continue;
+                }
+            };
+
+            loop {
+                match child.try_wait() {
+                    Ok(Some(status)) => {
+                        if !status.success() {
+                            eprintln!("preStop hook for {} exited with {}", container_name, status);
+                        }
+                        break;
+                    }
+                    Ok(None) if Instant::now() >= deadline => {
+                        eprintln!("preStop hook for {} still running after the grace period, killing it", container_name);
+                        let _ = child.kill();
+                        break;
+                    }
+                    Ok(None) => thread::sleep(Duration::from_millis(100)),
+                    Err(e) => {
+                        eprintln!("failed to wait for preStop hook for {}: {}", container_name, e);
+                        break;
+                    }
+                }
+            }
+        }
+    }
+
+    // creates what the pod's volumes need on this node, and turns :z/:Z suffixes on host paths into podman's
+    // bind mount options so they get relabelled for selinux
+    fn prepare_volumes(pod: &mut Pod) -> Result<(), Box<dyn Error>> {
+        let name = pod.metadata.name.clone().unwrap_or_default();
+        let ns = pod.metadata.namespace.clone().unwrap_or_default();
+        let volumes = match pod.spec.as_mut().and_then(|s| s.volumes.as_mut()) {
+            Some(volumes) => volumes,
+            None => return Ok(())
+        };
+
+        let mut annotations = pod.metadata.annotations.clone().unwrap_or_default();
+
+        for volume in volumes.iter_mut() {
+            // planned under the pod's original name, which a surge pod no longer has
+            let config_map = annotations.contains_key(&format!("{}{}", VOLUME_ANNOTATION_PREFIX, volume.name));
+            match volume.host_path.as_mut() {
+                Some(host_path) if config_map => host_path.path = configmap::volume_path(&ns, &name, &volume.name),
+                _ => {}
+            }
+            match volume.host_path.as_mut() {
+                Some(host_path) => {
+                    let (path, relabel) = match host_path.path.rsplit_once(':') {
+                        Some((path, opt)) if opt == "z" || opt == "Z" => (path.to_string(), Some(opt.to_string())),
+                        _ => (host_path.path.clone(), None)
+                    };
+                    match relabel {
+                        Some(opt) => {
+                            annotations.insert(format!("bind-mount-options:{}", path), opt);
+                        }
+                        None => {}
+                    }
+                    host_path.path = path.clone();
+
+                    match host_path.type_.as_deref() {
+                        Some("DirectoryOrCreate") => {
+                            fs::create_dir_all(&path).map_err(|e| anyhow!("failed to create host path {}: {}", path, e))?;
+                        }
+                        Some("FileOrCreate") if !Path::new(&path).exists() => {
+                            match Path::new(&path).parent() {
+                                Some(parent) => fs::create_dir_all(parent).map_err(|e| anyhow!("failed to create host path {}: {}", parent.display(), e))?,
+                                None => {}
+                            }
+                            File::create(&path).map_err(|e| anyhow!("failed to create host path {}: {}", path, e))?;
+                        }
+                        _ => {}
+                    }
+                }
+                None => {}
+            }
+
+            // skate resolves configMap volumes into a host path, with the files to put there in an annotation
+            match (annotations.remove(&format!("{}{}", VOLUME_ANNOTATION_PREFIX, volume.name)), volume.host_path.as_ref()) {
+                (Some(files), Some(host_path)) => Self::write_config_map_files(&host_path.path, &files)?,
+                _ => {}
+            }
+
+            // podman treats claims as named volumes
+            match volume.persistent_volume_claim.as_ref() {
+                Some(claim) => Self::ensure_named_volume(&claim.claim_name)?,
+                None => {}
+            }
+        }
+
+        pod.metadata.annotations = match annotations.len() {
+            0 => None,
+            _ => Some(annotations)
+        };
+        Ok(())
+    }
+
+    // starts from an empty directory each time so keys removed from the config map don't linger
+    fn write_config_map_files(dir: &str, files: &str) -> Result<(), Box<dyn Error>> {
+        let files: BTreeMap<String, String> = serde_json::from_str(files).map_err(|e| anyhow!("invalid configmap files for {}: {}", dir, e))?;
+        if Path::new(dir).exists() {
+            fs::remove_dir_all(dir).map_err(|e| anyhow!("failed to clear {}: {}", dir, e))?;
+        }
+        fs::create_dir_all(dir).map_err(|e| anyhow!("failed to create {}: {}", dir, e))?;
+
+        for (name, content) in files {
+            // nothing but plain names, an absolute path or .. would end up outside of it
+            let components: Vec<_> = Path::new(&name).components().collect();
+            if components.len() == 0 || components.iter().any(|c| !matches!(c, Component::Normal(_))) {
+                return Err(anyhow!("configmap path {} is outside the volume", name).into());
+            }
+            let path = Path::new(dir).join(&name);
+            match path.parent() {
+                Some(parent) => fs::create_dir_all(parent)?,
+                None => {}
+            }
+            fs::write(&path, content).map_err(|e| anyhow!("failed to write {}: {}", path.display(), e))?;
+        }
+        Ok(())
+    }
+
+    // play kube doesn't reliably carry limits over to the containers' cgroups on every podman version, so they're set
+    // again explicitly once the pod is up
+    fn apply_limits(pod: &Pod) -> Result<(), Box<dyn Error>> {
+        let pod_name = metadata_name(pod).to_string();
+        // sidecars are still running by now, the other init containers have exited
+        let containers = pod.spec.as_ref().map(|s| s.init_containers.iter().flatten().filter(|c| sidecar::is_sidecar(c))
+            .chain(s.containers.iter()).cloned().collect::<Vec<_>>()).unwrap_or_default();
+        for container in containers {
+            let limits = container.resources.and_then(|r| r.limits).unwrap_or_default();
+            let mut args = vec!["update".to_string()];
+            match limits.get("cpu") {
+                Some(cpu) => args.push(format!("--cpus={}", parse_cpu(&cpu.0)? as f64 / 1000.0)),
+                None => {}
+            }
+            match limits.get("memory") {
+                Some(memory) => args.push(format!("--memory={}", parse_memory(&memory.0)?)),
+                None => {}
+            }
+            if args.len() == 1 {
+                continue;
+            }
+
+            // podman names containers <pod>-<container>
+            let container_name = format!("{}-{}", pod_name, container.name);
+            args.push(container_name.clone());
+            let output = process::Command::new("podman")
+                .args(&args)
+                .stdin(Stdio::null())
+                .stdout(Stdio::piped())
+                .output()
+                .map_err(|e| anyhow!("failed to update container {}: {}", container_name, e))?;
+            if !output.status.success() {
+                return Err(anyhow!("failed to set limits on {}: exit code {}, stderr: {}", container_name, output.status, String::from_utf8_lossy(&output.stderr).to_string()).into());
+            }
+        }
+        Ok(())
+    }
+
+    // held from picking a pod's address until podman has started it, so two pods being applied at once can't both
+    // pick the same one
+    fn lock_pod_ips() -> Result<File, Box<dyn Error>> {
+        let path = format!("{}/pod-ip.lock", VAR_PATH);
+        let file = File::create(&path).map_err(|e| anyhow!("failed to create/open lock file {}: {}", path, e))?;
+        file.lock_exclusive()?;
+        Ok(file)
+    }
+
+    // an address for a pod whose env wants status.podIP, picked before podman starts it since env can't change
+    // afterwards. the first 9 addresses are left alone, the same as `skate create node` intends
+    fn free_pod_ip() -> Result<String, Box<dyn Error>> {
+        let config: serde_json::Value = serde_json::from_str(&fs::read_to_string(CNI_CONFIG_PATH)?)?;
+        // the bridge plugin ignores --ip without it, the pod would get some other address than its env says
+        if config["plugins"][0]["capabilities"]["ips"].as_bool() != Some(true) {
+            return Err(anyhow!("{} doesn't allow pods a static ip, which status.podIP needs: run `skate create node` for this node again", CNI_CONFIG_PATH).into());
+        }
+        let range = &config["plugins"][0]["ipam"]["ranges"][0][0];
+        let subnet = range["subnet"].as_str().ok_or(anyhow!("no subnet in {}", CNI_CONFIG_PATH))?;
+        let gateway = range["gateway"].as_str().unwrap_or_default();
+        let (network, prefix) = subnet.split_once('/').ok_or(anyhow!("invalid subnet {}", subnet))?;
+        let network: u32 = network.parse::<Ipv4Addr>()?.into();
+        let size = 1u32.checked_shl(32 - prefix.parse::<u32>()?.min(32)).unwrap_or(u32::MAX);
+
+        let taken: HashSet<String> = fs::read_dir(CNI_IPAM_PATH)
+            .map(|entries| entries.filter_map(|e| e.ok()).map(|e| e.file_name().to_string_lossy().to_string()).collect())
+            .unwrap_or_default();
+        // the broadcast address is the last one
+        (10..size.saturating_sub(1)).map(|i| Ipv4Addr::from(network.wrapping_add(i)).to_string())
+            .find(|ip| ip != gateway && !taken.contains(ip))
+            .ok_or(anyhow!("no free address left in {}", subnet).into())
+    }
+
+    fn ensure_named_volume(name: &str) -> Result<(), Box<dyn Error>> {
+        let exists = process::Command::new("podman")
+            .args(["volume", "exists", name])
+            .status()
+            .expect("failed to check volume");
+        if exists.success() {
+            return Ok(());
+        }
+
+        let output = process::Command::new("podman")
+            .args(["volume", "create", name])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .output()
+            .expect("failed to create volume");
+        if !output.status.success() {
+            return Err(anyhow!("failed to create volume {}: exit code {}, stderr: {}", name, output.status, String::from_utf8_lossy(&output.stderr).to_string()).into());
+        }
+        Ok(())
+    }
 }
 
 impl Executor for DefaultExecutor {
     fn apply(&self, manifest: &str) -> Result<(), Box<dyn Error>> {
         // just to check
-        let object: SupportedResources = serde_yaml::from_str(manifest).expect("failed to deserialize manifest");
+        let mut object: SupportedResources = serde_yaml::from_str(manifest).expect("failed to deserialize manifest");
 
 
-        let extra_args = match &object {
+        let mut auth_file = None;
+        let mut ip_lock = None;
+        let extra_args = match &mut object {
             SupportedResources::Pod(p) => {
+                // taken off the node again however the apply ends
+                let path = DefaultExecutor::registry_auth_path(p.metadata.namespace.as_deref().unwrap_or(""), p.metadata.name.as_deref().unwrap_or(""));
+                if Path::new(&path).exists() {
+                    auth_file = Some(RegistryAuthFile(path));
+                }
+
+                DefaultExecutor::prepare_volumes(p)?;
                 let alias = format!("bridge:alias={}", &metadata_name(p));
-                vec!["--network".to_string(), alias]
+                let mut args = vec!["--network".to_string(), alias];
+
+                // everything else from the downward api was filled in when the pod was scheduled
+                if downward::wants_pod_ip(p) {
+                    ip_lock = Some(DefaultExecutor::lock_pod_ips()?);
+                    let ip = DefaultExecutor::free_pod_ip()?;
+                    downward::project_pod_ip(p, &ip)?;
+                    args.extend(["--ip".to_string(), ip]);
+                }
+
+                match &auth_file {
+                    Some(RegistryAuthFile(path)) => args.extend(["--authfile".to_string(), path.clone()]),
+                    None => {}
+                }
+
+                // given to podman directly rather than left to play kube, which only picked them up in later versions.
+                // taken out of the manifest below so they aren't added twice
+                for alias in p.spec.as_ref().and_then(|s| s.host_aliases.clone()).unwrap_or_default() {
+                    for hostname in alias.hostnames.unwrap_or_default() {
+                        args.extend(["--add-host".to_string(), format!("{}:{}", hostname, alias.ip.clone().unwrap_or_default())]);
+                    }
+                }
+                args
             }
             SupportedResources::Deployment(_) => vec![],
             SupportedResources::DaemonSet(_) => vec![],
+            SupportedResources::HorizontalPodAutoscaler(_) => {
+                return Err(anyhow!("autoscalers are managed by skate and cannot be applied on a node").into());
+            }
+            SupportedResources::Job(_) => {
+                return Err(anyhow!("jobs are scheduled as pods by skate and cannot be applied on a node").into());
+            }
+            SupportedResources::StatefulSet(_) => {
+                return Err(anyhow!("statefulsets are scheduled as pods by skate and cannot be applied on a node").into());
+            }
+            SupportedResources::Secret(_) => {
+                return Err(anyhow!("secrets are kept by skate and cannot be applied on a node").into());
+            }
+            SupportedResources::ConfigMap(_) => {
+                return Err(anyhow!("configmaps are kept by skate and cannot be applied on a node").into());
+            }
         };
 
 
-        let file_path = DefaultExecutor::write_to_file(&serde_yaml::to_string(&object)?)?;
+        // podman gets <name>.<namespace> so pods of the same name in different namespaces don't clash on a node, the
+        // hostname stays the plain name
+        let manifest = match &object {
+            SupportedResources::Pod(p) => {
+                let mut pod = p.clone();
+                pod.metadata.name = Some(metadata_name(p).to_string());
+                // skate restarts the containers itself so it can back off, podman would restart them straight away
+                let skate_restarts = p.metadata.labels.as_ref().map(|l| l.contains_key(RECONCILE_RESTARTS_LABEL)).unwrap_or(false);
+                match pod.spec.as_mut() {
+                    Some(spec) => {
+                        if spec.hostname.is_none() {
+                            spec.hostname = p.metadata.name.clone();
+                        }
+                        if skate_restarts {
+                            spec.restart_policy = Some("Never".to_string());
+                        }
+                        spec.host_aliases = None;
+                    }
+                    None => {}
+                }
+                sidecar::promote(&mut pod);
+                // podman removes init containers once they've run, unless told to keep them. kept, their logs stay
+                // around and they run again when the pod is restarted, like in kubernetes
+                let has_init_containers = pod.spec.as_ref().and_then(|s| s.init_containers.as_ref()).map(|c| c.len() > 0).unwrap_or(false);
+                if has_init_containers {
+                    pod.metadata.annotations.get_or_insert_with(BTreeMap::new)
+                        .entry(INIT_CONTAINER_TYPE_ANNOTATION.to_string()).or_insert("always".to_string());
+                }
+                serde_yaml::to_string(&SupportedResources::Pod(pod))?
+            }
+            _ => serde_yaml::to_string(&object)?
+        };
+        let file_path = DefaultExecutor::write_to_file(&manifest)?;
 
         let output = process::Command::new("podman")
             .args([vec!["play", "kube", &file_path], extra_args.iter().map(|s| s as &str).collect()].concat())
@@ -48,10 +432,42 @@ impl Executor for DefaultExecutor {
             .output()
 
             .expect("failed to apply resource");
+
+        // podman is done with it, nothing else reads it
+        let _ = fs::remove_file(&file_path);
+
+        // host-local has recorded the pod's address by now
+        drop(ip_lock);
+
+        // the images are pulled by now, no need to keep the credentials around
+        drop(auth_file);
+
         if !output.status.success() {
             return Err(anyhow!("exit code {}, stderr: {}", output.status, String::from_utf8_lossy(&output.stderr).to_string()).into());
         }
 
+        match &object {
+            SupportedResources::Pod(p) => {
+                match DefaultExecutor::store_manifest(p) {
+                    Ok(_) => {}
+                    Err(e) => eprintln!("failed to store manifest for {}: {}", metadata_name(p), e)
+                }
+                // the pod is up, but without the limits it was applied with. it can't be left running like that, the
+                // next apply would take it for unchanged
+                match DefaultExecutor::apply_limits(p) {
+                    Ok(_) => {}
+                    Err(e) => {
+                        match self.remove(manifest, Some(0)) {
+                            Ok(_) => {}
+                            Err(rm_err) => eprintln!("failed to remove {} after its limits failed: {}", metadata_name(p), rm_err)
+                        }
+                        return Err(anyhow!("failed to set limits on pod {}, removed it again: {}", metadata_name(p), e).into());
+                    }
+                }
+            }
+            _ => {}
+        }
+
         println!("{}", String::from_utf8_lossy(&output.stdout).to_string());
         Ok(())
     }
@@ -69,6 +485,21 @@ impl Executor for DefaultExecutor {
             SupportedResources::DaemonSet(_) => {
                 todo!("remove daemonset")
             }
+            SupportedResources::HorizontalPodAutoscaler(_) => {
+                return Err(anyhow!("autoscalers are managed by skate and cannot be removed on a node").into());
+            }
+            SupportedResources::Job(_) => {
+                return Err(anyhow!("removing a job is not supported, instead supply it's individual pods").into());
+            }
+            SupportedResources::StatefulSet(_) => {
+                return Err(anyhow!("removing a statefulset is not supported, instead supply it's individual pods").into());
+            }
+            SupportedResources::Secret(_) => {
+                return Err(anyhow!("secrets are kept by skate and cannot be removed on a node").into());
+            }
+            SupportedResources::ConfigMap(_) => {
+                return Err(anyhow!("configmaps are kept by skate and cannot be removed on a node").into());
+            }
         };
         let id = id.trim().to_string();
         let ns = ns.trim().to_string();
@@ -80,12 +511,36 @@ impl Executor for DefaultExecutor {
             return Err(anyhow!("no metadata.name found").into());
         }
 
-        let grace = grace_period.unwrap_or(10);
+        let stored = DefaultExecutor::stored_manifest(&ns, &id);
+
+        // pods started before names were namespaced are still called by their plain name
+        let podman_name = NamespacedName::new(id.clone(), ns.clone()).to_string();
+        let exists = process::Command::new("podman")
+            .args(["pod", "exists", &podman_name])
+            .status()
+            .map_err(|e| anyhow!("failed to check pod {}: {}", podman_name, e))?;
+        let pod_id = match exists.success() {
+            true => podman_name,
+            false => id.clone()
+        };
+
+        // an explicit grace period wins over the pod's own terminationGracePeriodSeconds
+        let grace = grace_period.or_else(|| {
+            stored.as_ref().and_then(|p| p.spec.as_ref()?.termination_grace_period_seconds).map(|g| g.max(0) as usize)
+        }).unwrap_or(10);
+
+        // preStop hooks eat into the grace period, same as kubernetes
+        let started = Instant::now();
+        match &stored {
+            Some(pod) => DefaultExecutor::run_pre_stop_hooks(pod, &pod_id, started + Duration::from_secs(grace as u64)),
+            None => {}
+        }
+        let grace = grace.saturating_sub(started.elapsed().as_secs() as usize);
 
         let grace_str = format!("{}", grace);
         let stop_cmd = [
             vec!("pod", "stop", "-t", &grace_str),
-            vec!(&id),
+            vec!(&pod_id),
         ].concat();
         let output = process::Command::new("podman")
             .args(stop_cmd.clone())
@@ -100,7 +555,7 @@ impl Executor for DefaultExecutor {
 
         let rm_cmd = [
             vec!("pod", "rm", "--force"),
-            vec!(&id),
+            vec!(&pod_id),
         ].concat();
         let output = process::Command::new("podman")
             .args(rm_cmd.clone())
@@ -112,6 +567,15 @@ impl Executor for DefaultExecutor {
         if !output.status.success() {
             return Err(anyhow!("{:?} - exit code {}, stderr: {}", rm_cmd,  output.status, String::from_utf8_lossy(&output.stderr).to_string()).into());
         }
+
+        // no stale dns entries left pointing at an ip the next pod may get
+        match remove_pod_hosts("podman", &pod_id) {
+            Ok(_) => {}
+            Err(e) => eprintln!("failed to remove dns entries for {}: {}", pod_id, e)
+        }
+
+        let _ = fs::remove_file(DefaultExecutor::manifest_path(&ns, &id));
+        let _ = fs::remove_dir_all(format!("{}/configmaps/{}/{}", VAR_PATH, ns, id));
         Ok(())
     }
 }
@@ -1,17 +1,31 @@
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::error::Error;
+use std::io::Write;
+use std::time::Duration;
 
-use chrono::{Local, SecondsFormat};
+use anyhow::anyhow;
+use chrono::{Local, SecondsFormat, TimeZone, Utc};
 use clap::{Args, Subcommand};
 use itertools::{Itertools};
+use k8s_openapi::api::apps::v1::{Deployment, DeploymentStatus, StatefulSet, StatefulSetStatus};
+use k8s_openapi::api::batch::v1::Job;
+use k8s_openapi::api::core::v1::{ContainerState, ContainerStateRunning, ContainerStateTerminated, ContainerStateWaiting, ContainerStatus, Event as K8sEvent, EventSource, Node as K8sNode, ObjectReference, Pod, Secret};
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::{ObjectMeta, Time};
+use serde_json::{json, Value};
 use crate::config::Config;
+use crate::describe::applied_pod;
 use crate::refresh::refreshed_state;
+use crate::restart;
+use crate::restart::RestartState;
+use crate::secret;
 
 
-use crate::skate::ConfigFileArgs;
-use crate::skatelet::{PodmanPodInfo, PodmanPodStatus};
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::skatelet::{PodmanContainerInfo, PodmanPodInfo, PodmanPodStatus};
 use crate::ssh;
-use crate::state::state::{ClusterState, NodeState};
+use crate::ssh::SshClients;
+use crate::state::state::{ClusterState, Event, NodeState, NodeStatus};
+use crate::util::template_revision;
 
 
 #[derive(Debug, Clone, Args)]
@@ -30,8 +44,24 @@ pub enum IdCommand {
 pub struct GetObjectArgs {
     #[command(flatten)]
     config: ConfigFileArgs,
-    #[arg(long, short, long_help = "Filter by resource namespace")]
+    #[arg(long, short, long_help = "Filter by resource namespace, defaults to the context's default_namespace or default")]
     namespace: Option<String>,
+    #[arg(long, short = 'A', conflicts_with = "namespace", long_help = "List across all namespaces")]
+    all_namespaces: bool,
+    #[arg(long, long_help = "Show labels as the last column (nodes only)")]
+    show_labels: bool,
+    #[arg(long, long_help = "Only show events for this resource and its pods, eg deployment/foo (events only)")]
+    resource: Option<String>,
+    #[arg(long, long_help = "Print secret values in plain text, after asking for confirmation (secrets only)")]
+    show_values: bool,
+    #[arg(long, short, value_parser = parse_output, long_help = "Output format: json, yaml, name (<kind>/<name> per line) or jsonpath=<template>, eg jsonpath={.items[*].metadata.name}. A table when not set.")]
+    output: Option<OutputFormat>,
+    #[arg(long, short, long_help = "After listing, keep polling the nodes and print pods again as they change (pods only)")]
+    watch: bool,
+    #[arg(long, requires = "watch", long_help = "With --watch, print only what changed, as ADDED, MODIFIED and DELETED events (pods only)")]
+    output_watch_events: bool,
+    #[arg(long, default_value_t = 2, long_help = "Seconds between polls with --watch")]
+    watch_interval: u64,
     #[command(subcommand)]
     id: Option<IdCommand>,
 }
@@ -44,6 +74,14 @@ pub enum GetCommands {
     Deployment(GetObjectArgs),
     #[command(alias("nodes"))]
     Node(GetObjectArgs),
+    #[command(alias("statefulsets"))]
+    StatefulSet(GetObjectArgs),
+    #[command(alias("jobs"))]
+    Job(GetObjectArgs),
+    #[command(alias("events"))]
+    Event(GetObjectArgs),
+    #[command(alias("secrets"))]
+    Secret(GetObjectArgs),
 }
 
 pub async fn get(args: GetArgs) -> Result<(), Box<dyn Error>> {
@@ -51,20 +89,62 @@ pub async fn get(args: GetArgs) -> Result<(), Box<dyn Error>> {
     match args.commands {
         GetCommands::Pod(p_args) => get_pod(global_args, p_args).await,
         GetCommands::Deployment(d_args) => get_deployment(global_args, d_args).await,
-        GetCommands::Node(n_args) => get_nodes(global_args, n_args).await
+        GetCommands::Node(n_args) => get_nodes(global_args, n_args).await,
+        GetCommands::StatefulSet(s_args) => get_statefulsets(global_args, s_args).await,
+        GetCommands::Job(j_args) => get_jobs(global_args, j_args).await,
+        GetCommands::Event(e_args) => get_events(global_args, e_args).await,
+        GetCommands::Secret(s_args) => get_secrets(global_args, s_args).await,
+    }
+}
+
+#[derive(Clone, Debug)]
+pub enum OutputFormat {
+    Json,
+    Yaml,
+    Name,
+    JsonPath(String),
+}
+
+fn parse_output(s: &str) -> Result<OutputFormat, String> {
+    match s.split_once('=') {
+        Some(("jsonpath", template)) => Ok(OutputFormat::JsonPath(template.to_string())),
+        _ => match s {
+            "json" => Ok(OutputFormat::Json),
+            "yaml" => Ok(OutputFormat::Yaml),
+            "name" => Ok(OutputFormat::Name),
+            _ => Err(format!("unsupported output format {}, expected json, yaml, name or jsonpath=<template>", s))
+        }
     }
 }
 
 pub trait Lister<T> {
     fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<T>;
     fn print(&self, items: Vec<T>);
+    // kubernetes objects for -o, the applied spec along with a status filled in from what the nodes report
+    fn objects(&self, items: Vec<T>, state: &ClusterState) -> Vec<Value>;
+}
+
+// kubectl's NAMESPACE column, only there when listing across namespaces
+fn namespace_column(all_namespaces: bool, namespace: &str) -> String {
+    match all_namespaces {
+        true => format!("{0: <15}  ", namespace),
+        false => "".to_string()
+    }
 }
 
 async fn get_objects<T>(_global_args: GetArgs, args: GetObjectArgs, lister: &dyn Lister<T>) -> Result<(), Box<dyn Error>> {
-    let config = Config::load(Some(args.config.skateconfig.clone()))?;
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+
+    // one namespace unless all of them are asked for
+    let mut args = args;
+    args.namespace = match args.all_namespaces {
+        true => None,
+        false => Some(config.current_cluster()?.namespace(args.namespace.clone()))
+    };
+
     let (conns, errors) = ssh::cluster_connections(config.current_cluster()?).await;
     if errors.is_some() {
-        eprintln!("{}", errors.unwrap())
+        errors.unwrap().log()
     }
 
     if conns.is_none() {
@@ -73,66 +153,445 @@ async fn get_objects<T>(_global_args: GetArgs, args: GetObjectArgs, lister: &dyn
 
     let conns = conns.unwrap();
 
-    let state = refreshed_state(&config.current_context.clone().unwrap_or("".to_string()), &conns, &config).await?;
+    let state = refreshed_state(&config.current_cluster()?.name, &conns, &config).await?;
 
     let objects = lister.list(&args, &state);
 
-    lister.print(objects);
+    match &args.output {
+        Some(format) => {
+            let named = args.id.is_some();
+            print_objects(format, lister.objects(objects, &state), named)
+        }
+        None => {
+            lister.print(objects);
+            Ok(())
+        }
+    }
+}
+
+// like kubectl, a single named object is printed on its own and anything else as a List
+fn print_objects(format: &OutputFormat, objects: Vec<Value>, named: bool) -> Result<(), Box<dyn Error>> {
+    // sorted so the output can be diffed
+    let mut objects = objects;
+    objects.sort_by_key(|o| (o["metadata"]["namespace"].as_str().unwrap_or("").to_string(), o["metadata"]["name"].as_str().unwrap_or("").to_string()));
+
+    let value = match (named, objects.len()) {
+        (true, 1) => objects[0].clone(),
+        _ => json!({
+            "apiVersion": "v1",
+            "kind": "List",
+            "items": objects,
+        })
+    };
+
+    match format {
+        OutputFormat::Json => println!("{}", serde_json::to_string_pretty(&value)?),
+        OutputFormat::Yaml => print!("{}", serde_yaml::to_string(&value)?),
+        OutputFormat::Name => {
+            for object in objects {
+                println!("{}/{}", object["kind"].as_str().unwrap_or("").to_lowercase(), object["metadata"]["name"].as_str().unwrap_or(""));
+            }
+        }
+        OutputFormat::JsonPath(template) => println!("{}", jsonpath(template, &value)?),
+    }
     Ok(())
 }
 
-struct PodLister {}
+// the part of kubectl's jsonpath that's useful in scripts: {.field}, {.list[0]}, {.list[*]} and {"literal"}, with
+// text outside of braces printed as is
+fn jsonpath(template: &str, value: &Value) -> Result<String, Box<dyn Error>> {
+    let mut output = String::new();
+    let mut rest = template;
+    loop {
+        let start = match rest.find('{') {
+            Some(start) => start,
+            None => {
+                output.push_str(rest);
+                return Ok(output);
+            }
+        };
+        output.push_str(&rest[..start]);
+        let end = rest[start..].find('}').map(|e| start + e)
+            .ok_or(anyhow!("unclosed {{ in jsonpath {}", template))?;
+        let expression = rest[start + 1..end].trim();
+        rest = &rest[end + 1..];
+
+        if expression.starts_with('"') {
+            let literal = expression.trim_matches('"').replace("\\n", "\n").replace("\\t", "\t");
+            output.push_str(&literal);
+            continue;
+        }
+
+        let mut results = vec![value.clone()];
+        for segment in jsonpath_segments(expression)? {
+            results = results.into_iter().flat_map(|v| match segment.as_str() {
+                "[*]" => match v {
+                    Value::Array(items) => items,
+                    Value::Object(map) => map.into_iter().map(|(_, v)| v).collect(),
+                    _ => vec![]
+                },
+                index if index.starts_with('[') => {
+                    let index = index.trim_start_matches('[').trim_end_matches(']');
+                    match index.parse::<usize>() {
+                        Ok(i) => v.get(i).cloned().into_iter().collect(),
+                        Err(_) => v.get(index.trim_matches('\'').trim_matches('"')).cloned().into_iter().collect()
+                    }
+                }
+                field => v.get(field).cloned().into_iter().collect()
+            }).collect();
+        }
+
+        output.push_str(&results.iter().map(|r| match r {
+            Value::String(s) => s.clone(),
+            other => other.to_string()
+        }).join(" "));
+    }
+}
+
+// .a.b[0] into ["a", "b", "[0]"]
+fn jsonpath_segments(expression: &str) -> Result<Vec<String>, Box<dyn Error>> {
+    let mut segments = vec!();
+    let mut current = String::new();
+    let mut chars = expression.trim_start_matches('$').chars();
+    loop {
+        match chars.next() {
+            Some('.') => {
+                if !current.is_empty() {
+                    segments.push(current.clone());
+                    current.clear();
+                }
+            }
+            Some('[') => {
+                if !current.is_empty() {
+                    segments.push(current.clone());
+                    current.clear();
+                }
+                let mut index = "[".to_string();
+                loop {
+                    match chars.next() {
+                        Some(']') => break,
+                        Some(c) => index.push(c),
+                        None => return Err(anyhow!("unclosed [ in {}", expression).into())
+                    }
+                }
+                index.push(']');
+                segments.push(index);
+            }
+            Some(c) => current.push(c),
+            None => {
+                if !current.is_empty() {
+                    segments.push(current);
+                }
+                return Ok(segments);
+            }
+        }
+    }
+}
+
+struct PodLister {
+    all_namespaces: bool,
+}
+
+impl PodLister {
+    fn header(&self) -> String {
+        format!(
+            "{0}{1: <30}  {2: <10}  {3: <16}  {4: <10}  {5: <30}",
+            namespace_column(self.all_namespaces, "NAMESPACE"), "NAME", "READY", "STATUS", "RESTARTS", "CREATED"
+        )
+    }
+
+    fn row(&self, pod: &PodmanPodInfo, restarts: &HashMap<String, RestartState>, status: &str) -> String {
+        let containers = pod.containers.clone().unwrap_or_default();
+        // like kubectl, init containers don't count towards READY
+        let num_containers = containers.iter().filter(|c| !c.init).count();
+        let healthy_containers = containers.iter().filter(|c| !c.init && c.is_ready()).collect::<Vec<_>>().len();
+        // podman's own restarts, for pods it still restarts, and skate's
+        let restart_count = containers.iter().map(|c| c.restart_count.unwrap_or_default() + restarts.get(&c.names).map(|r| r.restarts as usize).unwrap_or_default())
+            .reduce(|a, c| a + c).unwrap_or_default();
+        format!(
+            "{0}{1: <30}  {2: <10}  {3: <16}  {4: <10}  {5: <30}",
+            namespace_column(self.all_namespaces, &pod.namespace()), pod.name, format!("{}/{}", healthy_containers, num_containers),
+            status, restart_count, pod.created.to_rfc3339_opts(SecondsFormat::Secs, true)
+        )
+    }
+}
 
-impl Lister<PodmanPodInfo> for PodLister {
-    fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<PodmanPodInfo> {
-        let ns = filters.namespace.clone().unwrap_or_default();
+// (pod, restart state of its containers by container name)
+impl Lister<(PodmanPodInfo, HashMap<String, RestartState>)> for PodLister {
+    fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<(PodmanPodInfo, HashMap<String, RestartState>)> {
         let id = match filters.id.clone() {
             Some(cmd) => match cmd {
-                IdCommand::Id(ids) => ids.into_iter().next().unwrap_or("".to_string())
+                IdCommand::Id(ids) => ids.into_iter().next()
             }
-            None => "".to_string()
+            None => None
         };
 
         let pods = state.filter_pods(&|p| {
-            return (!ns.is_empty() && p.labels.get("skate.io/namespace").unwrap_or(&"".to_string()).clone() == ns)
-                || (!id.is_empty() && (p.id == id || p.name == id)) || (ns.is_empty() && id.is_empty());
+            let match_ns = filters.namespace.as_ref().map(|ns| *ns == p.namespace()).unwrap_or(true);
+            let match_id = id.as_ref().map(|id| p.id == *id || p.name == *id).unwrap_or(true);
+            match_ns && match_id
         });
-        pods.iter().map(|(p, _)| p.clone()).collect()
+        pods.iter().map(|(p, _)| {
+            let restarts: HashMap<String, RestartState> = p.containers.clone().unwrap_or_default().iter()
+                .filter_map(|c| state.restarts.get(&restart::key(p, c)).map(|r| (c.names.clone(), r.clone())))
+                .collect();
+            (p.clone(), restarts)
+        }).collect()
     }
 
-    fn print(&self, pods: Vec<PodmanPodInfo>) {
-        println!(
-            "{0: <30}  {1: <10}  {2: <10}  {3: <10}  {4: <30}",
-            "NAME", "READY", "STATUS", "RESTARTS", "CREATED"
-        );
-        for pod in pods {
-            let num_containers = pod.containers.clone().unwrap_or_default().len();
-            let healthy_containers = pod.containers.clone().unwrap_or_default().iter().filter(|c| {
-                match c.status.as_str() {
-                    "running" => true,
-                    _ => false
-                }
-            }).collect::<Vec<_>>().len();
-            let restarts = pod.containers.clone().unwrap_or_default().iter().map(|c| c.restart_count.unwrap_or_default())
-                .reduce(|a, c| a + c).unwrap_or_default();
-            println!(
-                "{0: <30}  {1: <10}  {2: <10}  {3: <10}  {4: <30}",
-                pod.name, format!("{}/{}", healthy_containers, num_containers), pod.status, restarts, pod.created.to_rfc3339_opts(SecondsFormat::Secs, true)
-            )
+    fn print(&self, pods: Vec<(PodmanPodInfo, HashMap<String, RestartState>)>) {
+        println!("{}", self.header());
+        for (pod, restarts) in pods {
+            let status = pod_status(&pod, &restarts);
+            println!("{}", self.row(&pod, &restarts, &status))
+        }
+    }
+
+    fn objects(&self, pods: Vec<(PodmanPodInfo, HashMap<String, RestartState>)>, state: &ClusterState) -> Vec<Value> {
+        pods.into_iter().filter_map(|(info, restarts)| {
+            let node = state.nodes.iter().find(|n| {
+                n.host_info.as_ref().and_then(|h| h.system_info.as_ref()).and_then(|si| si.pods.as_ref())
+                    .map(|pods| pods.iter().any(|p| p.id == info.id)).unwrap_or(false)
+            });
+
+            let mut pod: Pod = info.clone().into();
+            match applied_pod(state, &info.name, &info.namespace(), Some(&info)) {
+                Some(applied) => pod.spec = applied.spec,
+                None => {}
+            }
+            let spec = pod.spec.get_or_insert_with(Default::default);
+            spec.node_name = node.map(|n| n.node_name.clone());
+
+            let mut status = pod.status.clone().unwrap_or_default();
+            status.host_ip = node.and_then(|n| n.host_info.as_ref()?.system_info.as_ref()?.internal_ip_address.clone());
+            status.start_time = Some(Time(info.created.with_timezone(&Utc)));
+            let (init, containers): (Vec<_>, Vec<_>) = info.containers.clone().unwrap_or_default().into_iter()
+                .filter(|c| !c.is_infra())
+                .map(|c| {
+                    let crash_looping = restart::crash_looping(&info, &c, restarts.get(&c.names));
+                    let restart = restarts.get(&c.names).cloned();
+                    (c.init, container_status(&info.podman_name(), c, restart, crash_looping))
+                })
+                .partition(|(init, _)| *init);
+            status.container_statuses = Some(containers.into_iter().map(|(_, c)| c).collect());
+            status.init_container_statuses = match init.len() {
+                0 => None,
+                _ => Some(init.into_iter().map(|(_, c)| c).collect())
+            };
+            pod.status = Some(status);
+
+            serde_json::to_value(&pod).ok()
+        }).collect()
+    }
+}
+
+// kubectl's STATUS: how far the init containers got, then whether anything is being held back from restarting
+fn pod_status(pod: &PodmanPodInfo, restarts: &HashMap<String, RestartState>) -> String {
+    let containers = pod.containers.clone().unwrap_or_default();
+    let crash_looping = |c: &PodmanContainerInfo| restart::crash_looping(pod, c, restarts.get(&c.names));
+
+    match pod.failed_init_container() {
+        Some(init) if crash_looping(&init) => return "Init:CrashLoopBackOff".to_string(),
+        Some(_) => return "Init:Error".to_string(),
+        None => {}
+    }
+    let init = containers.iter().filter(|c| c.init).count();
+    let init_done = containers.iter().filter(|c| c.init && c.exit_code == Some(0)).count();
+    if init_done < init {
+        return format!("Init:{}/{}", init_done, init);
+    }
+
+    match containers.iter().any(|c| crash_looping(c)) {
+        true => "CrashLoopBackOff".to_string(),
+        false => pod.status.to_string()
+    }
+}
+
+fn container_status(pod_name: &str, container: PodmanContainerInfo, restart: Option<RestartState>, crash_looping: bool) -> ContainerStatus {
+    let state = match (container.status.as_str(), container.exit_code) {
+        ("running", _) => ContainerState {
+            running: Some(ContainerStateRunning {
+                started_at: container.started_at.and_then(|t| Utc.timestamp_opt(t, 0).single()).map(Time)
+            }),
+            ..Default::default()
+        },
+        (_, Some(exit_code)) if crash_looping => ContainerState {
+            waiting: Some(ContainerStateWaiting {
+                reason: Some("CrashLoopBackOff".to_string()),
+                message: Some(format!("back-off restarting failed container, exited with {}", exit_code)),
+            }),
+            ..Default::default()
+        },
+        (_, Some(exit_code)) => ContainerState {
+            terminated: Some(ContainerStateTerminated { exit_code, reason: Some(restart::reason(exit_code)), ..Default::default() }),
+            ..Default::default()
+        },
+        (status, None) => ContainerState {
+            waiting: Some(ContainerStateWaiting { reason: Some(status.to_string()), message: None }),
+            ..Default::default()
         }
+    };
+
+    // the exit skate last restarted the container after
+    let last_state = restart.as_ref().and_then(|r| r.last_exit_code.map(|exit_code| ContainerState {
+        terminated: Some(ContainerStateTerminated { exit_code, reason: r.reason.clone(), ..Default::default() }),
+        ..Default::default()
+    }));
+
+    // podman names containers <pod>-<container>
+    ContainerStatus {
+        name: container.names.strip_prefix(&format!("{}-", pod_name)).unwrap_or(container.names.as_str()).to_string(),
+        container_id: Some(format!("podman://{}", container.id)),
+        ready: container.is_ready(),
+        restart_count: (container.restart_count.unwrap_or(0) + restart.map(|r| r.restarts as usize).unwrap_or(0)) as i32,
+        started: Some(container.status == "running"),
+        state: Some(state),
+        last_state,
+        ..Default::default()
     }
 }
 
 
 async fn get_pod(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
-    let lister = PodLister {};
-    get_objects(global_args, args, &lister).await
+    let lister = PodLister { all_namespaces: args.all_namespaces };
+    match args.watch {
+        true => watch_pods(args, &lister).await,
+        false => get_objects(global_args, args, &lister).await
+    }
+}
+
+// kubectl's get -w: everything once, then each pod again whenever what's shown for it changes. pods on nodes that
+// can't be reached show as Unknown until they can be again, a connection that dies mid-poll is dropped by its
+// keepalive
+async fn watch_pods(args: GetObjectArgs, lister: &PodLister) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let mut args = args;
+    args.namespace = match args.all_namespaces {
+        true => None,
+        false => Some(cluster.namespace(args.namespace.clone()))
+    };
+
+    let interval = Duration::from_secs(args.watch_interval.max(1));
+    // kept between polls, reconnecting only to nodes whose connection dropped
+    let mut conns: Option<SshClients> = None;
+    let mut last_errors = String::new();
+    // what was last printed for each pod by (namespace, name), and its object for -o
+    let mut seen: BTreeMap<(String, String), (String, Option<Value>)> = BTreeMap::new();
+    let mut first = true;
+
+    loop {
+        let (connected, errors) = ssh::reconnect(cluster, conns.take()).await;
+        // the same nodes failing on every poll is only worth saying once
+        let described = errors.as_ref().map(|e| e.to_string()).unwrap_or_default();
+        match errors {
+            Some(e) if described != last_errors => e.log(),
+            _ => {}
+        }
+        last_errors = described;
+        conns = connected;
+
+        let state = match conns.as_ref() {
+            Some(conns) => refreshed_state(&cluster.name, conns, &config).await?,
+            // nothing could be reached, all there is is what was last seen of each node
+            None => {
+                let mut state = ClusterState::load(&cluster.name)?;
+                state.nodes.iter_mut().for_each(|n| n.status = NodeStatus::Unknown);
+                state
+            }
+        };
+
+        let unreachable: HashSet<String> = state.filter_pods(&|_| true).into_iter()
+            .filter(|(_, n)| n.status == NodeStatus::Unknown)
+            .map(|(p, _)| p.id).collect();
+
+        let mut current = BTreeMap::new();
+        for (pod, restarts) in lister.list(&args, &state) {
+            let unknown = unreachable.contains(&pod.id);
+            let status = match unknown {
+                true => "Unknown".to_string(),
+                false => pod_status(&pod, &restarts)
+            };
+            let row = lister.row(&pod, &restarts, &status);
+            let object = match args.output {
+                Some(_) => lister.objects(vec![(pod.clone(), restarts.clone())], &state).into_iter().next().map(|mut o| {
+                    if unknown {
+                        o["status"]["phase"] = json!("Unknown");
+                    }
+                    o
+                }),
+                None => None
+            };
+            current.insert((pod.namespace(), pod.name.clone()), (row, object));
+        }
+
+        let mut changes: Vec<(&str, &(String, Option<Value>))> = current.iter().filter_map(|(key, entry)| match seen.get(key) {
+            None => Some(("ADDED", entry)),
+            Some((row, _)) if *row != entry.0 => Some(("MODIFIED", entry)),
+            Some(_) => None
+        }).collect();
+        // like kubectl, pods that are gone are only printed as events
+        if args.output_watch_events {
+            changes.extend(seen.iter().filter(|(key, _)| !current.contains_key(key)).map(|(_, entry)| ("DELETED", entry)));
+        }
+
+        if first && args.output.is_none() {
+            match args.output_watch_events {
+                true => println!("{0: <10}  {1}", "EVENT", lister.header()),
+                false => println!("{}", lister.header())
+            }
+        }
+        for (event, (row, object)) in changes {
+            let event = match args.output_watch_events {
+                true => Some(event),
+                false => None
+            };
+            match (&args.output, object) {
+                (Some(format), Some(object)) => print_watched(format, event, object)?,
+                _ => match event {
+                    Some(event) => println!("{0: <10}  {1}", event, row),
+                    None => println!("{}", row)
+                }
+            }
+        }
+        std::io::stdout().flush()?;
+
+        seen = current;
+        first = false;
+        tokio::time::sleep(interval).await;
+    }
 }
 
-struct DeploymentLister {}
+// one object per change, json on a single line so it can be read line by line. kubectl's watch events wrap the
+// object in {"type": ..., "object": ...}
+fn print_watched(format: &OutputFormat, event: Option<&str>, object: &Value) -> Result<(), Box<dyn Error>> {
+    let value = match event {
+        Some(event) => json!({"type": event, "object": object}),
+        None => object.clone()
+    };
+    match format {
+        OutputFormat::Json => println!("{}", serde_json::to_string(&value)?),
+        OutputFormat::Yaml => print!("---\n{}", serde_yaml::to_string(&value)?),
+        OutputFormat::Name => {
+            let name = format!("pod/{}", object["metadata"]["name"].as_str().unwrap_or(""));
+            match event {
+                Some(event) => println!("{} {}", event, name),
+                None => println!("{}", name)
+            }
+        }
+        OutputFormat::JsonPath(template) => println!("{}", jsonpath(template, &value)?),
+    }
+    Ok(())
+}
 
-impl Lister<(String, PodmanPodInfo)> for DeploymentLister {
-    fn list(&self, args: &GetObjectArgs, state: &ClusterState) -> Vec<(String, PodmanPodInfo)> {
+struct DeploymentLister {
+    all_namespaces: bool,
+}
+
+// (deployment name, desired replicas, pod)
+impl Lister<(String, Option<i32>, PodmanPodInfo)> for DeploymentLister {
+    fn list(&self, args: &GetObjectArgs, state: &ClusterState) -> Vec<(String, Option<i32>, PodmanPodInfo)> {
         let pods: Vec<_> = state.nodes.iter().filter_map(|n| {
             let items: Vec<_> = n.host_info.clone()?.system_info?.pods.unwrap_or_default().into_iter().filter_map(|p| {
                 let ns = args.namespace.clone();
@@ -145,20 +604,11 @@ impl Lister<(String, PodmanPodInfo)> for DeploymentLister {
                 let deployment = p.labels.get("skate.io/deployment");
                 match deployment {
                     Some(deployment) => {
-                        let match_ns = match ns.clone() {
-                            Some(ns) => {
-                                ns == p.labels.get("skate.io/namespace").unwrap_or(&"".to_string()).clone()
-                            }
-                            None => false
-                        };
-                        let match_id = match id.clone() {
-                            Some(id) => {
-                                id == deployment.clone()
-                            }
-                            None => false
-                        };
-                        if match_ns || match_id || (id.is_none() && ns.is_none()) {
-                            return Some((deployment.clone(), p));
+                        let match_ns = ns.as_ref().map(|ns| *ns == p.namespace()).unwrap_or(true);
+                        let match_id = id.as_ref().map(|id| id == deployment).unwrap_or(true);
+                        if match_ns && match_id {
+                            let desired = state.desired_replicas(deployment, &p.namespace());
+                            return Some((deployment.clone(), desired, p));
                         }
                         None
                     }
@@ -173,17 +623,19 @@ impl Lister<(String, PodmanPodInfo)> for DeploymentLister {
         pods
     }
 
-    fn print(&self, items: Vec<(String, PodmanPodInfo)>) {
+    fn print(&self, items: Vec<(String, Option<i32>, PodmanPodInfo)>) {
+        print!("{}", namespace_column(self.all_namespaces, "NAMESPACE"));
         println!(
-            "{0: <30}  {1: <10}  {2: <10}  {3: <10}  {4: <30}",
-            "NAME", "READY", "STATUS", "RESTARTS", "CREATED"
+            "{0: <30}  {1: <10}  {2: <10}  {3: <10}  {4: <10}  {5: <10}  {6: <30}",
+            "NAME", "DESIRED", "CURRENT", "READY", "STATUS", "RESTARTS", "CREATED"
         );
-        let pods = items.into_iter().fold(HashMap::<String, Vec<PodmanPodInfo>>::new(), |mut acc, (depl, pod)| {
-            acc.entry(depl).or_insert(vec![]).push(pod);
+        let pods = items.into_iter().fold(HashMap::<(String, String), (Option<i32>, Vec<PodmanPodInfo>)>::new(), |mut acc, (depl, desired, pod)| {
+            let entry = acc.entry((pod.namespace(), depl)).or_insert((desired, vec![]));
+            entry.1.push(pod);
             acc
         });
 
-        for (deployment, pods) in pods {
+        for ((namespace, deployment), (desired, pods)) in pods {
             let health_pods = pods.iter().filter(|p| PodmanPodStatus::Running == p.status).collect_vec().len();
             let all_pods = pods.len();
             let created = pods.iter().fold(Local::now(), |acc, item| {
@@ -193,21 +645,51 @@ impl Lister<(String, PodmanPodInfo)> for DeploymentLister {
                 return acc;
             });
 
+            print!("{}", namespace_column(self.all_namespaces, &namespace));
             println!(
-                "{0: <30}  {1: <10}  {2: <10}  {3: <10}  {4: <30}",
-                deployment, format!("{}/{}", health_pods, all_pods), "", "", created.to_rfc3339_opts(SecondsFormat::Secs, true)
+                "{0: <30}  {1: <10}  {2: <10}  {3: <10}  {4: <10}  {5: <10}  {6: <30}",
+                deployment, desired.map(|d| d.to_string()).unwrap_or("-".to_string()), all_pods,
+                format!("{}/{}", health_pods, all_pods), "", "", created.to_rfc3339_opts(SecondsFormat::Secs, true)
             )
         }
     }
+
+    fn objects(&self, items: Vec<(String, Option<i32>, PodmanPodInfo)>, state: &ClusterState) -> Vec<Value> {
+        let grouped = items.into_iter().map(|(name, _, pod)| ((pod.namespace(), name), pod)).into_group_map();
+
+        grouped.into_iter().map(|((ns, name), pods)| {
+            let mut deployment = state.locate_stored_deployment(&name, &ns).unwrap_or_else(|| Deployment {
+                metadata: ObjectMeta {
+                    name: Some(name.clone()),
+                    namespace: Some(ns.clone()),
+                    ..Default::default()
+                },
+                ..Default::default()
+            });
+
+            let revision = deployment.spec.as_ref().map(|s| template_revision(&s.template));
+            deployment.status = Some(DeploymentStatus {
+                replicas: Some(pods.len() as i32),
+                ready_replicas: Some(pods.iter().filter(|p| p.is_ready()).count() as i32),
+                available_replicas: Some(pods.iter().filter(|p| p.status == PodmanPodStatus::Running).count() as i32),
+                updated_replicas: revision.map(|r| pods.iter().filter(|p| p.labels.get("skate.io/revision") == Some(&r)).count() as i32),
+                ..Default::default()
+            });
+
+            serde_json::to_value(&deployment).unwrap_or(Value::Null)
+        }).collect()
+    }
 }
 
 async fn get_deployment(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
-    let lister = DeploymentLister {};
+    let lister = DeploymentLister { all_namespaces: args.all_namespaces };
     get_objects(global_args, args, &lister).await
 }
 
 
-struct NodeLister {}
+struct NodeLister {
+    show_labels: bool,
+}
 
 impl Lister<NodeState> for NodeLister {
     fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<NodeState> {
@@ -225,10 +707,26 @@ impl Lister<NodeState> for NodeLister {
 
     fn print(&self, items: Vec<NodeState>) {
         println!(
-            "{0: <30}  {1: <10}  {2: <10}",
-            "NAME", "PODS", "STATUS"
+            "{0: <30}  {1: <10}  {2: <10}  {3: <15}  {4: <15}{5}",
+            "NAME", "PODS", "STATUS", "CPU", "MEMORY", match self.show_labels {
+                true => "  LABELS",
+                false => ""
+            }
         );
         for node in items {
+            let labels = match self.show_labels {
+                true => format!("  {}", node.all_labels().iter().map(|(k, v)| format!("{}={}", k, v)).join(",")),
+                false => "".to_string()
+            };
+            // requested by pods / what they may request of the node
+            let (cpu_allocated, memory_allocated) = node.allocated();
+            let (cpu, memory) = match node.allocatable() {
+                Some((cpu, memory)) => (
+                    format!("{}m/{}m", cpu_allocated, cpu),
+                    format!("{}Mi/{}Mi", memory_allocated / (1024 * 1024), memory / (1024 * 1024))
+                ),
+                None => ("-".to_string(), "-".to_string())
+            };
             let num_pods = match node.host_info {
                 Some(hi) => match hi.system_info {
                     Some(si) => match si.pods {
@@ -239,16 +737,374 @@ impl Lister<NodeState> for NodeLister {
                 }
                 _ => 0
             };
+            let status = match node.unschedulable {
+                true => format!("{},SchedulingDisabled", node.status),
+                false => node.status.to_string()
+            };
             println!(
-                "{0: <30}  {1: <10}  {2: <10}",
-                node.node_name, num_pods, node.status
+                "{0: <30}  {1: <10}  {2: <10}  {3: <15}  {4: <15}{5}",
+                node.node_name, num_pods, status, cpu, memory, labels
             )
         }
     }
+
+    fn objects(&self, nodes: Vec<NodeState>, _state: &ClusterState) -> Vec<Value> {
+        nodes.into_iter().map(|n| {
+            let node: K8sNode = n.into();
+            serde_json::to_value(&node).unwrap_or(Value::Null)
+        }).collect()
+    }
 }
 
 async fn get_nodes(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
-    let lister = NodeLister {};
+    let lister = NodeLister { show_labels: args.show_labels };
+    get_objects(global_args, args, &lister).await
+}
+
+
+struct StatefulSetLister {
+    all_namespaces: bool,
+}
+
+// (statefulset, its pods)
+impl Lister<(StatefulSet, Vec<PodmanPodInfo>)> for StatefulSetLister {
+    fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<(StatefulSet, Vec<PodmanPodInfo>)> {
+        let id = match filters.id.clone() {
+            Some(cmd) => match cmd {
+                IdCommand::Id(ids) => ids.into_iter().next()
+            }
+            None => None
+        };
+
+        state.resources.iter().filter_map(|r| match r {
+            SupportedResources::StatefulSet(sts) => {
+                let name = sts.metadata.name.clone().unwrap_or_default();
+                let ns = sts.metadata.namespace.clone().unwrap_or_default();
+                let match_ns = filters.namespace.as_ref().map(|f| *f == ns).unwrap_or(true);
+                let match_id = id.as_ref().map(|f| *f == name).unwrap_or(true);
+                if !(match_ns && match_id) {
+                    return None;
+                }
+
+                let pods = state.locate_statefulset(&name, &ns).into_iter().map(|(p, _)| p).collect();
+                Some((sts.clone(), pods))
+            }
+            _ => None
+        }).collect()
+    }
+
+    fn print(&self, items: Vec<(StatefulSet, Vec<PodmanPodInfo>)>) {
+        print!("{}", namespace_column(self.all_namespaces, "NAMESPACE"));
+        println!(
+            "{0: <30}  {1: <10}  {2: <30}",
+            "NAME", "READY", "CREATED"
+        );
+        for (sts, pods) in items {
+            let replicas = sts.spec.as_ref().and_then(|s| s.replicas).unwrap_or(1);
+            let ready = pods.iter().filter(|p| p.is_ready()).count();
+            let created = pods.iter().map(|p| p.created).min();
+
+            print!("{}", namespace_column(self.all_namespaces, &sts.metadata.namespace.clone().unwrap_or_default()));
+            println!(
+                "{0: <30}  {1: <10}  {2: <30}",
+                sts.metadata.name.clone().unwrap_or_default(),
+                format!("{}/{}", ready, replicas),
+                created.map(|c| c.to_rfc3339_opts(SecondsFormat::Secs, true)).unwrap_or("-".to_string())
+            )
+        }
+    }
+
+    fn objects(&self, items: Vec<(StatefulSet, Vec<PodmanPodInfo>)>, _state: &ClusterState) -> Vec<Value> {
+        items.into_iter().map(|(mut sts, pods)| {
+            let revision = sts.spec.as_ref().map(|s| template_revision(&s.template));
+            sts.status = Some(StatefulSetStatus {
+                replicas: pods.len() as i32,
+                ready_replicas: Some(pods.iter().filter(|p| p.is_ready()).count() as i32),
+                available_replicas: Some(pods.iter().filter(|p| p.status == PodmanPodStatus::Running).count() as i32),
+                updated_replicas: revision.map(|r| pods.iter().filter(|p| p.labels.get("skate.io/revision") == Some(&r)).count() as i32),
+                ..Default::default()
+            });
+            serde_json::to_value(&sts).unwrap_or(Value::Null)
+        }).collect()
+    }
+}
+
+async fn get_statefulsets(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
+    let lister = StatefulSetLister { all_namespaces: args.all_namespaces };
+    get_objects(global_args, args, &lister).await
+}
+
+struct JobLister {
+    all_namespaces: bool,
+}
+
+// (job, exit code of its most recent finished pod)
+impl Lister<(Job, Option<i32>)> for JobLister {
+    fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<(Job, Option<i32>)> {
+        let id = match filters.id.clone() {
+            Some(cmd) => match cmd {
+                IdCommand::Id(ids) => ids.into_iter().next()
+            }
+            None => None
+        };
+
+        state.resources.iter().filter_map(|r| match r {
+            SupportedResources::Job(job) => {
+                let name = job.metadata.name.clone().unwrap_or_default();
+                let ns = job.metadata.namespace.clone().unwrap_or_default();
+                let match_ns = filters.namespace.as_ref().map(|f| *f == ns).unwrap_or(true);
+                let match_id = id.as_ref().map(|f| *f == name).unwrap_or(true);
+                if !(match_ns && match_id) {
+                    return None;
+                }
+
+                let exit_code = state.locate_job(&name, &ns).into_iter()
+                    .filter_map(|(p, _)| p.exit_code().map(|c| (p.created, c)))
+                    .max_by_key(|(created, _)| created.clone())
+                    .map(|(_, c)| c);
+                Some((job.clone(), exit_code))
+            }
+            _ => None
+        }).collect()
+    }
+
+    fn print(&self, items: Vec<(Job, Option<i32>)>) {
+        print!("{}", namespace_column(self.all_namespaces, "NAMESPACE"));
+        println!(
+            "{0: <30}  {1: <12}  {2: <10}  {3: <10}  {4: <30}",
+            "NAME", "COMPLETIONS", "STATUS", "EXIT CODE", "STARTED"
+        );
+        for (job, exit_code) in items {
+            let completions = job.spec.as_ref().and_then(|s| s.completions).unwrap_or(1);
+            let status = job.status.clone().unwrap_or_default();
+            let condition = status.conditions.clone().unwrap_or_default().into_iter()
+                .find(|c| c.status == "True")
+                .map(|c| c.type_)
+                .unwrap_or(match status.active.unwrap_or(0) {
+                    0 => "Pending".to_string(),
+                    _ => "Running".to_string()
+                });
+            // successful pods are cleaned up so there may be nothing left to ask
+            let exit_code = match (exit_code, condition.as_str()) {
+                (Some(code), _) => code.to_string(),
+                (None, "Complete") => "0".to_string(),
+                _ => "-".to_string()
+            };
+
+            print!("{}", namespace_column(self.all_namespaces, &job.metadata.namespace.clone().unwrap_or_default()));
+            println!(
+                "{0: <30}  {1: <12}  {2: <10}  {3: <10}  {4: <30}",
+                job.metadata.name.clone().unwrap_or_default(),
+                format!("{}/{}", status.succeeded.unwrap_or(0), completions),
+                condition,
+                exit_code,
+                status.start_time.map(|t| t.0.to_rfc3339_opts(SecondsFormat::Secs, true)).unwrap_or("-".to_string())
+            )
+        }
+    }
+
+    // the stored job already carries the status reconcile keeps up to date
+    fn objects(&self, items: Vec<(Job, Option<i32>)>, _state: &ClusterState) -> Vec<Value> {
+        items.into_iter().map(|(job, _)| serde_json::to_value(&job).unwrap_or(Value::Null)).collect()
+    }
+}
+
+async fn get_jobs(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
+    let lister = JobLister { all_namespaces: args.all_namespaces };
+    get_objects(global_args, args, &lister).await
+}
+
+
+struct EventLister {
+    all_namespaces: bool,
+}
+
+impl Lister<Event> for EventLister {
+    fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<Event> {
+        state.events.iter().filter(|e| {
+            let match_ns = filters.namespace.as_ref().map(|ns| *ns == e.namespace).unwrap_or(true);
+            let match_resource = filters.resource.as_ref().map(|r| e.concerns(r)).unwrap_or(true);
+            match_ns && match_resource
+        }).cloned().sorted_by_key(|e| e.time).collect()
+    }
+
+    fn print(&self, events: Vec<Event>) {
+        print!("{}", namespace_column(self.all_namespaces, "NAMESPACE"));
+        println!(
+            "{0: <22}  {1: <8}  {2: <20}  {3: <30}  {4: <15}  {5}",
+            "LAST SEEN", "TYPE", "REASON", "OBJECT", "NODE", "MESSAGE"
+        );
+        for event in events {
+            print!("{}", namespace_column(self.all_namespaces, &event.namespace));
+            println!(
+                "{0: <22}  {1: <8}  {2: <20}  {3: <30}  {4: <15}  {5}",
+                event.time.with_timezone(&Local).to_rfc3339_opts(SecondsFormat::Secs, true),
+                event.type_,
+                event.reason,
+                event.object,
+                event.node.unwrap_or("-".to_string()),
+                event.message
+            )
+        }
+    }
+
+    fn objects(&self, events: Vec<Event>, _state: &ClusterState) -> Vec<Value> {
+        events.into_iter().map(|e| {
+            let (kind, name) = e.object.split_once('/').unwrap_or(("pod", e.object.as_str()));
+            let kind = match kind {
+                "pod" => "Pod",
+                "deployment" => "Deployment",
+                "daemonset" => "DaemonSet",
+                "statefulset" => "StatefulSet",
+                "job" => "Job",
+                "node" => "Node",
+                "horizontalpodautoscaler" => "HorizontalPodAutoscaler",
+                other => other
+            };
+            let event = K8sEvent {
+                // unique the same way kubernetes does it, <object>.<timestamp in hex>
+                metadata: ObjectMeta {
+                    name: Some(format!("{}.{:x}", name, e.time.timestamp_millis())),
+                    namespace: Some(e.namespace.clone()),
+                    ..Default::default()
+                },
+                involved_object: ObjectReference {
+                    kind: Some(kind.to_string()),
+                    name: Some(name.to_string()),
+                    namespace: Some(e.namespace.clone()),
+                    ..Default::default()
+                },
+                reason: Some(e.reason.clone()),
+                message: Some(e.message.clone()),
+                type_: Some(e.type_.to_string()),
+                count: Some(1),
+                first_timestamp: Some(Time(e.time)),
+                last_timestamp: Some(Time(e.time)),
+                source: Some(EventSource {
+                    component: Some("skate".to_string()),
+                    host: e.node.clone(),
+                }),
+                ..Default::default()
+            };
+            serde_json::to_value(&event).unwrap_or(Value::Null)
+        }).collect()
+    }
+}
+
+async fn get_events(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
+    let lister = EventLister { all_namespaces: args.all_namespaces };
     get_objects(global_args, args, &lister).await
 }
 
+struct SecretLister {
+    show_values: bool,
+    all_namespaces: bool,
+}
+
+// (secret as stored, decrypted when its values are to be shown)
+impl Lister<(Secret, Option<Secret>)> for SecretLister {
+    fn list(&self, filters: &GetObjectArgs, state: &ClusterState) -> Vec<(Secret, Option<Secret>)> {
+        let id = match filters.id.clone() {
+            Some(cmd) => match cmd {
+                IdCommand::Id(ids) => ids.into_iter().next()
+            }
+            None => None
+        };
+
+        state.resources.iter().filter_map(|r| match r {
+            SupportedResources::Secret(secret) => {
+                let name = secret.metadata.name.clone().unwrap_or_default();
+                let ns = secret.metadata.namespace.clone().unwrap_or_default();
+                let match_ns = filters.namespace.as_ref().map(|f| *f == ns).unwrap_or(true);
+                let match_id = id.as_ref().map(|f| *f == name).unwrap_or(true);
+                if !(match_ns && match_id) {
+                    return None;
+                }
+
+                let decrypted = match self.show_values {
+                    true => match secret::decrypt(secret, state.secret_key.as_ref()) {
+                        Ok(decrypted) => Some(decrypted),
+                        Err(e) => {
+                            eprintln!("{}", e);
+                            None
+                        }
+                    },
+                    false => None
+                };
+                Some((secret.clone(), decrypted))
+            }
+            _ => None
+        }).collect()
+    }
+
+    fn print(&self, items: Vec<(Secret, Option<Secret>)>) {
+        print!("{}", namespace_column(self.all_namespaces, "NAMESPACE"));
+        println!(
+            "{0: <30}  {1: <36}  {2: <10}  {3}",
+            "NAME", "TYPE", "ENCRYPTED", "KEYS"
+        );
+        for (secret, _) in &items {
+            print!("{}", namespace_column(self.all_namespaces, &secret.metadata.namespace.clone().unwrap_or_default()));
+            println!(
+                "{0: <30}  {1: <36}  {2: <10}  {3}",
+                secret.metadata.name.clone().unwrap_or_default(),
+                secret.type_.clone().unwrap_or("Opaque".to_string()),
+                match secret::is_encrypted(secret) {
+                    true => "yes",
+                    false => "no"
+                },
+                secret_keys(secret).join(",")
+            )
+        }
+
+        for (secret, decrypted) in items {
+            match decrypted {
+                Some(decrypted) => {
+                    println!("\n{}:", secret.metadata.name.clone().unwrap_or_default());
+                    for (k, v) in decrypted.data.clone().unwrap_or_default() {
+                        println!("  {}={}", k, String::from_utf8_lossy(&v.0));
+                    }
+                    for (k, v) in decrypted.string_data.clone().unwrap_or_default() {
+                        println!("  {}={}", k, v);
+                    }
+                }
+                None => {}
+            }
+        }
+    }
+
+    // no values unless they were asked for, the keys are left with nulls
+    fn objects(&self, items: Vec<(Secret, Option<Secret>)>, _state: &ClusterState) -> Vec<Value> {
+        items.into_iter().map(|(secret, decrypted)| match decrypted {
+            Some(decrypted) => serde_json::to_value(&decrypted).unwrap_or(Value::Null),
+            None => {
+                let keys = secret_keys(&secret);
+                let mut secret = secret;
+                secret.string_data = None;
+                let mut value = serde_json::to_value(&secret).unwrap_or(Value::Null);
+                value["data"] = Value::Object(keys.into_iter().map(|k| (k, Value::Null)).collect());
+                value
+            }
+        }).collect()
+    }
+}
+
+fn secret_keys(secret: &Secret) -> Vec<String> {
+    secret.data.iter().flatten().map(|(k, _)| k.clone())
+        .chain(secret.string_data.iter().flatten().map(|(k, _)| k.clone()))
+        .sorted().dedup().collect()
+}
+
+async fn get_secrets(global_args: GetArgs, args: GetObjectArgs) -> Result<(), Box<dyn Error>> {
+    if args.show_values {
+        eprint!("Secret values will be printed in plain text. Type yes to continue: ");
+        std::io::stderr().flush()?;
+        let mut answer = String::new();
+        std::io::stdin().read_line(&mut answer)?;
+        if answer.trim() != "yes" {
+            return Err(anyhow!("not confirmed, no values shown").into());
+        }
+    }
+    let lister = SecretLister { show_values: args.show_values, all_namespaces: args.all_namespaces };
+    get_objects(global_args, args, &lister).await
+}
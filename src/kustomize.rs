@@ -0,0 +1,397 @@
+use std::collections::HashMap;
+use std::error::Error;
+use std::fs;
+use std::path::{Path, PathBuf};
+use anyhow::anyhow;
+use clap::Args;
+use serde::Deserialize;
+use serde_yaml::{Mapping, Value};
+
+#[derive(Debug, Clone, Default, Args)]
+pub struct RenderArgs {
+    #[arg(short = 'k', long, long_help = "Directory with a kustomization.yaml: its resources, with the patches, images, \
+replicas and namespace it sets applied on top.")]
+    pub kustomize: Option<String>,
+    #[arg(long, long_help = "Substitute ${KEY} in the manifests with VALUE, given as KEY=VALUE. Can be given more than once.")]
+    pub set: Vec<String>,
+    #[arg(long, long_help = "File of KEY=VALUE lines to substitute ${KEY} with, --set wins over it.")]
+    pub env_file: Option<String>,
+}
+
+#[derive(Debug, Args)]
+pub struct BuildArgs {
+    #[arg(short, long, long_help = "Manifests to render along with the kustomization.")]
+    filename: Vec<String>,
+    #[command(flatten)]
+    render: RenderArgs,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(rename_all = "camelCase", default, deny_unknown_fields)]
+struct Kustomization {
+    // only there to be allowed
+    #[allow(dead_code)]
+    api_version: Option<String>,
+    #[allow(dead_code)]
+    kind: Option<String>,
+    namespace: Option<String>,
+    resources: Vec<String>,
+    patches: Vec<Patch>,
+    patches_strategic_merge: Vec<String>,
+    images: Vec<ImageOverride>,
+    replicas: Vec<ReplicaOverride>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(rename_all = "camelCase", default, deny_unknown_fields)]
+struct Patch {
+    path: Option<String>,
+    patch: Option<String>,
+    target: Option<PatchTarget>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+struct PatchTarget {
+    kind: Option<String>,
+    name: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase", deny_unknown_fields)]
+struct ImageOverride {
+    name: String,
+    new_name: Option<String>,
+    new_tag: Option<String>,
+    digest: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ReplicaOverride {
+    name: String,
+    count: i64,
+}
+
+const KUSTOMIZATION_FILES: [&str; 3] = ["kustomization.yaml", "kustomization.yml", "Kustomization"];
+
+// --set on top of the env file
+fn variables(args: &RenderArgs) -> Result<HashMap<String, String>, Box<dyn Error>> {
+    let mut vars = HashMap::new();
+    match &args.env_file {
+        Some(env_file) => {
+            let contents = fs::read_to_string(env_file).map_err(|e| anyhow!(e).context(format!("failed to read {}", env_file)))?;
+            for (i, line) in contents.lines().enumerate() {
+                let line = line.trim();
+                if line.is_empty() || line.starts_with('#') {
+                    continue;
+                }
+                let (key, value) = line.split_once('=').ok_or(anyhow!("{}:{}: expected KEY=VALUE", env_file, i + 1))?;
+                let value = value.trim();
+                let value = value.strip_prefix('"').and_then(|v| v.strip_suffix('"')).unwrap_or(value);
+                vars.insert(key.trim().to_string(), value.to_string());
+            }
+        }
+        None => {}
+    }
+    for set in &args.set {
+        let (key, value) = set.split_once('=').ok_or(anyhow!("invalid --set {}, expected KEY=VALUE", set))?;
+        vars.insert(key.to_string(), value.to_string());
+    }
+    Ok(vars)
+}
+
+// ${KEY} becomes its value and $${ a literal ${. nothing is touched without any variables, otherwise keys that aren't
+// set are errors, so a typo doesn't go out as the text of the placeholder
+fn substitute(name: &str, contents: &str, vars: &HashMap<String, String>) -> Result<String, Box<dyn Error>> {
+    if vars.is_empty() {
+        return Ok(contents.to_string());
+    }
+    let mut result = String::with_capacity(contents.len());
+    let mut missing: Vec<String> = vec!();
+    let mut rest = contents;
+    while let Some(i) = rest.find('$') {
+        result.push_str(&rest[..i]);
+        rest = &rest[i..];
+        if rest.starts_with("$${") {
+            result.push_str("${");
+            rest = &rest[3..];
+            continue;
+        }
+        let key = match rest.starts_with("${") {
+            true => rest[2..].find('}').map(|end| &rest[2..2 + end]),
+            false => None
+        };
+        match key {
+            Some(key) if !key.is_empty() && key.chars().all(|c| c.is_ascii_alphanumeric() || c == '_') => {
+                match vars.get(key) {
+                    Some(value) => result.push_str(value),
+                    None => {
+                        missing.push(key.to_string());
+                        result.push_str(&rest[..key.len() + 3]);
+                    }
+                }
+                rest = &rest[key.len() + 3..];
+            }
+            _ => {
+                result.push('$');
+                rest = &rest[1..];
+            }
+        }
+    }
+    result.push_str(rest);
+
+    match missing.len() {
+        0 => Ok(result),
+        _ => {
+            missing.sort();
+            missing.dedup();
+            Err(anyhow!("{}: no value for {}, use --set or --env-file", name, missing.iter().map(|k| format!("${{{}}}", k)).collect::<Vec<_>>().join(", ")).into())
+        }
+    }
+}
+
+fn documents(name: &str, contents: &str) -> Result<Vec<Value>, Box<dyn Error>> {
+    let documents = serde_yaml::Deserializer::from_str(contents).map(Value::deserialize).collect::<Result<Vec<_>, _>>()
+        .map_err(|e| anyhow!("{}: {}", name, e))?;
+    Ok(documents.into_iter().filter(|d| !d.is_null()).collect())
+}
+
+fn read_file(path: &Path, vars: &HashMap<String, String>) -> Result<String, Box<dyn Error>> {
+    let name = path.display().to_string();
+    let contents = fs::read_to_string(path).map_err(|e| anyhow!(e).context(format!("failed to read {}", name)))?;
+    substitute(&name, &contents, vars)
+}
+
+// a strategic merge in the small: mappings are merged, lists of named objects (containers, env, volumes..) are merged
+// by name, anything else is replaced. a null removes the field
+fn merge(base: &mut Value, patch: &Value) {
+    match (base, patch) {
+        (Value::Mapping(base), Value::Mapping(patch)) => {
+            for (key, value) in patch {
+                if value.is_null() {
+                    base.remove(key);
+                    continue;
+                }
+                match base.get_mut(key) {
+                    Some(existing) => merge(existing, value),
+                    None => {
+                        base.insert(key.clone(), value.clone());
+                    }
+                }
+            }
+        }
+        (Value::Sequence(base), Value::Sequence(patch)) if named(base.as_slice()) && named(patch) => {
+            for item in patch {
+                match base.iter_mut().find(|b| b.get("name") == item.get("name")) {
+                    Some(existing) => merge(existing, item),
+                    None => base.push(item.clone())
+                }
+            }
+        }
+        (base, patch) => *base = patch.clone()
+    }
+}
+
+fn named(items: &[Value]) -> bool {
+    items.iter().all(|i| i.get("name").and_then(Value::as_str).is_some())
+}
+
+fn kind_and_name(resource: &Value) -> (Option<&str>, Option<&str>) {
+    (resource.get("kind").and_then(Value::as_str), resource.get("metadata").and_then(|m| m.get("name")).and_then(Value::as_str))
+}
+
+fn apply_patch(resources: &mut Vec<Value>, patch: &Value, target: Option<&PatchTarget>) -> Result<(), Box<dyn Error>> {
+    if patch.is_sequence() {
+        return Err(anyhow!("json6902 patches aren't supported, only strategic merge ones").into());
+    }
+    let (patch_kind, patch_name) = kind_and_name(patch);
+    // the target defaults to whatever the patch itself names
+    let kind = target.and_then(|t| t.kind.as_deref()).or(patch_kind);
+    let name = target.and_then(|t| t.name.as_deref()).or(patch_name);
+
+    let mut matched = 0;
+    for resource in resources.iter_mut() {
+        let (resource_kind, resource_name) = kind_and_name(resource);
+        if kind.is_some() && kind != resource_kind {
+            continue;
+        }
+        if name.is_some() && name != resource_name {
+            continue;
+        }
+        merge(resource, patch);
+        matched += 1;
+    }
+    match matched {
+        0 => Err(anyhow!("patch for {} {} matches no resource", kind.unwrap_or("*"), name.unwrap_or("*")).into()),
+        _ => Ok(())
+    }
+}
+
+// the image without its tag or digest, and the tag
+fn split_image(image: &str) -> (&str, Option<&str>) {
+    let image = image.split('@').next().unwrap_or(image);
+    match image.rfind(':') {
+        // a colon before the last slash is a registry port
+        Some(i) if !image[i..].contains('/') => (&image[..i], Some(&image[i + 1..])),
+        _ => (image, None)
+    }
+}
+
+fn override_image(image: &str, images: &[ImageOverride]) -> Option<String> {
+    let (name, tag) = split_image(image);
+    let matching = images.iter().find(|i| i.name == name)?;
+    let new_name = matching.new_name.as_deref().unwrap_or(name);
+    Some(match (&matching.digest, matching.new_tag.as_deref().or(tag)) {
+        (Some(digest), _) => format!("{}@{}", new_name, digest),
+        (None, Some(tag)) => format!("{}:{}", new_name, tag),
+        (None, None) => new_name.to_string()
+    })
+}
+
+// containers are found wherever they are, a pod's spec, a template's or a job template's
+fn override_images(value: &mut Value, images: &[ImageOverride]) {
+    match value {
+        Value::Mapping(mapping) => {
+            for (key, value) in mapping.iter_mut() {
+                match (key.as_str(), value) {
+                    (Some("containers") | Some("initContainers"), Value::Sequence(containers)) => {
+                        for container in containers {
+                            let image = container.get("image").and_then(Value::as_str).and_then(|i| override_image(i, images));
+                            match (image, container.as_mapping_mut()) {
+                                (Some(image), Some(container)) => {
+                                    container.insert(Value::String("image".to_string()), Value::String(image));
+                                }
+                                _ => {}
+                            }
+                        }
+                    }
+                    (_, value) => override_images(value, images)
+                }
+            }
+        }
+        Value::Sequence(items) => {
+            for item in items {
+                override_images(item, images)
+            }
+        }
+        _ => {}
+    }
+}
+
+fn set_field(resource: &mut Value, section: &str, key: &str, value: Value) {
+    let mapping = match resource.as_mapping_mut() {
+        Some(mapping) => mapping,
+        None => return
+    };
+    let section = mapping.entry(Value::String(section.to_string())).or_insert(Value::Mapping(Mapping::new()));
+    match section.as_mapping_mut() {
+        Some(section) => {
+            section.insert(Value::String(key.to_string()), value);
+        }
+        None => {}
+    }
+}
+
+// a kustomization's resources with its own changes on top. bases are built the same way, so each overlay works on
+// what the one below it produced
+fn build_dir(dir: &Path, vars: &HashMap<String, String>, seen: &mut Vec<PathBuf>) -> Result<Vec<Value>, Box<dyn Error>> {
+    let canonical = dir.canonicalize().map_err(|e| anyhow!(e).context(format!("failed to read {}", dir.display())))?;
+    if seen.contains(&canonical) {
+        return Err(anyhow!("kustomization in {} includes itself", dir.display()).into());
+    }
+    seen.push(canonical);
+
+    let file = KUSTOMIZATION_FILES.iter().map(|f| dir.join(f)).find(|p| p.is_file())
+        .ok_or(anyhow!("no kustomization.yaml in {}", dir.display()))?;
+    let kustomization: Kustomization = serde_yaml::from_str(&read_file(&file, vars)?)
+        .map_err(|e| anyhow!("{}: {}", file.display(), e))?;
+
+    let mut resources: Vec<Value> = vec!();
+    for resource in &kustomization.resources {
+        let path = dir.join(resource);
+        match path.is_dir() {
+            true => resources.extend(build_dir(&path, vars, seen)?),
+            false => resources.extend(documents(&path.display().to_string(), &read_file(&path, vars)?)?)
+        }
+    }
+
+    for path in &kustomization.patches_strategic_merge {
+        let path = dir.join(path);
+        let name = path.display().to_string();
+        for patch in documents(&name, &read_file(&path, vars)?)? {
+            apply_patch(&mut resources, &patch, None).map_err(|e| anyhow!("{}: {}", name, e))?;
+        }
+    }
+    for patch in &kustomization.patches {
+        let (name, contents) = match (&patch.path, &patch.patch) {
+            (Some(path), None) => {
+                let path = dir.join(path);
+                (path.display().to_string(), read_file(&path, vars)?)
+            }
+            // inline patches were substituted along with the kustomization
+            (None, Some(inline)) => (file.display().to_string(), inline.clone()),
+            _ => return Err(anyhow!("{}: a patch needs one of path or patch", file.display()).into())
+        };
+        for document in documents(&name, &contents)? {
+            apply_patch(&mut resources, &document, patch.target.as_ref()).map_err(|e| anyhow!("{}: {}", name, e))?;
+        }
+    }
+
+    for resource in resources.iter_mut() {
+        override_images(resource, &kustomization.images);
+
+        let (kind, name) = kind_and_name(resource);
+        let replicas = match kind {
+            Some("Deployment") | Some("StatefulSet") => kustomization.replicas.iter().find(|r| Some(r.name.as_str()) == name),
+            _ => None
+        };
+        match replicas {
+            Some(replicas) => set_field(resource, "spec", "replicas", Value::Number(replicas.count.into())),
+            None => {}
+        }
+
+        match &kustomization.namespace {
+            Some(namespace) => set_field(resource, "metadata", "namespace", Value::String(namespace.clone())),
+            None => {}
+        }
+    }
+
+    seen.pop();
+    Ok(resources)
+}
+
+pub fn render(dir: &str, vars: &HashMap<String, String>) -> Result<String, Box<dyn Error>> {
+    let resources = build_dir(Path::new(dir), vars, &mut vec!())?;
+    let documents = resources.iter().map(serde_yaml::to_string).collect::<Result<Vec<_>, _>>()?;
+    Ok(documents.join("---\n"))
+}
+
+// the manifests to read, along with the name errors are reported against: each -f file with variables substituted,
+// then what the kustomization renders to
+pub fn manifest_sources(filenames: &[String], args: &RenderArgs) -> Result<Vec<(String, String)>, Box<dyn Error>> {
+    if filenames.is_empty() && args.kustomize.is_none() {
+        return Err(anyhow!("no manifests given, use -f or -k").into());
+    }
+    let vars = variables(args)?;
+    let mut sources = vec!();
+    for filename in filenames {
+        sources.push((filename.clone(), read_file(Path::new(filename), &vars)?));
+    }
+    match &args.kustomize {
+        // line numbers are in the rendered output, which `skate build` prints
+        Some(dir) => sources.push((format!("{} (rendered)", dir), render(dir, &vars)?)),
+        None => {}
+    }
+    Ok(sources)
+}
+
+pub async fn build(args: BuildArgs) -> Result<(), Box<dyn Error>> {
+    let sources = manifest_sources(&args.filename, &args.render)?;
+    let rendered: Vec<String> = sources.into_iter().map(|(_, contents)| match contents.ends_with('\n') {
+        true => contents,
+        false => format!("{}\n", contents)
+    }).collect();
+    print!("{}", rendered.join("---\n"));
+    Ok(())
+}
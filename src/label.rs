@@ -0,0 +1,113 @@
+use std::collections::BTreeMap;
+use std::error::Error;
+use anyhow::anyhow;
+use clap::{Args, Subcommand};
+use crate::config::Config;
+use crate::refresh::refreshed_state;
+use crate::skate::ConfigFileArgs;
+use crate::ssh;
+use crate::util::CHECKBOX_EMOJI;
+
+#[derive(Debug, Args)]
+pub struct LabelArgs {
+    #[command(subcommand)]
+    command: LabelCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum LabelCommands {
+    #[command(alias("nodes"), about = "label a node", long_about = "Add, update or remove (key-) labels on a node. \
+Pods that no longer match their nodeSelector are moved on the next reconcile.")]
+    Node(LabelNodeArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct LabelNodeArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, long_help = "Allow existing labels to be overwritten.")]
+    overwrite: bool,
+    #[arg(long_help = "Name of the node.")]
+    name: String,
+    #[arg(required = true, long_help = "Labels of the form key=value, or key- to remove one.")]
+    labels: Vec<String>,
+}
+
+pub async fn label(args: LabelArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        LabelCommands::Node(args) => label_node(args).await
+    }
+}
+
+enum LabelChange {
+    Set(String, String),
+    Remove(String),
+}
+
+fn parse_label(label: &str) -> Result<LabelChange, Box<dyn Error>> {
+    let change = match label.split_once('=') {
+        Some((k, v)) => LabelChange::Set(k.to_string(), v.to_string()),
+        None => match label.strip_suffix('-') {
+            Some(k) => LabelChange::Remove(k.to_string()),
+            None => return Err(anyhow!("invalid label {}, expected key=value or key-", label).into())
+        }
+    };
+
+    let key = match &change {
+        LabelChange::Set(k, _) => k,
+        LabelChange::Remove(k) => k,
+    };
+    if key.is_empty() {
+        return Err(anyhow!("invalid label {}, key is empty", label).into());
+    }
+    // these are set by skate from the node's system info
+    if key.starts_with("skate.io/") {
+        return Err(anyhow!("invalid label {}, the skate.io/ prefix is reserved", label).into());
+    }
+    Ok(change)
+}
+
+async fn label_node(args: LabelNodeArgs) -> Result<(), Box<dyn Error>> {
+    let changes = args.labels.iter().map(|l| parse_label(l)).collect::<Result<Vec<_>, _>>()?;
+
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    let node = state.nodes.iter_mut().find(|n| n.node_name == args.name)
+        .ok_or(anyhow!("node {} not found", args.name))?;
+
+    let mut labels: BTreeMap<String, String> = node.labels.clone();
+    for change in changes {
+        match change {
+            LabelChange::Set(k, v) => {
+                match labels.get(&k) {
+                    Some(existing) if *existing != v && !args.overwrite => {
+                        return Err(anyhow!("node {} already has a value ({}) for label {}, use --overwrite", args.name, existing, k).into());
+                    }
+                    _ => {}
+                }
+                labels.insert(k, v);
+            }
+            LabelChange::Remove(k) => {
+                labels.remove(&k);
+            }
+        }
+    }
+    node.labels = labels;
+
+    state.persist()?;
+
+    println!("{} node {} labeled", CHECKBOX_EMOJI, args.name);
+    Ok(())
+}
@@ -14,6 +14,31 @@ mod get;
 mod executor;
 
 mod describe;
+mod reconcile;
+mod autoscaler;
+mod rollout;
+mod logs;
+mod exec;
+mod top;
+mod label;
+mod taint;
+mod diff;
+mod cordon;
+mod metrics;
+mod configmap;
+mod affinity;
+mod validate;
+mod secret;
+mod context;
+mod restart;
+mod port_forward;
+mod kustomize;
+mod downward;
+mod coredns;
+mod logging;
+mod retry;
+mod sidecar;
+mod cluster;
 
 pub use skate::skate;
 pub use skatelet::skatelet;
\ No newline at end of file
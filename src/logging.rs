@@ -0,0 +1,196 @@
+use std::collections::BTreeSet;
+use std::sync::{Mutex, OnceLock};
+use base64::Engine;
+use base64::engine::general_purpose;
+use chrono::{SecondsFormat, Utc};
+use clap::ValueEnum;
+use itertools::Itertools;
+use k8s_openapi::api::core::v1::Secret;
+use serde_json::{Map, Value};
+use strum_macros::Display;
+use crate::skate::SupportedResources;
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, EQUAL_EMOJI, INFO_EMOJI};
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, ValueEnum)]
+pub enum LogFormat {
+    #[default]
+    Text,
+    Json,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Display)]
+#[strum(serialize_all = "lowercase")]
+pub enum Level {
+    Info,
+    Warn,
+    Error,
+}
+
+const REDACTED: &str = "<redacted>";
+// anything shorter would take ordinary words out of messages along with it
+const MIN_SENSITIVE_LEN: usize = 4;
+// base64 this long in a command is a manifest on its way to the skatelet, which can hold secret values
+const MIN_PAYLOAD_LEN: usize = 64;
+const CREDENTIAL_KEYS: [&str; 7] = ["password", "passwd", "token", "secret", "apikey", "api-key", "api_key"];
+
+static FORMAT: OnceLock<LogFormat> = OnceLock::new();
+// values of every secret this invocation has seen, scrubbed from everything logged
+static SENSITIVE: Mutex<BTreeSet<String>> = Mutex::new(BTreeSet::new());
+
+pub fn init(format: LogFormat) {
+    let _ = FORMAT.set(format);
+}
+
+fn format() -> LogFormat {
+    FORMAT.get().cloned().unwrap_or_default()
+}
+
+pub fn is_json() -> bool {
+    format() == LogFormat::Json
+}
+
+// both as is and base64 encoded, the way it's stored in a secret's data
+pub fn sensitive(value: &[u8]) {
+    if value.len() < MIN_SENSITIVE_LEN {
+        return;
+    }
+    let mut values = SENSITIVE.lock().unwrap();
+    values.insert(String::from_utf8_lossy(value).to_string());
+    values.insert(general_purpose::STANDARD.encode(value));
+}
+
+pub fn sensitive_secret(secret: &Secret) {
+    for value in secret.data.iter().flatten().map(|(_, v)| v.0.clone()) {
+        sensitive(&value);
+    }
+    for value in secret.string_data.iter().flatten().map(|(_, v)| v.clone()) {
+        sensitive(value.as_bytes());
+    }
+}
+
+pub fn redact(message: &str) -> String {
+    let values = SENSITIVE.lock().unwrap();
+    // longest first, so a value containing another goes as a whole
+    values.iter().sorted_by_key(|v| std::cmp::Reverse(v.len()))
+        .fold(message.to_string(), |message, value| message.replace(value.as_str(), REDACTED))
+}
+
+fn credential(key: &str) -> bool {
+    let key = key.trim_start_matches('-').to_lowercase();
+    CREDENTIAL_KEYS.iter().any(|c| key.contains(c))
+}
+
+// a command as it can be logged: base64 payloads, the values of anything that looks like a credential (--token x,
+// password=x) and known secret values are taken out
+pub fn redact_command(command: &str) -> String {
+    let redacted = command.lines().map(|line| {
+        let mut hide_next = false;
+        line.split(' ').map(|word| {
+            let bare = word.trim_matches(|c| "\"'|;".contains(c));
+            if hide_next && !bare.is_empty() {
+                hide_next = false;
+                return word.replace(bare, REDACTED);
+            }
+            if bare.len() >= MIN_PAYLOAD_LEN && bare.chars().all(|c| c.is_ascii_alphanumeric() || "+/=".contains(c)) {
+                return word.replace(bare, REDACTED);
+            }
+            match bare.split_once('=') {
+                Some((key, value)) if credential(key) && !value.is_empty() => word.replace(bare, &format!("{}={}", key, REDACTED)),
+                None if bare.starts_with('-') && credential(bare) => {
+                    hide_next = true;
+                    word.to_string()
+                }
+                _ => word.to_string()
+            }
+        }).join(" ")
+    }).join("\n");
+    redact(&redacted)
+}
+
+// the text format leads with one of the status emojis, in json the level says as much
+fn strip_emoji(message: &str) -> &str {
+    [CHECKBOX_EMOJI.to_string(), CROSS_EMOJI.to_string(), EQUAL_EMOJI.to_string(), INFO_EMOJI.to_string()].iter()
+        .find_map(|e| message.strip_prefix(e.as_str()))
+        .map(|m| m.trim_start())
+        .unwrap_or(message)
+}
+
+// one line of skate's own output about what it's doing, plain text or with --log-format=json a json object with the
+// level, timestamp, node, resource and operation alongside the message
+pub struct Entry {
+    level: Level,
+    node: Option<String>,
+    resource: Option<String>,
+    operation: Option<String>,
+    message: String,
+}
+
+impl Entry {
+    fn new(level: Level, message: String) -> Self {
+        Entry { level, node: None, resource: None, operation: None, message }
+    }
+
+    pub fn info(message: impl Into<String>) -> Self {
+        Self::new(Level::Info, message.into())
+    }
+
+    pub fn warn(message: impl Into<String>) -> Self {
+        Self::new(Level::Warn, message.into())
+    }
+
+    pub fn error(message: impl Into<String>) -> Self {
+        Self::new(Level::Error, message.into())
+    }
+
+    pub fn node(mut self, node: &str) -> Self {
+        self.node = Some(node.to_string());
+        self
+    }
+
+    pub fn resource(mut self, resource: &str) -> Self {
+        self.resource = Some(resource.to_string());
+        self
+    }
+
+    // as <kind>/<name>.<namespace>
+    pub fn object(self, object: &SupportedResources) -> Self {
+        let resource = format!("{}/{}", object.to_string().to_lowercase(), object.name());
+        self.resource(&resource)
+    }
+
+    pub fn operation(mut self, operation: &str) -> Self {
+        self.operation = Some(operation.to_string());
+        self
+    }
+
+    fn render(&self) -> String {
+        let message = redact(&self.message);
+        match format() {
+            LogFormat::Text => message,
+            LogFormat::Json => {
+                let mut line = Map::new();
+                line.insert("timestamp".to_string(), Value::String(Utc::now().to_rfc3339_opts(SecondsFormat::Millis, true)));
+                line.insert("level".to_string(), Value::String(self.level.to_string()));
+                for (key, value) in [("node", &self.node), ("resource", &self.resource), ("operation", &self.operation)] {
+                    match value {
+                        Some(value) => {
+                            line.insert(key.to_string(), Value::String(redact(value)));
+                        }
+                        None => {}
+                    }
+                }
+                line.insert("message".to_string(), Value::String(strip_emoji(&message).to_string()));
+                Value::Object(line).to_string()
+            }
+        }
+    }
+
+    // on stdout or stderr, wherever the line went before there was a json format
+    pub fn print(self) {
+        println!("{}", self.render())
+    }
+
+    pub fn eprint(self) {
+        eprintln!("{}", self.render())
+    }
+}
@@ -0,0 +1,214 @@
+use std::error::Error;
+use std::process::Stdio;
+use std::time::Duration;
+use anyhow::anyhow;
+use chrono::{DateTime, FixedOffset, SecondsFormat};
+use clap::Args;
+use colored::Colorize;
+use futures::future::join_all;
+use tokio::io::{AsyncBufReadExt, BufReader};
+use tokio::process::Command;
+use crate::config::{Cluster, Config, Node};
+use crate::refresh::refreshed_state;
+use crate::skate::ConfigFileArgs;
+use crate::skatelet::PodmanPodInfo;
+use crate::ssh;
+use crate::ssh::native_ssh_command;
+use crate::state::state::ClusterState;
+use crate::util::shell_quote;
+
+const MAX_BACKOFF: Duration = Duration::from_secs(30);
+
+#[derive(Debug, Args)]
+pub struct LogArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, short, long_help = "Namespace of the resource, defaults to the context's default_namespace or default.")]
+    namespace: Option<String>,
+    #[arg(long, short, long_help = "Follow log output, reconnecting to nodes that drop.")]
+    follow: bool,
+    #[arg(long, short, long_help = "Only this container's logs, init containers included. Defaults to all of the pod's containers.")]
+    container: Option<String>,
+    #[arg(long, long_help = "Only show logs since a timestamp (eg 2024-01-01T00:00:00Z) or a relative duration (eg 10m).")]
+    since: Option<String>,
+    #[arg(long_help = "Pod name, pod/<name>, deployment/<name>, daemonset/<name> or statefulset/<name>.")]
+    resource: String,
+}
+
+struct LogTarget {
+    prefix: String,
+    node: Node,
+    container: String,
+}
+
+pub(crate) fn locate_resource_pods(state: &ClusterState, resource: &str, ns: &str) -> Result<Vec<(PodmanPodInfo, String)>, Box<dyn Error>> {
+    let pods = match resource.split_once('/') {
+        Some(("deployment", name)) | Some(("deployments", name)) => state.locate_deployment(name, ns),
+        Some(("daemonset", name)) | Some(("daemonsets", name)) => state.filter_pods(&|p| {
+            p.namespace() == ns && p.labels.get("skate.io/daemonset").map(|d| d.as_str()) == Some(name)
+        }),
+        Some(("statefulset", name)) | Some(("statefulsets", name)) => state.locate_statefulset(name, ns),
+        Some(("pod", name)) | Some(("pods", name)) => state.locate_pods(name, ns),
+        Some((kind, _)) => return Err(anyhow!("unsupported resource kind {}", kind).into()),
+        None => state.locate_pods(resource, ns)
+    };
+    Ok(pods.into_iter().map(|(p, n)| (p, n.node_name.clone())).collect())
+}
+
+pub async fn logs(args: LogArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let namespace = cluster.namespace(args.namespace.clone());
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let state = refreshed_state(&cluster.name, &conns, &config).await?;
+    let pods = locate_resource_pods(&state, &args.resource, &namespace)?;
+
+    if pods.len() == 0 {
+        return Err(anyhow!("no pods found for {} in namespace {}", args.resource, namespace).into());
+    }
+
+    // podman names containers <pod>-<container>
+    match &args.container {
+        Some(name) => {
+            let found = pods.iter().any(|(pod, _)| pod.containers.iter().flatten().any(|c| c.names == format!("{}-{}", pod.podman_name(), name)));
+            if !found {
+                return Err(anyhow!("container {} not found in {}", name, args.resource).into());
+            }
+        }
+        None => {}
+    }
+
+    let targets: Vec<_> = pods.into_iter().filter_map(|(pod, node_name)| {
+        let node = cluster.nodes.iter().find(|n| n.name == node_name)?.clone();
+        let containers: Vec<_> = pod.containers.clone().unwrap_or_default().into_iter()
+            .filter(|c| !c.is_infra())
+            .filter(|c| args.container.as_ref().map(|name| c.names == format!("{}-{}", pod.podman_name(), name)).unwrap_or(true))
+            .map(|c| LogTarget {
+                prefix: format!("{}/{}/{}", node_name, pod.name, c.names),
+                node: node.clone(),
+                container: c.names,
+            }).collect();
+        Some(containers)
+    }).flatten().collect();
+
+    join_all(targets.iter().map(|t| stream_logs(cluster, t, args.follow, args.since.clone()))).await;
+
+    Ok(())
+}
+
+// streams a single container's logs, reconnecting with backoff when following
+async fn stream_logs(cluster: &Cluster, target: &LogTarget, follow: bool, since: Option<String>) {
+    let mut since = since;
+    // the last line printed, so a reconnect can leave out what was already seen
+    let mut last_seen = None;
+    let mut backoff = Duration::from_secs(1);
+
+    loop {
+        // when following, lines come with podman's timestamps to resume from, taken off again before printing
+        let follow_arg = match follow {
+            true => " -f --timestamps",
+            false => ""
+        };
+        let since_arg = since.as_ref().map(|s| format!(" --since {}", shell_quote(s))).unwrap_or_default();
+
+        let mut cmd = native_ssh_command(cluster, &target.node);
+        cmd.arg(format!("sudo podman logs{}{} {}", follow_arg, since_arg, shell_quote(&target.container)));
+
+        let result = pipe_lines(cmd, &target.prefix, follow, last_seen).await;
+
+        if !follow {
+            match result {
+                Err(e) => eprintln!("{} | {}", target.prefix.red(), e),
+                _ => {}
+            }
+            return;
+        }
+
+        match result {
+            Ok(Some(last_line)) => {
+                // pick up where we left off rather than replaying everything. --since includes the line itself,
+                // which gets skipped as already seen
+                since = Some(last_line.to_rfc3339_opts(SecondsFormat::Nanos, true));
+                last_seen = Some(last_line);
+                backoff = Duration::from_secs(1);
+            }
+            Ok(None) => {}
+            Err(e) => eprintln!("{} | {}", target.prefix.red(), e)
+        }
+
+        eprintln!("{} | stream closed, reconnecting in {}s", target.prefix.yellow(), backoff.as_secs());
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+    }
+}
+
+// a line as podman logs --timestamps gives it: the time it was logged, then the line
+fn split_timestamp(line: &str) -> Option<(DateTime<FixedOffset>, &str)> {
+    let (timestamp, rest) = line.split_once(' ')?;
+    DateTime::parse_from_rfc3339(timestamp).ok().map(|t| (t, rest))
+}
+
+// prints each line prefixed, leaving out the ones logged no later than `after`. returns when the last line printed
+// was logged
+async fn pipe_lines(mut cmd: Command, prefix: &str, timestamps: bool, after: Option<DateTime<FixedOffset>>) -> Result<Option<DateTime<FixedOffset>>, Box<dyn Error>> {
+    let mut child = cmd.stdout(Stdio::piped()).stderr(Stdio::piped()).kill_on_drop(true).spawn()?;
+
+    let stdout = child.stdout.take().ok_or(anyhow!("failed to read stdout"))?;
+    let stderr = child.stderr.take().ok_or(anyhow!("failed to read stderr"))?;
+    let mut stdout = BufReader::new(stdout).lines();
+    let mut stderr = BufReader::new(stderr).lines();
+
+    let mut last_line = None;
+    let mut stdout_done = false;
+    let mut stderr_done = false;
+
+    // lines without a timestamp are podman's or ssh's own, always shown
+    let mut next = |line: String| -> Option<String> {
+        match split_timestamp(&line).filter(|_| timestamps) {
+            Some((logged, _)) if after.map(|a| logged <= a).unwrap_or(false) => None,
+            Some((logged, rest)) => {
+                last_line = Some(logged);
+                Some(rest.to_string())
+            }
+            None => Some(line)
+        }
+    };
+
+    while !(stdout_done && stderr_done) {
+        tokio::select! {
+            line = stdout.next_line(), if !stdout_done => match line? {
+                Some(line) => match next(line) {
+                    Some(line) => println!("{} | {}", prefix.green(), line),
+                    None => {}
+                },
+                None => stdout_done = true
+            },
+            line = stderr.next_line(), if !stderr_done => match line? {
+                Some(line) => match next(line) {
+                    Some(line) => eprintln!("{} | {}", prefix.green(), line),
+                    None => {}
+                },
+                None => stderr_done = true
+            },
+        }
+    }
+
+    let status = child.wait().await?;
+    match status.success() {
+        true => Ok(last_line),
+        false => match last_line {
+            // a dropped connection after some output should still resume from there
+            Some(_) => Ok(last_line),
+            None => Err(anyhow!("exit code {}", status).into())
+        }
+    }
+}
@@ -0,0 +1,174 @@
+use std::collections::BTreeMap;
+use std::error::Error;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+use crate::scheduler::{OpType, ScheduleResult};
+use crate::skate::SupportedResources;
+use crate::ssh::SshErrors;
+use crate::state::state::ClusterState;
+
+#[derive(Debug, Default)]
+struct MetricsData {
+    reconciles: BTreeMap<String, u64>,
+    last_reconcile_duration: f64,
+    reconcile_duration_sum: f64,
+    reconcile_duration_count: u64,
+    // (node, kind)
+    pods_scheduled: BTreeMap<(String, String), u64>,
+    scheduling_failures: BTreeMap<(String, String), u64>,
+    ssh_errors: BTreeMap<String, u64>,
+    node_pods: BTreeMap<String, u64>,
+}
+
+// shared between the reconcile loop and the http server
+#[derive(Debug, Clone, Default)]
+pub struct Metrics {
+    data: Arc<Mutex<MetricsData>>,
+}
+
+// what the pod was scheduled for: its deployment, daemonset, statefulset or job, or the pod itself
+fn kind(resource: &SupportedResources) -> String {
+    let owner = match resource {
+        SupportedResources::Pod(pod) => pod.metadata.labels.as_ref().and_then(|l| {
+            [("skate.io/deployment", "Deployment"), ("skate.io/daemonset", "DaemonSet"), ("skate.io/statefulset", "StatefulSet"), ("skate.io/job", "Job")].iter()
+                .find_map(|(label, kind)| l.get(*label).filter(|v| !v.is_empty()).map(|_| kind.to_string()))
+        }),
+        _ => None
+    };
+    owner.unwrap_or(resource.to_string())
+}
+
+impl Metrics {
+    pub fn record_reconcile(&self, duration: Duration, success: bool) {
+        let mut data = self.data.lock().unwrap();
+        let outcome = match success {
+            true => "success",
+            false => "failure"
+        };
+        *data.reconciles.entry(outcome.to_string()).or_insert(0) += 1;
+        data.last_reconcile_duration = duration.as_secs_f64();
+        data.reconcile_duration_sum += duration.as_secs_f64();
+        data.reconcile_duration_count += 1;
+    }
+
+    pub fn record_ssh_errors(&self, errors: &SshErrors) {
+        let mut data = self.data.lock().unwrap();
+        for e in &errors.errors {
+            *data.ssh_errors.entry(e.node_name.clone()).or_insert(0) += 1;
+        }
+    }
+
+    pub fn record_ssh_error(&self, node_name: &str) {
+        let mut data = self.data.lock().unwrap();
+        *data.ssh_errors.entry(node_name.to_string()).or_insert(0) += 1;
+    }
+
+    pub fn record_schedule(&self, result: &ScheduleResult) {
+        let mut data = self.data.lock().unwrap();
+        for placement in &result.placements {
+            let node_name = placement.node.as_ref().map(|n| n.node_name.clone()).unwrap_or_default();
+            let key = (node_name, kind(&placement.resource));
+            match (&placement.operation, &placement.error) {
+                (_, Some(_)) => *data.scheduling_failures.entry(key).or_insert(0) += 1,
+                (OpType::Create, None) => *data.pods_scheduled.entry(key).or_insert(0) += 1,
+                _ => {}
+            }
+        }
+    }
+
+    pub fn record_state(&self, state: &ClusterState) {
+        let mut data = self.data.lock().unwrap();
+        data.node_pods = state.nodes.iter().map(|n| {
+            let pods = n.host_info.as_ref().and_then(|h| h.system_info.as_ref())
+                .and_then(|si| si.pods.as_ref()).map(|p| p.len()).unwrap_or(0);
+            (n.node_name.clone(), pods as u64)
+        }).collect();
+    }
+
+    // prometheus text exposition format
+    pub fn render(&self) -> String {
+        let data = self.data.lock().unwrap();
+        let mut lines: Vec<String> = vec!();
+
+        lines.push("# HELP skate_reconciles_total Reconciles run, by outcome.".to_string());
+        lines.push("# TYPE skate_reconciles_total counter".to_string());
+        for (outcome, count) in &data.reconciles {
+            lines.push(format!("skate_reconciles_total{{outcome=\"{}\"}} {}", outcome, count));
+        }
+
+        lines.push("# HELP skate_reconcile_duration_seconds How long reconciles take.".to_string());
+        lines.push("# TYPE skate_reconcile_duration_seconds summary".to_string());
+        lines.push(format!("skate_reconcile_duration_seconds_sum {}", data.reconcile_duration_sum));
+        lines.push(format!("skate_reconcile_duration_seconds_count {}", data.reconcile_duration_count));
+
+        lines.push("# HELP skate_last_reconcile_duration_seconds How long the last reconcile took.".to_string());
+        lines.push("# TYPE skate_last_reconcile_duration_seconds gauge".to_string());
+        lines.push(format!("skate_last_reconcile_duration_seconds {}", data.last_reconcile_duration));
+
+        lines.push("# HELP skate_pods_scheduled_total Pods created, by node and resource kind.".to_string());
+        lines.push("# TYPE skate_pods_scheduled_total counter".to_string());
+        for ((node, kind), count) in &data.pods_scheduled {
+            lines.push(format!("skate_pods_scheduled_total{{node=\"{}\",kind=\"{}\"}} {}", escape(node), escape(kind), count));
+        }
+
+        lines.push("# HELP skate_scheduling_failures_total Failed scheduling operations, by node and resource kind.".to_string());
+        lines.push("# TYPE skate_scheduling_failures_total counter".to_string());
+        for ((node, kind), count) in &data.scheduling_failures {
+            lines.push(format!("skate_scheduling_failures_total{{node=\"{}\",kind=\"{}\"}} {}", escape(node), escape(kind), count));
+        }
+
+        lines.push("# HELP skate_ssh_errors_total Failed ssh connections and commands, by node.".to_string());
+        lines.push("# TYPE skate_ssh_errors_total counter".to_string());
+        for (node, count) in &data.ssh_errors {
+            lines.push(format!("skate_ssh_errors_total{{node=\"{}\"}} {}", escape(node), count));
+        }
+
+        lines.push("# HELP skate_node_pods Pods currently on each node.".to_string());
+        lines.push("# TYPE skate_node_pods gauge".to_string());
+        for (node, count) in &data.node_pods {
+            lines.push(format!("skate_node_pods{{node=\"{}\"}} {}", escape(node), count));
+        }
+
+        lines.join("\n") + "\n"
+    }
+}
+
+fn escape(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"").replace('\n', "\\n")
+}
+
+// a bare bones http server, all it has to do is answer GET /metrics
+pub async fn serve(bind: String, metrics: Metrics) -> Result<(), Box<dyn Error>> {
+    let listener = TcpListener::bind(&bind).await?;
+    println!("serving metrics on http://{}/metrics", bind);
+
+    loop {
+        let (mut stream, _) = match listener.accept().await {
+            Ok(conn) => conn,
+            Err(e) => {
+                eprintln!("failed to accept metrics connection: {}", e);
+                continue;
+            }
+        };
+        let metrics = metrics.clone();
+        tokio::spawn(async move {
+            let mut buf = [0u8; 1024];
+            let n = match tokio::time::timeout(Duration::from_secs(5), stream.read(&mut buf)).await {
+                Ok(Ok(n)) => n,
+                _ => return
+            };
+            let request = String::from_utf8_lossy(&buf[..n]);
+            let path = request.split_whitespace().nth(1).unwrap_or("");
+
+            let (status, body) = match path.split('?').next() {
+                Some("/metrics") => ("200 OK", metrics.render()),
+                _ => ("404 Not Found", "not found\n".to_string())
+            };
+            let response = format!("HTTP/1.1 {}\r\nContent-Type: text/plain; version=0.0.4\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}", status, body.len(), body);
+            let _ = stream.write_all(response.as_bytes()).await;
+            let _ = stream.shutdown().await;
+        });
+    }
+}
@@ -0,0 +1,176 @@
+use std::error::Error;
+use std::process::Stdio;
+use std::time::{Duration, Instant};
+use anyhow::anyhow;
+use clap::Args;
+use itertools::Itertools;
+use k8s_openapi::api::core::v1::Pod;
+use crate::config::{Cluster, Config};
+use crate::describe::applied_pod;
+use crate::logs::locate_resource_pods;
+use crate::refresh::refreshed_state;
+use crate::skate::ConfigFileArgs;
+use crate::ssh;
+use crate::ssh::{native_ssh_command, SshClients};
+use crate::util::{CROSS_EMOJI, INFO_EMOJI};
+
+const MAX_BACKOFF: Duration = Duration::from_secs(30);
+// how often the pod is checked on while the tunnel is up, with --retry
+const CHECK_INTERVAL: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Args)]
+pub struct PortForwardArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, short, long_help = "Namespace of the resource, defaults to the context's default_namespace or default.")]
+    namespace: Option<String>,
+    #[arg(long, default_value = "127.0.0.1", long_help = "Local address to listen on.")]
+    address: String,
+    #[arg(long, long_help = "Open the tunnel again when the connection drops or the pod stops, to whichever ready pod there \
+is by then.")]
+    retry: bool,
+    #[arg(long_help = "Pod name, pod/<name>, deployment/<name>, daemonset/<name> or statefulset/<name>. For anything with replicas a ready one \
+is picked.")]
+    resource: String,
+    #[arg(required = true, long_help = "Ports as <local>:<remote>, or <port> for the same on both ends. The remote port can also be the \
+name of a container port.")]
+    ports: Vec<String>,
+}
+
+struct PortMapping {
+    local: u16,
+    remote: String,
+}
+
+fn parse_mapping(port: &str) -> Result<PortMapping, Box<dyn Error>> {
+    let (local, remote) = match port.split_once(':') {
+        Some((local, remote)) => (local, remote),
+        None => (port, port)
+    };
+    let local = local.parse().map_err(|_| anyhow!("invalid local port {}", local))?;
+    Ok(PortMapping { local, remote: remote.to_string() })
+}
+
+fn resolve_port(port: &str, pod: Option<&Pod>) -> Result<u16, Box<dyn Error>> {
+    match port.parse::<u16>() {
+        Ok(port) => Ok(port),
+        Err(_) => pod.and_then(|p| p.spec.as_ref()).into_iter()
+            .flat_map(|s| s.containers.iter())
+            .flat_map(|c| c.ports.iter().flatten())
+            .find(|p| p.name.as_deref() == Some(port))
+            .map(|p| p.container_port as u16)
+            .ok_or(anyhow!("no container port named {}", port).into())
+    }
+}
+
+pub async fn port_forward(args: PortForwardArgs) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let namespace = cluster.namespace(args.namespace.clone());
+    let mappings = args.ports.iter().map(|p| parse_mapping(p)).collect::<Result<Vec<_>, _>>()?;
+
+    // kept between tunnels, reconnecting only to nodes whose connection dropped
+    let mut conns: Option<SshClients> = None;
+    let mut backoff = Duration::from_secs(1);
+
+    loop {
+        let start = Instant::now();
+        let result = forward(&args, cluster, &config, &namespace, &mappings, &mut conns).await;
+        if !args.retry {
+            return result;
+        }
+        match result {
+            Ok(_) => {}
+            Err(e) => eprintln!("{} {}", CROSS_EMOJI, e)
+        }
+        // a tunnel that was up for a while starts over from the shortest wait
+        if start.elapsed() > MAX_BACKOFF {
+            backoff = Duration::from_secs(1);
+        }
+        eprintln!("{} reopening tunnel in {}s", INFO_EMOJI, backoff.as_secs());
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+    }
+}
+
+// one tunnel to one pod, returns once it closes
+async fn forward(args: &PortForwardArgs, cluster: &Cluster, config: &Config, namespace: &str, mappings: &Vec<PortMapping>, conns: &mut Option<SshClients>) -> Result<(), Box<dyn Error>> {
+    let (connected, errors) = ssh::reconnect(cluster, conns.take()).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    *conns = connected;
+    let conns = conns.as_ref().ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let state = refreshed_state(&cluster.name, &conns, config).await?;
+    let pods = locate_resource_pods(&state, &args.resource, namespace)?;
+    if pods.len() == 0 {
+        return Err(anyhow!("no pods found for {} in namespace {}", args.resource, namespace).into());
+    }
+    // sorted so repeated calls land on the same pod
+    let (pod, node_name) = pods.into_iter()
+        .filter(|(p, n)| p.is_ready() && conns.find(n).is_some())
+        .sorted_by_key(|(p, _)| p.name.clone())
+        .next()
+        .ok_or(anyhow!("no ready pods for {} in namespace {}", args.resource, namespace))?;
+    let conn = conns.find(&node_name).ok_or(anyhow!("no connection to node {}", node_name))?;
+    let node = cluster.nodes.iter().find(|n| n.name == node_name).ok_or(anyhow!("node {} not found in config", node_name))?;
+
+    let applied = applied_pod(&state, &pod.name, namespace, Some(&pod));
+    let ports = mappings.iter().map(|m| resolve_port(&m.remote, applied.as_ref()).map(|remote| (m.local, remote)))
+        .collect::<Result<Vec<_>, _>>()?;
+
+    // with host networking the pod listens on the node itself, otherwise on its address on the podman bridge
+    let host_network = applied.as_ref().and_then(|p| p.spec.as_ref()).and_then(|s| s.host_network).unwrap_or(false);
+    let host = match host_network {
+        true => "127.0.0.1".to_string(),
+        false => {
+            // containers in a pod share the infra container's network namespace
+            let containers = pod.containers.clone().unwrap_or_default();
+            let container = containers.iter().find(|c| c.is_infra()).or(containers.first())
+                .ok_or(anyhow!("pod {} has no containers", pod.name))?;
+            let inspected = conn.inspect_containers(&[container.id.clone()]).await?;
+            inspected[0]["NetworkSettings"]["Networks"].as_object().into_iter().flat_map(|n| n.values())
+                .filter_map(|n| n["IPAddress"].as_str())
+                .find(|ip| !ip.is_empty())
+                .map(|ip| ip.to_string())
+                .ok_or(anyhow!("no ip address for pod {} on node {}", pod.name, node_name))?
+        }
+    };
+
+    let mut cmd = native_ssh_command(cluster, node);
+    cmd.args(["-N", "-o", "ExitOnForwardFailure=yes"]);
+    for (local, remote) in &ports {
+        cmd.arg("-L").arg(format!("{}:{}:{}:{}", args.address, local, host, remote));
+    }
+    // ctrl-c reaches ssh along with us, which closes the forwarded ports on its way out
+    let mut child = cmd.stdin(Stdio::null()).kill_on_drop(true).spawn()?;
+
+    println!("{} forwarding to pod {} on node {}", INFO_EMOJI, pod.name, node_name);
+    for (local, remote) in &ports {
+        println!("Forwarding from {}:{} -> {}", args.address, local, remote);
+    }
+
+    let status = match args.retry {
+        false => child.wait().await?,
+        true => loop {
+            // moved or stopped pods leave the tunnel up, pointing at nothing
+            let running = tokio::select! {
+                status = child.wait() => break status?,
+                _ = tokio::time::sleep(CHECK_INTERVAL) => conn.pod_running(&pod.podman_name()).await.unwrap_or(false)
+            };
+            if !running {
+                let _ = child.kill().await;
+                return Err(anyhow!("pod {} is no longer running on node {}", pod.name, node_name).into());
+            }
+        }
+    };
+
+    match status.success() {
+        true => Ok(()),
+        false => Err(anyhow!("tunnel to node {} closed: {}", node_name, status).into())
+    }
+}
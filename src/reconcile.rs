@@ -0,0 +1,172 @@
+use std::error::Error;
+use std::time::{Duration, Instant};
+use anyhow::anyhow;
+use clap::Args;
+use crate::config::Config;
+use crate::configmap;
+use crate::logging::Entry;
+use crate::metrics;
+use crate::metrics::Metrics;
+use crate::refresh::refreshed_state;
+use crate::restart;
+use crate::sidecar;
+use crate::scheduler::{DefaultScheduler, Scheduler};
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::ssh;
+use crate::ssh::SshClients;
+use crate::skatelet::PodmanPodInfo;
+use crate::state::state::{Event, EventType};
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI};
+
+#[derive(Debug, Args)]
+pub struct ReconcileArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, default_value_t = 30, long_help = "Seconds to wait between reconciles.")]
+    interval: u64,
+    #[arg(long, long_help = "Reconcile once and exit.")]
+    once: bool,
+    #[arg(long, long_help = "Serve prometheus metrics on this address, eg 127.0.0.1:9090. Off unless set.")]
+    metrics_bind: Option<String>,
+    #[arg(long, long_help = "Leave pods running with their old config when a configmap they use changes, until they are next applied.")]
+    no_config_restarts: bool,
+}
+
+pub async fn reconcile(args: ReconcileArgs) -> Result<(), Box<dyn Error>> {
+    let metrics = Metrics::default();
+    match &args.metrics_bind {
+        Some(bind) => {
+            let bind = bind.clone();
+            let metrics = metrics.clone();
+            tokio::spawn(async move {
+                match metrics::serve(bind, metrics).await {
+                    Ok(_) => {}
+                    Err(e) => Entry::error(format!("{} metrics server failed: {}", CROSS_EMOJI, e)).operation("metrics").eprint()
+                }
+            });
+        }
+        None => {}
+    }
+
+    // connections are kept between reconciles, reconnecting only to nodes whose connection dropped
+    let mut conns: Option<SshClients> = None;
+
+    loop {
+        let start = Instant::now();
+        let result = reconcile_once(&args, &metrics, &mut conns).await;
+        metrics.record_reconcile(start.elapsed(), result.is_ok());
+        match result {
+            Ok(_) => {}
+            Err(e) => {
+                Entry::error(format!("{} reconcile failed: {}", CROSS_EMOJI, e)).operation("reconcile").eprint()
+            }
+        }
+
+        if args.once {
+            return Ok(());
+        }
+        tokio::time::sleep(Duration::from_secs(args.interval)).await;
+    }
+}
+
+async fn reconcile_once(args: &ReconcileArgs, metrics: &Metrics, conns: &mut Option<SshClients>) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    // reconnect every time so nodes that come back are picked up again
+    let (connected, errors) = ssh::reconnect(cluster, conns.take()).await;
+    match errors {
+        Some(e) => {
+            metrics.record_ssh_errors(&e);
+            e.log()
+        }
+        _ => {}
+    };
+
+    *conns = connected;
+    let conns = conns.as_ref().ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    // the skatelet only reports liveness, restarting is up to us
+    let failing: Vec<_> = state.filter_pods(&|_| true).into_iter().flat_map(|(p, n)| {
+        p.containers.clone().unwrap_or_default().into_iter()
+            .filter(|c| c.live == Some(false))
+            .map(|c| (p.clone(), c.names, n.node_name.clone()))
+            .collect::<Vec<_>>()
+    }).collect();
+
+    for (pod, container, node_name) in failing {
+        let conn = match conns.find(&node_name) {
+            Some(conn) => conn,
+            None => continue
+        };
+        let pod = SupportedResources::Pod(pod.into());
+        state.record_event(Event::for_resource(&pod, Some(&node_name), EventType::Warning, "Unhealthy", &format!("liveness probe failed for {}, restarting", container)));
+        match conn.restart_container(&container).await {
+            Ok(_) => Entry::info(format!("{} restarted {} on node {}: liveness probe failing", CHECKBOX_EMOJI, container, node_name))
+                .node(&node_name).object(&pod).operation("restart").print(),
+            Err(e) => {
+                metrics.record_ssh_error(&node_name);
+                Entry::error(format!("{} failed to restart {} on node {}: {}", CROSS_EMOJI, container, node_name, e))
+                    .node(&node_name).object(&pod).operation("restart").eprint()
+            }
+        }
+    }
+
+    restart::restart_exited(&conns, &mut state, metrics).await;
+    sidecar::stop_finished(&conns, &mut state, metrics).await;
+
+    // pods on nodes that were relabelled out from under their nodeSelector or tainted NoExecute, on nodes that are
+    // down, or left running twice by a node coming back after its pods were rescheduled
+    let misplaced: Vec<_> = state.misplaced_pods().into_iter()
+        .chain(state.untolerated_pods())
+        .chain(state.stranded_pods())
+        .chain(state.duplicate_pods())
+        .map(|(p, _)| p).collect();
+
+    // jobs are rescheduled when their node goes away and cleaned up once finished
+    let reconcilable: Vec<_> = state.resources.iter().filter(|r| match r {
+        SupportedResources::HorizontalPodAutoscaler(_) => true,
+        SupportedResources::Job(_) => true,
+        // picks up changed config maps, pods whose config didn't change are left alone
+        _ if !args.no_config_restarts && uses_config_maps(r) => true,
+        // a relabelled node may now need a pod
+        SupportedResources::DaemonSet(ds) => ds.spec.as_ref().and_then(|s| s.template.spec.as_ref())
+            .and_then(|s| s.node_selector.as_ref()).is_some(),
+        _ => misplaced.iter().any(|p| owns(r, p))
+    }).map(|r| r.clone()).collect();
+
+    let scheduler = DefaultScheduler::default();
+    let result = scheduler.schedule(&conns, &mut state, reconcilable).await?;
+    metrics.record_schedule(&result);
+    metrics.record_state(&state);
+
+    state.persist()
+}
+
+pub(crate) fn owns(resource: &SupportedResources, pod: &PodmanPodInfo) -> bool {
+    let name = resource.name();
+    if pod.namespace() != name.namespace {
+        return false;
+    }
+    match resource {
+        SupportedResources::Pod(_) => pod.name == name.name,
+        SupportedResources::Deployment(_) => pod.deployment() == name.name,
+        SupportedResources::DaemonSet(_) => pod.labels.get("skate.io/daemonset") == Some(&name.name),
+        SupportedResources::StatefulSet(_) => pod.labels.get("skate.io/statefulset") == Some(&name.name),
+        SupportedResources::Job(_) => pod.labels.get("skate.io/job") == Some(&name.name),
+        _ => false
+    }
+}
+
+fn uses_config_maps(resource: &SupportedResources) -> bool {
+    let spec = match resource {
+        SupportedResources::Pod(p) => p.spec.as_ref(),
+        SupportedResources::Deployment(d) => d.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        SupportedResources::DaemonSet(ds) => ds.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        SupportedResources::StatefulSet(sts) => sts.spec.as_ref().and_then(|s| s.template.spec.as_ref()),
+        _ => None
+    };
+    spec.map(|s| configmap::referenced(s).len() > 0).unwrap_or(false)
+}
@@ -1,8 +1,10 @@
+use std::collections::BTreeMap;
 use std::error::Error;
 use anyhow::anyhow;
 use clap::Args;
 use crate::config::Config;
 use crate::skate::ConfigFileArgs;
+use crate::secret::SecretKey;
 use crate::ssh;
 
 use crate::ssh::SshClients;
@@ -19,15 +21,14 @@ pub struct RefreshArgs {
 
 
 pub async fn refresh(args: RefreshArgs) -> Result<(), Box<dyn Error>> {
-    let config = Config::load(Some(args.config.skateconfig))?;
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
     let cluster = config.current_cluster()?;
 
 
     let (clients, errors) = ssh::cluster_connections(&cluster).await;
 
     if errors.is_some() {
-        eprintln!();
-        eprintln!("{}", errors.expect("should have had errors"))
+        errors.expect("should have had errors").log()
     }
 
     if clients.is_none() {
@@ -69,9 +70,22 @@ pub async fn refreshed_state(cluster_name: &str, conns: &SshClients, config: &Co
             cluster_name: cluster_name.to_string(),
             hash: "".to_string(),
             nodes: vec![],
+            resources: vec![],
+            events: vec![],
+            volume_nodes: BTreeMap::new(),
+            restarts: BTreeMap::new(),
+            secret_key: None,
+            reconcile_restarts: false,
         }
     };
 
+    state.secret_key = match config.clusters.iter().find(|c| c.name == cluster_name).and_then(|c| c.secret_key_file.clone()) {
+        Some(path) => Some(SecretKey::load(&path)?),
+        None => None
+    };
+
+    state.reconcile_restarts = config.clusters.iter().find(|c| c.name == cluster_name).and_then(|c| c.reconcile_restarts).unwrap_or(false);
+
     let _ = state.reconcile_all_nodes(&config, &healthy_host_infos)?;
     Ok(state)
 }
\ No newline at end of file
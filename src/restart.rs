@@ -0,0 +1,188 @@
+use std::collections::HashSet;
+use chrono::{DateTime, Duration, TimeZone, Utc};
+use serde::{Deserialize, Serialize};
+use crate::logging::Entry;
+use crate::metrics::Metrics;
+use crate::sidecar;
+use crate::skate::SupportedResources;
+use crate::skatelet::{PodmanContainerInfo, PodmanPodInfo};
+use crate::ssh::SshClients;
+use crate::state::state::{ClusterState, Event, EventType, NodeStatus};
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, INFO_EMOJI};
+
+// the pod's restartPolicy, recorded by the scheduler. job pods go without since the job retries them itself
+pub(crate) const RESTART_POLICY_LABEL: &str = "skate.io/restart-policy";
+// set on pods applied with the cluster's reconcile_restarts on, their containers are restarted by `skate reconcile`
+// instead of podman
+pub(crate) const RECONCILE_RESTARTS_LABEL: &str = "skate.io/reconcile-restarts";
+
+// same as the kubelet: 10s, doubling up to 5 minutes, back to 10s once the container stays up for 10 minutes
+const INITIAL_BACKOFF_SECONDS: i64 = 10;
+const MAX_BACKOFF_SECONDS: i64 = 300;
+const BACKOFF_RESET_SECONDS: i64 = 600;
+
+#[derive(Serialize, Deserialize, Clone, Debug, Default)]
+pub struct RestartState {
+    // every restart skate made, never reset
+    pub restarts: u32,
+    // restarts since the container last stayed up, the delay before the next one doubles with each
+    pub backoff: u32,
+    pub last_exit_code: Option<i32>,
+    pub reason: Option<String>,
+    pub last_restart: Option<DateTime<Utc>>,
+}
+
+impl RestartState {
+    // the earliest the container is restarted again, None is straight away
+    pub fn retry_at(&self) -> Option<DateTime<Utc>> {
+        if self.backoff == 0 {
+            return None;
+        }
+        let delay = (INITIAL_BACKOFF_SECONDS << (self.backoff - 1).min(16)).min(MAX_BACKOFF_SECONDS);
+        self.last_restart.map(|t| t + Duration::seconds(delay))
+    }
+}
+
+// pods and containers get new ids when they're recreated, so a replacement starts without a backoff
+pub fn key(pod: &PodmanPodInfo, container: &PodmanContainerInfo) -> String {
+    format!("{}/{}", pod.id, container.names)
+}
+
+pub fn policy(pod: &PodmanPodInfo) -> Option<String> {
+    pod.labels.get(RESTART_POLICY_LABEL).cloned()
+}
+
+// the restarts are left to podman otherwise
+pub fn managed(pod: &PodmanPodInfo) -> bool {
+    pod.labels.contains_key(RECONCILE_RESTARTS_LABEL) && policy(pod).is_some()
+}
+
+pub(crate) fn wants_restart(policy: &str, exit_code: i32) -> bool {
+    match policy {
+        "Never" => false,
+        "OnFailure" => exit_code != 0,
+        // Always is the default
+        _ => true
+    }
+}
+
+// sidecars are restarted whatever the pod's restartPolicy, up until the pod's own containers are done
+fn container_policy(pod: &PodmanPodInfo, container: &PodmanContainerInfo) -> Option<String> {
+    match pod.is_sidecar(container) {
+        true if sidecar::finished(pod) => Some("Never".to_string()),
+        true => Some("Always".to_string()),
+        false => policy(pod)
+    }
+}
+
+// kubernetes also has OOMKilled, which podman ps doesn't tell apart from any other failure
+pub fn reason(exit_code: i32) -> String {
+    match exit_code {
+        0 => "Completed",
+        _ => "Error"
+    }.to_string()
+}
+
+// exited, due to be restarted and being held back
+pub fn crash_looping(pod: &PodmanPodInfo, container: &PodmanContainerInfo, restart: Option<&RestartState>) -> bool {
+    if !managed(pod) {
+        return false;
+    }
+    match (container_policy(pod, container), container.exit_code, restart.and_then(|r| r.retry_at())) {
+        (_, Some(0), _) if container.init => false,
+        (Some(policy), Some(code), Some(retry_at)) => wants_restart(&policy, code) && retry_at > Utc::now(),
+        _ => false
+    }
+}
+
+// restarts exited containers as their pod's restartPolicy says, waiting longer each time one goes straight back down
+pub(crate) async fn restart_exited(conns: &SshClients, state: &mut ClusterState, metrics: &Metrics) {
+    let now = Utc::now();
+    let containers: Vec<_> = state.filter_pods(&|p| managed(p)).into_iter().flat_map(|(p, n)| {
+        p.containers.clone().unwrap_or_default().into_iter()
+            .filter(|c| !c.is_infra())
+            .map(|c| (p.clone(), c, n.node_name.clone(), n.status == NodeStatus::Healthy))
+            .collect::<Vec<_>>()
+    }).collect();
+
+    // containers that are gone have nothing left to back off
+    let keys: HashSet<String> = containers.iter().map(|(p, c, _, _)| key(p, c)).collect();
+    state.restarts.retain(|k, _| keys.contains(k));
+
+    for (pod, container, node_name, healthy) in containers {
+        if !healthy {
+            continue;
+        }
+        let key = key(&pod, &container);
+
+        let exit_code = match container.exit_code {
+            Some(exit_code) => exit_code,
+            None => {
+                // up for long enough, the next failure is restarted straight away again
+                let stable = container.status == "running" && container.started_at.and_then(|t| Utc.timestamp_opt(t, 0).single())
+                    .map(|t| (now - t).num_seconds() >= BACKOFF_RESET_SECONDS).unwrap_or(false);
+                match state.restarts.get_mut(&key) {
+                    Some(restart) if stable => restart.backoff = 0,
+                    _ => {}
+                }
+                continue;
+            }
+        };
+
+        // an init container that's done stays exited
+        if container.init && exit_code == 0 {
+            continue;
+        }
+        if !wants_restart(&container_policy(&pod, &container).unwrap_or_default(), exit_code) {
+            continue;
+        }
+
+        let mut restart = state.restarts.get(&key).cloned().unwrap_or_default();
+        restart.last_exit_code = Some(exit_code);
+        restart.reason = Some(reason(exit_code));
+
+        match restart.retry_at() {
+            Some(retry_at) if retry_at > now => {
+                Entry::warn(format!("{} {} on node {} is in CrashLoopBackOff, restarting in {}s", INFO_EMOJI, container.names, node_name, (retry_at - now).num_seconds()))
+                    .node(&node_name).resource(&format!("pod/{}", pod.name)).operation("restart").print();
+                state.restarts.insert(key, restart);
+                continue;
+            }
+            _ => {}
+        }
+
+        let conn = match conns.find(&node_name) {
+            Some(conn) => conn,
+            None => continue
+        };
+
+        let resource = SupportedResources::Pod(pod.clone().into());
+        // the containers after a failed init container never started, restarting the pod runs them all in order again
+        let result = match container.init {
+            true => conn.restart_pod(&pod.podman_name()).await,
+            false => conn.restart_container(&container.names).await
+        };
+        match result {
+            Ok(_) => {
+                // a container that had already been restarted without staying up
+                let event_reason = match restart.backoff {
+                    0 => "Restarted",
+                    _ => "BackOff"
+                };
+                restart.restarts += 1;
+                restart.backoff += 1;
+                restart.last_restart = Some(now);
+                Entry::info(format!("{} restarted {} on node {}: exited with {} ({}), restart {}", CHECKBOX_EMOJI, container.names, node_name, exit_code, reason(exit_code), restart.restarts))
+                    .node(&node_name).object(&resource).operation("restart").print();
+                let message = format!("container {} exited with {}, restarted ({} times)", container.names, exit_code, restart.restarts);
+                state.record_event(Event::for_resource(&resource, Some(&node_name), EventType::Warning, event_reason, &message));
+            }
+            Err(e) => {
+                metrics.record_ssh_error(&node_name);
+                Entry::error(format!("{} failed to restart {} on node {}: {}", CROSS_EMOJI, container.names, node_name, e))
+                    .node(&node_name).object(&resource).operation("restart").eprint()
+            }
+        }
+        state.restarts.insert(key, restart);
+    }
+}
@@ -0,0 +1,87 @@
+use std::error::Error;
+use std::future::Future;
+use std::sync::OnceLock;
+use std::time::Duration;
+use crate::logging::Entry;
+use crate::util::INFO_EMOJI;
+
+pub const DEFAULT_RETRIES: u32 = 2;
+pub const DEFAULT_RETRY_BACKOFF: f64 = 1.0;
+const MAX_BACKOFF: Duration = Duration::from_secs(30);
+
+// a retry can't fix credentials, an image that isn't there or a manifest podman won't take, so these win over
+// anything that also looks transient
+const FATAL: [&str; 9] = ["authentication", "permission denied", "unauthorized", "access denied", "manifest unknown",
+    "not found", "no such", "invalid", "bad manifest"];
+
+const TRANSIENT: [&str; 16] = ["timed out", "timeout", "connection reset", "connection refused", "connection closed",
+    "connection aborted", "broken pipe", "eof", "network is unreachable", "no route to host", "temporary failure",
+    "temporarily unavailable", "too many requests", "502 bad gateway", "503 service unavailable", "disconnected"];
+
+#[derive(Clone, Copy, Debug)]
+pub struct RetryPolicy {
+    pub retries: u32,
+    // the wait before the first retry, doubling after each one
+    pub backoff: Duration,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        RetryPolicy { retries: DEFAULT_RETRIES, backoff: Duration::from_secs_f64(DEFAULT_RETRY_BACKOFF) }
+    }
+}
+
+static POLICY: OnceLock<RetryPolicy> = OnceLock::new();
+
+pub fn init(policy: RetryPolicy) {
+    let _ = POLICY.set(policy);
+}
+
+fn policy() -> RetryPolicy {
+    POLICY.get().cloned().unwrap_or_default()
+}
+
+// whether a failure could go away by itself
+pub fn transient(message: &str) -> bool {
+    let message = message.to_lowercase();
+    !FATAL.iter().any(|f| message.contains(f)) && TRANSIENT.iter().any(|t| message.contains(t))
+}
+
+// for operations whose errors say it all
+pub fn failed<T>(outcome: &Result<T, Box<dyn Error>>) -> Option<String> {
+    match outcome {
+        Err(e) if transient(&e.to_string()) => Some(e.to_string()),
+        _ => None
+    }
+}
+
+// runs the operation again for as long as `failure` gives a reason to and the policy allows, with exponential
+// backoff in between. only for operations that are safe to run twice: the first attempt may have done its work and
+// only the answer got lost
+pub async fn retry<T, F, Fut>(node: &str, operation: &str, failure: impl Fn(&Result<T, Box<dyn Error>>) -> Option<String>, attempt: F) -> Result<T, Box<dyn Error>>
+where
+    F: Fn() -> Fut,
+    Fut: Future<Output=Result<T, Box<dyn Error>>>,
+{
+    let policy = policy();
+    let mut delay = policy.backoff;
+    let mut retry = 0;
+    loop {
+        // the outcome isn't kept across the wait, only why it failed
+        let reason = {
+            let outcome = attempt().await;
+            if retry >= policy.retries {
+                return outcome;
+            }
+            match failure(&outcome) {
+                Some(reason) => reason,
+                None => return outcome
+            }
+        };
+        retry += 1;
+        Entry::warn(format!("{} {} failed on node {}, retrying in {:.1}s ({}/{}): {}", INFO_EMOJI, operation, node,
+            delay.as_secs_f64(), retry, policy.retries, reason.trim())).node(node).operation(operation).eprint();
+        tokio::time::sleep(delay).await;
+        delay = (delay * 2).min(MAX_BACKOFF);
+    }
+}
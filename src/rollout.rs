@@ -0,0 +1,150 @@
+use std::collections::HashMap;
+use std::error::Error;
+use std::process;
+use std::time::{Duration, Instant};
+use anyhow::anyhow;
+use clap::{Args, Subcommand};
+use strum_macros::Display;
+use crate::config::Config;
+use crate::refresh::refreshed_state;
+use crate::skate::ConfigFileArgs;
+use crate::skatelet::{PodmanPodInfo, PodmanPodStatus};
+use crate::ssh;
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, parse_duration, template_revision};
+
+const POLL_INTERVAL: Duration = Duration::from_secs(5);
+
+// distinct exit codes so ci can tell why a rollout didn't finish
+const EXIT_CRASH_LOOPING: i32 = 2;
+const EXIT_TIMED_OUT: i32 = 3;
+
+#[derive(Debug, Args)]
+pub struct RolloutArgs {
+    #[command(subcommand)]
+    command: RolloutCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum RolloutCommands {
+    #[command(about = "wait for a rollout to finish", long_about = "Wait for a rollout to finish. \
+Exits with 2 if pods of the new revision are crash looping and 3 if the timeout was reached for any other reason.")]
+    Status(RolloutStatusArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct RolloutStatusArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, short, long_help = "Namespace of the resource, defaults to the context's default_namespace or default.")]
+    namespace: Option<String>,
+    #[arg(long, default_value = "5m", value_parser = parse_duration, long_help = "How long to wait for the rollout, eg 30s, 5m, 1h30m.")]
+    timeout: Duration,
+    #[arg(long_help = "The resource to wait for, eg deployment/foo.")]
+    resource: String,
+}
+
+pub async fn rollout(args: RolloutArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        RolloutCommands::Status(args) => status(args).await
+    }
+}
+
+#[derive(Debug, Clone, Display, PartialEq)]
+enum PodProgress {
+    #[strum(serialize = "old revision still running")]
+    OldRevision,
+    #[strum(serialize = "new revision pending")]
+    Pending,
+    #[strum(serialize = "new revision ready")]
+    Ready,
+    #[strum(serialize = "new revision crash looping")]
+    CrashLooping,
+}
+
+fn pod_progress(pod: &PodmanPodInfo, revision: &str) -> PodProgress {
+    if pod.labels.get("skate.io/revision").map(|r| r.as_str()) != Some(revision) {
+        return PodProgress::OldRevision;
+    }
+
+    let restarts: usize = pod.containers.clone().unwrap_or_default().iter().map(|c| c.restart_count.unwrap_or_default()).sum();
+
+    match pod.status {
+        _ if pod.is_ready() => PodProgress::Ready,
+        PodmanPodStatus::Exited | PodmanPodStatus::Dead | PodmanPodStatus::Degraded | PodmanPodStatus::Stopped => PodProgress::CrashLooping,
+        _ if restarts > 0 => PodProgress::CrashLooping,
+        _ => PodProgress::Pending
+    }
+}
+
+pub(crate) fn deployment_name(resource: &str) -> Result<String, Box<dyn Error>> {
+    match resource.split_once('/') {
+        Some(("deployment", name)) | Some(("deployments", name)) => Ok(name.to_string()),
+        Some((kind, _)) => Err(anyhow!("unsupported resource kind {}, only deployments are supported", kind).into()),
+        None => Err(anyhow!("expected resource of the form deployment/<name>, got {}", resource).into())
+    }
+}
+
+async fn status(args: RolloutStatusArgs) -> Result<(), Box<dyn Error>> {
+    let name = deployment_name(&args.resource)?;
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+    let ns = cluster.namespace(args.namespace.clone());
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let deadline = Instant::now() + args.timeout;
+    let mut last_seen: HashMap<String, PodProgress> = HashMap::new();
+
+    loop {
+        let state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+        let deployment = state.locate_stored_deployment(&name, &ns)
+            .ok_or(anyhow!("deployment {}.{} has not been applied", name, ns))?;
+        let revision = template_revision(&deployment.spec.clone().unwrap_or_default().template);
+        let desired = state.desired_replicas(&name, &ns).unwrap_or(0);
+
+        let pods: Vec<_> = state.locate_deployment(&name, &ns).into_iter().map(|(pod, node)| {
+            (pod_progress(&pod, &revision), pod, node.node_name.clone())
+        }).collect();
+
+        for (progress, pod, node_name) in &pods {
+            if last_seen.get(&pod.name) != Some(progress) {
+                println!("{} | {} {}", node_name, pod.name, progress);
+                last_seen.insert(pod.name.clone(), progress.clone());
+            }
+        }
+
+        let ready = pods.iter().filter(|(p, _, _)| *p == PodProgress::Ready).count();
+        let old = pods.iter().filter(|(p, _, _)| *p == PodProgress::OldRevision).count();
+
+        if ready as i32 >= desired && old == 0 {
+            println!("{} deployment {}.{} successfully rolled out, {}/{} ready", CHECKBOX_EMOJI, name, ns, ready, desired);
+            return Ok(());
+        }
+
+        if Instant::now() >= deadline {
+            let crashing: Vec<_> = pods.iter().filter(|(p, _, _)| *p == PodProgress::CrashLooping)
+                .map(|(_, pod, node_name)| format!("{} on {}", pod.name, node_name)).collect();
+
+            if crashing.len() > 0 {
+                eprintln!("{} deployment {}.{} new revision crash looping: {}", CROSS_EMOJI, name, ns, crashing.join(", "));
+                process::exit(EXIT_CRASH_LOOPING);
+            }
+
+            match old {
+                0 => eprintln!("{} timed out waiting for deployment {}.{}, {}/{} ready", CROSS_EMOJI, name, ns, ready, desired),
+                _ => eprintln!("{} timed out waiting for deployment {}.{}, {} pods of the old revision still running", CROSS_EMOJI, name, ns, old)
+            }
+            process::exit(EXIT_TIMED_OUT);
+        }
+
+        tokio::time::sleep(POLL_INTERVAL).await;
+    }
+}
@@ -1,21 +1,36 @@
 use std::any::Any;
-use std::cmp::Ordering;
-use std::collections::BTreeMap;
+use std::collections::{BTreeMap, BTreeSet};
 use std::error::Error;
+use std::time::{Duration, Instant};
 use anyhow::anyhow;
 use async_trait::async_trait;
+use chrono::Utc;
+use futures::{stream, StreamExt};
 use itertools::Itertools;
 
-use k8s_openapi::api::apps::v1::{DaemonSet, Deployment};
-use k8s_openapi::api::core::v1::{Node as K8sNode, Pod};
+use k8s_openapi::api::apps::v1::{DaemonSet, Deployment, StatefulSet};
+use k8s_openapi::api::autoscaling::v1::HorizontalPodAutoscaler;
+use k8s_openapi::api::batch::v1::{Job, JobCondition};
+use k8s_openapi::api::core::v1::{Node as K8sNode, PersistentVolumeClaimVolumeSource, Pod, PodTemplateSpec, Toleration, Volume};
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::Time;
+use k8s_openapi::apimachinery::pkg::util::intstr::IntOrString;
 use k8s_openapi::Metadata;
 
 
+use crate::affinity;
+use crate::autoscaler;
+use crate::configmap;
+use crate::downward;
+use crate::executor::DefaultExecutor;
+use crate::logging::Entry;
+use crate::restart::{RECONCILE_RESTARTS_LABEL, RESTART_POLICY_LABEL};
 use crate::skate::SupportedResources;
-use crate::skatelet::PodmanPodStatus;
+use crate::skatelet::{PodmanPodInfo, PodmanPodStatus};
 use crate::ssh::{SshClients};
-use crate::state::state::{ClusterState, NodeState, NodeStatus};
-use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, EQUAL_EMOJI, hash_k8s_resource, INFO_EMOJI};
+use async_ssh2_tokio::Error as SshError;
+use crate::state::state::{ClusterState, Event, EventType, NodeState, NodeStatus};
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI, EQUAL_EMOJI, format_taint, hash_k8s_resource, INFO_EMOJI, metadata_name, pod_requests, template_revision};
+use crate::validate::validate_host_aliases;
 
 
 #[derive(Debug)]
@@ -28,7 +43,18 @@ pub trait Scheduler {
     async fn schedule(&self, conns: &SshClients, state: &mut ClusterState, objects: Vec<SupportedResources>) -> Result<ScheduleResult, Box<dyn Error>>;
 }
 
-pub struct DefaultScheduler {}
+pub struct DefaultScheduler {
+    // how many nodes to work on at once
+    pub max_concurrency: usize,
+}
+
+pub const DEFAULT_MAX_CONCURRENCY: usize = 5;
+
+impl Default for DefaultScheduler {
+    fn default() -> Self {
+        DefaultScheduler { max_concurrency: DEFAULT_MAX_CONCURRENCY }
+    }
+}
 
 
 #[derive(Debug, Clone, PartialEq)]
@@ -47,13 +73,34 @@ pub struct ScheduledOperation<T> {
     pub error: Option<String>,
 }
 
+struct RollingUpdateBounds {
+    max_unavailable: usize,
+    max_surge: usize,
+}
+
 pub struct ApplyPlan {
     // pub existing: Vec<ScheduledOperation<SupportedResources>>,
     pub actions: Vec<ScheduledOperation<SupportedResources>>,
 }
 
 impl DefaultScheduler {
-    fn choose_node(nodes: Vec<NodeState>, object: &SupportedResources) -> Option<NodeState> {
+    // nodes that the object is allowed to run on
+    pub(crate) fn eligible_nodes(nodes: &Vec<NodeState>, object: &SupportedResources) -> Vec<NodeState> {
+        let candidates = Self::schedulable_nodes(nodes, object);
+        match object {
+            // then the ones that put it with the pods it has to be with, away from the ones it has to avoid, and spread
+            // as asked
+            SupportedResources::Pod(pod) => candidates.iter().filter(|n| {
+                affinity::violated_affinity(nodes, n, pod).len() == 0
+                    && affinity::violated_anti_affinity(nodes, n, pod).len() == 0
+                    && affinity::violated_spread(&candidates, n, pod).len() == 0
+            }).cloned().collect(),
+            _ => candidates
+        }
+    }
+
+    // nodes the pod could go on by itself, before looking at the other pods
+    fn schedulable_nodes(nodes: &Vec<NodeState>, object: &SupportedResources) -> Vec<NodeState> {
         // filter nodes based on resource requirements  - cpu, memory, etc
 
         let node_selector = match object {
@@ -67,41 +114,152 @@ impl DefaultScheduler {
 
 
 
+        let requests = Self::requests(object);
+        let tolerations = Self::tolerations(object);
+
         let filtered_nodes = nodes.iter().filter(|n| {
             let k8s_node: K8sNode = (**n).clone().into();
-            let node_labels = k8s_node.metadata.labels.unwrap_or_default();
             // only schedulable nodes
             k8s_node.spec.and_then(|s| {
                 s.unschedulable.and_then(|u| Some(!u))
             }).unwrap_or(false)
                 &&
                 // only nodes that match the nodeselectors
-                node_selector.iter().all(|(k, v)| {
-                    node_labels.get(k).unwrap_or(&"".to_string()) == v
-                })
-        }).collect::<Vec<_>>();
+                n.matches_selector(&node_selector)
+                &&
+                // and have room for the pod's requests
+                n.fits(requests)
+                &&
+                // and don't have taints it doesn't tolerate
+                n.untolerated_taints(&tolerations, &["NoSchedule", "NoExecute"]).len() == 0
+        }).map(|n| n.clone()).collect::<Vec<_>>();
 
+        filtered_nodes
+    }
 
-        let feasible_node = filtered_nodes.into_iter().fold(None, |maybe_prev_node, node| {
-            let node_pods = node.clone().host_info.and_then(|h| {
-                h.system_info.and_then(|si| {
-                    si.pods.and_then(|p| Some(p.len()))
-                })
-            }).unwrap_or(0);
-
-            maybe_prev_node.and_then(|prev_node: NodeState| {
-                prev_node.host_info.clone().and_then(|h| {
-                    h.system_info.and_then(|si| {
-                        si.pods.and_then(|prev_pods| {
-                            match prev_pods.len().cmp(&node_pods) {
-                                Ordering::Less => Some(prev_node.clone()),
-                                Ordering::Equal => Some(node.clone()),
-                                Ordering::Greater => Some(node.clone()),
-                            }
-                        })
-                    })
-                })
-            }).or_else(|| Some(node.clone()))
+    // as recorded on the pod by plan_pod, in (millicores, bytes)
+    fn requests(object: &SupportedResources) -> (u64, u64) {
+        match object {
+            SupportedResources::Pod(pod) => PodmanPodInfo::from(pod.clone()).requests(),
+            _ => (0, 0)
+        }
+    }
+
+    fn tolerations(object: &SupportedResources) -> Vec<Toleration> {
+        match object {
+            SupportedResources::Pod(pod) => pod.spec.as_ref().and_then(|s| s.tolerations.clone()).unwrap_or_default(),
+            _ => vec!()
+        }
+    }
+
+    // why choose_node came up empty
+    fn infeasible_reason(nodes: &Vec<NodeState>, object: &SupportedResources) -> String {
+        let (cpu, memory) = Self::requests(object);
+        let without_requests = match object {
+            SupportedResources::Pod(pod) => {
+                let mut pod = pod.clone();
+                let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+                labels.remove("skate.io/cpu-request");
+                labels.remove("skate.io/memory-request");
+                pod.metadata.labels = Some(labels);
+                SupportedResources::Pod(pod)
+            }
+            _ => object.clone()
+        };
+        let node_selector = match object {
+            SupportedResources::Pod(pod) => pod.spec.as_ref().and_then(|s| s.node_selector.clone()),
+            _ => None
+        }.unwrap_or_default();
+        match (cpu, memory) {
+            (0, 0) => {}
+            _ => {
+                let candidates = Self::eligible_nodes(nodes, &without_requests);
+                if candidates.len() > 0 {
+                    let free = candidates.iter().map(|n| match n.free() {
+                        Some((cpu, memory)) => format!("{} has {}m cpu and {}Mi memory left", n.node_name, cpu, memory / (1024 * 1024)),
+                        None => format!("{} hasn't reported its capacity", n.node_name)
+                    }).join(", ");
+                    return format!("failed to find feasible node: no node has room for {}m cpu and {}Mi memory within its max allocation ({})",
+                        cpu, memory / (1024 * 1024), free);
+                }
+            }
+        }
+        if node_selector.len() > 0 && !nodes.iter().any(|n| n.matches_selector(&node_selector)) {
+            return format!("failed to find feasible node: no node matches nodeSelector {}", node_selector.iter().map(|(k, v)| format!("{}={}", k, v)).join(","));
+        }
+        let tolerations = Self::tolerations(object);
+        let tainted: Vec<_> = nodes.iter().filter(|n| n.matches_selector(&node_selector)).filter_map(|n| {
+            let taints = n.untolerated_taints(&tolerations, &["NoSchedule", "NoExecute"]);
+            match taints.len() {
+                0 => None,
+                _ => Some(format!("{} on node {}", taints.iter().map(|t| format_taint(t)).join(","), n.node_name))
+            }
+        }).collect();
+        if tainted.len() > 0 {
+            return format!("failed to find feasible node: untolerated taints {}", tainted.join(", "));
+        }
+
+        // the node would do, it's the pods already there that rule it out
+        let pod = match object {
+            SupportedResources::Pod(pod) => pod,
+            _ => return "failed to find feasible node".to_string()
+        };
+        let candidates = Self::schedulable_nodes(nodes, object);
+        // a term that every candidate breaks is the one to blame, one that only some break could be either's fault
+        let pod_affinity = candidates.first().map(|n| affinity::violated_affinity(nodes, n, pod)).unwrap_or_default().into_iter()
+            .find(|term| candidates.iter().all(|n| affinity::violated_affinity(nodes, n, pod).contains(term)));
+        let anti_affinity = candidates.iter().flat_map(|n| affinity::violated_anti_affinity(nodes, n, pod)).next();
+        let spread = candidates.iter().flat_map(|n| affinity::violated_spread(&candidates, n, pod)).next();
+        match (pod_affinity, anti_affinity, spread) {
+            (Some(term), _, _) => format!("failed to find feasible node: podAffinity, no schedulable {} has a pod matching {}",
+                term.topology_key, affinity::describe_selector(term.label_selector.as_ref())),
+            (None, Some(term), _) => format!("failed to find feasible node: podAntiAffinity, every {} already has a pod matching {}",
+                term.topology_key, affinity::describe_selector(term.label_selector.as_ref())),
+            (None, None, Some(constraint)) => format!("failed to find feasible node: topologySpreadConstraints, any node would take {} over maxSkew {}",
+                constraint.topology_key, constraint.max_skew),
+            (None, None, None) => "failed to find feasible node".to_string()
+        }
+    }
+
+    fn choose_node(nodes: Vec<NodeState>, object: &SupportedResources) -> Option<NodeState> {
+        let filtered_nodes = Self::eligible_nodes(&nodes, object);
+
+        // PreferNoSchedule taints are only avoided, if nothing else fits they're used anyway
+        let tolerations = Self::tolerations(object);
+        let preferred: Vec<_> = filtered_nodes.iter().filter(|n| n.untolerated_taints(&tolerations, &["PreferNoSchedule"]).len() == 0).cloned().collect();
+        let filtered_nodes = match preferred.len() {
+            0 => filtered_nodes,
+            _ => preferred
+        };
+
+        // the nodes satisfying the most weight of preferred podAffinity terms
+        let filtered_nodes = match object {
+            SupportedResources::Pod(pod) => {
+                let scores: Vec<_> = filtered_nodes.into_iter().map(|n| (affinity::affinity_score(&nodes, &n, pod), n)).collect();
+                let best = scores.iter().map(|(score, _)| *score).max().unwrap_or(0);
+                scores.into_iter().filter(|(score, _)| *score == best).map(|(_, n)| n).collect()
+            }
+            _ => filtered_nodes
+        };
+
+        // the least crowded domains for the pod's topologySpreadConstraints, fewest pods overall after that
+        let filtered_nodes = match object {
+            SupportedResources::Pod(pod) => {
+                let candidates = Self::schedulable_nodes(&nodes, object);
+                let scores: Vec<_> = filtered_nodes.into_iter().map(|n| (affinity::spread_score(&candidates, &n, pod), n)).collect();
+                let best = scores.iter().map(|(score, _)| *score).min().unwrap_or(0);
+                scores.into_iter().filter(|(score, _)| *score == best).map(|(_, n)| n).collect()
+            }
+            _ => filtered_nodes
+        };
+
+        // the least loaded of those, by the fuller of cpu and memory once the pod's requests are on it, so bigger
+        // nodes take more. fewest pods after that, which is all there is to go on when nothing has requests
+        let requests = Self::requests(object);
+        let feasible_node = filtered_nodes.into_iter().min_by_key(|node| {
+            let node_pods = node.host_info.as_ref().and_then(|h| h.system_info.as_ref())
+                .and_then(|si| si.pods.as_ref()).map(|p| p.len()).unwrap_or(0);
+            (node.load_with(requests).unwrap_or(u64::MAX), node_pods)
         });
 
         feasible_node
@@ -114,9 +272,31 @@ impl DefaultScheduler {
         let ns = ds.metadata.namespace.clone().unwrap_or("".to_string());
 
         for node in state.nodes.iter() {
+            // its pod can't go anywhere else, and is dealt with once the node is back
+            if node.down {
+                continue;
+            }
             let node_name = node.node_name.clone();
             let mut pod_spec = ds.spec.clone().and_then(|s| Some(s.template)).and_then(|t| t.spec).unwrap_or_default();
 
+            // a NoSchedule taint keeps new pods off without touching the one already there
+            let tolerations = pod_spec.tolerations.clone().unwrap_or_default();
+            let pod_name = format!("{}-{}", name, node_name);
+            if node.untolerated_taints(&tolerations, &["NoSchedule"]).len() > 0 && !state.locate_daemonset(&pod_name, &ns).iter().any(|(_, n)| n.node_name == node_name) {
+                continue;
+            }
+
+            // nodes excluded by the nodeSelector or a NoExecute taint get no pod, and lose any they had
+            if !node.matches_selector(&pod_spec.node_selector.clone().unwrap_or_default()) || node.untolerated_taints(&tolerations, &["NoExecute"]).len() > 0 {
+                actions.extend(state.locate_daemonset(&pod_name, &ns).into_iter().filter(|(_, n)| n.node_name == node_name).map(|(pod_info, n)| ScheduledOperation {
+                    node: Some(n.clone()),
+                    resource: SupportedResources::Pod(pod_info.clone().into()),
+                    error: None,
+                    operation: OpType::Delete,
+                }));
+                continue;
+            }
+
             let mut meta = ds.spec.as_ref().and_then(|s| s.template.metadata.clone()).unwrap_or_default();
             meta.name = Some(format!("{}-{}", ds.metadata.name.as_ref().unwrap(), node_name));
             meta.namespace = ds.metadata.namespace.clone();
@@ -151,14 +331,30 @@ impl DefaultScheduler {
     fn plan_deployment(state: &ClusterState, d: &Deployment) -> Result<ApplyPlan, Box<dyn Error>> {
         let d = d.clone();
 
-        let replicas = d.spec.as_ref().and_then(|s| s.replicas).unwrap_or(0);
         let mut actions = vec!();
 
         let name = d.metadata.name.clone().unwrap_or("".to_string());
         let ns = d.metadata.namespace.clone().unwrap_or("".to_string());
+
+        // an autoscaler's decision overrides the replicas in the spec
+        let replicas = match state.locate_deployment_autoscaler(&name, &ns).and_then(|h| h.status) {
+            Some(status) => status.desired_replicas,
+            None => d.spec.as_ref().and_then(|s| s.replicas).unwrap_or(0)
+        };
         // check if  there are more pods than replicas running
         // cull them if so
-        let deployment_pods = state.locate_deployment(&name, &ns);
+        // pods on nodes that are down are replaced, so they don't count
+        let (surge_pods, deployment_pods): (Vec<_>, Vec<_>) = state.locate_deployment(&name, &ns).into_iter()
+            .filter(|(_, node)| !node.down)
+            .partition(|(dp, _)| dp.labels.get("skate.io/surge").is_some());
+
+        // left over from an interrupted rolling update
+        actions.extend(surge_pods.into_iter().map(|(pod_info, node)| ScheduledOperation {
+            node: Some(node.clone()),
+            resource: SupportedResources::Pod(pod_info.clone().into()),
+            error: None,
+            operation: OpType::Delete,
+        }));
 
         let deployment_pods: Vec<_> = deployment_pods.into_iter().map(|(dp, node)| {
             let replica = dp.labels.get("skate.io/replica").unwrap_or(&"0".to_string()).clone();
@@ -184,6 +380,9 @@ impl DefaultScheduler {
         }
 
 
+        let revision = template_revision(&d.spec.clone().unwrap_or_default().template);
+        Self::check_anti_affinity_capacity(state, &d.spec.clone().unwrap_or_default().template, replicas, &format!("deployment {}.{}", name, ns))?;
+
         for i in 0..replicas {
             let pod_spec = d.spec.clone().and_then(|s| Some(s.template)).and_then(|t| t.spec).unwrap_or_default();
 
@@ -193,6 +392,7 @@ impl DefaultScheduler {
             let mut labels = meta.labels.unwrap_or_default();
             labels.insert("skate.io/deployment".to_string(), d.metadata.name.as_ref().unwrap().clone());
             labels.insert("skate.io/replica".to_string(), i.to_string());
+            labels.insert("skate.io/revision".to_string(), revision.clone());
             meta.labels = Some(labels.clone());
             meta.labels = Some(labels);
 
@@ -212,16 +412,141 @@ impl DefaultScheduler {
             actions: [actions].concat()
         })
     }
+    // pods <name>-0 to <name>-N-1, each with its own volumes. podman volumes live on one node, so once a pod's volumes
+    // have been created it always goes back to that node
+    fn plan_statefulset(state: &ClusterState, sts: &StatefulSet) -> Result<ApplyPlan, Box<dyn Error>> {
+        let mut actions = vec!();
+
+        let name = sts.metadata.name.clone().unwrap_or("".to_string());
+        let ns = sts.metadata.namespace.clone().unwrap_or("".to_string());
+        let spec = sts.spec.clone().unwrap_or_default();
+        let replicas = spec.replicas.unwrap_or(1);
+        let revision = template_revision(&spec.template);
+        Self::check_anti_affinity_capacity(state, &spec.template, replicas, &format!("statefulset {}.{}", name, ns))?;
+
+        // highest ordinal goes first when scaling down
+        let scaled_down: Vec<_> = state.locate_statefulset(&name, &ns).into_iter().filter(|(_, node)| !node.down).filter_map(|(pod_info, node)| {
+            let ordinal = pod_info.labels.get("skate.io/ordinal").and_then(|o| o.parse::<i32>().ok()).unwrap_or(0);
+            match ordinal >= replicas {
+                true => Some((ordinal, pod_info, node)),
+                false => None
+            }
+        }).sorted_by_key(|(ordinal, _, _)| *ordinal).rev().collect();
+        actions.extend(scaled_down.into_iter().map(|(_, pod_info, node)| ScheduledOperation {
+            node: Some(node.clone()),
+            resource: SupportedResources::Pod(pod_info.clone().into()),
+            error: None,
+            operation: OpType::Delete,
+        }));
+
+        for i in 0..replicas {
+            let pod_name = format!("{}-{}", name, i);
+            let mut pod_spec = spec.template.spec.clone().unwrap_or_default();
+
+            let mut meta = spec.template.metadata.clone().unwrap_or_default();
+            meta.name = Some(pod_name.clone());
+            meta.namespace = sts.metadata.namespace.clone();
+            let mut labels = meta.labels.unwrap_or_default();
+            labels.insert("skate.io/statefulset".to_string(), name.clone());
+            labels.insert("skate.io/ordinal".to_string(), i.to_string());
+            labels.insert("skate.io/revision".to_string(), revision.clone());
+            meta.labels = Some(labels);
+
+            // same as kubernetes, the pod's hostname is its name
+            pod_spec.hostname = Some(pod_name.clone());
+
+            let claims = claim_volumes(sts, &pod_name);
+            let mut volumes: Vec<_> = pod_spec.volumes.clone().unwrap_or_default().into_iter()
+                .filter(|v| !claims.iter().any(|c| c.name == v.name)).collect();
+            volumes.extend(claims.clone());
+            pod_spec.volumes = match volumes.len() {
+                0 => None,
+                _ => Some(volumes)
+            };
+
+            let bound_node = claims.iter().find_map(|c| state.volume_node(&ns, &c.persistent_volume_claim.as_ref()?.claim_name));
+            // it can't go anywhere else without its data, so waits for the node to come back
+            match &bound_node {
+                Some(node_name) => match state.nodes.iter().find(|n| n.node_name == *node_name) {
+                    Some(node) if node.down => continue,
+                    _ => {}
+                },
+                None => {}
+            }
+
+            let pod = Pod {
+                metadata: meta,
+                spec: Some(pod_spec),
+                status: None,
+            };
+
+            let mut result = Self::plan_pod(state, &pod)?;
+            // pinned after planning, so binding the volumes doesn't change the pod's hash and restart it
+            match bound_node {
+                Some(node_name) => for action in result.actions.iter_mut().filter(|a| a.operation == OpType::Create) {
+                    match &mut action.resource {
+                        SupportedResources::Pod(pod) => {
+                            let spec = pod.spec.get_or_insert_with(Default::default);
+                            let mut selector = spec.node_selector.clone().unwrap_or_default();
+                            selector.insert("skate.io/hostname".to_string(), node_name.clone());
+                            spec.node_selector = Some(selector);
+                            let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+                            labels.insert("nodeselector/skate.io/hostname".to_string(), node_name.clone());
+                            pod.metadata.labels = Some(labels);
+                        }
+                        _ => {}
+                    }
+                },
+                None => {}
+            }
+            actions.extend(result.actions);
+        }
+
+        Ok(ApplyPlan {
+            actions
+        })
+    }
+
+    // replicas that have to stay apart can't outnumber the places there are to put them, better to say so up front
+    // than to schedule some and fail on the rest
+    fn check_anti_affinity_capacity(state: &ClusterState, template: &PodTemplateSpec, replicas: i32, owner: &str) -> Result<(), Box<dyn Error>> {
+        let mut pod = Pod {
+            metadata: template.metadata.clone().unwrap_or_default(),
+            spec: template.spec.clone(),
+            status: None,
+        };
+        pod.metadata.name = None;
+        let candidates = Self::schedulable_nodes(&state.nodes, &SupportedResources::Pod(pod.clone()));
+        match affinity::anti_affinity_capacity(&candidates, &pod) {
+            Some((capacity, topology_key)) if replicas as usize > capacity => {
+                Err(anyhow!("{} wants {} replicas but its required podAntiAffinity allows at most {}, one per {}", owner, replicas, capacity, topology_key).into())
+            }
+            _ => Ok(())
+        }
+    }
+
     fn plan_pod(state: &ClusterState, object: &Pod) -> Result<ApplyPlan, Box<dyn Error>> {
         let mut new_pod = object.clone();
         //let feasible_node = Self::choose_node(state.nodes.clone(), &SupportedResources::Pod(object.clone())).ok_or("failed to find feasible node")?;
 
+        // before hashing, so that changing a config map replaces the pods using it
+        configmap::project(state, &mut new_pod)?;
 
         let new_hash = hash_k8s_resource(&mut new_pod);
 
         let name = new_pod.metadata.name.clone().unwrap_or("".to_string());
         let ns = new_pod.metadata.namespace.clone().unwrap_or("".to_string());
 
+        record_grace_period(&mut new_pod);
+        record_tolerations(&mut new_pod)?;
+        record_resource_requests(&mut new_pod)?;
+        record_restart_policy(&mut new_pod, state.reconcile_restarts)?;
+
+        let alias_errors = new_pod.spec.as_ref().map(validate_host_aliases).unwrap_or_default();
+        if alias_errors.len() > 0 {
+            return Err(anyhow!("pod {}.{}: {}", name, ns, alias_errors.join(", ")).into());
+        }
+
         // smuggle node selectors as labels
         match new_pod.spec.as_ref() {
             Some(spec) => {
@@ -239,9 +564,22 @@ impl DefaultScheduler {
         }
 
 
-        // existing pods with same name (duplicates if more than 1)
-        // sort by replicas descending
-        let existing_pods = state.locate_pods(&name, &ns);
+        let node_selector = new_pod.spec.as_ref().and_then(|s| s.node_selector.clone()).unwrap_or_default();
+        if !state.nodes.iter().any(|n| n.matches_selector(&node_selector)) {
+            return Err(anyhow!("no nodes match nodeSelector {} for pod {}.{}",
+                node_selector.iter().map(|(k, v)| format!("{}={}", k, v)).join(","), name, ns).into());
+        }
+
+        // existing pods with same name (duplicates if more than 1), ignoring any on nodes that are down.
+        // the one to keep goes first: up to date and running, then the newest, which is the replacement when a node
+        // that was down comes back with its old copy
+        let existing_pods: Vec<_> = state.locate_pods(&name, &ns).into_iter()
+            .filter(|(_, node)| !node.down)
+            .sorted_by_key(|(pod_info, _)| (
+                pod_info.labels.get("skate.io/hash") == Some(&new_hash),
+                pod_info.status == PodmanPodStatus::Running,
+                pod_info.created,
+            )).rev().collect();
 
 
         let cull_actions: Vec<_> = match existing_pods.len() {
@@ -266,7 +604,10 @@ impl DefaultScheduler {
                 let state_running = pod_info.status == PodmanPodStatus::Running;
 
                 let hash_matches = previous_hash.clone() == new_hash;
-                match hash_matches && state_running {
+                // the node may have been relabelled or tainted since, or be getting drained
+                let node_matches = node.matches_selector(&node_selector) && !node.draining
+                    && node.untolerated_taints(&pod_info.tolerations(), &["NoExecute"]).len() == 0;
+                match hash_matches && state_running && node_matches {
                     true => vec!(ScheduledOperation {
                         node: Some((**node).clone()),
                         resource: SupportedResources::Pod(pod_info.clone().into()),
@@ -306,83 +647,885 @@ impl DefaultScheduler {
             actions: [cull_actions, actions].concat()
         })
     }
+    fn plan_autoscaler(state: &mut ClusterState, hpa: &HorizontalPodAutoscaler) -> Result<ApplyPlan, Box<dyn Error>> {
+        let ns = hpa.metadata.namespace.clone().unwrap_or("".to_string());
+        let target = hpa.spec.as_ref().ok_or(anyhow!("spec is empty"))?.scale_target_ref.clone();
+
+        if target.kind != "Deployment" {
+            return Err(anyhow!("cannot autoscale {}: only deployments are supported", target.kind).into());
+        }
+
+        let deployment = state.locate_stored_deployment(&target.name, &ns)
+            .ok_or(anyhow!("deployment {}.{} has not been applied", target.name, ns))?;
+
+        let decision = autoscaler::decide(state, hpa, &deployment);
+        if decision.desired_replicas != decision.current_replicas {
+            Entry::info(format!("{} scaling deployment {}.{} from {} to {} replicas (cpu {})", INFO_EMOJI, target.name, ns,
+                                decision.current_replicas, decision.desired_replicas,
+                                decision.current_cpu_percent.map(|c| format!("{:.1}%", c)).unwrap_or("unknown".to_string())))
+                .resource(&format!("deployment/{}.{}", target.name, ns)).operation("scale").print();
+        }
+
+        let mut hpa = hpa.clone();
+        hpa.status = Some(decision.into_status(hpa.status.clone()));
+        state.store_resource(&SupportedResources::HorizontalPodAutoscaler(hpa))?;
+
+        Self::plan_deployment(state, &deployment)
+    }
+
+    // one pod per completion, named <job>-<index>, retried until backoffLimit. played with podman like any other pod
+    // rather than as a transient systemd unit, so the skatelet reports its exit code the same way it does for the rest
+    fn plan_job(state: &mut ClusterState, job: &Job) -> Result<ApplyPlan, Box<dyn Error>> {
+        let name = job.metadata.name.clone().unwrap_or("".to_string());
+        let ns = job.metadata.namespace.clone().unwrap_or("".to_string());
+        let spec = job.spec.clone().unwrap_or_default();
+
+        let completions = spec.completions.unwrap_or(1);
+        let backoff_limit = spec.backoff_limit.unwrap_or(6);
+        let revision = template_revision(&spec.template);
+
+        let mut status = state.locate_stored_job(&name, &ns).and_then(|j| j.status).unwrap_or_default();
+        let mut completed: BTreeSet<i32> = status.completed_indexes.clone().unwrap_or_default()
+            .split(',').filter_map(|i| i.trim().parse().ok()).collect();
+        let mut failed = status.failed.unwrap_or(0);
+
+        let finished_at = |status: &k8s_openapi::api::batch::v1::JobStatus| {
+            status.completion_time.clone().or_else(|| status.conditions.clone().unwrap_or_default().into_iter()
+                .find(|c| c.type_ == "Failed" && c.status == "True")
+                .and_then(|c| c.last_transition_time))
+        };
+        // once finished everything goes after the ttl, without a ttl successful pods go straight away
+        let ttl_expired = |finished: Option<Time>| match (spec.ttl_seconds_after_finished, finished) {
+            (Some(ttl), Some(finished)) => (Utc::now() - finished.0).num_seconds() >= ttl as i64,
+            _ => false
+        };
+
+        let mut actions = vec!();
+        let mut events = vec!();
+        let mut active = 0;
+
+        let delete = |pod_info: &crate::skatelet::PodmanPodInfo, node: &NodeState| ScheduledOperation {
+            node: Some(node.clone()),
+            resource: SupportedResources::Pod(pod_info.clone().into()),
+            error: None,
+            operation: OpType::Delete,
+        };
+
+        let job_pods: Vec<_> = state.locate_job(&name, &ns).into_iter().map(|(p, n)| (p, n.clone())).collect();
+
+        // pods from a previous version of the job
+        actions.extend(job_pods.iter().filter(|(p, _)| p.labels.get("skate.io/revision") != Some(&revision))
+            .map(|(p, n)| delete(p, n)));
+
+        for i in 0..completions {
+            let pods: Vec<_> = job_pods.iter().filter(|(p, _)| {
+                p.labels.get("skate.io/revision") == Some(&revision) && p.labels.get("skate.io/completion") == Some(&i.to_string())
+            }).collect();
+            // pods on nodes that are down are as good as gone, ones on nodes only briefly unreachable may still finish
+            let (mut reachable, unreachable): (Vec<_>, Vec<_>) = pods.into_iter().partition(|(_, n)| n.status == NodeStatus::Healthy);
+            let (lost, pending): (Vec<_>, Vec<_>) = unreachable.into_iter().partition(|(_, n)| n.down);
+
+            // a node coming back after its pod was replaced leaves the completion with two, only the one furthest
+            // along is kept: succeeded, then still running, then failed
+            reachable.sort_by_key(|(p, _)| match p.exit_code() {
+                Some(0) => 0,
+                None => 1,
+                Some(_) => 2
+            });
+            actions.extend(reachable.iter().skip(1).map(|(p, n)| delete(p, n)));
+            reachable.truncate(1);
+
+            let finished = finished_at(&status).is_some();
+
+            if completed.contains(&i) {
+                actions.extend(reachable.iter().filter(|(p, _)| match spec.ttl_seconds_after_finished {
+                    None => p.exit_code() == Some(0),
+                    Some(_) => ttl_expired(finished_at(&status))
+                }).map(|(p, n)| delete(p, n)));
+                continue;
+            }
+
+            let mut create = false;
+
+            match reachable.first() {
+                Some((pod_info, node)) => match pod_info.exit_code() {
+                    None => {
+                        active = active + 1;
+                        actions.push(ScheduledOperation {
+                            node: Some((*node).clone()),
+                            resource: SupportedResources::Pod(pod_info.clone().into()),
+                            error: None,
+                            operation: OpType::Unchanged,
+                        });
+                    }
+                    Some(0) => {
+                        completed.insert(i);
+                        if spec.ttl_seconds_after_finished.is_none() {
+                            actions.push(delete(pod_info, node));
+                        }
+                    }
+                    Some(_) if finished => {
+                        // kept around for inspection
+                        if ttl_expired(finished_at(&status)) {
+                            actions.push(delete(pod_info, node));
+                        }
+                    }
+                    Some(code) => {
+                        failed = failed + 1;
+                        match failed > backoff_limit {
+                            // keep the last failure around for inspection
+                            true => Entry::error(format!("{} job {}.{} failed, pod {} on node {} exited with {}", CROSS_EMOJI, name, ns, pod_info.name, node.node_name, code))
+                                .node(&node.node_name).resource(&format!("job/{}.{}", name, ns)).operation("run").print(),
+                            false => {
+                                actions.push(delete(pod_info, node));
+                                create = true;
+                            }
+                        }
+                    }
+                },
+                None if finished => {}
+                None if pending.len() > 0 => {
+                    active = active + 1;
+                }
+                None => {
+                    if lost.len() > 0 {
+                        failed = failed + 1;
+                        Entry::warn(format!("{} job {}.{} pod {} lost with node {}", INFO_EMOJI, name, ns, lost[0].0.name, lost[0].1.node_name))
+                            .node(&lost[0].1.node_name).resource(&format!("job/{}.{}", name, ns)).operation("run").print();
+                        let message = format!("pod {} lost with node {}", lost[0].0.name, lost[0].1.node_name);
+                        events.push(Event::for_resource(&SupportedResources::Job(job.clone()), Some(&lost[0].1.node_name), EventType::Warning, "PodLost", &message));
+                    }
+                    create = failed <= backoff_limit;
+                }
+            }
+
+            if !create {
+                continue;
+            }
+            active = active + 1;
+
+            let mut meta = spec.template.metadata.clone().unwrap_or_default();
+            meta.name = Some(format!("{}-{}", name, i));
+            meta.namespace = Some(ns.clone());
+            let mut labels = meta.labels.unwrap_or_default();
+            labels.insert("skate.io/job".to_string(), name.clone());
+            labels.insert("skate.io/completion".to_string(), i.to_string());
+            labels.insert("skate.io/revision".to_string(), revision.clone());
+            meta.labels = Some(labels);
+
+            let mut pod = Pod {
+                metadata: meta,
+                spec: spec.template.spec.clone(),
+                status: None,
+            };
+            // podman would restart an OnFailure container in place, the pod would never exit non zero and
+            // backoffLimit would never count it. the retries are ours to do
+            match pod.spec.as_mut() {
+                Some(spec) => spec.restart_policy = Some("Never".to_string()),
+                None => {}
+            }
+            configmap::project(state, &mut pod)?;
+            hash_k8s_resource(&mut pod);
+            record_grace_period(&mut pod);
+            record_tolerations(&mut pod)?;
+            record_resource_requests(&mut pod)?;
+
+            actions.push(ScheduledOperation {
+                node: None,
+                resource: SupportedResources::Pod(pod),
+                error: None,
+                operation: OpType::Create,
+            });
+        }
+
+        let now = Some(Time(Utc::now()));
+        if status.start_time.is_none() {
+            status.start_time = now.clone();
+        }
+        status.active = Some(active);
+        status.succeeded = Some(completed.len() as i32);
+        status.failed = Some(failed);
+        status.completed_indexes = Some(completed.iter().map(|i| i.to_string()).join(","));
+
+        if finished_at(&status).is_none() {
+            let condition = match (completed.len() as i32 >= completions, failed > backoff_limit) {
+                (true, _) => {
+                    status.completion_time = now.clone();
+                    Entry::info(format!("{} job {}.{} complete", CHECKBOX_EMOJI, name, ns)).resource(&format!("job/{}.{}", name, ns)).operation("run").print();
+                    events.push(Event::for_resource(&SupportedResources::Job(job.clone()), None, EventType::Normal, "Completed", "job completed"));
+                    Some(("Complete", None))
+                }
+                (false, true) => {
+                    events.push(Event::for_resource(&SupportedResources::Job(job.clone()), None, EventType::Warning, "BackoffLimitExceeded", "job has reached the specified backoff limit"));
+                    Some(("Failed", Some("BackoffLimitExceeded".to_string())))
+                }
+                _ => None
+            };
+            match condition {
+                Some((type_, reason)) => {
+                    let mut conditions = status.conditions.clone().unwrap_or_default();
+                    conditions.push(JobCondition {
+                        type_: type_.to_string(),
+                        status: "True".to_string(),
+                        reason,
+                        last_transition_time: now.clone(),
+                        ..Default::default()
+                    });
+                    status.conditions = Some(conditions);
+                }
+                None => {}
+            }
+        }
+
+        for event in events {
+            state.record_event(event);
+        }
+
+        let mut job = job.clone();
+        job.status = Some(status);
+        state.store_resource(&SupportedResources::Job(job))?;
+
+        Ok(ApplyPlan {
+            actions
+        })
+    }
+
     // returns tuple of (Option(prev node), Option(new node))
     fn plan(state: &mut ClusterState, object: &SupportedResources) -> Result<ApplyPlan, Box<dyn Error>> {
         match object {
             SupportedResources::Pod(pod) => Self::plan_pod(state, pod),
             SupportedResources::Deployment(deployment) => Self::plan_deployment(state, deployment),
-            SupportedResources::DaemonSet(ds) => Self::plan_daemonset(state, ds)
+            SupportedResources::DaemonSet(ds) => Self::plan_daemonset(state, ds),
+            SupportedResources::StatefulSet(sts) => Self::plan_statefulset(state, sts),
+            SupportedResources::HorizontalPodAutoscaler(hpa) => Self::plan_autoscaler(state, hpa),
+            SupportedResources::Job(job) => Self::plan_job(state, job),
+            // only stored, they go to nodes along with the pods that use them
+            SupportedResources::Secret(_) => Ok(ApplyPlan { actions: vec!() }),
+            SupportedResources::ConfigMap(_) => Ok(ApplyPlan { actions: vec!() }),
         }
     }
 
+    // what schedule would do without touching any nodes, creates are given the node they'd land on
+    pub(crate) fn dry_run(state: &mut ClusterState, objects: &Vec<SupportedResources>) -> Vec<ScheduledOperation<SupportedResources>> {
+        let mut result = vec!();
+        for object in objects {
+            let plan = match Self::plan(state, object) {
+                Ok(plan) => plan,
+                Err(err) => {
+                    result.push(ScheduledOperation {
+                        resource: object.clone(),
+                        node: None,
+                        operation: OpType::Info,
+                        error: Some(err.to_string()),
+                    });
+                    continue;
+                }
+            };
+
+            for mut action in plan.actions {
+                if action.operation == OpType::Create {
+                    action.node = Self::choose_node(state.nodes.clone(), &action.resource);
+                    match &action.node {
+                        // so the next pod sees this one when spreading
+                        Some(node) => {
+                            let _ = state.reconcile_object_creation(&action.resource, &node.node_name);
+                        }
+                        None => action.error = Some(Self::infeasible_reason(&state.nodes, &action.resource))
+                    }
+                }
+                result.push(action);
+            }
+        }
+        result
+    }
+
     async fn remove_existing(conns: &SshClients, resource: ScheduledOperation<SupportedResources>) -> Result<(), Box<dyn Error>> {
         let conn = conns.find(&resource.node.unwrap().node_name).ok_or("failed to find connection to host")?;
 
+        // the grace period the node will wait for, as recorded when the pod was created
+        let grace_period = match &resource.resource {
+            SupportedResources::Pod(p) => p.metadata.labels.as_ref().and_then(|l| l.get("skate.io/grace-period"))
+                .and_then(|g| g.parse().ok()),
+            _ => None
+        }.unwrap_or(DEFAULT_TERMINATION_GRACE_PERIOD);
+
         let manifest = serde_yaml::to_string(&resource.resource).expect("failed to serialize manifest");
-        match conn.remove_resource(&manifest).await {
+        match conn.remove_resource(&manifest, grace_period).await {
             Ok(_) => Ok(()),
             Err(err) => Err(err)
         }
     }
 
-    async fn schedule_one(conns: &SshClients, state: &mut ClusterState, object: SupportedResources) -> Result<Vec<ScheduledOperation<SupportedResources>>, Box<dyn Error>> {
-        let plan = Self::plan(state, &object)?;
-        if plan.actions.len() == 0 {
-            return Err(anyhow!("failed to schedule resources").into());
+    async fn apply_new(conns: &SshClients, state: &ClusterState, action: &ScheduledOperation<SupportedResources>) -> Result<(), Box<dyn Error>> {
+        let node_name = action.node.as_ref().ok_or("no node chosen")?.node_name.clone();
+        let client = conns.find(&node_name).ok_or("failed to find connection to host")?;
+
+        // the downward api's fields are only known now that there's a node
+        let resource = match &action.resource {
+            SupportedResources::Pod(pod) => {
+                let mut pod = pod.clone();
+                let host_ip = action.node.as_ref().and_then(|n| n.host_info.as_ref()).and_then(|h| h.system_info.as_ref())
+                    .and_then(|i| i.internal_ip_address.clone());
+                downward::project(&mut pod, &node_name, host_ip.as_deref())?;
+                SupportedResources::Pod(pod)
+            }
+            resource => resource.clone()
+        };
+
+        // registry credentials are sent separately so they never end up in the manifest or on a command line
+        let mut auth_written = None;
+        match &action.resource {
+            SupportedResources::Pod(pod) => {
+                let name = metadata_name(pod);
+                let auth_file = match state.registry_auth(pod)? {
+                    Some(auth) => {
+                        client.write_registry_auth(&name.namespace, &name.name, &auth).await?;
+                        auth_written = Some((name.namespace.clone(), name.name.clone()));
+                        Some(DefaultExecutor::registry_auth_path(&name.namespace, &name.name))
+                    }
+                    None => None
+                };
+                // the apply goes ahead regardless, kube play pulls whatever is still missing, says why it can't
+                // and takes the credentials off the node again
+                let images = pod_images(pod);
+                match client.pull_images(&images, auth_file.as_deref()).await {
+                    Ok(_) => {}
+                    Err(e) => Entry::warn(format!("{} {}", CROSS_EMOJI, e)).node(&node_name).object(&action.resource).operation("pull").eprint()
+                }
+            }
+            _ => {}
         }
 
+        let serialized = serde_yaml::to_string(&resource).expect("failed to serialize object");
+        let result = client.apply_resource(&serialized).await.map(|_| ());
+        // the skatelet takes the credentials off the node itself once it runs, not when it never got to
+        match (&result, &auth_written) {
+            (Err(_), Some((namespace, name))) => match client.remove_registry_auth(namespace, name).await {
+                Ok(_) => {}
+                Err(e) => Entry::warn(format!("{} {}", CROSS_EMOJI, e)).node(&node_name).object(&action.resource).operation("apply").eprint()
+            },
+            _ => {}
+        }
+        result
+    }
+
+    // nodes are worked on side by side, up to max_concurrency at a time, but each node only gets one
+    // operation at a time since podman doesn't cope well with concurrent changes
+    async fn run_on_nodes(conns: &SshClients, state: &ClusterState, actions: Vec<ScheduledOperation<SupportedResources>>, max_concurrency: usize) -> Vec<(ScheduledOperation<SupportedResources>, Result<(), Box<dyn Error>>)> {
+        let by_node = actions.into_iter().into_group_map_by(|a| a.node.as_ref().map(|n| n.node_name.clone()).unwrap_or_default());
+
+        let results: Vec<Vec<_>> = stream::iter(by_node.into_values().map(|actions| async move {
+            let mut results = vec!();
+            for action in actions {
+                let outcome = match action.operation {
+                    OpType::Delete => Self::remove_existing(conns, action.clone()).await,
+                    _ => Self::apply_new(conns, state, &action).await
+                };
+                results.push((action, outcome));
+            }
+            results
+        })).buffer_unordered(max_concurrency.max(1)).collect().await;
+
+        results.into_iter().flatten().collect()
+    }
+
+    // carries out a plan's deletes, then its creates, a failure on one node doesn't stop the others
+    pub(crate) async fn execute(conns: &SshClients, state: &mut ClusterState, actions: Vec<ScheduledOperation<SupportedResources>>, max_concurrency: usize) -> Result<Vec<ScheduledOperation<SupportedResources>>, Box<dyn Error>> {
         let mut result: Vec<ScheduledOperation<SupportedResources>> = vec!();
+        let mut deletes = vec!();
+        let mut creates = vec!();
 
-        for mut action in plan.actions {
+        for action in actions {
             match action.operation {
-                OpType::Delete => {
+                OpType::Delete => deletes.push(action),
+                OpType::Create => creates.push(action),
+                OpType::Info => {
+                    let node_name = action.node.clone().unwrap().node_name;
+                    Entry::info(format!("{} {} on {}", INFO_EMOJI, action.resource.name(), node_name)).node(&node_name).object(&action.resource).print();
+                    result.push(action);
+                }
+                OpType::Unchanged => {
                     let node_name = action.node.clone().unwrap().node_name;
+                    Entry::info(format!("{} {} on {} unchanged", EQUAL_EMOJI, action.resource.name(), node_name)).node(&node_name).object(&action.resource).operation("unchanged").print();
+                }
+            }
+        }
 
-                    match Self::remove_existing(conns, action.clone()).await {
-                        Ok(_) => {
-                            println!("{} deleted {} on node {} ", CHECKBOX_EMOJI, action.resource.name(), node_name);
-                            result.push(action.clone());
-                        }
-                        Err(err) => {
-                            action.error = Some(err.to_string());
-                            println!("{} failed to delete {} on node {}: {}", CROSS_EMOJI, action.resource.name(), node_name, err.to_string());
-                            result.push(action.clone());
-                        }
+        // a pod recreated on the same node needs the old one gone first
+        let outcomes = Self::run_on_nodes(conns, state, deletes, max_concurrency).await;
+        for (mut action, outcome) in outcomes {
+            let node_name = action.node.clone().unwrap().node_name;
+            match outcome {
+                Ok(_) => {
+                    // so the pods placed after this don't count it when spreading
+                    state.reconcile_object_deletion(&action.resource, &node_name);
+                    state.record_event(Event::for_resource(&action.resource, Some(&node_name), EventType::Normal, "Killed", &format!("deleted from node {}", node_name)));
+                    Entry::info(format!("{} deleted {} on node {} ", CHECKBOX_EMOJI, action.resource.name(), node_name)).node(&node_name).object(&action.resource).operation("delete").print()
+                }
+                Err(err) => {
+                    state.record_event(Event::for_resource(&action.resource, Some(&node_name), EventType::Warning, "FailedKill", &err.to_string()));
+                    action.error = Some(err.to_string());
+                    Entry::error(format!("{} failed to delete {} on node {}: {}", CROSS_EMOJI, action.resource.name(), node_name, err.to_string())).node(&node_name).object(&action.resource).operation("delete").print();
+                }
+            }
+            result.push(action);
+        }
+
+        while creates.len() > 0 {
+            // placed one by one up front, so each pod sees the ones before it when spreading
+            for action in creates.iter_mut() {
+                let node = match Self::choose_node(state.nodes.clone(), &action.resource) {
+                    Some(node) => node,
+                    None => {
+                        let reason = Self::infeasible_reason(&state.nodes, &action.resource);
+                        state.record_event(Event::for_resource(&action.resource, None, EventType::Warning, "FailedScheduling", &reason));
+                        return Err(anyhow!(reason).into());
+                    }
+                };
+                let _ = state.reconcile_object_creation(&action.resource, &node.node_name)?;
+                action.node = Some(node);
+            }
+
+            let mut retries = vec!();
+            let outcomes = Self::run_on_nodes(conns, state, creates, max_concurrency).await;
+            for (mut action, outcome) in outcomes {
+                let node_name = action.node.clone().unwrap().node_name;
+                match outcome {
+                    Ok(_) => {
+                        state.bind_volumes(&action.resource, &node_name);
+                        action.node = state.nodes.iter().find(|n| n.node_name == node_name).cloned();
+                        state.record_event(Event::for_resource(&action.resource, Some(&node_name), EventType::Normal, "Scheduled", &format!("created on node {}", node_name)));
+                        Entry::info(format!("{} created {} on node {}", CHECKBOX_EMOJI, action.resource.name(), node_name)).node(&node_name).object(&action.resource).operation("create").print();
+                        result.push(action);
+                    }
+                    Err(err) if err.downcast_ref::<SshError>().is_some() => {
+                        // the node went away, rule it out rather than retrying it for every pod
+                        Entry::warn(format!("{} node {} unreachable, rescheduling {}: {}", CROSS_EMOJI, node_name, action.resource.name(), err.to_string())).node(&node_name).object(&action.resource).operation("create").print();
+                        state.reconcile_object_deletion(&action.resource, &node_name);
+                        state.mark_node_unreachable(&node_name);
+                        state.record_event(Event::for_resource(&action.resource, Some(&node_name), EventType::Warning, "Rescheduled", &format!("node {} unreachable: {}", node_name, err)));
+                        action.node = None;
+                        retries.push(action);
+                    }
+                    Err(err) => {
+                        state.reconcile_object_deletion(&action.resource, &node_name);
+                        // podman's pull errors are the most common reason for a pod not starting
+                        let reason = match err.to_string().to_lowercase() {
+                            e if e.contains("pull") || e.contains("manifest unknown") => "ErrImagePull",
+                            _ => "FailedCreate"
+                        };
+                        state.record_event(Event::for_resource(&action.resource, Some(&node_name), EventType::Warning, reason, &err.to_string()));
+                        action.error = Some(err.to_string());
+                        Entry::error(format!("{} failed to created {} on node {}: {}", CROSS_EMOJI, action.resource.name(), node_name, err.to_string())).node(&node_name).object(&action.resource).operation("create").print();
+                        result.push(action);
                     }
                 }
-                OpType::Create => {
-                    let node_name = Self::choose_node(state.nodes.clone(), &action.resource).ok_or("failed to find feasible node")?.node_name.clone();
-                    let client = conns.find(&node_name).unwrap();
-                    let serialized = serde_yaml::to_string(&action.resource).expect("failed to serialize object");
+            }
+            creates = retries;
+        }
 
-                    match client.apply_resource(&serialized).await {
-                        Ok(_) => {
-                            let _ = state.reconcile_object_creation(&action.resource, &node_name)?;
+        Ok(result)
+    }
 
-                            println!("{} created {} on node {}", CHECKBOX_EMOJI, action.resource.name(), node_name);
-                            result.push(action.clone());
-                        }
-                        Err(err) => {
-                            action.error = Some(err.to_string());
-                            println!("{} failed to created {} on node {}: {}", CROSS_EMOJI, action.resource.name(), node_name, err.to_string());
-                            result.push(action.clone());
-                        }
+    // None means the deployment should be replaced pod by pod without waiting, which only an explicit Recreate asks
+    // for. like kubernetes, no strategy is a rolling update
+    fn rolling_update_bounds(state: &ClusterState, d: &Deployment) -> Option<RollingUpdateBounds> {
+        let spec = d.spec.as_ref()?;
+        let strategy = spec.strategy.clone().unwrap_or_default();
+        let rolling_update = match strategy.type_.as_deref() {
+            // draining never takes a deployment down all at once, whatever its strategy
+            Some("Recreate") if state.nodes.iter().any(|n| n.draining) => Default::default(),
+            Some("Recreate") => return None,
+            _ => strategy.rolling_update.clone().unwrap_or_default()
+        };
+
+        let name = d.metadata.name.clone().unwrap_or("".to_string());
+        let ns = d.metadata.namespace.clone().unwrap_or("".to_string());
+        let replicas = state.desired_replicas(&name, &ns).or(spec.replicas).unwrap_or(0);
+
+        // kubernetes defaults both to 25%, rounding unavailable down and surge up
+        let max_unavailable = resolve_int_or_percent(rolling_update.max_unavailable.as_ref(), replicas, false);
+        let max_surge = resolve_int_or_percent(rolling_update.max_surge.as_ref(), replicas, true);
+
+        Some(RollingUpdateBounds {
+            max_unavailable: match (max_unavailable, max_surge) {
+                (0, 0) => 1,
+                _ => max_unavailable
+            },
+            max_surge,
+        })
+    }
+
+    // copy of the pod under a temporary name, keeps serving while the real one gets replaced
+    fn surge_pod(action: &ScheduledOperation<SupportedResources>) -> ScheduledOperation<SupportedResources> {
+        let mut surge = action.clone();
+        match surge.resource {
+            SupportedResources::Pod(ref mut pod) => {
+                pod.metadata.name = pod.metadata.name.as_ref().map(|n| format!("{}-surge", n));
+                let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+                labels.insert("skate.io/surge".to_string(), "true".to_string());
+                pod.metadata.labels = Some(labels);
+            }
+            _ => {}
+        }
+        surge
+    }
+
+    pub(crate) async fn wait_for_pods(conns: &SshClients, pods: Vec<(String, String)>, timeout: Duration) -> Result<(), Box<dyn Error>> {
+        let deadline = Instant::now() + timeout;
+        let mut pending = pods;
+
+        while pending.len() > 0 {
+            let mut still_pending = vec!();
+            for (pod_name, node_name) in pending {
+                let conn = conns.find(&node_name).ok_or(anyhow!("no connection to node {}", node_name))?;
+                let info = conn.get_node_system_info().await?;
+                let pod = info.system_info.and_then(|si| si.pods).unwrap_or_default().into_iter().find(|p| p.name == pod_name);
+
+                match pod {
+                    Some(pod) if pod.is_ready() => {
+                        Entry::info(format!("{} {} on node {} is healthy", CHECKBOX_EMOJI, pod_name, node_name)).node(&node_name).resource(&format!("pod/{}", pod_name)).operation("rollout").print();
+                    }
+                    Some(pod) if pod.status == PodmanPodStatus::Exited || pod.status == PodmanPodStatus::Dead => {
+                        return Err(anyhow!("pod {} on node {} failed to become healthy, status {}", pod_name, node_name, pod.status).into());
                     }
+                    _ => still_pending.push((pod_name, node_name))
                 }
-                OpType::Info => {
-                    let node_name = action.node.clone().unwrap().node_name;
-                    println!("{} {} on {}", INFO_EMOJI, action.resource.name(), node_name);
-                    result.push(action.clone());
+            }
+
+            if still_pending.len() > 0 {
+                if Instant::now() >= deadline {
+                    let names: Vec<_> = still_pending.iter().map(|(p, n)| format!("{} on node {}", p, n)).collect();
+                    return Err(anyhow!("timed out waiting for {} to become healthy", names.join(", ")).into());
                 }
-                OpType::Unchanged => {
-                    let node_name = action.node.clone().unwrap().node_name;
-                    println!("{} {} on {} unchanged", EQUAL_EMOJI, action.resource.name(), node_name);
+                tokio::time::sleep(Duration::from_secs(2)).await;
+            }
+            pending = still_pending;
+        }
+        Ok(())
+    }
+
+    async fn rolling_update(conns: &SshClients, state: &mut ClusterState, d: &Deployment, bounds: RollingUpdateBounds, plan: ApplyPlan, max_concurrency: usize) -> Result<Vec<ScheduledOperation<SupportedResources>>, Box<dyn Error>> {
+        let timeout = Duration::from_secs(d.spec.as_ref().and_then(|s| s.progress_deadline_seconds).unwrap_or(600) as u64);
+
+        let mut result: Vec<ScheduledOperation<SupportedResources>> = vec!();
+
+        // plan_pod emits the delete of an old pod straight before the create of its replacement
+        let mut replacements = vec!();
+        let mut additions = vec!();
+        let mut removals = vec!();
+        let mut actions = plan.actions.into_iter().peekable();
+        while let Some(action) = actions.next() {
+            match action.operation {
+                OpType::Delete => {
+                    let replaced_by = match actions.peek() {
+                        Some(next) if next.operation == OpType::Create && next.resource.name().to_string() == action.resource.name().to_string() => actions.next(),
+                        _ => None
+                    };
+                    match replaced_by {
+                        Some(create) => replacements.push((action, create)),
+                        None => removals.push(action)
+                    }
+                }
+                OpType::Create => additions.push(action),
+                _ => {
+                    let node_name = action.node.clone().map(|n| n.node_name).unwrap_or_default();
+                    Entry::info(format!("{} {} on {} unchanged", EQUAL_EMOJI, action.resource.name(), node_name)).node(&node_name).object(&action.resource).operation("unchanged").print();
+                }
+            }
+        }
+
+        // brand new replicas only add capacity so can all go at once
+        let added = Self::execute(conns, state, additions, max_concurrency).await?;
+        match Self::wait_for_pods(conns, Self::created_pods(&added), timeout).await {
+            Ok(_) => {}
+            Err(e) => return Err(Self::rollout_paused(state, &SupportedResources::Deployment(d.clone()), e))
+        }
+        result.extend(added);
+
+        let batch_size = match bounds.max_surge {
+            0 => bounds.max_unavailable,
+            surge => surge
+        }.max(1);
+
+        for batch in replacements.chunks(batch_size) {
+            let mut surges = vec!();
+            if bounds.max_surge > 0 {
+                let planned = batch.iter().map(|(_, create)| Self::surge_pod(create)).collect();
+                surges = Self::execute(conns, state, planned, max_concurrency).await?;
+                match surges.iter().find(|s| s.error.is_some()) {
+                    Some(surge) => {
+                        let err = anyhow!("failed to start {}: {}", surge.resource.name(), surge.error.clone().unwrap_or_default());
+                        return Err(Self::rollout_paused(state, &SupportedResources::Deployment(d.clone()), err.into()));
+                    }
+                    None => {}
+                }
+                match Self::wait_for_pods(conns, Self::created_pods(&surges), timeout).await {
+                    Ok(_) => {}
+                    Err(e) => return Err(Self::rollout_paused(state, &SupportedResources::Deployment(d.clone()), e))
                 }
             }
+
+            let replaced = batch.iter().flat_map(|(delete, create)| vec![delete.clone(), create.clone()]).collect();
+            let replaced = Self::execute(conns, state, replaced, max_concurrency).await?;
+            match Self::wait_for_pods(conns, Self::created_pods(&replaced), timeout).await {
+                Ok(_) => {}
+                Err(e) => return Err(Self::rollout_paused(state, &SupportedResources::Deployment(d.clone()), e))
+            }
+            result.extend(replaced);
+
+            let surges = surges.into_iter().map(|mut s| {
+                s.operation = OpType::Delete;
+                s
+            }).collect();
+            Self::execute(conns, state, surges, max_concurrency).await?;
         }
 
+        result.extend(Self::execute(conns, state, removals, max_concurrency).await?);
+
         Ok(result)
     }
+
+    // recorded against the deployment or statefulset so it shows up in `skate get events`
+    fn rollout_paused(state: &mut ClusterState, object: &SupportedResources, err: Box<dyn Error>) -> Box<dyn Error> {
+        state.record_event(Event::for_resource(object, None, EventType::Warning, "RolloutPaused", &err.to_string()));
+        anyhow!("rollout of {} {} paused: {}", object.to_string().to_lowercase(), object.name().name, err).into()
+    }
+
+    // new ordinals are started lowest first and updated ones are replaced highest first, like kubernetes, each one
+    // ready before the next is touched. scaled down pods go last, highest first
+    async fn ordered_rollout(conns: &SshClients, state: &mut ClusterState, sts: &StatefulSet, plan: ApplyPlan, max_concurrency: usize) -> Result<Vec<ScheduledOperation<SupportedResources>>, Box<dyn Error>> {
+        let object = SupportedResources::StatefulSet(sts.clone());
+        let replicas = sts.spec.as_ref().and_then(|s| s.replicas).unwrap_or(1);
+
+        let (removals, actions): (Vec<_>, Vec<_>) = plan.actions.into_iter()
+            .partition(|a| a.operation == OpType::Delete && pod_ordinal(&a.resource) >= replicas);
+        let by_ordinal = actions.into_iter().fold(BTreeMap::<i32, Vec<_>>::new(), |mut acc, action| {
+            acc.entry(pod_ordinal(&action.resource)).or_insert(vec!()).push(action);
+            acc
+        });
+        let (replacements, additions): (Vec<_>, Vec<_>) = by_ordinal.into_iter()
+            .partition(|(_, actions)| actions.iter().any(|a| a.operation == OpType::Delete));
+
+        let mut result = vec!();
+        for (_, actions) in additions.into_iter().chain(replacements.into_iter().rev()) {
+            let executed = Self::execute(conns, state, actions, max_concurrency).await?;
+            match executed.iter().find(|a| a.error.is_some()) {
+                Some(failed) => {
+                    let err = anyhow!("failed to start {}: {}", failed.resource.name(), failed.error.clone().unwrap_or_default());
+                    return Err(Self::rollout_paused(state, &object, err.into()));
+                }
+                None => {}
+            }
+            match Self::wait_for_pods(conns, Self::created_pods(&executed), STATEFULSET_READY_TIMEOUT).await {
+                Ok(_) => {}
+                Err(e) => return Err(Self::rollout_paused(state, &object, e))
+            }
+            result.extend(executed);
+        }
+
+        for removal in removals {
+            let removed = Self::execute(conns, state, vec!(removal), max_concurrency).await?;
+            Self::remove_scaled_volumes(conns, state, sts, &removed).await;
+            result.extend(removed);
+        }
+
+        Ok(result)
+    }
+
+    // scaled down pods keep their volumes, for when they're scaled back up, unless
+    // persistentVolumeClaimRetentionPolicy.whenScaled is Delete
+    async fn remove_scaled_volumes(conns: &SshClients, state: &mut ClusterState, sts: &StatefulSet, removed: &Vec<ScheduledOperation<SupportedResources>>) {
+        let policy = sts.spec.as_ref().and_then(|s| s.persistent_volume_claim_retention_policy.as_ref()).and_then(|p| p.when_scaled.clone());
+        if policy.as_deref() != Some("Delete") {
+            return;
+        }
+        let ns = sts.metadata.namespace.clone().unwrap_or_default();
+        let replicas = sts.spec.as_ref().and_then(|s| s.replicas).unwrap_or(1);
+
+        // replaced pods are recreated with the same volumes, only the ones scaled away lose theirs
+        for action in removed.iter().filter(|a| a.operation == OpType::Delete && a.error.is_none() && pod_ordinal(&a.resource) >= replicas) {
+            let node_name = match &action.node {
+                Some(node) => node.node_name.clone(),
+                None => continue
+            };
+            let conn = match conns.find(&node_name) {
+                Some(conn) => conn,
+                None => continue
+            };
+            for volume in claim_volumes(sts, &action.resource.name().name) {
+                let claim = match volume.persistent_volume_claim {
+                    Some(claim) => claim.claim_name,
+                    None => continue
+                };
+                match conn.remove_volume(&claim).await {
+                    Ok(_) => {
+                        state.volume_nodes.remove(&format!("{}/{}", ns, claim));
+                        Entry::info(format!("{} deleted volume {} on node {}", CHECKBOX_EMOJI, claim, node_name)).node(&node_name).resource(&format!("volume/{}", claim)).operation("delete").print()
+                    }
+                    Err(e) => Entry::error(format!("{} failed to delete volume {} on node {}: {}", CROSS_EMOJI, claim, node_name, e)).node(&node_name).resource(&format!("volume/{}", claim)).operation("delete").print()
+                }
+            }
+        }
+    }
+
+    // (pod, node) for every pod that was successfully created
+    fn created_pods(actions: &Vec<ScheduledOperation<SupportedResources>>) -> Vec<(String, String)> {
+        actions.iter().filter(|a| a.operation == OpType::Create && a.error.is_none()).filter_map(|a| {
+            Some((a.resource.name().name, a.node.as_ref()?.node_name.clone()))
+        }).collect()
+    }
+
+    async fn schedule_one(conns: &SshClients, state: &mut ClusterState, object: SupportedResources, max_concurrency: usize) -> Result<Vec<ScheduledOperation<SupportedResources>>, Box<dyn Error>> {
+        let plan = Self::plan(state, &object)?;
+        if plan.actions.len() == 0 {
+            match &object {
+                // nothing left to do for a finished job
+                SupportedResources::Job(_) => return Ok(vec!()),
+                SupportedResources::Secret(_) => {
+                    Entry::info(format!("{} secret {} stored", CHECKBOX_EMOJI, object.name())).object(&object).operation("store").print();
+                    return Ok(vec!());
+                }
+                SupportedResources::ConfigMap(_) => {
+                    Entry::info(format!("{} configmap {} stored", CHECKBOX_EMOJI, object.name())).object(&object).operation("store").print();
+                    return Ok(vec!());
+                }
+                _ => return Err(anyhow!("failed to schedule resources").into())
+            }
+        }
+
+        match &object {
+            SupportedResources::Deployment(d) => match Self::rolling_update_bounds(state, d) {
+                Some(bounds) => return Self::rolling_update(conns, state, d, bounds, plan, max_concurrency).await,
+                None => {}
+            },
+            SupportedResources::StatefulSet(sts) => match sts.spec.as_ref().and_then(|s| s.pod_management_policy.as_deref()) {
+                Some("Parallel") => {
+                    let result = Self::execute(conns, state, plan.actions, max_concurrency).await?;
+                    Self::remove_scaled_volumes(conns, state, sts, &result).await;
+                    return Ok(result);
+                }
+                _ => return Self::ordered_rollout(conns, state, sts, plan, max_concurrency).await
+            },
+            _ => {}
+        }
+
+        Self::execute(conns, state, plan.actions, max_concurrency).await
+    }
+}
+
+// statefulsets have no progressDeadlineSeconds, this is the deployment default
+const STATEFULSET_READY_TIMEOUT: Duration = Duration::from_secs(600);
+
+fn pod_ordinal(object: &SupportedResources) -> i32 {
+    match object {
+        SupportedResources::Pod(pod) => pod.metadata.labels.as_ref().and_then(|l| l.get("skate.io/ordinal"))
+            .and_then(|o| o.parse::<i32>().ok()).unwrap_or(0),
+        _ => 0
+    }
+}
+
+// one persistentVolumeClaim volume per claim template, named <template>-<pod> like kubernetes names the claims, plus
+// the namespace since podman volumes aren't namespaced
+pub(crate) fn claim_volumes(sts: &StatefulSet, pod_name: &str) -> Vec<Volume> {
+    let ns = sts.metadata.namespace.clone().unwrap_or_default();
+    sts.spec.as_ref().and_then(|s| s.volume_claim_templates.clone()).unwrap_or_default().into_iter().filter_map(|t| {
+        let template = t.metadata.name?;
+        Some(Volume {
+            name: template.clone(),
+            persistent_volume_claim: Some(PersistentVolumeClaimVolumeSource {
+                claim_name: format!("{}-{}.{}", template, pod_name, ns),
+                read_only: None,
+            }),
+            ..Default::default()
+        })
+    }).collect()
+}
+
+// matches skatelet's default when the pod doesn't set terminationGracePeriodSeconds
+pub(crate) const DEFAULT_TERMINATION_GRACE_PERIOD: u64 = 10;
+
+// kept as a label since the pod info we get back from nodes doesn't include the spec
+// kept as labels, so what's already on a node can be counted from podman's view of it
+fn record_resource_requests(pod: &mut Pod) -> Result<(), Box<dyn Error>> {
+    let (cpu, memory) = match pod.spec.as_ref() {
+        Some(spec) => pod_requests(spec)?,
+        None => return Ok(())
+    };
+    let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+    if cpu > 0 {
+        labels.insert("skate.io/cpu-request".to_string(), cpu.to_string());
+    }
+    if memory > 0 {
+        labels.insert("skate.io/memory-request".to_string(), memory.to_string());
+    }
+    pod.metadata.labels = Some(labels);
+    Ok(())
+}
+
+// so pods already running can be checked against taints added after they were scheduled
+fn record_tolerations(pod: &mut Pod) -> Result<(), Box<dyn Error>> {
+    match pod.spec.as_ref().and_then(|s| s.tolerations.as_ref()) {
+        Some(tolerations) if tolerations.len() > 0 => {
+            let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+            labels.insert("skate.io/tolerations".to_string(), serde_json::to_string(tolerations)?);
+            pod.metadata.labels = Some(labels);
+        }
+        _ => {}
+    }
+    Ok(())
+}
+
+// init containers first, in the order they start, each image once
+fn pod_images(pod: &Pod) -> Vec<String> {
+    pod.spec.as_ref().map(|s| s.init_containers.iter().flatten().chain(s.containers.iter())
+        .filter_map(|c| c.image.clone())
+        .unique()
+        .collect()).unwrap_or_default()
+}
+
+fn record_grace_period(pod: &mut Pod) {
+    match pod.spec.as_ref().and_then(|s| s.termination_grace_period_seconds) {
+        Some(grace) => {
+            let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+            labels.insert("skate.io/grace-period".to_string(), grace.max(0).to_string());
+            pod.metadata.labels = Some(labels);
+        }
+        None => {}
+    }
+}
+
+// the skatelet leaves restarting to skate for pods marked for it, so it can back off. that's only with
+// reconcile_restarts on the cluster, podman keeps restarting them otherwise since nothing else would
+fn record_restart_policy(pod: &mut Pod, reconcile_restarts: bool) -> Result<(), Box<dyn Error>> {
+    let policy = pod.spec.as_ref().and_then(|s| s.restart_policy.clone()).unwrap_or("Always".to_string());
+    match policy.as_str() {
+        "Always" | "OnFailure" | "Never" => {}
+        _ => return Err(anyhow!("restartPolicy must be Always, OnFailure or Never, got {}", policy).into())
+    }
+    let mut labels = pod.metadata.labels.clone().unwrap_or_default();
+    labels.insert(RESTART_POLICY_LABEL.to_string(), policy);
+    if reconcile_restarts {
+        labels.insert(RECONCILE_RESTARTS_LABEL.to_string(), "true".to_string());
+    }
+    pod.metadata.labels = Some(labels);
+    Ok(())
+}
+
+// resolves a rolling update bound that's either an absolute number or a percentage of replicas
+fn resolve_int_or_percent(value: Option<&IntOrString>, replicas: i32, round_up: bool) -> usize {
+    match value {
+        Some(IntOrString::Int(i)) => (*i).max(0) as usize,
+        Some(IntOrString::String(s)) => {
+            let percent = s.trim().trim_end_matches('%').parse::<f64>().unwrap_or(25.0);
+            let count = replicas.max(0) as f64 * percent / 100.0;
+            match round_up {
+                true => count.ceil() as usize,
+                false => count.floor() as usize
+            }
+        }
+        None => resolve_int_or_percent(Some(&IntOrString::String("25%".to_string())), replicas, round_up)
+    }
 }
 
 #[async_trait(? Send)]
@@ -390,12 +1533,12 @@ impl Scheduler for DefaultScheduler {
     async fn schedule(&self, conns: &SshClients, state: &mut ClusterState, objects: Vec<SupportedResources>) -> Result<ScheduleResult, Box<dyn Error>> {
         let mut results = ScheduleResult { placements: vec![] };
         for object in objects {
-            match Self::schedule_one(&conns, state, object.clone()).await {
+            match Self::schedule_one(&conns, state, object.clone(), self.max_concurrency).await {
                 Ok(placements) => {
                     results.placements = [results.placements, placements].concat();
                 }
                 Err(err) => {
-                    println!("{} failed to schedule {} : {}", CROSS_EMOJI, object.name(), err.to_string());
+                    Entry::error(format!("{} failed to schedule {} : {}", CROSS_EMOJI, object.name(), err.to_string())).object(&object).operation("schedule").print();
                     results.placements = [results.placements, vec![ScheduledOperation {
                         resource: object.clone(),
                         node: None,
@@ -0,0 +1,308 @@
+use std::collections::BTreeMap;
+use std::error::Error;
+use std::fmt;
+use std::fs;
+use std::io::Write;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::Path;
+use anyhow::anyhow;
+use base64::Engine;
+use base64::engine::general_purpose;
+use chrono::{SecondsFormat, Utc};
+use clap::{Args, Subcommand};
+use itertools::Itertools;
+use k8s_openapi::api::core::v1::Secret;
+use k8s_openapi::ByteString;
+use openssl::rand::rand_bytes;
+use openssl::sha::sha256;
+use openssl::symm::{Cipher, decrypt_aead, encrypt_aead};
+use serde::{Deserialize, Serialize};
+use crate::config::Config;
+use crate::logging;
+use crate::skate::{ConfigFileArgs, SupportedResources};
+use crate::state::state::ClusterState;
+use crate::util::{CHECKBOX_EMOJI, INFO_EMOJI};
+
+// the id of the key a secret's values are encrypted with, its absence means they're in plain text
+pub(crate) const ENCRYPTED_ANNOTATION: &str = "skate.io/encrypted";
+
+const KEY_PREFIX: &str = "SKATE-SECRET-KEY-";
+const NONCE_LEN: usize = 12;
+const TAG_LEN: usize = 16;
+
+#[derive(Clone)]
+pub struct SecretKey {
+    key: Vec<u8>,
+}
+
+// never print the key itself
+impl fmt::Debug for SecretKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "SecretKey({})", self.id())
+    }
+}
+
+impl SecretKey {
+    pub fn generate() -> Result<Self, Box<dyn Error>> {
+        let mut key = vec![0u8; 32];
+        rand_bytes(&mut key)?;
+        Ok(SecretKey { key })
+    }
+
+    // short enough to show, stored on each secret so a wrong key is caught before trying to decrypt with it
+    pub fn id(&self) -> String {
+        sha256(&self.key)[..8].iter().map(|b| format!("{:02x}", b)).join("")
+    }
+
+    // same layout as an age identity file, comments and then the key on a line of its own
+    pub fn load(path: &str) -> Result<Self, Box<dyn Error>> {
+        let path = shellexpand::tilde(path).to_string();
+        let contents = fs::read_to_string(&path).map_err(|e| anyhow!("failed to read secret key file {}", path).context(e))?;
+        let line = contents.lines().map(|l| l.trim()).find(|l| !l.is_empty() && !l.starts_with('#'))
+            .ok_or(anyhow!("no key found in {}", path))?;
+        SecretKey::decode(line).map_err(|e| anyhow!("invalid key in {}: {}", path, e).into())
+    }
+
+    // the key's line in its file, how it's handed to a node
+    pub fn encode(&self) -> String {
+        format!("{}{}", KEY_PREFIX, general_purpose::STANDARD.encode(&self.key))
+    }
+
+    pub fn decode(line: &str) -> Result<Self, Box<dyn Error>> {
+        let encoded = line.strip_prefix(KEY_PREFIX).ok_or(anyhow!("not a skate secret key"))?;
+        let key = general_purpose::STANDARD.decode(encoded)?;
+        if key.len() != 32 {
+            return Err(anyhow!("expected 32 bytes, got {}", key.len()).into());
+        }
+        Ok(SecretKey { key })
+    }
+
+    // refuses to overwrite, losing a key means losing every secret encrypted with it
+    pub fn write(&self, path: &str) -> Result<(), Box<dyn Error>> {
+        let path = shellexpand::tilde(path).to_string();
+        let mut file = fs::OpenOptions::new().write(true).create_new(true).mode(0o600).open(&path)
+            .map_err(|e| anyhow!("failed to create secret key file {}", path).context(e))?;
+        writeln!(file, "# created: {}", Utc::now().to_rfc3339_opts(SecondsFormat::Secs, true))?;
+        writeln!(file, "# key id: {}", self.id())?;
+        writeln!(file, "{}", self.encode())?;
+        Ok(())
+    }
+}
+
+pub fn is_encrypted(secret: &Secret) -> bool {
+    secret.metadata.annotations.as_ref().map(|a| a.contains_key(ENCRYPTED_ANNOTATION)).unwrap_or(false)
+}
+
+// binds each value to the secret and key it belongs to, so values can't be moved between them
+fn associated_data(secret: &Secret, key: &str) -> Vec<u8> {
+    format!("{}/{}/{}", secret.metadata.namespace.clone().unwrap_or_default(), secret.metadata.name.clone().unwrap_or_default(), key).into_bytes()
+}
+
+// stringData is folded into data first, like the api server does, so only data is left holding anything
+pub fn encrypt(secret: &Secret, key: &SecretKey) -> Result<Secret, Box<dyn Error>> {
+    if is_encrypted(secret) {
+        return Ok(secret.clone());
+    }
+
+    let mut plain: BTreeMap<String, Vec<u8>> = secret.data.clone().unwrap_or_default().into_iter().map(|(k, v)| (k, v.0)).collect();
+    plain.extend(secret.string_data.clone().unwrap_or_default().into_iter().map(|(k, v)| (k, v.into_bytes())));
+
+    let mut data = BTreeMap::new();
+    for (name, value) in plain {
+        let mut nonce = [0u8; NONCE_LEN];
+        rand_bytes(&mut nonce)?;
+        let mut tag = [0u8; TAG_LEN];
+        let ciphertext = encrypt_aead(Cipher::aes_256_gcm(), &key.key, Some(&nonce), &associated_data(secret, &name), &value, &mut tag)?;
+        data.insert(name, ByteString([nonce.to_vec(), ciphertext, tag.to_vec()].concat()));
+    }
+
+    let mut encrypted = secret.clone();
+    encrypted.data = Some(data);
+    encrypted.string_data = None;
+    encrypted.metadata.annotations.get_or_insert_with(BTreeMap::new).insert(ENCRYPTED_ANNOTATION.to_string(), key.id());
+    Ok(encrypted)
+}
+
+pub fn decrypt(secret: &Secret, key: Option<&SecretKey>) -> Result<Secret, Box<dyn Error>> {
+    let key_id = match secret.metadata.annotations.as_ref().and_then(|a| a.get(ENCRYPTED_ANNOTATION)) {
+        Some(key_id) => key_id.clone(),
+        None => {
+            logging::sensitive_secret(secret);
+            return Ok(secret.clone());
+        }
+    };
+    let name = secret.metadata.name.clone().unwrap_or_default();
+    let key = key.ok_or(anyhow!("secret {} is encrypted but the cluster has no secret_key_file configured", name))?;
+    if key.id() != key_id {
+        return Err(anyhow!("secret {} is encrypted with key {}, the configured key is {}", name, key_id, key.id()).into());
+    }
+
+    let mut data = BTreeMap::new();
+    for (value_name, value) in secret.data.clone().unwrap_or_default() {
+        if value.0.len() < NONCE_LEN + TAG_LEN {
+            return Err(anyhow!("secret {} key {} is corrupt", name, value_name).into());
+        }
+        let (nonce, rest) = value.0.split_at(NONCE_LEN);
+        let (ciphertext, tag) = rest.split_at(rest.len() - TAG_LEN);
+        let plain = decrypt_aead(Cipher::aes_256_gcm(), &key.key, Some(nonce), &associated_data(secret, &value_name), ciphertext, tag)
+            .map_err(|e| anyhow!("failed to decrypt secret {} key {}", name, value_name).context(e))?;
+        data.insert(value_name, ByteString(plain));
+    }
+
+    let mut decrypted = secret.clone();
+    decrypted.data = Some(data);
+    logging::sensitive_secret(&decrypted);
+    match decrypted.metadata.annotations.as_mut() {
+        Some(annotations) => {
+            annotations.remove(ENCRYPTED_ANNOTATION);
+            if annotations.is_empty() {
+                decrypted.metadata.annotations = None;
+            }
+        }
+        None => {}
+    }
+    Ok(decrypted)
+}
+
+// what skate sends a node to put a pod's registry credentials together from: its imagePullSecrets as stored, and the
+// key to decrypt them with, which isn't kept on the node
+#[derive(Serialize, Deserialize)]
+pub struct RegistryAuthRequest {
+    pub key: Option<String>,
+    pub secrets: Vec<Secret>,
+}
+
+// the imagePullSecrets merged into one docker config, for podman's --authfile. only done on the node the pod goes to,
+// the one place their values are decrypted
+pub fn registry_auth(request: &RegistryAuthRequest) -> Result<String, Box<dyn Error>> {
+    let key = match &request.key {
+        Some(key) => Some(SecretKey::decode(key)?),
+        None => None
+    };
+
+    let mut auths = serde_json::Map::new();
+    for secret in &request.secrets {
+        let name = secret.metadata.name.clone().unwrap_or_default();
+        let secret = decrypt(secret, key.as_ref())?;
+        let config = secret.data.as_ref().and_then(|d| d.get(".dockerconfigjson")).map(|b| b.0.clone())
+            .or_else(|| secret.string_data.as_ref().and_then(|d| d.get(".dockerconfigjson")).map(|s| s.clone().into_bytes()))
+            .ok_or(anyhow!("imagePullSecret {} has no .dockerconfigjson", name))?;
+        let config: serde_json::Value = serde_json::from_slice(&config)
+            .map_err(|e| anyhow!("imagePullSecret {} is not valid json: {}", name, e))?;
+
+        // a later secret wins when two have credentials for the same registry
+        match config.get("auths").and_then(|a| a.as_object()) {
+            Some(registries) => auths.extend(registries.clone()),
+            None => return Err(anyhow!("imagePullSecret {} has no auths", name).into())
+        }
+    }
+
+    Ok(serde_json::json!({ "auths": auths }).to_string())
+}
+
+#[derive(Debug, Args)]
+pub struct SecretArgs {
+    #[command(subcommand)]
+    command: SecretCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum SecretCommands {
+    #[command(about = "create a new secret key file", long_about = "Create a new key file for encrypting secrets. Nothing uses it \
+until it's passed to rotate-key.")]
+    GenerateKey(GenerateKeyArgs),
+    #[command(about = "re-encrypt all secrets under a new key", long_about = "Decrypt every stored secret with the cluster's \
+current key, encrypt it again with the new one and make the new key the cluster's secret_key_file. Also how encryption is \
+turned on for a cluster that has no key yet. Running pods are not touched.")]
+    RotateKey(RotateKeyArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct GenerateKeyArgs {
+    #[arg(long_help = "Where to write the key, it must not exist yet.")]
+    file: String,
+}
+
+#[derive(Debug, Args)]
+pub struct RotateKeyArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, long_help = "Key file to encrypt secrets with from now on, as created by generate-key.")]
+    new_key_file: String,
+}
+
+pub async fn secret(args: SecretArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        SecretCommands::GenerateKey(args) => generate_key(args),
+        SecretCommands::RotateKey(args) => rotate_key(args),
+    }
+}
+
+fn generate_key(args: GenerateKeyArgs) -> Result<(), Box<dyn Error>> {
+    let key = SecretKey::generate()?;
+    key.write(&args.file)?;
+    println!("{} wrote key {} to {}", CHECKBOX_EMOJI, key.id(), args.file);
+    Ok(())
+}
+
+// only the local state holds secrets, so there's no need to talk to the nodes
+fn rotate_key(args: RotateKeyArgs) -> Result<(), Box<dyn Error>> {
+    let mut config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?.clone();
+
+    let old_key = match &cluster.secret_key_file {
+        Some(path) => Some(SecretKey::load(path)?),
+        None => None
+    };
+    let new_key = SecretKey::load(&args.new_key_file)?;
+
+    let state = match Path::new(&ClusterState::path(&cluster.name)).exists() {
+        true => Some(ClusterState::load(&cluster.name)?),
+        false => None
+    };
+
+    // everything is decrypted before anything is written, a secret the old key can't open leaves it all as it was
+    let mut rotated = 0;
+    let state = match state {
+        Some(mut state) => {
+            for resource in state.resources.iter_mut() {
+                match resource {
+                    SupportedResources::Secret(secret) => {
+                        let plain = decrypt(secret, old_key.as_ref())?;
+                        *secret = encrypt(&plain, &new_key)?;
+                        rotated += 1;
+                    }
+                    _ => {}
+                }
+            }
+            Some(state)
+        }
+        None => None
+    };
+
+    // the key goes in first: should storing the state fail, the config goes back to the old key, which the stored
+    // secrets are still encrypted with
+    let (index, _) = config.clusters.iter().find_position(|c| c.name == cluster.name)
+        .ok_or(anyhow!("no cluster by name of {}", cluster.name))?;
+    config.clusters[index].secret_key_file = Some(args.new_key_file.clone());
+    config.persist(Some(args.config.skateconfig.clone()))?;
+
+    match state {
+        Some(state) => match state.persist() {
+            Ok(_) => println!("{} re-encrypted {} secrets with key {}", CHECKBOX_EMOJI, rotated, new_key.id()),
+            Err(e) => {
+                config.clusters[index].secret_key_file = cluster.secret_key_file.clone();
+                config.persist(Some(args.config.skateconfig.clone()))?;
+                return Err(anyhow!("failed to store the re-encrypted secrets, kept the old key: {}", e).into());
+            }
+        },
+        None => {}
+    }
+    println!("{} cluster {} now uses secret key file {}", CHECKBOX_EMOJI, cluster.name, args.new_key_file);
+
+    match (&cluster.secret_key_file, old_key) {
+        (Some(path), Some(old_key)) => println!("{} the old key {} in {} is no longer used", INFO_EMOJI, old_key.id(), path),
+        _ => {}
+    }
+    Ok(())
+}
@@ -0,0 +1,98 @@
+use k8s_openapi::api::core::v1::{Container, Pod};
+use crate::logging::Entry;
+use crate::metrics::Metrics;
+use crate::restart;
+use crate::scheduler::DEFAULT_TERMINATION_GRACE_PERIOD;
+use crate::skate::SupportedResources;
+use crate::skatelet::PodmanPodInfo;
+use crate::ssh::SshClients;
+use crate::state::state::{ClusterState, Event, EventType, NodeStatus};
+use crate::util::{CHECKBOX_EMOJI, CROSS_EMOJI};
+
+// the names of the pod's sidecars, comma separated, set on the node so skate can tell them apart from the pod's own
+// containers once they're running
+pub(crate) const SIDECARS_LABEL: &str = "skate.io/sidecars";
+
+// kubernetes' native sidecars: init containers with restartPolicy Always, started before the app containers and left
+// running alongside them
+pub fn is_sidecar(container: &Container) -> bool {
+    container.restart_policy.as_deref() == Some("Always")
+}
+
+// podman runs init containers to completion before anything else starts, which a sidecar never gets to. they go in
+// with the app containers instead, ahead of them so podman starts them first
+pub fn promote(pod: &mut Pod) {
+    let spec = match pod.spec.as_mut() {
+        Some(spec) => spec,
+        None => return
+    };
+    let (mut sidecars, init): (Vec<_>, Vec<_>) = spec.init_containers.clone().unwrap_or_default().into_iter().partition(is_sidecar);
+    if sidecars.len() == 0 {
+        return;
+    }
+    let names = sidecars.iter().map(|c| c.name.clone()).collect::<Vec<_>>().join(",");
+    for sidecar in sidecars.iter_mut() {
+        sidecar.restart_policy = None;
+    }
+    sidecars.extend(spec.containers.drain(..));
+    spec.containers = sidecars;
+    spec.init_containers = match init.len() {
+        0 => None,
+        _ => Some(init)
+    };
+    pod.metadata.labels.get_or_insert_with(Default::default).insert(SIDECARS_LABEL.to_string(), names);
+}
+
+// the pod's own containers have all exited and none of them will be restarted
+pub fn finished(pod: &PodmanPodInfo) -> bool {
+    if pod.sidecars().len() == 0 {
+        return false;
+    }
+    let containers: Vec<_> = pod.containers.clone().unwrap_or_default().into_iter()
+        .filter(|c| !c.is_infra() && !c.init && !pod.is_sidecar(c))
+        .collect();
+    // pods without a recorded restartPolicy are job pods, which podman doesn't restart either
+    let policy = restart::policy(pod).unwrap_or("Never".to_string());
+    containers.len() > 0 && containers.iter().all(|c| match c.exit_code {
+        Some(code) => !restart::wants_restart(&policy, code),
+        None => false
+    })
+}
+
+// sidecars would otherwise keep a pod whose work is done running for good
+pub(crate) async fn stop_finished(conns: &SshClients, state: &mut ClusterState, metrics: &Metrics) {
+    let pods: Vec<_> = state.filter_pods(&|p| finished(p)).into_iter()
+        .filter(|(_, n)| n.status == NodeStatus::Healthy)
+        .map(|(p, n)| (p, n.node_name.clone()))
+        .collect();
+
+    for (pod, node_name) in pods {
+        let running: Vec<_> = pod.containers.clone().unwrap_or_default().into_iter()
+            .filter(|c| pod.is_sidecar(c) && c.status == "running")
+            .map(|c| c.names)
+            .collect();
+        if running.len() == 0 {
+            continue;
+        }
+        let conn = match conns.find(&node_name) {
+            Some(conn) => conn,
+            None => continue
+        };
+
+        let grace_period = pod.labels.get("skate.io/grace-period").and_then(|g| g.parse().ok()).unwrap_or(DEFAULT_TERMINATION_GRACE_PERIOD);
+        let resource = SupportedResources::Pod(pod.clone().into());
+        match conn.stop_containers(&running, grace_period).await {
+            Ok(_) => {
+                Entry::info(format!("{} stopped sidecars {} on node {}: the pod's containers have exited", CHECKBOX_EMOJI, running.join(", "), node_name))
+                    .node(&node_name).object(&resource).operation("stop").print();
+                state.record_event(Event::for_resource(&resource, Some(&node_name), EventType::Normal, "Killing",
+                    &format!("stopping sidecars {}, the pod's containers have exited", running.join(", "))));
+            }
+            Err(e) => {
+                metrics.record_ssh_error(&node_name);
+                Entry::error(format!("{} failed to stop sidecars of {} on node {}: {}", CROSS_EMOJI, pod.name, node_name, e))
+                    .node(&node_name).object(&resource).operation("stop").eprint()
+            }
+        }
+    }
+}
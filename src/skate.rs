@@ -4,8 +4,10 @@ use std::error::Error;
 use async_trait::async_trait;
 use clap::{Args, Command, Parser, Subcommand};
 use k8s_openapi::{List, Metadata, NamespaceResourceScope, Resource, ResourceScope};
-use k8s_openapi::api::apps::v1::{DaemonSet, Deployment, DeploymentSpec};
-use k8s_openapi::api::core::v1::Pod;
+use k8s_openapi::api::apps::v1::{DaemonSet, Deployment, DeploymentSpec, StatefulSet};
+use k8s_openapi::api::autoscaling::v1::HorizontalPodAutoscaler;
+use k8s_openapi::api::batch::v1::Job;
+use k8s_openapi::api::core::v1::{ConfigMap, Pod, Secret};
 use serde_yaml;
 use serde::{Deserialize, Serialize};
 use tokio;
@@ -33,16 +35,51 @@ use crate::create::{create, CreateArgs};
 use crate::delete::{delete, DeleteArgs};
 use crate::get::{get, GetArgs};
 use crate::describe::{DescribeArgs, describe};
+use crate::reconcile::{reconcile, ReconcileArgs};
+use crate::rollout::{rollout, RolloutArgs};
+use crate::logs::{logs, LogArgs};
+use crate::exec::{exec, ExecArgs};
+use crate::port_forward::{port_forward, PortForwardArgs};
+use crate::kustomize::{build, BuildArgs};
+use crate::logging;
+use crate::logging::{Entry, LogFormat};
+use crate::retry;
+use crate::retry::RetryPolicy;
+use crate::top::{top, TopArgs};
+use crate::label::{label, LabelArgs};
+use crate::taint::{taint, TaintArgs};
+use crate::secret::{secret, SecretArgs};
+use crate::cluster::{cluster, ClusterArgs};
+use crate::context::{config as config_command, ConfigArgs};
+use crate::diff::{diff, DiffArgs};
+use crate::cordon::{cordon, CordonArgs, drain, DrainArgs, uncordon};
 use crate::skate::Distribution::{Debian, Raspbian, Ubuntu, Unknown};
 use crate::skate::Os::{Darwin, Linux};
+use crate::ssh;
 use crate::ssh::SshClient;
 use crate::util::{metadata_name, NamespacedName, slugify, TARGET};
+use crate::validate;
 
 
 #[derive(Debug, Parser)]
 #[command(name = "skate")]
 #[command(about = "Skate CLI", long_about = None, arg_required_else_help = true, version)]
 struct Cli {
+    // the same as each command's own --context, so it can come before the command too
+    #[arg(long, global = true, long_help = "Name of the context to use.")]
+    context: Option<String>,
+    #[arg(long, global = true, value_enum, default_value_t = LogFormat::Text, env = "SKATE_LOG_FORMAT", long_help = "Format of skate's \
+own log lines: text, or json with level, timestamp, node, resource, operation and message fields. Command output such as get's \
+tables is left as is.")]
+    log_format: LogFormat,
+    #[arg(long, global = true, default_value_t = retry::DEFAULT_RETRIES, env = "SKATE_RETRIES", long_help = "How many times to \
+retry a node operation that is safe to repeat (connecting, pulling images, restarts, status checks) when it fails in a way \
+that could go away by itself, like a timeout or a reset connection. Authentication failures and bad manifests aren't \
+retried, and neither is applying or removing a resource.")]
+    retries: u32,
+    #[arg(long, global = true, default_value_t = retry::DEFAULT_RETRY_BACKOFF, env = "SKATE_RETRY_BACKOFF", long_help = "Seconds \
+to wait before the first retry, doubling after each one up to 30s.")]
+    retry_backoff: f64,
     #[command(subcommand)]
     command: Commands,
 }
@@ -52,9 +89,36 @@ enum Commands {
     Create(CreateArgs),
     Delete(DeleteArgs),
     Apply(ApplyArgs),
+    #[command(about = "print manifests as apply would see them, with the kustomization and variables applied")]
+    Build(BuildArgs),
     Refresh(RefreshArgs),
     Get(GetArgs),
     Describe(DescribeArgs),
+    Reconcile(ReconcileArgs),
+    Rollout(RolloutArgs),
+    Logs(LogArgs),
+    #[command(about = "run a command in a container of a running pod")]
+    Exec(ExecArgs),
+    #[command(about = "forward local ports to a pod over ssh")]
+    PortForward(PortForwardArgs),
+    #[command(about = "show cpu and memory usage of nodes and pods")]
+    Top(TopArgs),
+    Label(LabelArgs),
+    #[command(about = "add or remove taints on a node")]
+    Taint(TaintArgs),
+    #[command(about = "manage the key secrets are encrypted with")]
+    Secret(SecretArgs),
+    #[command(about = "switch between and list contexts")]
+    Config(ConfigArgs),
+    Diff(DiffArgs),
+    #[command(about = "back up and restore the cluster's state")]
+    Cluster(ClusterArgs),
+    #[command(about = "mark a node as unschedulable")]
+    Cordon(CordonArgs),
+    #[command(about = "mark a node as schedulable again")]
+    Uncordon(CordonArgs),
+    #[command(about = "cordon a node and move its pods elsewhere")]
+    Drain(DrainArgs),
 }
 
 #[derive(Debug, Clone, Args)]
@@ -68,15 +132,61 @@ pub struct ConfigFileArgs {
 pub async fn skate() -> Result<(), Box<dyn Error>> {
     config::ensure_config();
     let args = Cli::parse();
-    match args.command {
+    logging::init(args.log_format);
+    retry::init(RetryPolicy { retries: args.retries, backoff: Duration::from_secs_f64(args.retry_backoff.max(0.0)) });
+
+    // an interrupted ssh can leave its control socket behind
+    tokio::spawn(async {
+        match tokio::signal::ctrl_c().await {
+            Ok(_) => {
+                ssh::cleanup_control_sockets();
+                process::exit(130);
+            }
+            Err(_) => {}
+        }
+    });
+
+    let result = match args.command {
         Commands::Create(args) => create(args).await,
         Commands::Delete(args) => delete(args).await,
 
         Commands::Apply(args) => apply(args).await,
+        Commands::Build(args) => build(args).await,
         Commands::Refresh(args) => refresh(args).await,
         Commands::Get(args) => get(args).await,
         Commands::Describe(args) => describe(args).await,
+        Commands::Reconcile(args) => reconcile(args).await,
+        Commands::Rollout(args) => rollout(args).await,
+        Commands::Logs(args) => logs(args).await,
+        Commands::Exec(args) => exec(args).await,
+        Commands::PortForward(args) => port_forward(args).await,
+        Commands::Top(args) => top(args).await,
+        Commands::Label(args) => label(args).await,
+        Commands::Taint(args) => taint(args).await,
+        Commands::Secret(args) => secret(args).await,
+        Commands::Cluster(args) => cluster(args).await,
+        Commands::Config(args) => config_command(args).await,
+        Commands::Diff(args) => diff(args).await,
+        Commands::Cordon(args) => cordon(args).await,
+        Commands::Uncordon(args) => uncordon(args).await,
+        Commands::Drain(args) => drain(args).await,
         _ => Ok(())
+    };
+
+    ssh::cleanup_control_sockets();
+    match result {
+        // what main would print, as a log line like any other
+        Err(e) => {
+            let message = format!("{:?}", e);
+            match logging::is_json() {
+                true => {
+                    Entry::error(message).eprint();
+                    process::exit(1)
+                }
+                false => Err(anyhow!(logging::redact(&message)).into())
+            }
+        }
+        Ok(_) => Ok(())
     }
 }
 
@@ -89,6 +199,16 @@ pub enum SupportedResources {
     Deployment(Deployment),
     #[strum(serialize = "DaemonSet")]
     DaemonSet(DaemonSet),
+    #[strum(serialize = "StatefulSet")]
+    StatefulSet(StatefulSet),
+    #[strum(serialize = "HorizontalPodAutoscaler")]
+    HorizontalPodAutoscaler(HorizontalPodAutoscaler),
+    #[strum(serialize = "Job")]
+    Job(Job),
+    #[strum(serialize = "Secret")]
+    Secret(Secret),
+    #[strum(serialize = "ConfigMap")]
+    ConfigMap(ConfigMap),
 }
 
 
@@ -98,8 +218,31 @@ impl SupportedResources {
             SupportedResources::Pod(p) => metadata_name(p),
             SupportedResources::Deployment(d) => metadata_name(d),
             SupportedResources::DaemonSet(d) => metadata_name(d),
+            SupportedResources::StatefulSet(s) => metadata_name(s),
+            SupportedResources::HorizontalPodAutoscaler(h) => metadata_name(h),
+            SupportedResources::Job(j) => metadata_name(j),
+            SupportedResources::Secret(s) => metadata_name(s),
+            SupportedResources::ConfigMap(c) => metadata_name(c),
         }
     }
+    // manifests without a metadata.namespace go in the context's namespace, like kubectl
+    pub fn with_default_namespace(self, namespace: &str) -> Self {
+        let mut resource = self;
+        let meta = match resource {
+            SupportedResources::Pod(ref mut p) => &mut p.metadata,
+            SupportedResources::Deployment(ref mut d) => &mut d.metadata,
+            SupportedResources::DaemonSet(ref mut d) => &mut d.metadata,
+            SupportedResources::StatefulSet(ref mut s) => &mut s.metadata,
+            SupportedResources::HorizontalPodAutoscaler(ref mut h) => &mut h.metadata,
+            SupportedResources::Job(ref mut j) => &mut j.metadata,
+            SupportedResources::Secret(ref mut s) => &mut s.metadata,
+            SupportedResources::ConfigMap(ref mut c) => &mut c.metadata,
+        };
+        if meta.namespace.is_none() {
+            meta.namespace = Some(namespace.to_string());
+        }
+        resource
+    }
     fn fixup_metadata(meta: ObjectMeta, extra_labels: Option<HashMap<String, String>>) -> Result<ObjectMeta, Box<dyn Error>> {
         let mut meta = meta.clone();
         let ns = meta.namespace.clone().unwrap_or("default".to_string());
@@ -192,56 +335,232 @@ impl SupportedResources {
                 };
                 resource
             }
+            SupportedResources::StatefulSet(ref mut sts) => {
+                let original_name = sts.metadata.name.clone().unwrap_or("".to_string());
+                if original_name.is_empty() {
+                    return Err(anyhow!("metadata.name is empty").into());
+                }
+                if sts.metadata.namespace.is_none() {
+                    return Err(anyhow!("metadata.namespace is empty").into());
+                }
+
+                let extra_labels = HashMap::from([
+                    ("skate.io/statefulset".to_string(), original_name)
+                ]);
+                sts.metadata = Self::fixup_metadata(sts.metadata.clone(), None)?;
+                sts.spec = match sts.spec.clone() {
+                    Some(mut spec) => {
+                        let mut meta = spec.template.metadata.clone().unwrap_or_default();
+                        // forward the namespace
+                        meta.namespace = sts.metadata.namespace.clone();
+                        spec.template.metadata = Some(Self::fixup_metadata(meta, Some(extra_labels))?);
+                        Some(spec)
+                    }
+                    None => None
+                };
+                resource
+            }
+            SupportedResources::HorizontalPodAutoscaler(ref mut hpa) => {
+                if hpa.metadata.name.is_none() {
+                    return Err(anyhow!("metadata.name is empty").into());
+                }
+                if hpa.metadata.namespace.is_none() {
+                    return Err(anyhow!("metadata.namespace is empty").into());
+                }
+                hpa.metadata = Self::fixup_metadata(hpa.metadata.clone(), None)?;
+                resource
+            }
+            SupportedResources::Job(ref mut job) => {
+                let original_name = job.metadata.name.clone().unwrap_or("".to_string());
+                if original_name.is_empty() {
+                    return Err(anyhow!("metadata.name is empty").into());
+                }
+                if job.metadata.namespace.is_none() {
+                    return Err(anyhow!("metadata.namespace is empty").into());
+                }
+
+                let extra_labels = HashMap::from([
+                    ("skate.io/job".to_string(), original_name)
+                ]);
+                job.metadata = Self::fixup_metadata(job.metadata.clone(), None)?;
+                job.spec = match job.spec.clone() {
+                    Some(mut spec) => {
+                        let meta = spec.template.metadata.clone().unwrap_or_default();
+                        let mut meta = meta.clone();
+                        // forward the namespace
+                        meta.namespace = job.metadata.namespace.clone();
+                        spec.template.metadata = Some(Self::fixup_metadata(meta, Some(extra_labels))?);
+
+                        // podman would otherwise keep restarting it
+                        spec.template.spec = match spec.template.spec.clone() {
+                            Some(mut pod_spec) => {
+                                match pod_spec.restart_policy.as_deref() {
+                                    None => pod_spec.restart_policy = Some("Never".to_string()),
+                                    Some("Never") | Some("OnFailure") => {}
+                                    Some(policy) => return Err(anyhow!("job restartPolicy must be Never or OnFailure, got {}", policy).into())
+                                }
+                                Some(pod_spec)
+                            }
+                            None => None
+                        };
+                        Some(spec)
+                    }
+                    None => None
+                };
+                resource
+            }
+            SupportedResources::Secret(ref mut secret) => {
+                if secret.metadata.name.is_none() {
+                    return Err(anyhow!("metadata.name is empty").into());
+                }
+                if secret.metadata.namespace.is_none() {
+                    return Err(anyhow!("metadata.namespace is empty").into());
+                }
+                secret.metadata = Self::fixup_metadata(secret.metadata.clone(), None)?;
+                resource
+            }
+            SupportedResources::ConfigMap(ref mut cm) => {
+                if cm.metadata.name.is_none() {
+                    return Err(anyhow!("metadata.name is empty").into());
+                }
+                if cm.metadata.namespace.is_none() {
+                    return Err(anyhow!("metadata.namespace is empty").into());
+                }
+                cm.metadata = Self::fixup_metadata(cm.metadata.clone(), None)?;
+                resource
+            }
         };
         Ok(resource)
     }
 }
 
 
-pub fn read_manifests(filenames: Vec<String>) -> Result<Vec<SupportedResources>, Box<dyn Error>> {
+// the resource along with how it serializes back, fields that go missing on the way weren't ones the type has
+fn parse_document<'de, T: Deserialize<'de> + Serialize>(document: serde_yaml::Deserializer<'de>) -> Result<(T, Value), SerdeYamlError> {
+    let parsed = T::deserialize(document)?;
+    let value = serde_yaml::to_value(&parsed)?;
+    Ok((parsed, value))
+}
+
+// every error in every document is collected, with its path and line, before giving up. with `strict`, fields the
+// resource type doesn't have are errors too rather than being dropped
+pub fn read_manifests(sources: Vec<(String, String)>, strict: bool) -> Result<Vec<SupportedResources>, Box<dyn Error>> {
     let api_version_key = Value::String("apiVersion".to_owned());
     let kind_key = Value::String("kind".to_owned());
 
     let mut result: Vec<SupportedResources> = Vec::new();
+    let mut errors: Vec<String> = Vec::new();
+
+    for (filename, str_file) in sources {
+        // syntax errors stop the parser, there's no going on to the next document after one
+        let values = match serde_yaml::Deserializer::from_str(&str_file).map(Value::deserialize).collect::<Result<Vec<_>, _>>() {
+            Ok(values) => values,
+            Err(e) => {
+                errors.push(format!("{}: {}", filename, e));
+                continue;
+            }
+        };
+        let lines: Vec<&str> = str_file.lines().collect();
+        let offsets = validate::document_offsets(&str_file);
+
+        // each document is read a second time straight into its type, so that errors have positions in the file
+        for (index, (value, document)) in values.iter().zip(serde_yaml::Deserializer::from_str(&str_file)).enumerate() {
+            let mapping = match value {
+                Value::Mapping(mapping) => mapping,
+                _ => continue
+            };
+            let api_version = mapping.get(&api_version_key).and_then(Value::as_str);
+            let kind = mapping.get(&kind_key).and_then(Value::as_str);
+            let parsed = match (api_version, kind) {
+                (Some(api_version), Some(kind)) if
+                api_version == <Pod as Resource>::API_VERSION &&
+                    kind == <Pod as Resource>::KIND =>
+                    {
+                        parse_document::<Pod>(document).map(|(r, v)| (SupportedResources::Pod(r), v))
+                    }
 
-    for filename in filenames {
-        let str_file = fs::read_to_string(filename).expect("failed to read file");
-        for document in serde_yaml::Deserializer::from_str(&str_file) {
-            let value = Value::deserialize(document).expect("failed to read document");
-            if let Value::Mapping(mapping) = &value {
-                let api_version = mapping.get(&api_version_key).and_then(Value::as_str);
-                let kind = mapping.get(&kind_key).and_then(Value::as_str);
-                match (api_version, kind) {
-                    (Some(api_version), Some(kind)) if
-                    api_version == <Pod as Resource>::API_VERSION &&
-                        kind == <Pod as Resource>::KIND =>
-                        {
-                            let pod: Pod = serde::Deserialize::deserialize(value)?;
-                            result.push(SupportedResources::Pod(pod))
-                        }
-
-                    (Some(api_version), Some(kind)) if
-                    api_version == <Deployment as Resource>::API_VERSION &&
-                        kind == <Deployment as Resource>::KIND =>
-                        {
-                            let deployment: Deployment = serde::Deserialize::deserialize(value)?;
-                            result.push(SupportedResources::Deployment(deployment))
-                        }
-                    (Some(api_version), Some(kind)) if
-                    api_version == <DaemonSet as Resource>::API_VERSION &&
-                        kind == <DaemonSet as Resource>::KIND =>
-                        {
-                            let daemonset: DaemonSet = serde::Deserialize::deserialize(value)?;
-                            result.push(SupportedResources::DaemonSet(daemonset))
-                        }
-                    _ => {
-                        return Err(anyhow!(format!("kind {:?}", kind)).context("unsupported resource type").into());
+                (Some(api_version), Some(kind)) if
+                api_version == <Deployment as Resource>::API_VERSION &&
+                    kind == <Deployment as Resource>::KIND =>
+                    {
+                        parse_document::<Deployment>(document).map(|(r, v)| (SupportedResources::Deployment(r), v))
+                    }
+                (Some(api_version), Some(kind)) if
+                api_version == <DaemonSet as Resource>::API_VERSION &&
+                    kind == <DaemonSet as Resource>::KIND =>
+                    {
+                        parse_document::<DaemonSet>(document).map(|(r, v)| (SupportedResources::DaemonSet(r), v))
+                    }
+                (Some(api_version), Some(kind)) if
+                api_version == <StatefulSet as Resource>::API_VERSION &&
+                    kind == <StatefulSet as Resource>::KIND =>
+                    {
+                        parse_document::<StatefulSet>(document).map(|(r, v)| (SupportedResources::StatefulSet(r), v))
+                    }
+                (Some(api_version), Some(kind)) if
+                api_version == <HorizontalPodAutoscaler as Resource>::API_VERSION &&
+                    kind == <HorizontalPodAutoscaler as Resource>::KIND =>
+                    {
+                        parse_document::<HorizontalPodAutoscaler>(document).map(|(r, v)| (SupportedResources::HorizontalPodAutoscaler(r), v))
+                    }
+                (Some(api_version), Some(kind)) if
+                api_version == <Job as Resource>::API_VERSION &&
+                    kind == <Job as Resource>::KIND =>
+                    {
+                        parse_document::<Job>(document).map(|(r, v)| (SupportedResources::Job(r), v))
+                    }
+                (Some(api_version), Some(kind)) if
+                api_version == <Secret as Resource>::API_VERSION &&
+                    kind == <Secret as Resource>::KIND =>
+                    {
+                        parse_document::<Secret>(document).map(|(r, v)| (SupportedResources::Secret(r), v))
+                    }
+                (Some(api_version), Some(kind)) if
+                api_version == <ConfigMap as Resource>::API_VERSION &&
+                    kind == <ConfigMap as Resource>::KIND =>
+                    {
+                        parse_document::<ConfigMap>(document).map(|(r, v)| (SupportedResources::ConfigMap(r), v))
+                    }
+                _ => {
+                    errors.push(format!("{}: document {}: unsupported resource type: apiVersion {:?}, kind {:?}", filename, index + 1, api_version, kind));
+                    continue;
+                }
+            };
+
+            let (resource, parsed_value) = match parsed {
+                Ok(parsed) => parsed,
+                Err(e) => {
+                    errors.push(format!("{}: {}", filename, e));
+                    continue;
+                }
+            };
+
+            if strict {
+                // offsets only line up when every --- was found, otherwise errors go without a line
+                let document_lines = match offsets.len() == values.len() {
+                    true => Some(&lines[offsets[index]..offsets.get(index + 1).cloned().unwrap_or(lines.len())]),
+                    false => None
+                };
+                for path in validate::unknown_fields(value, &parsed_value) {
+                    let key = match path.last() {
+                        Some(validate::PathSegment::Key(key)) => key.clone(),
+                        _ => continue
+                    };
+                    let line = document_lines.and_then(|l| validate::locate(l, &path)).map(|l| offsets[index] + l + 1);
+                    match line {
+                        Some(line) => errors.push(format!("{}: {}: unknown field `{}` at line {}", filename, validate::format_path(&path), key, line)),
+                        None => errors.push(format!("{}: document {}: {}: unknown field `{}`", filename, index + 1, validate::format_path(&path), key))
                     }
                 }
             }
+            result.push(resource);
         }
     }
-    Ok(result)
+
+    match errors.len() {
+        0 => Ok(result),
+        _ => Err(anyhow!("invalid manifests:\n{}", errors.join("\n")).into())
+    }
 }
 
 #[derive(Debug, Display, EnumString, Clone, Serialize, Deserialize)]
@@ -7,6 +7,8 @@ use std::io::{Read};
 
 
 use crate::executor::{DefaultExecutor, Executor};
+use crate::secret;
+use crate::secret::RegistryAuthRequest;
 
 
 #[derive(Debug, Args)]
@@ -59,3 +61,18 @@ pub fn remove(args: RemoveArgs) -> Result<(), Box<dyn Error>> {
     let executor = DefaultExecutor {};
     executor.remove(&manifest, args.termination_grace_period)
 }
+
+#[derive(Debug, Args)]
+pub struct RegistryAuthArgs {
+    namespace: String,
+    name: String,
+}
+
+// the pod's imagePullSecrets come in on stdin, still encrypted, and only leave decrypted into the auth file
+pub fn registry_auth(args: RegistryAuthArgs) -> Result<(), Box<dyn Error>> {
+    let mut buffer = String::new();
+    io::stdin().read_to_string(&mut buffer)?;
+    let request: RegistryAuthRequest = serde_json::from_str(&buffer)?;
+    let auth = secret::registry_auth(&request)?;
+    DefaultExecutor::write_registry_auth(&args.namespace, &args.name, &auth)
+}
@@ -89,6 +89,30 @@ fn extract_prev_result(prev_value: Option<Value>) -> Option<SuccessReply> {
     })
 }
 
+// drops the entries naming a pod, which are its podman name, the alias it's started with. only exact matches, other
+// pods' names may start with this one's. the plugin removes them itself on DEL, by the pod's ip, which doesn't happen
+// when the network teardown fails part way
+pub fn remove_pod_hosts(network_name: &str, pod_name: &str) -> Result<(), Box<dyn Error>> {
+    let addnhosts_path = Path::new(&conf_path()).join(network_name).join("addnhosts");
+    if !addnhosts_path.exists() {
+        return Ok(());
+    }
+
+    lock(network_name, &|| {
+        let contents = fs::read_to_string(&addnhosts_path)?;
+        let kept: Vec<&str> = contents.lines()
+            .filter(|line| !line.split_whitespace().skip(1).any(|name| name == pod_name))
+            .collect();
+        if kept.len() == contents.lines().count() {
+            return Ok(());
+        }
+        let newaddnhosts_path = Path::new(&conf_path()).join(network_name).join("addnhosts-new");
+        fs::write(&newaddnhosts_path, kept.iter().map(|l| format!("{}\n", l)).collect::<String>())?;
+        fs::rename(&newaddnhosts_path, &addnhosts_path)?;
+        Ok(())
+    })
+}
+
 pub fn cni() {
     logger::install("skatelet.log");
 
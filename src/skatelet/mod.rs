@@ -4,9 +4,14 @@ mod apply;
 mod system;
 mod cni;
 mod ocihooks;
+mod probes;
 
 pub use skatelet::skatelet;
+pub use skatelet::VAR_PATH;
 pub use system::SystemInfo;
+pub use system::PodmanContainerInfo;
 pub use system::PodmanPodInfo;
 pub use system::PodmanPodStatus;
+pub use system::PodmanPodStats;
+pub use cni::remove_pod_hosts;
 
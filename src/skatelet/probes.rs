@@ -0,0 +1,244 @@
+use std::error::Error;
+use std::fs;
+use std::io::{Read, Write};
+use std::net::{SocketAddr, TcpStream, ToSocketAddrs};
+use std::process;
+use std::process::Stdio;
+use std::thread;
+use std::time::{Duration, Instant};
+use anyhow::anyhow;
+use chrono::{DateTime, Local, LocalResult, TimeZone};
+use k8s_openapi::api::core::v1::{Container, Probe};
+use k8s_openapi::apimachinery::pkg::util::intstr::IntOrString;
+use serde::{Deserialize, Serialize};
+use crate::executor::DefaultExecutor;
+use crate::skate::exec_cmd;
+use crate::skatelet::skatelet::VAR_PATH;
+use crate::skatelet::system::{list_pods, PodmanContainerInfo, PodmanPodInfo};
+
+// probes are run by `skatelet system probe` once per periodSeconds, results are kept between runs for system info to
+// report
+#[derive(Debug, Serialize, Deserialize)]
+struct ProbeState {
+    started_at: i64,
+    started: DateTime<Local>,
+    last_run: Option<DateTime<Local>>,
+    successes: i32,
+    failures: i32,
+    passing: Option<bool>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum ProbeKind {
+    Readiness,
+    Liveness,
+}
+
+impl ProbeKind {
+    fn name(&self) -> &str {
+        match self {
+            ProbeKind::Readiness => "readiness",
+            ProbeKind::Liveness => "liveness",
+        }
+    }
+    // what to report before the probe has passed or failed enough times to say
+    fn initially(&self) -> bool {
+        match self {
+            ProbeKind::Readiness => false,
+            ProbeKind::Liveness => true,
+        }
+    }
+}
+
+// keeps running the probes that are due, a tick a second covers any periodSeconds
+pub async fn run_probes() -> Result<(), Box<dyn Error>> {
+    loop {
+        match list_pods() {
+            Ok(mut pods) => probe_pods(&mut pods, true),
+            Err(e) => eprintln!("failed to list pods: {}", e)
+        }
+        tokio::time::sleep(Duration::from_secs(1)).await;
+    }
+}
+
+// the last results of every running container's probes, without running any
+pub fn probe_results(pods: &mut Vec<PodmanPodInfo>) {
+    probe_pods(pods, false)
+}
+
+// evaluates the probes of every running container from the manifest it was started with, running the due ones
+fn probe_pods(pods: &mut Vec<PodmanPodInfo>, run: bool) {
+    for pod in pods.iter_mut() {
+        let manifest = match DefaultExecutor::stored_manifest(&pod.namespace(), &pod.name) {
+            Some(manifest) => manifest,
+            None => continue
+        };
+        let specs = manifest.spec.map(|s| s.containers).unwrap_or_default();
+        let pod_name = pod.podman_name();
+        let created = pod.created;
+
+        for container in pod.containers.iter_mut().flatten() {
+            if container.status != "running" {
+                continue;
+            }
+            // podman names containers <pod>-<container>
+            let spec = match specs.iter().find(|c| format!("{}-{}", pod_name, c.name) == container.names) {
+                Some(spec) => spec,
+                None => continue
+            };
+
+            container.ready = spec.readiness_probe.as_ref().map(|p| probe(container, spec, p, ProbeKind::Readiness, created, run));
+            container.live = spec.liveness_probe.as_ref().map(|p| probe(container, spec, p, ProbeKind::Liveness, created, run));
+        }
+    }
+}
+
+fn probe(container: &PodmanContainerInfo, spec: &Container, probe: &Probe, kind: ProbeKind, created: DateTime<Local>, run: bool) -> bool {
+    let path = format!("{}/probes/{}-{}.json", VAR_PATH, container.id, kind.name());
+    let started_at = container.started_at.unwrap_or(0);
+
+    // start over whenever the container restarts
+    let mut state = fs::read_to_string(&path).ok()
+        .and_then(|s| serde_json::from_str::<ProbeState>(&s).ok())
+        .filter(|s| s.started_at == started_at)
+        .unwrap_or_else(|| ProbeState {
+            started_at,
+            started: match Local.timestamp_opt(started_at, 0) {
+                LocalResult::Single(started) if started_at > 0 => started,
+                _ => created
+            },
+            last_run: None,
+            successes: 0,
+            failures: 0,
+            passing: None,
+        });
+
+    let now = Local::now();
+    let initial_delay = probe.initial_delay_seconds.unwrap_or(0) as i64;
+    let period = probe.period_seconds.unwrap_or(10) as i64;
+
+    let due = (now - state.started).num_seconds() >= initial_delay
+        && state.last_run.map(|l| (now - l).num_seconds() >= period).unwrap_or(true);
+    if !due || !run {
+        return state.passing.unwrap_or(kind.initially());
+    }
+
+    let timeout = Duration::from_secs(probe.timeout_seconds.unwrap_or(1).max(1) as u64);
+    match run_probe(container, spec, probe, timeout) {
+        Ok(_) => {
+            state.successes = state.successes + 1;
+            state.failures = 0;
+        }
+        Err(e) => {
+            eprintln!("{} probe for {} failed: {}", kind.name(), container.names, e);
+            state.failures = state.failures + 1;
+            state.successes = 0;
+        }
+    }
+    state.last_run = Some(now);
+
+    if state.successes >= probe.success_threshold.unwrap_or(1) {
+        state.passing = Some(true);
+    }
+    if state.failures >= probe.failure_threshold.unwrap_or(3) {
+        state.passing = Some(false);
+    }
+
+    let _ = fs::create_dir_all(format!("{}/probes", VAR_PATH));
+    match serde_json::to_string(&state) {
+        Ok(json) => {
+            let _ = fs::write(&path, json);
+        }
+        Err(_) => {}
+    }
+
+    state.passing.unwrap_or(kind.initially())
+}
+
+fn run_probe(container: &PodmanContainerInfo, spec: &Container, probe: &Probe, timeout: Duration) -> Result<(), Box<dyn Error>> {
+    match (probe.exec.as_ref(), probe.http_get.as_ref(), probe.tcp_socket.as_ref()) {
+        (Some(exec), _, _) => {
+            let command = exec.command.clone().unwrap_or_default();
+            let mut child = process::Command::new("podman")
+                .args([vec!["exec".to_string(), container.names.clone()], command].concat())
+                .stdin(Stdio::null())
+                .stdout(Stdio::null())
+                .stderr(Stdio::null())
+                .spawn()?;
+
+            let deadline = Instant::now() + timeout;
+            loop {
+                match child.try_wait()? {
+                    Some(status) if status.success() => return Ok(()),
+                    Some(status) => return Err(anyhow!("exited with {}", status).into()),
+                    None if Instant::now() >= deadline => {
+                        let _ = child.kill();
+                        return Err(anyhow!("timed out after {}s", timeout.as_secs()).into());
+                    }
+                    None => thread::sleep(Duration::from_millis(50))
+                }
+            }
+        }
+        (_, Some(http), _) => {
+            if http.scheme.as_deref() == Some("HTTPS") {
+                return Err(anyhow!("https probes are not supported").into());
+            }
+            let host = match &http.host {
+                Some(host) => host.clone(),
+                None => container_ip(container)?
+            };
+            let port = resolve_port(&http.port, spec)?;
+
+            let mut stream = TcpStream::connect_timeout(&socket_addr(&host, port)?, timeout)?;
+            stream.set_read_timeout(Some(timeout))?;
+            stream.set_write_timeout(Some(timeout))?;
+
+            let mut request = format!("GET {} HTTP/1.0\r\nHost: {}\r\n", http.path.clone().unwrap_or("/".to_string()), host);
+            for header in http.http_headers.clone().unwrap_or_default() {
+                request.push_str(&format!("{}: {}\r\n", header.name, header.value));
+            }
+            request.push_str("\r\n");
+            stream.write_all(request.as_bytes())?;
+
+            let mut buf = [0u8; 64];
+            let n = stream.read(&mut buf)?;
+            let status = String::from_utf8_lossy(&buf[..n]).split_whitespace().nth(1)
+                .and_then(|c| c.parse::<u16>().ok())
+                .ok_or(anyhow!("invalid http response"))?;
+            match status {
+                200..=399 => Ok(()),
+                _ => Err(anyhow!("http status {}", status).into())
+            }
+        }
+        (_, _, Some(tcp)) => {
+            let host = match &tcp.host {
+                Some(host) => host.clone(),
+                None => container_ip(container)?
+            };
+            let port = resolve_port(&tcp.port, spec)?;
+            TcpStream::connect_timeout(&socket_addr(&host, port)?, timeout)?;
+            Ok(())
+        }
+        _ => Err(anyhow!("only exec, httpGet and tcpSocket probes are supported").into())
+    }
+}
+
+// containers in a pod share the network namespace, so any of their addresses will do
+fn container_ip(container: &PodmanContainerInfo) -> Result<String, Box<dyn Error>> {
+    let ip = exec_cmd("podman", &["inspect", "--format", "{{range .NetworkSettings.Networks}}{{.IPAddress}} {{end}}", &container.id])?;
+    ip.split_whitespace().next().map(|ip| ip.to_string()).ok_or(anyhow!("no ip address for {}", container.names).into())
+}
+
+fn resolve_port(port: &IntOrString, spec: &Container) -> Result<u16, Box<dyn Error>> {
+    match port {
+        IntOrString::Int(port) => Ok(*port as u16),
+        IntOrString::String(name) => spec.ports.clone().unwrap_or_default().into_iter()
+            .find(|p| p.name.as_ref() == Some(name))
+            .map(|p| p.container_port as u16)
+            .ok_or(anyhow!("no container port named {}", name).into())
+    }
+}
+
+fn socket_addr(host: &str, port: u16) -> Result<SocketAddr, Box<dyn Error>> {
+    (host, port).to_socket_addrs()?.next().ok_or(anyhow!("failed to resolve {}", host).into())
+}
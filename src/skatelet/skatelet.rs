@@ -1,7 +1,7 @@
 use std::error::Error;
 use clap::{Parser, Subcommand};
 use crate::skatelet::apply;
-use crate::skatelet::apply::{ApplyArgs, remove, RemoveArgs};
+use crate::skatelet::apply::{ApplyArgs, registry_auth, RegistryAuthArgs, remove, RemoveArgs};
 use crate::skatelet::cni::cni;
 use crate::skatelet::ocihooks::{HookArgs, oci};
 use crate::skatelet::system::{system, SystemArgs};
@@ -21,6 +21,7 @@ enum Commands {
     Apply(ApplyArgs),
     System(SystemArgs),
     Remove(RemoveArgs),
+    RegistryAuth(RegistryAuthArgs),
     Cni,
     Oci(HookArgs)
 }
@@ -31,6 +32,7 @@ pub async fn skatelet() -> Result<(), Box<dyn Error>> {
         Commands::Apply(args) => apply::apply(args),
         Commands::System(args) => system(args).await,
         Commands::Remove(args) => remove(args),
+        Commands::RegistryAuth(args) => registry_auth(args),
         Commands::Cni => {
             cni();
             Ok(())
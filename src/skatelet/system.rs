@@ -6,12 +6,15 @@ use std::str::FromStr;
 use anyhow::anyhow;
 use chrono::{DateTime, Local};
 use clap::{Args, Subcommand};
-use k8s_openapi::api::core::v1::{Pod, PodSpec, PodStatus as K8sPodStatus};
+use k8s_openapi::api::core::v1::{Pod, PodSpec, PodStatus as K8sPodStatus, Toleration};
 use k8s_openapi::apimachinery::pkg::apis::meta::v1::ObjectMeta;
 use serde::{Deserialize, Serialize};
 use strum_macros::{Display, EnumString};
 
 use crate::skate::{Distribution, exec_cmd, Os, Platform};
+use crate::skatelet::probes;
+use crate::executor::DefaultExecutor;
+use crate::sidecar::{self, SIDECARS_LABEL};
 
 
 #[derive(Debug, Args)]
@@ -25,11 +28,14 @@ pub struct SystemArgs {
 pub enum SystemCommands {
     #[command(about = "report system information")]
     Info,
+    #[command(about = "run the pods' probes as they fall due, until stopped")]
+    Probe,
 }
 
 pub async fn system(args: SystemArgs) -> Result<(), Box<dyn Error>> {
     match args.command {
-        SystemCommands::Info => info().await?
+        SystemCommands::Info => info().await?,
+        SystemCommands::Probe => probes::run_probes().await?
     }
     Ok(())
 }
@@ -58,6 +64,70 @@ pub struct SystemInfo {
     pub internal_ip_address: Option<String>,
     pub external_ip_address: Option<String>,
     pub hostname: String,
+    #[serde(default)]
+    pub pod_stats: Option<Vec<PodmanPodStats>>,
+}
+
+impl SystemInfo {
+    // sum of the cpu usage of all containers in the pod, 100 is one full core
+    pub fn pod_cpu_percent(&self, pod_id: &str) -> Option<f32> {
+        let stats = self.pod_stats.as_ref()?;
+        let usages: Vec<_> = stats.iter().filter(|s| !s.pod.is_empty() && pod_id.starts_with(&s.pod))
+            .map(|s| s.cpu_percent()).collect();
+        match usages.len() {
+            0 => None,
+            _ => Some(usages.iter().sum())
+        }
+    }
+    // sum of the memory used by all containers in the pod, in bytes
+    pub fn pod_memory_bytes(&self, pod_id: &str) -> Option<u64> {
+        let stats = self.pod_stats.as_ref()?;
+        let usages: Vec<_> = stats.iter().filter(|s| !s.pod.is_empty() && pod_id.starts_with(&s.pod))
+            .map(|s| s.memory_bytes()).collect();
+        match usages.len() {
+            0 => None,
+            _ => Some(usages.iter().sum())
+        }
+    }
+}
+
+// one entry per container as output by `podman pod stats --format json`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct PodmanPodStats {
+    #[serde(rename = "Pod")]
+    pub pod: String,
+    #[serde(rename = "CID")]
+    pub container_id: String,
+    #[serde(rename = "Name")]
+    pub name: String,
+    #[serde(rename = "CPU")]
+    pub cpu: String,
+    #[serde(rename = "MemUsage")]
+    pub mem_usage: String,
+    #[serde(rename = "Mem")]
+    pub mem: String,
+}
+
+impl PodmanPodStats {
+    pub fn cpu_percent(&self) -> f32 {
+        self.cpu.trim().trim_end_matches('%').parse::<f32>().unwrap_or(0.0)
+    }
+    // MemUsage is "<used> / <limit>" with podman's decimal units, eg 12.5MB / 2.1GB
+    pub fn memory_bytes(&self) -> u64 {
+        let used = self.mem_usage.split('/').next().unwrap_or("").trim();
+        let (num, unit) = used.split_at(used.find(|c: char| c.is_ascii_alphabetic()).unwrap_or(used.len()));
+        let multiplier: f64 = match unit.to_lowercase().as_str() {
+            "kb" => 1e3,
+            "mb" => 1e6,
+            "gb" => 1e9,
+            "tb" => 1e12,
+            "kib" => 1024.0,
+            "mib" => 1024.0 * 1024.0,
+            "gib" => 1024.0 * 1024.0 * 1024.0,
+            _ => 1.0
+        };
+        (num.trim().parse::<f64>().unwrap_or(0.0) * multiplier) as u64
+    }
 }
 
 #[derive(Clone, Debug, EnumString, Display, Serialize, Deserialize, PartialEq)]
@@ -104,15 +174,65 @@ pub struct PodmanPodInfo {
     pub created: DateTime<Local>,
     pub labels: BTreeMap<String, String>,
     pub containers: Option<Vec<PodmanContainerInfo>>,
+    // what podman calls the pod, <name>.<namespace> so the same name can be used in more than one namespace. name is
+    // without the namespace, like everywhere else in skate
+    #[serde(default)]
+    pub podman_name: String,
 }
 
 impl PodmanPodInfo {
+    // pods from before namespaced names, or from an older skatelet, are called by their plain name
+    pub fn podman_name(&self) -> String {
+        match self.podman_name.is_empty() {
+            true => self.name.clone(),
+            false => self.podman_name.clone()
+        }
+    }
     pub fn namespace(&self) -> String {
         self.labels.get("skate.io/namespace").map(|ns| ns.clone()).unwrap_or("".to_string())
     }
     pub fn deployment(&self) -> String {
         self.labels.get("skate.io/deployment").map(|d| d.clone()).unwrap_or("".to_string())
     }
+    // recorded by skate when the pod was scheduled, in (millicores, bytes)
+    pub fn requests(&self) -> (u64, u64) {
+        let request = |key: &str| self.labels.get(key).and_then(|v| v.parse().ok()).unwrap_or(0);
+        (request("skate.io/cpu-request"), request("skate.io/memory-request"))
+    }
+    // recorded by the scheduler, so taints added later can be checked against pods already running
+    pub fn tolerations(&self) -> Vec<Toleration> {
+        self.labels.get("skate.io/tolerations").and_then(|t| serde_json::from_str(t).ok()).unwrap_or_default()
+    }
+    // podman names of the pod's sidecars, recorded on the node when they were moved in with the app containers
+    pub fn sidecars(&self) -> Vec<String> {
+        self.labels.get(SIDECARS_LABEL).map(|s| s.split(',').filter(|n| !n.is_empty()).map(|n| format!("{}-{}", self.podman_name(), n)).collect())
+            .unwrap_or_default()
+    }
+    pub fn is_sidecar(&self, container: &PodmanContainerInfo) -> bool {
+        self.sidecars().contains(&container.names)
+    }
+    // running with every container up and passing its readiness probe, init containers are done by then
+    pub fn is_ready(&self) -> bool {
+        self.status == PodmanPodStatus::Running && self.containers.clone().unwrap_or_default().iter().filter(|c| !c.init).all(|c| c.is_ready())
+    }
+    // the first init container to fail, the others don't start after it
+    pub fn failed_init_container(&self) -> Option<PodmanContainerInfo> {
+        self.containers.clone().unwrap_or_default().into_iter().find(|c| c.init && c.exit_code.unwrap_or(0) != 0)
+    }
+    // once every container (bar infra, init and sidecars) has exited, the first non zero exit code or 0. a failed init
+    // container is as good as exited
+    pub fn exit_code(&self) -> Option<i32> {
+        match self.failed_init_container() {
+            Some(init) => return init.exit_code,
+            None => {}
+        }
+        let containers: Vec<_> = self.containers.clone().unwrap_or_default().into_iter().filter(|c| !c.is_infra() && !c.init && !self.is_sidecar(c)).collect();
+        if containers.len() == 0 {
+            return None;
+        }
+        let codes: Option<Vec<i32>> = containers.iter().map(|c| c.exit_code).collect();
+        codes.map(|codes| codes.into_iter().find(|c| *c != 0).unwrap_or(0))
+    }
 }
 
 impl From<Pod> for PodmanPodInfo {
@@ -126,6 +246,7 @@ impl From<Pod> for PodmanPodInfo {
             created: value.metadata.creation_timestamp.and_then(|ts| Some(DateTime::from(ts.0))).unwrap_or(DateTime::from(Local::now())),
             labels: value.metadata.labels.unwrap_or(BTreeMap::new()),
             containers: None, // TODO
+            podman_name: "".to_string(),
         }
     }
 }
@@ -236,6 +357,39 @@ pub struct PodmanContainerInfo {
     pub names: String,
     pub status: String,
     pub restart_count: Option<usize>,
+    // filled in from `podman ps` once the container has exited
+    #[serde(default)]
+    pub exit_code: Option<i32>,
+    // unix timestamp, also from `podman ps`
+    #[serde(default)]
+    pub started_at: Option<i64>,
+    // results of the readiness and liveness probes, if the container has them
+    #[serde(default)]
+    pub ready: Option<bool>,
+    #[serde(default)]
+    pub live: Option<bool>,
+    // one of the pod's initContainers, they run one after the other and have to exit 0 before the rest start
+    #[serde(default)]
+    pub init: bool,
+}
+
+impl PodmanContainerInfo {
+    pub fn is_infra(&self) -> bool {
+        self.names.ends_with("-infra")
+    }
+    pub fn is_ready(&self) -> bool {
+        self.status == "running" && self.ready != Some(false)
+    }
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct PodmanContainerState {
+    id: String,
+    exit_code: i32,
+    exited: bool,
+    #[serde(default)]
+    started_at: i64,
 }
 
 // returns (external, internal)
@@ -276,6 +430,69 @@ fn get_ips(os: &Os) -> Result<(Option<String>, Option<String>), Box<dyn Error>>
     Ok((Some(external_ip), None))
 }
 
+// skate's pods on the node, with what podman ps has to say about their containers
+pub(crate) fn list_pods() -> Result<Vec<PodmanPodInfo>, Box<dyn Error>> {
+    let result = match exec_cmd(
+        "sudo",
+        &["podman", "pod", "ps", "--filter", "label=skate.io/namespace", "--format", "json"],
+    ) {
+        Ok(result) => match result.as_str() {
+            "" => "[]".to_string(),
+            "null" => "[]".to_string(),
+            _ => result
+        },
+        Err(err) => {
+            eprintln!("failed to list pods: {}", err);
+            "[]".to_string()
+        }
+    };
+
+    let mut podman_pod_info: Vec<PodmanPodInfo> = serde_json::from_str(&result).map_err(|e| anyhow!(e).context("failed to deserialize pod info"))?;
+
+    // pod ps doesn't report exit codes or start times
+    let container_states: Vec<PodmanContainerState> = match exec_cmd(
+        "sudo",
+        &["podman", "ps", "-a", "--format", "json"],
+    ) {
+        Ok(result) => match result.as_str() {
+            "" | "null" => vec![],
+            _ => serde_json::from_str(&result).unwrap_or_else(|e| {
+                eprintln!("failed to deserialize container states: {}", e);
+                vec![]
+            })
+        },
+        Err(err) => {
+            eprintln!("failed to list containers: {}", err);
+            vec![]
+        }
+    };
+
+    for pod in podman_pod_info.iter_mut() {
+        let suffix = format!(".{}", pod.namespace());
+        pod.podman_name = pod.name.clone();
+        match pod.name.strip_suffix(&suffix) {
+            Some(name) => pod.name = name.to_string(),
+            None => {}
+        }
+
+        // podman doesn't say which containers are init containers, the manifest the pod was started with does. sidecars
+        // are init containers there too, but run with the app containers
+        let init_containers: Vec<_> = DefaultExecutor::stored_manifest(&pod.namespace(), &pod.name)
+            .and_then(|m| m.spec).and_then(|s| s.init_containers).unwrap_or_default().into_iter()
+            .filter(|c| !sidecar::is_sidecar(c))
+            .map(|c| format!("{}-{}", pod.podman_name, c.name)).collect();
+
+        for container in pod.containers.iter_mut().flatten() {
+            let state = container_states.iter().find(|s| s.id.starts_with(&container.id));
+            container.exit_code = state.filter(|s| s.exited).map(|s| s.exit_code);
+            container.started_at = state.map(|s| s.started_at);
+            container.init = init_containers.contains(&container.names);
+        }
+    }
+
+    Ok(podman_pod_info)
+}
+
 const BYTES_IN_MIB: u64 = (2u64).pow(20);
 
 async fn info() -> Result<(), Box<dyn Error>> {
@@ -288,23 +505,24 @@ async fn info() -> Result<(), Box<dyn Error>> {
     );
     let os = Os::from_str_loose(&(sys.name().ok_or("")?));
 
-    let result = match exec_cmd(
+    let mut podman_pod_info = list_pods()?;
+    // run by `skatelet system probe`, only their results are reported here
+    probes::probe_results(&mut podman_pod_info);
+
+    let pod_stats: Option<Vec<PodmanPodStats>> = match exec_cmd(
         "sudo",
-        &["podman", "pod", "ps", "--filter", "label=skate.io/namespace", "--format", "json"],
+        &["podman", "pod", "stats", "--no-stream", "--format", "json"],
     ) {
         Ok(result) => match result.as_str() {
-            "" => "[]".to_string(),
-            "null" => "[]".to_string(),
-            _ => result
+            "" | "null" => Some(vec![]),
+            _ => serde_json::from_str(&result).map_err(|e| eprintln!("failed to deserialize pod stats: {}", e)).ok()
         },
         Err(err) => {
-            eprintln!("failed to list pods: {}", err);
-            "[]".to_string()
+            eprintln!("failed to get pod stats: {}", err);
+            None
         }
     };
 
-    let podman_pod_info: Vec<PodmanPodInfo> = serde_json::from_str(&result).map_err(|e| anyhow!(e).context("failed to deserialize pod info"))?;
-
     let iface_ipv4 = match get_ips(&os) {
         Ok(v) => v,
         Err(e) => {
@@ -346,6 +564,7 @@ async fn info() -> Result<(), Box<dyn Error>> {
         hostname: sys.host_name().unwrap_or("".to_string()),
         external_ip_address: iface_ipv4.0,
         internal_ip_address: iface_ipv4.1,
+        pod_stats,
     };
     let json = serde_json::to_string(&info)?;
     println!("{}", json);
@@ -1,6 +1,13 @@
 use std::error::Error;
+use std::collections::BTreeMap;
 use std::fmt;
 use std::fmt::{Debug, Formatter};
+use std::fs;
+use std::os::unix::fs::DirBuilderExt;
+use std::path::PathBuf;
+use std::process::Stdio;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::time::Duration;
 use anyhow::anyhow;
 use async_ssh2_tokio::{AuthMethod, ServerCheckMethod};
@@ -10,16 +17,41 @@ use base64::engine::general_purpose;
 use futures::stream::FuturesUnordered;
 use itertools::{Either, Itertools};
 use crate::config::{Cluster, Node};
+use crate::executor::DefaultExecutor;
+use crate::secret::RegistryAuthRequest;
 use crate::skate::{Distribution, exec_cmd, Os, Platform};
 use futures::StreamExt;
+use tokio::io::AsyncWriteExt;
 use serde::{Deserialize, Serialize};
 use crate::skatelet::SystemInfo;
 use crate::state::state::{NodeState, NodeStatus};
 use colored::Colorize;
+use crate::logging;
+use crate::logging::Entry;
+use crate::retry;
+use crate::util::shell_quote;
+
+const DEFAULT_CONNECT_TIMEOUT: u64 = 5;
+const DEFAULT_KEEPALIVE_INTERVAL: u64 = 5;
 
 pub struct SshClient {
     pub node_name: String,
-    pub client: Client,
+    pub client: Arc<Client>,
+    // with the cluster defaults applied, for the native client
+    node: Node,
+    connect_timeout: Duration,
+    keepalive_interval: Duration,
+    alive: Arc<AtomicBool>,
+    keepalive: Option<tokio::task::JoinHandle<()>>,
+}
+
+impl Drop for SshClient {
+    fn drop(&mut self) {
+        match &self.keepalive {
+            Some(handle) => handle.abort(),
+            None => {}
+        }
+    }
 }
 
 impl Debug for SshClient {
@@ -52,6 +84,14 @@ impl Into<NodeState> for NodeSystemInfo {
                 false => NodeStatus::Unhealthy
             },
             host_info: Some(self),
+            labels: BTreeMap::new(),
+            unschedulable: false,
+            taints: vec!(),
+            draining: false,
+            failures: 0,
+            last_seen: None,
+            down: false,
+            max_allocation: None,
         }
     }
 }
@@ -64,6 +104,73 @@ impl NodeSystemInfo {
 }
 
 impl SshClient {
+    // false once a keepalive has gone unanswered
+    pub fn is_alive(&self) -> bool {
+        self.alive.load(Ordering::Relaxed)
+    }
+
+    pub fn native_command(&self) -> tokio::process::Command {
+        native_command(&self.node, self.connect_timeout.as_secs(), self.keepalive_interval.as_secs(), false)
+    }
+
+    // goes through the native client's stdin so the credentials don't show up in `ps` on either end. the skatelet
+    // decrypts them and writes the auth file
+    pub async fn write_registry_auth(&self, namespace: &str, name: &str, request: &RegistryAuthRequest) -> Result<(), Box<dyn Error>> {
+        let mut cmd = self.native_command();
+        cmd.arg(format!("sudo skatelet registry-auth {} {}", shell_quote(namespace), shell_quote(name)));
+        let mut child = cmd.stdin(Stdio::piped()).stdout(Stdio::null()).stderr(Stdio::piped()).kill_on_drop(true).spawn()?;
+
+        let mut stdin = child.stdin.take().ok_or(anyhow!("failed to open stdin"))?;
+        stdin.write_all(serde_json::to_string(request)?.as_bytes()).await?;
+        drop(stdin);
+
+        let output = child.wait_with_output().await?;
+        match output.status.success() {
+            true => Ok(()),
+            false => Err(anyhow!("failed to write registry credentials: exit code {}, {}", output.status, String::from_utf8_lossy(&output.stderr)).into())
+        }
+    }
+
+    // for when the skatelet never got to run and remove them itself
+    pub async fn remove_registry_auth(&self, namespace: &str, name: &str) -> Result<(), Box<dyn Error>> {
+        let path = DefaultExecutor::registry_auth_path(namespace, name);
+        let result = self.client.execute(&format!("sudo rm -f {}", shell_quote(&path))).await?;
+        match result.exit_status {
+            0 => Ok(()),
+            _ => Err(anyhow!("failed to remove registry credentials: exit code {}, {}", result.exit_status, result.stderr).into())
+        }
+    }
+
+    // for commands that are safe to run again: retried when the connection or the command fails in a way that could
+    // go away by itself, otherwise the last result is returned as is
+    async fn execute_retrying(&self, cmd: &str, operation: &str) -> Result<CommandExecutedResult, Box<dyn Error>> {
+        retry::retry(&self.node_name, operation, |outcome: &Result<CommandExecutedResult, Box<dyn Error>>| match outcome {
+            Ok(result) if result.exit_status > 0 && retry::transient(&result.stderr) => Some(result.stderr.clone()),
+            Ok(_) => None,
+            Err(_) => retry::failed(outcome)
+        }, || async { Ok(self.client.execute(cmd).await?) }).await
+    }
+
+    // podman would otherwise pull during kube play, where a dropped connection to the registry fails the apply
+    // halfway. pulling on its own first can be retried without any chance of ending up with the pod twice
+    pub async fn pull_images(&self, images: &[String], auth_file: Option<&str>) -> Result<(), Box<dyn Error>> {
+        let auth = auth_file.map(|a| format!(" --authfile {}", shell_quote(a))).unwrap_or_default();
+        for image in images {
+            let result = self.execute_retrying(&format!("sudo podman image exists '{0}' || sudo podman pull -q{1} '{0}'", image, auth), "pull").await?;
+            match result.exit_status {
+                0 => {}
+                _ => {
+                    let message = match result.stderr.len() {
+                        0 => result.stdout,
+                        _ => result.stderr
+                    };
+                    return Err(anyhow!("failed to pull image {}: exit code {}, {}", image, result.exit_status, message).into());
+                }
+            }
+        }
+        Ok(())
+    }
+
     pub async fn get_node_system_info(&self) -> Result<NodeSystemInfo, Box<dyn Error>> {
         let command = "\
 hostname > /tmp/hostname-$$ &
@@ -87,7 +194,7 @@ echo sys=$(cat /tmp/sys-$$);
 echo ovs=$(cat /tmp/ovs-$$);
 ";
 
-        let result = self.client.execute(command).await?;
+        let result = self.execute_retrying(command, "system info").await?;
 
         if result.exit_status > 0 {
             let mut errlines = result.stderr.lines();
@@ -210,9 +317,100 @@ echo ovs=$(cat /tmp/ovs-$$);
         }
     }
 
-    pub async fn remove_resource(&self, manifest: &str) -> Result<(String, String), Box<dyn Error>> {
+    pub async fn restart_container(&self, container: &str) -> Result<(), Box<dyn Error>> {
+        let result = self.execute_retrying(&format!("sudo podman restart {}", container), "restart").await?;
+        match result.exit_status {
+            0 => Ok(()),
+            _ => {
+                let message = match result.stderr.len() {
+                    0 => result.stdout,
+                    _ => result.stderr
+                };
+                Err(anyhow!("failed to restart container: exit code {}, {}", result.exit_status, message).into())
+            }
+        }
+    }
+
+    // runs the init containers again before starting the rest
+    pub async fn restart_pod(&self, pod: &str) -> Result<(), Box<dyn Error>> {
+        let result = self.execute_retrying(&format!("sudo podman pod restart {}", pod), "restart").await?;
+        match result.exit_status {
+            0 => Ok(()),
+            _ => {
+                let message = match result.stderr.len() {
+                    0 => result.stdout,
+                    _ => result.stderr
+                };
+                Err(anyhow!("failed to restart pod: exit code {}, {}", result.exit_status, message).into())
+            }
+        }
+    }
+
+    // waits up to the grace period for them to stop before they're killed
+    pub async fn stop_containers(&self, containers: &[String], grace_period: u64) -> Result<(), Box<dyn Error>> {
+        let result = self.execute_retrying(&format!("sudo podman stop -t {} {}", grace_period, containers.join(" ")), "stop").await?;
+        match result.exit_status {
+            0 => Ok(()),
+            _ => {
+                let message = match result.stderr.len() {
+                    0 => result.stdout,
+                    _ => result.stderr
+                };
+                Err(anyhow!("failed to stop containers: exit code {}, {}", result.exit_status, message).into())
+            }
+        }
+    }
+
+    // podman's view of the containers, as json
+    pub async fn remove_volume(&self, name: &str) -> Result<(), Box<dyn Error>> {
+        let result = self.client.execute(&format!("sudo podman volume rm {}", name)).await?;
+        match result.exit_status {
+            0 => Ok(()),
+            _ => {
+                let message = match result.stderr.len() {
+                    0 => result.stdout,
+                    _ => result.stderr
+                };
+                Err(anyhow!("failed to remove volume: exit code {}, {}", result.exit_status, message).into())
+            }
+        }
+    }
+
+    pub async fn inspect_containers(&self, ids: &[String]) -> Result<serde_json::Value, Box<dyn Error>> {
+        let result = self.execute_retrying(&format!("sudo podman container inspect {}", ids.join(" ")), "inspect").await?;
+        match result.exit_status {
+            0 => Ok(serde_json::from_str(&result.stdout)?),
+            _ => {
+                let message = match result.stderr.len() {
+                    0 => result.stdout,
+                    _ => result.stderr
+                };
+                Err(anyhow!("failed to inspect containers: exit code {}, {}", result.exit_status, message).into())
+            }
+        }
+    }
+
+    // false once the pod has stopped or is gone from the node
+    pub async fn pod_running(&self, pod: &str) -> Result<bool, Box<dyn Error>> {
+        let result = self.execute_retrying(&format!("sudo podman pod inspect --format '{{{{.State}}}}' {}", pod), "status").await?;
+        Ok(result.exit_status == 0 && result.stdout.trim() == "Running")
+    }
+
+    // with the systemd cgroup manager each container runs in a libpod-<id>.scope unit
+    pub async fn unit_state(&self, unit: &str) -> Result<String, Box<dyn Error>> {
+        let result = self.execute_retrying(&format!("systemctl show --property=ActiveState --property=SubState --value {}", unit), "status").await?;
+        match result.exit_status {
+            0 => Ok(result.stdout.lines().filter(|l| !l.trim().is_empty()).join(" / ")),
+            _ => Err(anyhow!("failed to get state of {}: exit code {}, {}", unit, result.exit_status, result.stderr).into())
+        }
+    }
+
+    // waits for the pod to stop in its grace period, so the timeout has to be longer than that
+    pub async fn remove_resource(&self, manifest: &str, grace_period: u64) -> Result<(String, String), Box<dyn Error>> {
         let base64_manifest = general_purpose::STANDARD.encode(manifest);
-        let result = self.client.execute(&format!("echo \"{}\" |base64  --decode|sudo skatelet remove -", base64_manifest)).await?;
+        let timeout = Duration::from_secs(grace_period + 30);
+        let result = tokio::time::timeout(timeout, self.client.execute(&format!("echo \"{}\" |base64  --decode|sudo skatelet remove -", base64_manifest))).await
+            .map_err(|_| anyhow!("timed out after {}s waiting for the pod to stop", timeout.as_secs()))??;
         match result.exit_status {
             0 => {
                 Ok((result.stdout, result.stderr))
@@ -227,15 +425,23 @@ echo ovs=$(cat /tmp/ovs-$$);
         }
     }
 
+    // echoes the command and what it printed, redacted, and errors with the node and the redacted command
     pub async fn execute(self: &SshClient, cmd: &str) -> Result<String, Box<dyn Error>> {
-        cmd.lines().for_each(|l| println!("{} | > {}", self.node_name, l.green()));
+        let command = logging::redact_command(cmd);
+        match logging::is_json() {
+            true => Entry::info(command.clone()).node(&self.node_name).operation("execute").print(),
+            false => command.lines().for_each(|l| println!("{} | > {}", self.node_name, l.green()))
+        }
         let result = self.client.execute(cmd).await.
-            map_err(|e| anyhow!("{} failed", cmd).context(e))?;
+            map_err(|e| anyhow!("{} failed on node {}", command, self.node_name).context(e))?;
         if result.exit_status > 0 {
-            return Err(anyhow!("{} failed", cmd).context(result.stderr).into());
+            return Err(anyhow!("{} failed on node {}", command, self.node_name).context(logging::redact(&result.stderr)).into());
         }
         if result.stdout.len() > 0 {
-            result.stdout.lines().for_each(|l| println!("{} |   {}", self.node_name, l));
+            match logging::is_json() {
+                true => Entry::info(result.stdout.trim_end()).node(&self.node_name).operation("execute").print(),
+                false => result.stdout.lines().for_each(|l| println!("{} |   {}", self.node_name, logging::redact(l)))
+            }
         }
         Ok(result.stdout)
     }
@@ -266,6 +472,15 @@ impl fmt::Display for SshErrors {
     }
 }
 
+impl SshErrors {
+    // on stderr, one line per node that couldn't be reached
+    pub fn log(&self) {
+        for error in &self.errors {
+            Entry::error(error.to_string()).node(&error.node_name).operation("connect").eprint();
+        }
+    }
+}
+
 
 impl Node {
     fn with_cluster_defaults(&self, cluster: &Cluster) -> Node {
@@ -280,9 +495,74 @@ impl Node {
     }
 }
 
+// one per invocation so concurrent skate commands don't share masters
+fn control_dir() -> PathBuf {
+    std::env::temp_dir().join(format!("skate-{}", std::process::id()))
+}
+
+// masters exit along with their last session, this gets rid of anything left behind by an interrupted one
+pub fn cleanup_control_sockets() {
+    let _ = fs::remove_dir_all(control_dir());
+}
+
+// the native openssh client, for when output needs to be streamed as it happens
+pub fn native_ssh_command(cluster: &Cluster, node: &Node) -> tokio::process::Command {
+    let node = node.with_cluster_defaults(cluster);
+    native_command(&node, cluster.connect_timeout.unwrap_or(DEFAULT_CONNECT_TIMEOUT), cluster.keepalive_interval.unwrap_or(DEFAULT_KEEPALIVE_INTERVAL), false)
+}
+
+// same again with a pseudo-terminal on the node, ssh passes resizes and keystrokes like ctrl-c through to it
+pub fn native_ssh_tty_command(cluster: &Cluster, node: &Node) -> tokio::process::Command {
+    let node = node.with_cluster_defaults(cluster);
+    native_command(&node, cluster.connect_timeout.unwrap_or(DEFAULT_CONNECT_TIMEOUT), cluster.keepalive_interval.unwrap_or(DEFAULT_KEEPALIVE_INTERVAL), true)
+}
+
+fn native_command(node: &Node, connect_timeout: u64, keepalive_interval: u64, tty: bool) -> tokio::process::Command {
+    let mut cmd = tokio::process::Command::new("ssh");
+    // same host key policy as the vendored client
+    cmd.args(["-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR"]);
+    cmd.arg("-o").arg(format!("ConnectTimeout={}", connect_timeout));
+    match keepalive_interval {
+        0 => {}
+        interval => {
+            cmd.arg("-o").arg(format!("ServerAliveInterval={}", interval)).args(["-o", "ServerAliveCountMax=3"]);
+        }
+    }
+    // several streams to the same node (eg logs for each container) share one connection
+    let dir = control_dir();
+    match fs::DirBuilder::new().recursive(true).mode(0o700).create(&dir) {
+        Ok(_) => {
+            cmd.args(["-o", "ControlMaster=auto", "-o", "ControlPersist=no"]);
+            cmd.arg("-o").arg(format!("ControlPath={}/%C", dir.to_string_lossy()));
+        }
+        Err(_) => {}
+    }
+    match tty {
+        true => {
+            cmd.arg("-t");
+        }
+        false => {}
+    }
+    cmd.arg("-p").arg(node.port.unwrap_or(22).to_string());
+    match node.key {
+        Some(ref key) => {
+            cmd.arg("-i").arg(shellexpand::tilde(key).to_string());
+        }
+        None => {}
+    }
+    match node.user {
+        Some(ref user) => cmd.arg(format!("{}@{}", user, node.host)),
+        None => cmd.arg(node.host.clone())
+    };
+    cmd
+}
+
 pub async fn node_connection(cluster: &Cluster, node: &Node) -> Result<SshClient, SshError> {
     let node = node.with_cluster_defaults(cluster);
-    match connect_node(&node).await {
+    let timeout = Duration::from_secs(cluster.connect_timeout.unwrap_or(DEFAULT_CONNECT_TIMEOUT));
+    let keepalive = Duration::from_secs(cluster.keepalive_interval.unwrap_or(DEFAULT_KEEPALIVE_INTERVAL));
+    // a refused key stays refused, a timed out or reset connection is worth another try
+    match retry::retry(&node.name, "connect", retry::failed, || connect_node(&node, timeout, keepalive)).await {
         Ok(c) => Ok(c),
         Err(err) => {
             Err(SshError { node_name: node.name.clone(), error: err.into() })
@@ -291,7 +571,18 @@ pub async fn node_connection(cluster: &Cluster, node: &Node) -> Result<SshClient
 }
 
 pub async fn cluster_connections(cluster: &Cluster) -> (Option<SshClients>, Option<SshErrors>) {
-    let fut: FuturesUnordered<_> = cluster.nodes.iter().map(|n| node_connection(cluster, n)).collect();
+    reconnect(cluster, None).await
+}
+
+// keeps the connections that are still alive, only connecting to the nodes that need it
+pub async fn reconnect(cluster: &Cluster, existing: Option<SshClients>) -> (Option<SshClients>, Option<SshErrors>) {
+    let mut kept: Vec<SshClient> = existing.map(|c| c.clients).unwrap_or_default().into_iter()
+        .filter(|c| c.is_alive() && cluster.nodes.iter().any(|n| n.name == c.node_name))
+        .collect();
+
+    let fut: FuturesUnordered<_> = cluster.nodes.iter()
+        .filter(|n| !kept.iter().any(|c| c.node_name == n.name))
+        .map(|n| node_connection(cluster, n)).collect();
 
 
     let results: Vec<_> = fut.collect().await;
@@ -299,6 +590,8 @@ pub async fn cluster_connections(cluster: &Cluster) -> (Option<SshClients>, Opti
         Ok(client) => Either::Left(client),
         Err(err) => Either::Right(err)
     });
+    kept.extend(clients);
+    let clients = kept;
 
 
     return (
@@ -312,11 +605,10 @@ pub async fn cluster_connections(cluster: &Cluster) -> (Option<SshClients>, Opti
         });
 }
 
-async fn connect_node(node: &Node) -> Result<SshClient, Box<dyn Error>> {
+async fn connect_node(node: &Node, timeout: Duration, keepalive: Duration) -> Result<SshClient, Box<dyn Error>> {
     let default_key = "";
     let key = node.key.clone().unwrap_or(default_key.to_string());
     let key = shellexpand::tilde(&key);
-    let timeout = Duration::from_secs(5);
 
     let auth_method = AuthMethod::with_key_file(&key, None);
     let result = tokio::time::timeout(timeout, Client::connect(
@@ -331,9 +623,40 @@ async fn connect_node(node: &Node) -> Result<SshClient, Box<dyn Error>> {
         _ => Err(anyhow!("timeout").into())
     };
 
-    let ssh_client = result?;
+    let ssh_client = Arc::new(result?);
+    let alive = Arc::new(AtomicBool::new(true));
+
+    // the connection gets reused for everything done on the node, this keeps it from
+    // being dropped by firewalls while idle and notices when it has gone away
+    let keepalive_task = match keepalive.as_secs() {
+        0 => None,
+        _ => {
+            let client = ssh_client.clone();
+            let alive = alive.clone();
+            Some(tokio::spawn(async move {
+                loop {
+                    tokio::time::sleep(keepalive).await;
+                    match tokio::time::timeout(keepalive.max(timeout), client.execute("true")).await {
+                        Ok(Ok(_)) => {}
+                        _ => {
+                            alive.store(false, Ordering::Relaxed);
+                            return;
+                        }
+                    }
+                }
+            }))
+        }
+    };
 
-    Ok(SshClient { node_name: node.name.clone(), client: ssh_client })
+    Ok(SshClient {
+        node_name: node.name.clone(),
+        client: ssh_client,
+        node: node.clone(),
+        connect_timeout: timeout,
+        keepalive_interval: keepalive,
+        alive,
+        keepalive: keepalive_task,
+    })
 }
 
 impl SshClients {
@@ -1,19 +1,28 @@
 use std::collections::{BTreeMap, HashSet};
 use serde::{Deserialize, Serialize};
 use std::error::Error;
-use std::fs::File;
+use std::fs::{File, OpenOptions};
 use std::ops::DerefMut;
+use std::os::unix::fs::OpenOptionsExt;
 use std::path::Path;
 use anyhow::anyhow;
+use chrono::{DateTime, Duration, Utc};
 use itertools::Itertools;
-use k8s_openapi::api::core::v1::{NodeSpec, NodeStatus as K8sNodeStatus, Node as K8sNode, NodeAddress};
+use k8s_openapi::api::apps::v1::Deployment;
+use k8s_openapi::api::autoscaling::v1::HorizontalPodAutoscaler;
+use k8s_openapi::api::batch::v1::Job;
+use k8s_openapi::api::core::v1::{ConfigMap, NodeSpec, NodeStatus as K8sNodeStatus, Node as K8sNode, NodeAddress, Pod, Secret, Taint, Toleration};
 use k8s_openapi::apimachinery::pkg::api::resource::Quantity;
 use k8s_openapi::apimachinery::pkg::apis::meta::v1::{ObjectMeta};
 use strum_macros::Display;
 use crate::config::{cache_dir, Config};
 use crate::get::GetCommands::Node;
+use crate::logging;
 use crate::skate::SupportedResources;
-use crate::skatelet::PodmanPodInfo;
+use crate::restart::RestartState;
+use crate::secret;
+use crate::secret::{RegistryAuthRequest, SecretKey};
+use crate::skatelet::{PodmanPodInfo, PodmanPodStatus};
 use crate::ssh::NodeSystemInfo;
 use crate::state::state::NodeStatus::{Healthy, Unhealthy, Unknown};
 use crate::util::{hash_string, slugify};
@@ -30,6 +39,121 @@ pub struct NodeState {
     pub node_name: String,
     pub status: NodeStatus,
     pub host_info: Option<NodeSystemInfo>,
+    // set with `skate label node`
+    #[serde(default)]
+    pub labels: BTreeMap<String, String>,
+    // set with `skate cordon`
+    #[serde(default)]
+    pub unschedulable: bool,
+    // set with `skate taint node`
+    #[serde(default)]
+    pub taints: Vec<Taint>,
+    // only while draining, pods on the node are moved elsewhere when planned
+    #[serde(skip)]
+    pub draining: bool,
+    // consecutive refreshes the node wasn't healthy for
+    #[serde(default)]
+    pub failures: u32,
+    #[serde(default)]
+    pub last_seen: Option<DateTime<Utc>>,
+    // unreachable for long enough that its pods are run elsewhere, whatever is left on it is removed once it's back
+    #[serde(default)]
+    pub down: bool,
+    // percent of the node's cpu and memory that pods may request, from the cluster config
+    #[serde(skip)]
+    pub max_allocation: Option<(u32, u32)>,
+}
+
+impl NodeState {
+    // the labels skate sets (arch, os, hostname) along with user labels
+    pub fn all_labels(&self) -> BTreeMap<String, String> {
+        let k8s_node: K8sNode = self.clone().into();
+        k8s_node.metadata.labels.unwrap_or_default()
+    }
+
+    pub fn matches_selector(&self, selector: &BTreeMap<String, String>) -> bool {
+        let labels = self.all_labels();
+        selector.iter().all(|(k, v)| labels.get(k) == Some(v))
+    }
+
+    // the taints with one of the given effects that none of the tolerations match
+    pub fn untolerated_taints(&self, tolerations: &Vec<Toleration>, effects: &[&str]) -> Vec<Taint> {
+        self.taints.iter()
+            .filter(|t| effects.contains(&t.effect.as_str()))
+            .filter(|t| !tolerations.iter().any(|tol| tolerates(tol, t)))
+            .cloned().collect()
+    }
+
+    // what the node has for pods in (millicores, bytes)
+    pub fn capacity(&self) -> Option<(u64, u64)> {
+        let si = self.host_info.as_ref()?.system_info.as_ref()?;
+        Some((si.num_cpus as u64 * 1000, si.total_memory_mib * 1024 * 1024))
+    }
+
+    // requested by the pods on the node that haven't finished
+    pub fn allocated(&self) -> (u64, u64) {
+        let pods = self.host_info.as_ref().and_then(|h| h.system_info.as_ref()).and_then(|si| si.pods.clone()).unwrap_or_default();
+        pods.iter().filter(|p| p.status != PodmanPodStatus::Exited && p.status != PodmanPodStatus::Dead)
+            .map(|p| p.requests())
+            .fold((0, 0), |(cpu, memory), (c, m)| (cpu + c, memory + m))
+    }
+
+    // the share of the capacity that pods may request, as the cluster's max_cpu_allocation and max_memory_allocation
+    // say
+    pub fn allocatable(&self) -> Option<(u64, u64)> {
+        let (cpu_percent, memory_percent) = self.max_allocation.unwrap_or((DEFAULT_MAX_ALLOCATION, DEFAULT_MAX_ALLOCATION));
+        self.capacity().map(|(cpu, memory)| (cpu * cpu_percent as u64 / 100, memory * memory_percent as u64 / 100))
+    }
+
+    // what's left of the allocatable for new pods
+    pub fn free(&self) -> Option<(u64, u64)> {
+        let (cpu, memory) = self.allocated();
+        self.allocatable().map(|(cpu_allocatable, memory_allocatable)| (cpu_allocatable.saturating_sub(cpu), memory_allocatable.saturating_sub(memory)))
+    }
+
+    // whether requests fit on top of what's already allocated, pods without requests always do
+    pub fn fits(&self, requests: (u64, u64)) -> bool {
+        if requests == (0, 0) {
+            return true;
+        }
+        match self.free() {
+            Some((cpu, memory)) => requests.0 <= cpu && requests.1 <= memory,
+            None => false
+        }
+    }
+
+    // how full the node would be with the requests on top, the fuller of cpu and memory in permille of the allocatable
+    pub fn load_with(&self, requests: (u64, u64)) -> Option<u64> {
+        let (cpu, memory) = self.allocated();
+        self.allocatable().map(|(cpu_allocatable, memory_allocatable)| {
+            ((cpu + requests.0) * 1000 / cpu_allocatable.max(1)).max((memory + requests.1) * 1000 / memory_allocatable.max(1))
+        })
+    }
+}
+
+// same matching as kubernetes: an empty key with Exists matches every taint, an empty effect matches every effect.
+// a NoExecute taint is only tolerated for tolerationSeconds after it was added
+pub fn tolerates(toleration: &Toleration, taint: &Taint) -> bool {
+    let key = toleration.key.clone().unwrap_or_default();
+    let effect = toleration.effect.clone().unwrap_or_default();
+    if !effect.is_empty() && effect != taint.effect {
+        return false;
+    }
+    if !key.is_empty() && key != taint.key {
+        return false;
+    }
+    let matches = match toleration.operator.as_deref() {
+        Some("Exists") => true,
+        // Equal is the default
+        _ => !key.is_empty() && toleration.value.clone().unwrap_or_default() == taint.value.clone().unwrap_or_default()
+    };
+    if !matches {
+        return false;
+    }
+    match (taint.effect.as_str(), toleration.toleration_seconds, taint.time_added.as_ref()) {
+        ("NoExecute", Some(seconds), Some(added)) => added.0 + Duration::seconds(seconds) > Utc::now(),
+        _ => true
+    }
 }
 
 impl Into<K8sNode> for NodeState {
@@ -49,6 +173,7 @@ impl Into<K8sNode> for NodeState {
         };
 
         spec.unschedulable = match self.status {
+            _ if self.unschedulable => Some(true),
             Unknown => Some(true),
             Healthy => Some(false),
             Unhealthy => Some(true),
@@ -103,6 +228,20 @@ impl Into<K8sNode> for NodeState {
             None => (None, None, None, None)
         };
 
+        spec.taints = match self.taints.len() {
+            0 => None,
+            _ => Some(self.taints.clone())
+        };
+
+        match self.labels.len() {
+            0 => {}
+            _ => {
+                let mut labels = metadata.labels.unwrap_or_default();
+                labels.extend(self.labels.clone());
+                metadata.labels = Some(labels);
+            }
+        }
+
 
         K8sNode {
             metadata,
@@ -117,6 +256,98 @@ pub struct ClusterState {
     pub cluster_name: String,
     pub hash: String,
     pub nodes: Vec<NodeState>,
+    // the last applied spec of every resource, as given to `skate apply`
+    #[serde(default)]
+    pub resources: Vec<SupportedResources>,
+    // oldest first, pruned as new ones come in
+    #[serde(default)]
+    pub events: Vec<Event>,
+    // statefulset volumes are podman volumes, local to the node they were first created on. <namespace>/<claim> -> node
+    #[serde(default)]
+    pub volume_nodes: BTreeMap<String, String>,
+    // backoff of the containers `skate reconcile` restarts, <pod id>/<container> -> state
+    #[serde(default)]
+    pub restarts: BTreeMap<String, RestartState>,
+    // from the cluster's secret_key_file, secrets are encrypted with it as they're stored
+    #[serde(skip)]
+    pub secret_key: Option<SecretKey>,
+    // the cluster's reconcile_restarts, whether pods applied now get their restarts from `skate reconcile`
+    #[serde(skip)]
+    pub reconcile_restarts: bool,
+}
+
+const DEFAULT_NODE_FAILURE_THRESHOLD: u32 = 3;
+const DEFAULT_NODE_GRACE_PERIOD: u64 = 60;
+pub(crate) const DEFAULT_MAX_ALLOCATION: u32 = 100;
+
+const MAX_EVENTS: usize = 1000;
+const MAX_EVENT_AGE_HOURS: i64 = 24;
+
+#[derive(Serialize, Deserialize, Clone, Debug, Display, PartialEq)]
+pub enum EventType {
+    Normal,
+    Warning,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+pub struct Event {
+    pub time: DateTime<Utc>,
+    #[serde(rename = "type")]
+    pub type_: EventType,
+    pub namespace: String,
+    // kind/name, eg pod/foo-1
+    pub object: String,
+    // the deployment, daemonset or job a pod belongs to
+    pub owner: Option<String>,
+    pub node: Option<String>,
+    pub reason: String,
+    pub message: String,
+}
+
+impl Event {
+    pub fn for_resource(object: &SupportedResources, node: Option<&str>, type_: EventType, reason: &str, message: &str) -> Event {
+        let name = object.name();
+        let owner = match object {
+            SupportedResources::Pod(pod) => pod.metadata.labels.as_ref().and_then(|l| {
+                [("skate.io/deployment", "deployment"), ("skate.io/daemonset", "daemonset"), ("skate.io/statefulset", "statefulset"), ("skate.io/job", "job")].iter()
+                    .find_map(|(label, kind)| l.get(*label).filter(|v| !v.is_empty()).map(|v| format!("{}/{}", kind, v)))
+            }),
+            _ => None
+        };
+        Event {
+            time: Utc::now(),
+            type_,
+            namespace: name.namespace,
+            object: format!("{}/{}", object.to_string().to_lowercase(), name.name),
+            owner,
+            node: node.map(|n| n.to_string()),
+            reason: reason.to_string(),
+            message: message.to_string(),
+        }
+    }
+
+    pub fn for_node(node: &str, type_: EventType, reason: &str, message: &str) -> Event {
+        Event {
+            time: Utc::now(),
+            type_,
+            namespace: "".to_string(),
+            object: format!("node/{}", node),
+            owner: None,
+            node: Some(node.to_string()),
+            reason: reason.to_string(),
+            message: message.to_string(),
+        }
+    }
+
+    // kind/name of the object itself or of what it belongs to, kinds may be plural
+    pub fn concerns(&self, resource: &str) -> bool {
+        let normalize = |r: &str| match r.split_once('/') {
+            Some((kind, name)) => format!("{}/{}", kind.to_lowercase().trim_end_matches('s'), name),
+            None => format!("pod/{}", r)
+        };
+        let resource = normalize(resource);
+        normalize(&self.object) == resource || self.owner.as_ref().map(|o| normalize(o) == resource).unwrap_or(false)
+    }
 }
 
 pub struct ReconciledResult {
@@ -126,14 +357,21 @@ pub struct ReconciledResult {
 }
 
 impl ClusterState {
-    fn path(cluster_name: &str) -> String {
+    pub(crate) fn path(cluster_name: &str) -> String {
         format!("{}/{}.state", cache_dir(), slugify(cluster_name))
     }
+    // written next to it and moved into place, a failed write leaves the previous state as it was
     pub fn persist(&self) -> Result<(), Box<dyn Error>> {
-        let state_file = File::create(Path::new(ClusterState::path(&self.cluster_name.clone()).as_str()))
+        let path = ClusterState::path(&self.cluster_name.clone());
+        let tmp_path = format!("{}.tmp", path);
+        // stored secrets and all, so only for the owner. a leftover tmp file would keep whatever mode it had
+        let _ = std::fs::remove_file(&tmp_path);
+        let state_file = OpenOptions::new().write(true).create(true).truncate(true).mode(0o600).open(Path::new(tmp_path.as_str()))
             .map_err(|e| anyhow!("failed to open or create state file").context(e))?;
         serde_json::to_writer(state_file, self)
             .map_err(|e| anyhow!("failed to serialize state").context(e))?;
+        std::fs::rename(&tmp_path, &path)
+            .map_err(|e| anyhow!("failed to replace state file").context(e))?;
         Ok(())
     }
 
@@ -144,12 +382,28 @@ impl ClusterState {
         Ok(result)
     }
 
+    pub fn record_event(&mut self, event: Event) {
+        self.events.push(event);
+
+        let cutoff = Utc::now() - Duration::hours(MAX_EVENT_AGE_HOURS);
+        self.events.retain(|e| e.time > cutoff);
+        if self.events.len() > MAX_EVENTS {
+            self.events.drain(0..self.events.len() - MAX_EVENTS);
+        }
+    }
+
     pub fn reconcile_node(&mut self, node: &NodeSystemInfo) -> Result<ReconciledResult, Box<dyn Error>> {
         let mut pos = self.nodes.iter_mut().find_position(|n| n.node_name == node.node_name);
 
         let result = match pos {
             Some((p, obj)) => {
+                let labels = obj.labels.clone();
+                let unschedulable = obj.unschedulable;
+                let taints = obj.taints.clone();
                 self.nodes[p] = (*node).clone().into();
+                self.nodes[p].labels = labels;
+                self.nodes[p].unschedulable = unschedulable;
+                self.nodes[p].taints = taints;
                 ReconciledResult {
                     removed: 0,
                     added: 0,
@@ -194,6 +448,20 @@ impl ClusterState {
             updated: 0,
         })
     }
+    // undoes reconcile_object_creation when the pod didn't get created after all
+    pub fn reconcile_object_deletion(&mut self, object: &SupportedResources, node_name: &str) {
+        let pod = match object {
+            SupportedResources::Pod(pod) => PodmanPodInfo::from((*pod).clone()),
+            _ => return
+        };
+        match self.nodes.iter_mut().find(|n| n.node_name == node_name)
+            .and_then(|n| n.host_info.as_mut())
+            .and_then(|hi| hi.system_info.as_mut())
+            .and_then(|si| si.pods.as_mut()) {
+            Some(pods) => pods.retain(|p| !(p.name == pod.name && p.namespace() == pod.namespace())),
+            None => {}
+        }
+    }
     pub fn reconcile_all_nodes(&mut self, config: &Config, host_info: &Vec<NodeSystemInfo>) -> Result<ReconciledResult, Box<dyn Error>> {
         let cluster = config.current_cluster()?;
         self.hash = hash_string(cluster);
@@ -220,6 +488,14 @@ impl ClusterState {
                     node_name: n.name.clone(),
                     status: Unknown,
                     host_info: None,
+                    labels: BTreeMap::new(),
+                    unschedulable: false,
+                    taints: vec!(),
+                    draining: false,
+                    failures: 0,
+                    last_seen: None,
+                    down: false,
+                    max_allocation: None,
                 }),
                 false => None
             }
@@ -228,10 +504,21 @@ impl ClusterState {
         self.nodes.append(&mut new_nodes);
 
 
+        let previous: Vec<_> = self.nodes.iter().map(|n| (n.node_name.clone(), n.status.clone(), n.down)).collect();
+
+        // a node has to fail several checks over a while before it counts as down, a slow one shouldn't end up with
+        // its pods running twice
+        let failure_threshold = cluster.node_failure_threshold.unwrap_or(DEFAULT_NODE_FAILURE_THRESHOLD);
+        let grace_period = cluster.node_grace_period.unwrap_or(DEFAULT_NODE_GRACE_PERIOD) as i64;
+        let now = Utc::now();
+
+        let max_allocation = (cluster.max_cpu_allocation.unwrap_or(DEFAULT_MAX_ALLOCATION), cluster.max_memory_allocation.unwrap_or(DEFAULT_MAX_ALLOCATION));
+
         let mut updated = 0;
         // now that we have our list, go through and mark them healthy or unhealthy
         self.nodes = self.nodes.iter().map(|node| {
             let mut node = node.clone();
+            node.max_allocation = Some(max_allocation);
             match host_info.iter().find(|h| h.node_name == node.node_name) {
                 Some(info) => {
                     updated = updated + 1;
@@ -245,9 +532,35 @@ impl ClusterState {
                     node.status = Unknown;
                 }
             };
+            match node.status {
+                Healthy => {
+                    node.failures = 0;
+                    node.last_seen = Some(now);
+                    node.down = false;
+                }
+                _ => {
+                    node.failures = node.failures + 1;
+                    node.down = node.failures >= failure_threshold
+                        && node.last_seen.map(|l| (now - l).num_seconds() >= grace_period).unwrap_or(true);
+                }
+            }
             node
         }).collect();
 
+        let changes: Vec<_> = self.nodes.iter().filter_map(|n| {
+            let (_, was, was_down) = previous.iter().find(|(name, _, _)| *name == n.node_name)?;
+            match (was, &n.status) {
+                _ if n.down && !was_down => Some(Event::for_node(&n.node_name, EventType::Warning, "NodeDown", &format!("node {} failed {} health checks, rescheduling its pods", n.node_name, n.failures))),
+                (Healthy, Healthy) => None,
+                (Healthy, _) => Some(Event::for_node(&n.node_name, EventType::Warning, "NodeNotReady", &format!("node {} is {}", n.node_name, n.status))),
+                (_, Healthy) => Some(Event::for_node(&n.node_name, EventType::Normal, "NodeReady", &format!("node {} is healthy", n.node_name))),
+                _ => None
+            }
+        }).collect();
+        for event in changes {
+            self.record_event(event);
+        }
+
 
         Ok(ReconciledResult {
             removed: orphaned.len(),
@@ -281,4 +594,198 @@ impl ClusterState {
         let name = name.strip_prefix(format!("{}.", namespace).as_str()).unwrap_or(name);
         self.filter_pods(&|p| p.deployment() == name && p.namespace() == namespace)
     }
+
+    // pods whose node no longer satisfies their node selector, eg after relabelling a node
+    pub fn misplaced_pods(&self) -> Vec<(PodmanPodInfo, &NodeState)> {
+        self.nodes.iter().flat_map(|n| {
+            let pods = n.host_info.as_ref().and_then(|h| h.system_info.as_ref()).and_then(|si| si.pods.clone()).unwrap_or_default();
+            pods.into_iter().filter(|p| {
+                let selector: BTreeMap<String, String> = p.labels.iter().filter_map(|(k, v)| {
+                    k.strip_prefix("nodeselector/").map(|k| (k.to_string(), v.clone()))
+                }).collect();
+                !n.matches_selector(&selector)
+            }).map(move |p| (p, n)).collect::<Vec<_>>()
+        }).collect()
+    }
+
+    // pods on nodes with a NoExecute taint they don't tolerate, eg after `skate taint node`
+    pub fn untolerated_pods(&self) -> Vec<(PodmanPodInfo, &NodeState)> {
+        self.filter_pods(&|_| true).into_iter()
+            .filter(|(p, n)| n.untolerated_taints(&p.tolerations(), &["NoExecute"]).len() > 0)
+            .collect()
+    }
+
+    // pods stranded on nodes that are down, their owners need running somewhere else
+    pub fn stranded_pods(&self) -> Vec<(PodmanPodInfo, &NodeState)> {
+        self.filter_pods(&|_| true).into_iter().filter(|(_, n)| n.down).collect()
+    }
+
+    // pods running on more than one node, eg once a node that was down comes back with the pods it had
+    pub fn duplicate_pods(&self) -> Vec<(PodmanPodInfo, &NodeState)> {
+        let pods: Vec<_> = self.filter_pods(&|_| true).into_iter().filter(|(_, n)| !n.down).collect();
+        pods.iter().filter(|(p, n)| pods.iter().any(|(other, other_node)| {
+            other.name == p.name && other.namespace() == p.namespace() && other_node.node_name != n.node_name
+        })).cloned().collect()
+    }
+
+    pub fn locate_statefulset(&self, name: &str, namespace: &str) -> Vec<(PodmanPodInfo, &NodeState)> {
+        self.filter_pods(&|p| p.labels.get("skate.io/statefulset").map(|s| s.as_str()) == Some(name) && p.namespace() == namespace)
+    }
+
+    pub fn locate_job(&self, name: &str, namespace: &str) -> Vec<(PodmanPodInfo, &NodeState)> {
+        self.filter_pods(&|p| p.labels.get("skate.io/job").map(|j| j.as_str()) == Some(name) && p.namespace() == namespace)
+    }
+
+    // stores the resource, replacing any previous version of it
+    pub fn store_resource(&mut self, object: &SupportedResources) -> Result<(), Box<dyn Error>> {
+        let kind = object.to_string();
+        let name = object.name().to_string();
+        match object {
+            SupportedResources::Secret(s) => logging::sensitive_secret(s),
+            _ => {}
+        }
+        let object = match (object, &self.secret_key) {
+            (SupportedResources::Secret(s), Some(key)) => SupportedResources::Secret(secret::encrypt(s, key)?),
+            _ => object.clone()
+        };
+        match self.resources.iter().find_position(|r| r.to_string() == kind && r.name().to_string() == name) {
+            Some((p, previous)) => {
+                let mut object = object;
+                // re-applying an unchanged job carries on from where it got to rather than running it again
+                match (&mut object, previous) {
+                    (SupportedResources::Job(job), SupportedResources::Job(previous)) if job.status.is_none() && job.spec == previous.spec => {
+                        job.status = previous.status.clone();
+                    }
+                    _ => {}
+                }
+                self.resources[p] = object
+            }
+            None => self.resources.push(object),
+        }
+        Ok(())
+    }
+
+    pub fn remove_stored_resource(&mut self, object: &SupportedResources) {
+        let kind = object.to_string();
+        let name = object.name().to_string();
+        self.resources.retain(|r| !(r.to_string() == kind && r.name().to_string() == name));
+    }
+
+    // secrets come back decrypted, or as stored if they can't be
+    pub fn locate_stored_resource(&self, object: &SupportedResources) -> Option<SupportedResources> {
+        let kind = object.to_string();
+        let name = object.name().to_string();
+        self.resources.iter().find(|r| r.to_string() == kind && r.name().to_string() == name).map(|r| match r {
+            SupportedResources::Secret(s) => match secret::decrypt(s, self.secret_key.as_ref()) {
+                Ok(s) => SupportedResources::Secret(s),
+                Err(_) => r.clone()
+            },
+            _ => r.clone()
+        })
+    }
+
+    pub fn locate_stored_job(&self, name: &str, namespace: &str) -> Option<Job> {
+        self.resources.iter().find_map(|r| match r {
+            SupportedResources::Job(j) if j.metadata.name.as_deref() == Some(name) && j.metadata.namespace.as_deref() == Some(namespace) => Some(j.clone()),
+            _ => None
+        })
+    }
+
+    // as stored, encrypted when the cluster has a key. they're only decrypted on the node they're materialized on
+    pub fn locate_stored_secret(&self, name: &str, namespace: &str) -> Option<Secret> {
+        self.resources.iter().find_map(|r| match r {
+            SupportedResources::Secret(s) if s.metadata.name.as_deref() == Some(name) && s.metadata.namespace.as_deref() == Some(namespace) => Some(s.clone()),
+            _ => None
+        })
+    }
+
+    pub fn locate_stored_config_map(&self, name: &str, namespace: &str) -> Option<ConfigMap> {
+        self.resources.iter().find_map(|r| match r {
+            SupportedResources::ConfigMap(c) if c.metadata.name.as_deref() == Some(name) && c.metadata.namespace.as_deref() == Some(namespace) => Some(c.clone()),
+            _ => None
+        })
+    }
+
+    // what the pod's node needs to put its imagePullSecrets together into one docker config, for podman's --authfile
+    pub fn registry_auth(&self, pod: &Pod) -> Result<Option<RegistryAuthRequest>, Box<dyn Error>> {
+        let ns = pod.metadata.namespace.clone().unwrap_or_default();
+        let refs = pod.spec.as_ref().and_then(|s| s.image_pull_secrets.clone()).unwrap_or_default();
+        if refs.len() == 0 {
+            return Ok(None);
+        }
+
+        let mut secrets = vec!();
+        for secret_ref in refs {
+            let name = secret_ref.name.unwrap_or_default();
+            let secret = self.locate_stored_secret(&name, &ns)
+                .ok_or(anyhow!("imagePullSecret {} not found in namespace {}", name, ns))?;
+            if secret.type_.as_deref() != Some("kubernetes.io/dockerconfigjson") {
+                return Err(anyhow!("imagePullSecret {} is not of type kubernetes.io/dockerconfigjson", name).into());
+            }
+            secrets.push(secret);
+        }
+
+        Ok(Some(RegistryAuthRequest { key: self.secret_key.as_ref().map(|k| k.encode()), secrets }))
+    }
+
+    pub fn locate_stored_deployment(&self, name: &str, namespace: &str) -> Option<Deployment> {
+        self.resources.iter().find_map(|r| match r {
+            SupportedResources::Deployment(d) if d.metadata.name.as_deref() == Some(name) && d.metadata.namespace.as_deref() == Some(namespace) => Some(d.clone()),
+            _ => None
+        })
+    }
+
+    // the node holding a statefulset pod's volume, which is where the pod has to run
+    pub fn volume_node(&self, namespace: &str, claim: &str) -> Option<String> {
+        self.volume_nodes.get(&format!("{}/{}", namespace, claim)).cloned()
+    }
+
+    // remembers where a statefulset pod's volumes got created, once it's up
+    pub fn bind_volumes(&mut self, object: &SupportedResources, node_name: &str) {
+        let pod = match object {
+            SupportedResources::Pod(pod) if pod.metadata.labels.as_ref().and_then(|l| l.get("skate.io/statefulset")).is_some() => pod,
+            _ => return
+        };
+        let ns = pod.metadata.namespace.clone().unwrap_or_default();
+        for volume in pod.spec.as_ref().and_then(|s| s.volumes.clone()).unwrap_or_default() {
+            match volume.persistent_volume_claim {
+                Some(claim) => {
+                    self.volume_nodes.insert(format!("{}/{}", ns, claim.claim_name), node_name.to_string());
+                }
+                None => {}
+            }
+        }
+    }
+
+    // the autoscaler, if any, that targets the given deployment
+    pub fn locate_deployment_autoscaler(&self, name: &str, namespace: &str) -> Option<HorizontalPodAutoscaler> {
+        self.resources.iter().find_map(|r| match r {
+            SupportedResources::HorizontalPodAutoscaler(h) if h.metadata.namespace.as_deref() == Some(namespace) => {
+                let target = &h.spec.as_ref()?.scale_target_ref;
+                match target.kind == "Deployment" && target.name == name {
+                    true => Some(h.clone()),
+                    false => None
+                }
+            }
+            _ => None
+        })
+    }
+
+    // replica count wanted for a deployment, the autoscaler's last decision takes precedence over the spec
+    pub fn desired_replicas(&self, name: &str, namespace: &str) -> Option<i32> {
+        let autoscaled = self.locate_deployment_autoscaler(name, namespace)
+            .and_then(|h| h.status.and_then(|s| Some(s.desired_replicas)));
+        match autoscaled {
+            Some(replicas) => Some(replicas),
+            None => self.locate_stored_deployment(name, namespace).and_then(|d| d.spec.and_then(|s| s.replicas))
+        }
+    }
+
+    // used when a node stops responding part way through scheduling so we don't keep picking it
+    pub fn mark_node_unreachable(&mut self, node_name: &str) {
+        match self.nodes.iter_mut().find(|n| n.node_name == node_name) {
+            Some(node) => node.status = Unhealthy,
+            None => {}
+        }
+    }
 }
@@ -0,0 +1,151 @@
+use std::error::Error;
+use anyhow::anyhow;
+use chrono::Utc;
+use clap::{Args, Subcommand};
+use k8s_openapi::api::core::v1::Taint;
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::Time;
+use crate::config::Config;
+use crate::refresh::refreshed_state;
+use crate::skate::ConfigFileArgs;
+use crate::ssh;
+use crate::util::{CHECKBOX_EMOJI, format_taint, INFO_EMOJI};
+
+#[derive(Debug, Args)]
+pub struct TaintArgs {
+    #[command(subcommand)]
+    command: TaintCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum TaintCommands {
+    #[command(alias("nodes"), about = "taint a node", long_about = "Add, update or remove (key:Effect- or key-) taints on a \
+node. Only pods tolerating a NoSchedule taint are scheduled on the node, pods not tolerating a NoExecute taint are also \
+moved off it on the next reconcile.")]
+    Node(TaintNodeArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct TaintNodeArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, long_help = "Allow existing taints to be overwritten.")]
+    overwrite: bool,
+    #[arg(long_help = "Name of the node.")]
+    name: String,
+    #[arg(required = true, long_help = "Taints of the form key=value:Effect or key:Effect, or key:Effect- or key- to remove \
+them. Effect is one of NoSchedule, PreferNoSchedule or NoExecute.")]
+    taints: Vec<String>,
+}
+
+pub async fn taint(args: TaintArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        TaintCommands::Node(args) => taint_node(args).await
+    }
+}
+
+enum TaintChange {
+    Set(Taint),
+    // no effect removes the key with any effect
+    Remove(String, Option<String>),
+}
+
+const EFFECTS: [&str; 3] = ["NoSchedule", "PreferNoSchedule", "NoExecute"];
+
+fn parse_effect(taint: &str, effect: &str) -> Result<String, Box<dyn Error>> {
+    match EFFECTS.contains(&effect) {
+        true => Ok(effect.to_string()),
+        false => Err(anyhow!("invalid taint {}, effect must be one of {}", taint, EFFECTS.join(", ")).into())
+    }
+}
+
+fn parse_taint(taint: &str) -> Result<TaintChange, Box<dyn Error>> {
+    let change = match taint.strip_suffix('-') {
+        Some(rest) => match rest.split_once(':') {
+            Some((key, effect)) => TaintChange::Remove(key.to_string(), Some(parse_effect(taint, effect)?)),
+            None => TaintChange::Remove(rest.to_string(), None)
+        },
+        None => {
+            let (key_value, effect) = taint.split_once(':')
+                .ok_or(anyhow!("invalid taint {}, expected key=value:Effect, key:Effect or key-", taint))?;
+            let (key, value) = match key_value.split_once('=') {
+                Some((key, value)) => (key, Some(value.to_string())),
+                None => (key_value, None)
+            };
+            TaintChange::Set(Taint {
+                key: key.to_string(),
+                value,
+                effect: parse_effect(taint, effect)?,
+                time_added: None,
+            })
+        }
+    };
+
+    let key = match &change {
+        TaintChange::Set(t) => &t.key,
+        TaintChange::Remove(k, _) => k,
+    };
+    if key.is_empty() {
+        return Err(anyhow!("invalid taint {}, key is empty", taint).into());
+    }
+    Ok(change)
+}
+
+async fn taint_node(args: TaintNodeArgs) -> Result<(), Box<dyn Error>> {
+    let changes = args.taints.iter().map(|t| parse_taint(t)).collect::<Result<Vec<_>, _>>()?;
+
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let (conns, errors) = ssh::cluster_connections(cluster).await;
+    match errors {
+        Some(e) => {
+            e.log()
+        }
+        _ => {}
+    };
+    let conns = conns.ok_or(anyhow!("failed to connect to any hosts"))?;
+
+    let mut state = refreshed_state(&cluster.name, &conns, &config).await?;
+
+    let node = state.nodes.iter_mut().find(|n| n.node_name == args.name)
+        .ok_or(anyhow!("node {} not found", args.name))?;
+
+    let mut taints = node.taints.clone();
+    let mut no_execute = false;
+    for change in changes {
+        match change {
+            TaintChange::Set(mut taint) => {
+                match taints.iter().find(|t| t.key == taint.key && t.effect == taint.effect) {
+                    Some(existing) if existing.value != taint.value && !args.overwrite => {
+                        return Err(anyhow!("node {} already has taint {}, use --overwrite", args.name, format_taint(existing)).into());
+                    }
+                    Some(existing) if existing.value == taint.value => continue,
+                    _ => {}
+                }
+                // tolerationSeconds count from here, kubernetes only sets it for NoExecute too
+                if taint.effect == "NoExecute" {
+                    taint.time_added = Some(Time(Utc::now()));
+                    no_execute = true;
+                }
+                taints.retain(|t| !(t.key == taint.key && t.effect == taint.effect));
+                taints.push(taint);
+            }
+            TaintChange::Remove(key, effect) => {
+                let before = taints.len();
+                taints.retain(|t| !(t.key == key && effect.as_ref().map(|e| *e == t.effect).unwrap_or(true)));
+                if taints.len() == before {
+                    return Err(anyhow!("node {} has no taint {}{}", args.name, key, effect.map(|e| format!(":{}", e)).unwrap_or_default()).into());
+                }
+            }
+        }
+    }
+    node.taints = taints;
+
+    state.persist()?;
+
+    println!("{} node {} tainted", CHECKBOX_EMOJI, args.name);
+    if no_execute {
+        println!("{} pods not tolerating it are moved on the next `skate reconcile`", INFO_EMOJI);
+    }
+    Ok(())
+}
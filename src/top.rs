@@ -0,0 +1,198 @@
+use std::error::Error;
+use std::time::Duration;
+use anyhow::anyhow;
+use clap::{Args, Subcommand};
+use futures::stream::FuturesUnordered;
+use futures::StreamExt;
+use itertools::Itertools;
+use crate::config::{Cluster, Config};
+use crate::skate::ConfigFileArgs;
+use crate::skatelet::PodmanPodStatus;
+use crate::ssh;
+use crate::ssh::{NodeSystemInfo, SshClients};
+use crate::util::parse_duration;
+
+// a node that takes longer than this is shown as unreachable rather than holding up the others
+const NODE_TIMEOUT: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Args)]
+pub struct TopArgs {
+    #[command(subcommand)]
+    command: TopCommands,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum TopCommands {
+    #[command(alias("nodes"), about = "show cpu and memory usage of nodes")]
+    Node(TopObjectArgs),
+    #[command(alias("pods"), about = "show cpu and memory usage of pods, busiest first")]
+    Pod(TopObjectArgs),
+}
+
+#[derive(Debug, Args)]
+pub struct TopObjectArgs {
+    #[command(flatten)]
+    config: ConfigFileArgs,
+    #[arg(long, short, long_help = "Filter by resource namespace, defaults to the context's default_namespace or default (pods only)")]
+    namespace: Option<String>,
+    #[arg(long, short = 'A', conflicts_with = "namespace", long_help = "Show pods across all namespaces (pods only)")]
+    all_namespaces: bool,
+    #[arg(long, short, long_help = "Keep refreshing until interrupted.")]
+    watch: bool,
+    #[arg(long, default_value = "5s", value_parser = parse_duration, long_help = "How often to refresh with --watch, eg 5s or 1m.")]
+    interval: Duration,
+}
+
+pub async fn top(args: TopArgs) -> Result<(), Box<dyn Error>> {
+    match args.command {
+        TopCommands::Node(args) => top_objects(args, print_nodes).await,
+        TopCommands::Pod(args) => top_objects(args, print_pods).await,
+    }
+}
+
+// (node name, system info or why there isn't any), in the order of the config
+type NodeUsage = Vec<(String, Result<NodeSystemInfo, String>)>;
+
+async fn top_objects(args: TopObjectArgs, print: fn(&TopObjectArgs, &NodeUsage)) -> Result<(), Box<dyn Error>> {
+    let config = Config::load(Some(args.config.skateconfig.clone()), args.config.context.clone())?;
+    let cluster = config.current_cluster()?;
+
+    let mut args = args;
+    args.namespace = match args.all_namespaces {
+        true => None,
+        false => Some(cluster.namespace(args.namespace.clone()))
+    };
+
+    let mut conns: Option<SshClients> = None;
+    loop {
+        // nodes that went away are retried on every refresh
+        let (connected, errors) = ssh::reconnect(cluster, conns.take()).await;
+        conns = connected;
+        let usage = node_usage(cluster, conns.as_ref(), errors.map(|e| e.errors).unwrap_or_default()).await;
+
+        if !args.watch {
+            print(&args, &usage);
+            return match usage.iter().all(|(_, u)| u.is_err()) {
+                true => Err(anyhow!("failed to get usage from any nodes").into()),
+                false => Ok(())
+            };
+        }
+
+        // clear the screen, like top
+        print!("\x1b[2J\x1b[H");
+        print(&args, &usage);
+        tokio::time::sleep(args.interval).await;
+    }
+}
+
+async fn node_usage(cluster: &Cluster, conns: Option<&SshClients>, errors: Vec<ssh::SshError>) -> NodeUsage {
+    let fut: FuturesUnordered<_> = conns.map(|c| c.clients.iter().collect::<Vec<_>>()).unwrap_or_default().into_iter().map(|c| async move {
+        let info = match tokio::time::timeout(NODE_TIMEOUT, c.get_node_system_info()).await {
+            Ok(Ok(info)) => Ok(info),
+            Ok(Err(e)) => Err(e.to_string()),
+            Err(_) => Err(format!("timed out after {}s", NODE_TIMEOUT.as_secs()))
+        };
+        (c.node_name.clone(), info)
+    }).collect();
+    let mut results: Vec<_> = fut.collect().await;
+    results.extend(errors.into_iter().map(|e| (e.node_name, Err(e.error.to_string()))));
+
+    cluster.nodes.iter().filter_map(|n| {
+        let (p, _) = results.iter().find_position(|(name, _)| *name == n.name)?;
+        Some(results.remove(p))
+    }).collect()
+}
+
+fn print_nodes(_args: &TopObjectArgs, usage: &NodeUsage) {
+    println!(
+        "{0: <30}  {1: <12}  {2: <8}  {3: <20}  {4: <8}  {5: <5}",
+        "NAME", "STATUS", "CPU%", "MEMORY", "MEMORY%", "PODS"
+    );
+    let mut unreachable = vec!();
+    for (node_name, info) in usage {
+        let si = match info {
+            Ok(info) => info.system_info.as_ref(),
+            Err(e) => {
+                unreachable.push(format!("{}: {}", node_name, e));
+                println!(
+                    "{0: <30}  {1: <12}  {2: <8}  {3: <20}  {4: <8}  {5: <5}",
+                    node_name, "Unreachable", "-", "-", "-", "-"
+                );
+                continue;
+            }
+        };
+        match si {
+            Some(si) => {
+                let pods = si.pods.iter().flatten().filter(|p| p.status == PodmanPodStatus::Running).count();
+                let memory_percent = match si.total_memory_mib {
+                    0 => 0.0,
+                    total => si.used_memory_mib as f64 * 100.0 / total as f64
+                };
+                println!(
+                    "{0: <30}  {1: <12}  {2: <8}  {3: <20}  {4: <8}  {5: <5}",
+                    node_name, "Ready", format!("{:.1}%", si.cpu_usage), format!("{}Mi/{}Mi", si.used_memory_mib, si.total_memory_mib),
+                    format!("{:.1}%", memory_percent), pods
+                )
+            }
+            // skatelet isn't installed, or failed
+            None => println!(
+                "{0: <30}  {1: <12}  {2: <8}  {3: <20}  {4: <8}  {5: <5}",
+                node_name, "Unknown", "-", "-", "-", "-"
+            )
+        }
+    }
+    print_unreachable(unreachable);
+}
+
+fn print_pods(args: &TopObjectArgs, usage: &NodeUsage) {
+    let mut unreachable = vec!();
+    let mut rows = vec!();
+    for (node_name, info) in usage {
+        let si = match info {
+            Ok(info) => match info.system_info.as_ref() {
+                Some(si) => si,
+                None => continue
+            },
+            Err(e) => {
+                unreachable.push(format!("{}: {}", node_name, e));
+                continue;
+            }
+        };
+        for pod in si.pods.iter().flatten() {
+            let ns = pod.namespace();
+            // pods skate didn't create, like the ones podman makes for itself
+            if ns.is_empty() || pod.status != PodmanPodStatus::Running {
+                continue;
+            }
+            if args.namespace.as_ref().map(|f| *f != ns).unwrap_or(false) {
+                continue;
+            }
+            rows.push((ns, pod.name.clone(), node_name.clone(), si.pod_cpu_percent(&pod.id), si.pod_memory_bytes(&pod.id)));
+        }
+    }
+
+    println!(
+        "{0: <15}  {1: <40}  {2: <20}  {3: <8}  {4: <10}",
+        "NAMESPACE", "NAME", "NODE", "CPU%", "MEMORY"
+    );
+    // 100% is a whole core, so a pod can be over 100
+    for (ns, name, node_name, cpu, memory) in rows.into_iter().sorted_by(|a, b| b.3.unwrap_or(0.0).total_cmp(&a.3.unwrap_or(0.0))) {
+        println!(
+            "{0: <15}  {1: <40}  {2: <20}  {3: <8}  {4: <10}",
+            ns, name, node_name,
+            cpu.map(|c| format!("{:.1}%", c)).unwrap_or("-".to_string()),
+            memory.map(|m| format!("{}Mi", m / (1024 * 1024))).unwrap_or("-".to_string())
+        )
+    }
+    print_unreachable(unreachable);
+}
+
+fn print_unreachable(unreachable: Vec<String>) {
+    if unreachable.len() == 0 {
+        return;
+    }
+    eprintln!();
+    for line in unreachable {
+        eprintln!("{}", line);
+    }
+}
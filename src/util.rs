@@ -1,11 +1,16 @@
 use std::collections::hash_map::DefaultHasher;
+use std::error::Error;
 use std::fmt::{Display, Formatter};
 use std::hash::{Hash, Hasher};
+use std::time::Duration;
+use anyhow::anyhow;
 use deunicode::deunicode_char;
 use itertools::Itertools;
 use k8s_openapi::{Metadata, NamespaceResourceScope};
+use k8s_openapi::api::core::v1::{Container, PodSpec, PodTemplateSpec, Taint};
 use k8s_openapi::apimachinery::pkg::apis::meta::v1::ObjectMeta;
 use serde::{Deserialize, Deserializer, Serialize};
+use crate::sidecar;
 
 pub const CHECKBOX_EMOJI: char = '✅';
 pub const CROSS_EMOJI: char = '❌';
@@ -147,4 +152,189 @@ pub fn hash_k8s_resource(obj: &mut (impl Metadata<Scope=NamespaceResourceScope,
     labels.insert("skate.io/hash".to_string(), hash.clone());
     obj.metadata_mut().labels = Option::from(labels);
     hash
-}
\ No newline at end of file
+}
+// identifies a version of a pod template, pods created from the same template share a revision
+pub fn template_revision(template: &PodTemplateSpec) -> String {
+    hash_string(serde_yaml::to_string(template).unwrap_or_default())
+}
+
+// parses durations like 30s, 5m, 1h or 1h30m, plain numbers are seconds
+pub fn parse_duration(s: &str) -> Result<Duration, String> {
+    let s = s.trim();
+    if s.len() == 0 {
+        return Err("invalid duration: empty".to_string());
+    }
+    if s.chars().all(|c| c.is_ascii_digit()) {
+        let num: u64 = s.parse().map_err(|_| format!("invalid duration: {}", s))?;
+        return Ok(Duration::from_secs(num));
+    }
+
+    let mut secs: u64 = 0;
+    let mut rest = s;
+    while rest.len() > 0 {
+        let (num, after) = rest.split_at(rest.find(|c: char| !c.is_ascii_digit()).unwrap_or(rest.len()));
+        let (unit, after) = after.split_at(after.find(|c: char| c.is_ascii_digit()).unwrap_or(after.len()));
+        let num: u64 = num.parse().map_err(|_| format!("invalid duration: {}", s))?;
+        let unit_secs = match unit {
+            "s" => 1,
+            "m" => 60,
+            "h" => 60 * 60,
+            _ => return Err(format!("invalid duration unit {} in {}", unit, s))
+        };
+        secs = num.checked_mul(unit_secs).and_then(|n| secs.checked_add(n)).ok_or(format!("duration {} is too long", s))?;
+        rest = after;
+    }
+    Ok(Duration::from_secs(secs))
+}
+
+// cpu quantities in millicores, eg 500m, 0.5 or 2
+pub fn parse_cpu(quantity: &str) -> Result<u64, Box<dyn Error>> {
+    let q = quantity.trim();
+    let (num, scale) = match q.strip_suffix('m') {
+        Some(num) => (num, 1.0),
+        None => match q.strip_suffix('u') {
+            Some(num) => (num, 0.001),
+            None => match q.strip_suffix('n') {
+                Some(num) => (num, 0.000001),
+                None => (q, 1000.0)
+            }
+        }
+    };
+    let num: f64 = num.parse().map_err(|_| anyhow!("invalid cpu quantity {}", quantity))?;
+    if num < 0.0 {
+        return Err(anyhow!("invalid cpu quantity {}", quantity).into());
+    }
+    Ok(round_quantity(num * scale))
+}
+
+// memory quantities in bytes, with binary (Ki, Mi, Gi..) or decimal (k, M, G..) suffixes, eg 512Mi or 1G
+pub fn parse_memory(quantity: &str) -> Result<u64, Box<dyn Error>> {
+    let q = quantity.trim();
+    let suffixes: [(&str, f64); 12] = [
+        ("Ki", 1024_f64), ("Mi", 1024_f64.powi(2)), ("Gi", 1024_f64.powi(3)),
+        ("Ti", 1024_f64.powi(4)), ("Pi", 1024_f64.powi(5)), ("Ei", 1024_f64.powi(6)),
+        ("k", 1e3), ("M", 1e6), ("G", 1e9), ("T", 1e12), ("P", 1e15), ("E", 1e18),
+    ];
+    let (num, scale) = suffixes.iter().find_map(|(suffix, scale)| q.strip_suffix(suffix).map(|num| (num, *scale)))
+        .unwrap_or((q, 1.0));
+    let num: f64 = num.parse().map_err(|_| anyhow!("invalid memory quantity {}", quantity))?;
+    if num < 0.0 {
+        return Err(anyhow!("invalid memory quantity {}", quantity).into());
+    }
+    Ok(round_quantity(num * scale))
+}
+
+// whole units, anything above zero is at least one. rounding rather than going up as 0.1 * 1000 isn't quite 100
+fn round_quantity(value: f64) -> u64 {
+    match value {
+        v if v > 0.0 && v < 1.0 => 1,
+        v => v.round() as u64
+    }
+}
+
+// what the pod asks for in (millicores, bytes). like kubernetes, a limit without a request is also the request, and
+// init containers run before the others so only the largest of them counts
+pub fn pod_requests(spec: &PodSpec) -> Result<(u64, u64), Box<dyn Error>> {
+    let container_requests = |c: &Container| -> Result<(u64, u64), Box<dyn Error>> {
+        let resources = c.resources.clone().unwrap_or_default();
+        let requests = resources.requests.unwrap_or_default();
+        let limits = resources.limits.unwrap_or_default();
+        let cpu = match requests.get("cpu").or(limits.get("cpu")) {
+            Some(q) => parse_cpu(&q.0)?,
+            None => 0
+        };
+        let memory = match requests.get("memory").or(limits.get("memory")) {
+            Some(q) => parse_memory(&q.0)?,
+            None => 0
+        };
+        Ok((cpu, memory))
+    };
+
+    // sidecars run alongside the containers, the other init containers one at a time before them
+    let sidecars = spec.init_containers.iter().flatten().filter(|c| sidecar::is_sidecar(c));
+    let (mut cpu, mut memory) = (0, 0);
+    for container in spec.containers.iter().chain(sidecars) {
+        let (c, m) = container_requests(container)?;
+        cpu = cpu + c;
+        memory = memory + m;
+    }
+    for container in spec.init_containers.iter().flatten().filter(|c| !sidecar::is_sidecar(c)) {
+        let (c, m) = container_requests(container)?;
+        cpu = cpu.max(c);
+        memory = memory.max(m);
+    }
+    Ok((cpu, memory))
+}
+
+// a line based unified diff of old and new, empty when they're the same
+pub fn unified_diff(old: &str, new: &str, context: usize) -> String {
+    let a: Vec<&str> = old.lines().collect();
+    let b: Vec<&str> = new.lines().collect();
+
+    // longest common subsequence lengths of every suffix pair
+    let mut lcs = vec![vec![0usize; b.len() + 1]; a.len() + 1];
+    for i in (0..a.len()).rev() {
+        for j in (0..b.len()).rev() {
+            lcs[i][j] = match a[i] == b[j] {
+                true => lcs[i + 1][j + 1] + 1,
+                false => lcs[i + 1][j].max(lcs[i][j + 1])
+            };
+        }
+    }
+
+    // (op, old line index, new line index, line)
+    let mut ops = vec!();
+    let (mut i, mut j) = (0, 0);
+    while i < a.len() || j < b.len() {
+        if i < a.len() && j < b.len() && a[i] == b[j] {
+            ops.push((' ', i, j, a[i]));
+            i += 1;
+            j += 1;
+        } else if j < b.len() && (i == a.len() || lcs[i][j + 1] >= lcs[i + 1][j]) {
+            ops.push(('+', i, j, b[j]));
+            j += 1;
+        } else {
+            ops.push(('-', i, j, a[i]));
+            i += 1;
+        }
+    }
+
+    // changes close enough together share a hunk
+    let mut hunks: Vec<(usize, usize)> = vec!();
+    for (k, _) in ops.iter().enumerate().filter(|(_, o)| o.0 != ' ') {
+        let start = k.saturating_sub(context);
+        let end = (k + context + 1).min(ops.len());
+        match hunks.last_mut() {
+            Some(last) if start <= last.1 => last.1 = end,
+            _ => hunks.push((start, end)),
+        }
+    }
+
+    let mut lines = vec!();
+    for (start, end) in hunks {
+        let hunk = &ops[start..end];
+        let old_count = hunk.iter().filter(|o| o.0 != '+').count();
+        let new_count = hunk.iter().filter(|o| o.0 != '-').count();
+        let old_start = hunk[0].1 + if old_count > 0 { 1 } else { 0 };
+        let new_start = hunk[0].2 + if new_count > 0 { 1 } else { 0 };
+        lines.push(format!("@@ -{},{} +{},{} @@", old_start, old_count, new_start, new_count));
+        lines.extend(hunk.iter().map(|o| format!("{}{}", o.0, o.3)));
+    }
+    lines.join("\n")
+}
+
+// single quotes anything the shell on the other end of ssh would otherwise interpret
+pub fn shell_quote(arg: &str) -> String {
+    match arg.chars().all(|c| c.is_ascii_alphanumeric() || "-_./=:,@%+".contains(c)) && !arg.is_empty() {
+        true => arg.to_string(),
+        false => format!("'{}'", arg.replace('\'', "'\\''"))
+    }
+}
+
+// kubectl's key=value:Effect form
+pub fn format_taint(taint: &Taint) -> String {
+    match taint.value.as_deref() {
+        Some(value) if !value.is_empty() => format!("{}={}:{}", taint.key, value, taint.effect),
+        _ => format!("{}:{}", taint.key, taint.effect)
+    }
+}
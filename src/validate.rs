@@ -0,0 +1,410 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::net::IpAddr;
+use itertools::Itertools;
+use k8s_openapi::api::core::v1::{Container, PodSpec, Volume};
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::LabelSelector;
+use serde_yaml::Value;
+use crate::downward;
+use crate::skate::SupportedResources;
+use crate::util::{parse_cpu, parse_memory};
+
+// checks that only need the manifest, anything that depends on the cluster is left to the scheduler's dry run
+pub fn validate(resource: &SupportedResources) -> Vec<String> {
+    let mut errors = vec!();
+    match resource {
+        SupportedResources::Pod(pod) => match &pod.spec {
+            Some(spec) => validate_pod_spec(spec, &mut errors),
+            None => errors.push("spec is empty".to_string())
+        },
+        SupportedResources::Deployment(deployment) => match &deployment.spec {
+            Some(spec) => {
+                validate_selector(Some(&spec.selector), spec.template.metadata.as_ref().and_then(|m| m.labels.as_ref()), &mut errors);
+                match &spec.template.spec {
+                    Some(spec) => validate_pod_spec(spec, &mut errors),
+                    None => errors.push("spec.template.spec is empty".to_string())
+                }
+            }
+            None => errors.push("spec is empty".to_string())
+        },
+        SupportedResources::DaemonSet(daemonset) => match &daemonset.spec {
+            Some(spec) => {
+                validate_selector(Some(&spec.selector), spec.template.metadata.as_ref().and_then(|m| m.labels.as_ref()), &mut errors);
+                match &spec.template.spec {
+                    Some(spec) => validate_pod_spec(spec, &mut errors),
+                    None => errors.push("spec.template.spec is empty".to_string())
+                }
+            }
+            None => errors.push("spec is empty".to_string())
+        },
+        SupportedResources::StatefulSet(sts) => match &sts.spec {
+            Some(spec) => {
+                validate_selector(Some(&spec.selector), spec.template.metadata.as_ref().and_then(|m| m.labels.as_ref()), &mut errors);
+                // each pod gets a volume per claim template, mounted by the template's name
+                let claims: Vec<_> = spec.volume_claim_templates.iter().flatten()
+                    .map(|c| c.metadata.name.clone().unwrap_or_default()).collect();
+                if claims.iter().any(|c| c.is_empty()) {
+                    errors.push("volumeClaimTemplates need a metadata.name".to_string());
+                }
+                match &spec.template.spec {
+                    Some(pod_spec) => {
+                        let mut pod_spec = pod_spec.clone();
+                        let mut volumes = pod_spec.volumes.clone().unwrap_or_default();
+                        volumes.extend(claims.iter().map(|c| Volume { name: c.clone(), ..Default::default() }));
+                        pod_spec.volumes = Some(volumes);
+                        validate_pod_spec(&pod_spec, &mut errors)
+                    }
+                    None => errors.push("spec.template.spec is empty".to_string())
+                }
+            }
+            None => errors.push("spec is empty".to_string())
+        },
+        SupportedResources::Job(job) => match &job.spec {
+            Some(spec) => {
+                validate_selector(spec.selector.as_ref(), spec.template.metadata.as_ref().and_then(|m| m.labels.as_ref()), &mut errors);
+                match &spec.template.spec {
+                    Some(spec) => validate_pod_spec(spec, &mut errors),
+                    None => errors.push("spec.template.spec is empty".to_string())
+                }
+            }
+            None => errors.push("spec is empty".to_string())
+        },
+        SupportedResources::HorizontalPodAutoscaler(hpa) => match &hpa.spec {
+            Some(spec) => {
+                if spec.max_replicas < spec.min_replicas.unwrap_or(1) {
+                    errors.push(format!("spec.maxReplicas {} is less than spec.minReplicas {}", spec.max_replicas, spec.min_replicas.unwrap_or(1)));
+                }
+            }
+            None => errors.push("spec is empty".to_string())
+        },
+        SupportedResources::Secret(_) | SupportedResources::ConfigMap(_) => {}
+    }
+    errors
+}
+
+// same rule as kubernetes, the selector has to pick out the template's own pods
+fn validate_selector(selector: Option<&LabelSelector>, labels: Option<&BTreeMap<String, String>>, errors: &mut Vec<String>) {
+    let match_labels = selector.and_then(|s| s.match_labels.clone()).unwrap_or_default();
+    let labels = labels.cloned().unwrap_or_default();
+    for (k, v) in match_labels {
+        if labels.get(&k) != Some(&v) {
+            errors.push(format!("spec.selector {}={} does not match the template's labels", k, v));
+        }
+    }
+}
+
+fn validate_pod_spec(spec: &PodSpec, errors: &mut Vec<String>) {
+    if spec.containers.len() == 0 {
+        errors.push("no containers".to_string());
+    }
+    errors.extend(validate_host_aliases(spec));
+
+    let volumes: BTreeSet<_> = spec.volumes.iter().flatten().map(|v| v.name.clone()).collect();
+    let mut names = BTreeSet::new();
+    for container in spec.init_containers.iter().flatten().chain(spec.containers.iter()) {
+        if container.name.is_empty() {
+            errors.push("container with no name".to_string());
+        } else if !names.insert(container.name.clone()) {
+            errors.push(format!("container name {} is used more than once", container.name));
+        }
+
+        match container.image.as_deref() {
+            Some(image) if !image.is_empty() => match parse_image_reference(image) {
+                Ok(_) => {}
+                Err(e) => errors.push(format!("container {}: invalid image reference {}: {}", container.name, image, e))
+            },
+            _ => errors.push(format!("container {} has no image", container.name))
+        }
+
+        for mount in container.volume_mounts.iter().flatten() {
+            if !volumes.contains(&mount.name) {
+                errors.push(format!("container {} mounts volume {}, which isn't in spec.volumes", container.name, mount.name));
+            }
+        }
+
+        for env in container.env.iter().flatten() {
+            match env.value_from.as_ref().and_then(|v| v.field_ref.as_ref()) {
+                Some(field) if !downward::is_supported(&field.field_path) => {
+                    errors.push(format!("container {}: env {}: unsupported fieldRef {}", container.name, env.name, field.field_path))
+                }
+                _ => {}
+            }
+        }
+
+        validate_resources(container, errors);
+    }
+
+    // a container's own restartPolicy only makes an init container a sidecar
+    for container in spec.containers.iter().filter(|c| c.restart_policy.is_some()) {
+        errors.push(format!("container {}: restartPolicy is only allowed on initContainers", container.name));
+    }
+    for container in spec.init_containers.iter().flatten() {
+        match container.restart_policy.as_deref() {
+            None | Some("Always") => {}
+            Some(policy) => errors.push(format!("init container {}: unsupported restartPolicy {}, only Always for a sidecar", container.name, policy))
+        }
+    }
+}
+
+// podman turns them into the pod's /etc/hosts entries, and would only complain once it's creating the pod
+pub fn validate_host_aliases(spec: &PodSpec) -> Vec<String> {
+    let mut errors = vec!();
+    for (i, alias) in spec.host_aliases.iter().flatten().enumerate() {
+        let ip = alias.ip.clone().unwrap_or_default();
+        match ip.parse::<IpAddr>() {
+            Ok(_) => {}
+            Err(_) => errors.push(format!("hostAliases[{}]: invalid ip {:?}", i, ip))
+        }
+        let hostnames = alias.hostnames.clone().unwrap_or_default();
+        if hostnames.len() == 0 {
+            errors.push(format!("hostAliases[{}]: no hostnames", i));
+        }
+        for hostname in hostnames {
+            if hostname.trim().is_empty() {
+                errors.push(format!("hostAliases[{}]: empty hostname", i));
+            } else if hostname.chars().any(|c| c.is_whitespace() || c == '#' || c == ':') {
+                errors.push(format!("hostAliases[{}]: invalid hostname {:?}", i, hostname));
+            }
+        }
+    }
+    errors
+}
+
+fn validate_resources(container: &Container, errors: &mut Vec<String>) {
+    let resources = match &container.resources {
+        Some(resources) => resources,
+        None => return
+    };
+
+    for (field, quantities) in [("requests", &resources.requests), ("limits", &resources.limits)] {
+        for (name, quantity) in quantities.iter().flatten() {
+            let parsed = match name.as_str() {
+                "cpu" => parse_cpu(&quantity.0),
+                "memory" => parse_memory(&quantity.0),
+                _ => continue
+            };
+            match parsed {
+                Ok(_) => {}
+                Err(e) => errors.push(format!("container {}: resources.{}.{}: {}", container.name, field, name, e))
+            }
+        }
+    }
+
+    let requests = resources.requests.clone().unwrap_or_default();
+    let limits = resources.limits.clone().unwrap_or_default();
+    let cpu = (requests.get("cpu").and_then(|q| parse_cpu(&q.0).ok()), limits.get("cpu").and_then(|q| parse_cpu(&q.0).ok()));
+    let memory = (requests.get("memory").and_then(|q| parse_memory(&q.0).ok()), limits.get("memory").and_then(|q| parse_memory(&q.0).ok()));
+    for (name, parsed) in [("cpu", cpu), ("memory", memory)] {
+        match parsed {
+            (Some(request), Some(limit)) if request > limit => {
+                errors.push(format!("container {}: {} request {} is more than its limit {}", container.name, name, requests[name].0, limits[name].0))
+            }
+            _ => {}
+        }
+    }
+}
+
+// docker's reference grammar, [registry[:port]/]path[:tag][@digest]
+pub fn parse_image_reference(image: &str) -> Result<(), String> {
+    if image.chars().any(|c| c.is_whitespace()) {
+        return Err("contains whitespace".to_string());
+    }
+
+    let (rest, digest) = match image.split_once('@') {
+        Some((rest, digest)) => (rest, Some(digest)),
+        None => (image, None)
+    };
+    match digest {
+        Some(digest) => match digest.split_once(':') {
+            Some((algorithm, hex)) if !algorithm.is_empty() && hex.len() >= 32 && hex.chars().all(|c| c.is_ascii_hexdigit()) => {}
+            _ => return Err(format!("invalid digest {}", digest))
+        },
+        None => {}
+    }
+
+    // a colon after the last slash starts the tag, before it it's the registry's port
+    let (name, tag) = match rest.rfind(':') {
+        Some(i) if !rest[i + 1..].contains('/') => (&rest[..i], Some(&rest[i + 1..])),
+        _ => (rest, None)
+    };
+    match tag {
+        Some(tag) => {
+            let valid = tag.len() > 0 && tag.len() <= 128
+                && tag.chars().all(|c| c.is_ascii_alphanumeric() || "_.-".contains(c))
+                && !tag.starts_with('.') && !tag.starts_with('-');
+            if !valid {
+                return Err(format!("invalid tag {}", tag));
+            }
+        }
+        None => {}
+    }
+
+    let mut components: Vec<&str> = name.split('/').collect();
+    if components.len() > 1 && (components[0].contains('.') || components[0].contains(':') || components[0] == "localhost") {
+        let registry = components.remove(0);
+        let (host, port) = match registry.split_once(':') {
+            Some((host, port)) => (host, Some(port)),
+            None => (registry, None)
+        };
+        if host.is_empty() || !host.chars().all(|c| c.is_ascii_alphanumeric() || ".-".contains(c)) {
+            return Err(format!("invalid registry {}", registry));
+        }
+        match port {
+            Some(port) if port.parse::<u16>().is_err() => return Err(format!("invalid registry port {}", port)),
+            _ => {}
+        }
+    }
+
+    for component in components {
+        let valid = !component.is_empty()
+            && component.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || "._-".contains(c))
+            && component.starts_with(|c: char| c.is_ascii_alphanumeric())
+            && component.ends_with(|c: char| c.is_ascii_alphanumeric());
+        if !valid {
+            return Err(format!("invalid repository name component {}, must be lowercase", component));
+        }
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone)]
+pub enum PathSegment {
+    Key(String),
+    Index(usize),
+}
+
+// the same as serde_yaml's paths in its errors, eg spec.containers[0].name
+pub fn format_path(path: &[PathSegment]) -> String {
+    path.iter().enumerate().map(|(i, segment)| match segment {
+        PathSegment::Key(key) if i == 0 => key.clone(),
+        PathSegment::Key(key) => format!(".{}", key),
+        PathSegment::Index(index) => format!("[{}]", index),
+    }).join("")
+}
+
+// keys in the manifest that don't survive a round trip through the resource's type, so fields it doesn't have. serde
+// would otherwise drop them without a word
+pub fn unknown_fields(original: &Value, parsed: &Value) -> Vec<Vec<PathSegment>> {
+    let mut unknown = vec!();
+    collect_unknown_fields(original, parsed, &mut vec!(), &mut unknown);
+    unknown
+}
+
+fn collect_unknown_fields(original: &Value, parsed: &Value, path: &mut Vec<PathSegment>, unknown: &mut Vec<Vec<PathSegment>>) {
+    match (original, parsed) {
+        (Value::Mapping(original), Value::Mapping(parsed)) => {
+            for (key, value) in original {
+                // an explicit null is dropped on the way through, the same as leaving the field out
+                if value.is_null() {
+                    continue;
+                }
+                let name = match key.as_str() {
+                    Some(name) => name.to_string(),
+                    None => continue
+                };
+                path.push(PathSegment::Key(name));
+                match parsed.get(key) {
+                    Some(parsed) => collect_unknown_fields(value, parsed, path, unknown),
+                    None => unknown.push(path.clone())
+                }
+                path.pop();
+            }
+        }
+        (Value::Sequence(original), Value::Sequence(parsed)) => {
+            for (i, (original, parsed)) in original.iter().zip(parsed.iter()).enumerate() {
+                path.push(PathSegment::Index(i));
+                collect_unknown_fields(original, parsed, path, unknown);
+                path.pop();
+            }
+        }
+        _ => {}
+    }
+}
+
+// the line each document of a file starts on, counting from 0, lined up with serde_yaml's documents
+pub fn document_offsets(contents: &str) -> Vec<usize> {
+    let lines: Vec<&str> = contents.lines().collect();
+    let mut offsets = vec!(0);
+    for (i, line) in lines.iter().enumerate() {
+        if line.trim_end() == "---" || line.starts_with("--- ") {
+            offsets.push(i + 1);
+        }
+    }
+    // a --- with nothing before it doesn't end a document
+    if offsets.len() > 1 && lines[..offsets[1] - 1].iter().all(|l| l.trim().is_empty() || l.trim_start().starts_with('#')) {
+        offsets.remove(0);
+    }
+    offsets
+}
+
+// a line of block style yaml: where its key starts, after any "- " of sequence items
+struct YamlLine {
+    line: usize,
+    indent: usize,
+    dash: bool,
+    key_column: usize,
+    key: Option<String>,
+}
+
+fn yaml_lines(lines: &[&str]) -> Vec<YamlLine> {
+    lines.iter().enumerate().filter_map(|(i, line)| {
+        let trimmed = line.trim_start_matches(' ');
+        if trimmed.trim().is_empty() || trimmed.starts_with('#') {
+            return None;
+        }
+        let indent = line.len() - trimmed.len();
+        let mut column = indent;
+        let mut rest = trimmed;
+        let mut dash = false;
+        while rest.starts_with("- ") || rest == "-" {
+            dash = true;
+            let after = &rest[1..];
+            let spaces = after.len() - after.trim_start_matches(' ').len();
+            column += 1 + spaces;
+            rest = &after[spaces..];
+        }
+        // a colon only makes a key when followed by a space or the end of the line, urls are values
+        let key = rest.find(": ").or(match rest.trim_end().ends_with(':') {
+            true => Some(rest.trim_end().len() - 1),
+            false => None
+        }).map(|end| rest[..end].trim_matches(|c| c == '"' || c == '\'').to_string());
+        Some(YamlLine { line: i, indent, dash, key_column: column, key })
+    }).collect()
+}
+
+// the line a path is on, counting from 0. None when it can't be told, eg for flow style yaml
+pub fn locate(lines: &[&str], path: &[PathSegment]) -> Option<usize> {
+    let entries = yaml_lines(lines);
+    let (mut start, mut end) = (0, entries.len());
+    let mut found = None;
+
+    for segment in path {
+        if start >= end {
+            return None;
+        }
+        match segment {
+            PathSegment::Key(key) => {
+                let column = entries[start].key_column;
+                let i = (start..end).find(|i| entries[*i].key_column == column && entries[*i].key.as_ref() == Some(key))?;
+                // the value runs until something at the key's own level or further out, a sequence can sit at the
+                // key's level
+                let entry = &entries[i];
+                start = i + 1;
+                end = (start..end).find(|j| {
+                    let e = &entries[*j];
+                    e.indent < entry.key_column || (e.indent == entry.key_column && !e.dash)
+                }).unwrap_or(end);
+                found = Some(entry.line);
+            }
+            PathSegment::Index(index) => {
+                let column = entries[start].indent;
+                let items: Vec<_> = (start..end).filter(|i| entries[*i].dash && entries[*i].indent == column).collect();
+                let i = *items.get(*index)?;
+                // the item's first key is on the same line as its dash
+                start = i;
+                end = items.get(index + 1).cloned().unwrap_or(end);
+                found = Some(entries[i].line);
+            }
+        }
+    }
+    found
+}